@@ -125,7 +125,12 @@ start_sftp() {
     image=$(sftp_image_name)
     echo "Using SFTP config options from $sftp_dir"
     docker rm -f dart-sftp > /dev/null 2>&1 || true
+    # Use a fixed host key, so tests can pin its fingerprint.
+    # sshd refuses private keys that others can read.
+    chmod 600 "$sftp_dir/sftp_host_key"
     DOCKER_SFTP_ID=$(docker run --name dart-sftp --rm \
+        -v "$sftp_dir/sftp_host_key:/etc/ssh/ssh_host_ed25519_key:ro" \
+        -v "$sftp_dir/sftp_host_key.pub:/etc/ssh/ssh_host_ed25519_key.pub:ro" \
         -v "$sftp_dir/sftp_user_key.pub:/home/key_user/.ssh/keys/sftp_user_key.pub:ro" \
         -v "$sftp_dir/users.conf:/etc/sftp/users.conf:ro" \
         -p 2222:22 -d "$image")
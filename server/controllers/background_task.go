@@ -0,0 +1,131 @@
+package controllers
+
+import (
+	"context"
+	"sync"
+)
+
+// Statuses of records whose work runs as a BackgroundTask.
+const (
+	TaskRunning   = "running"
+	TaskCompleted = "completed"
+	TaskFailed    = "failed"
+	TaskCanceled  = "canceled"
+)
+
+// taskInterruptedMessage explains a record that says it's running when
+// no task is working on it. That happens when DART quits mid-task.
+const taskInterruptedMessage = "DART stopped before this finished. Please run it again."
+
+// BackgroundTask tracks work that keeps going after the request that
+// started it returns, such as building an inventory report. Each task
+// has the ID of the record it fills in. Pages poll the task's progress
+// through BackgroundTaskStatus until it's gone, and then show the
+// record. Tasks live in memory only.
+type BackgroundTask struct {
+	ID      string
+	Message string
+	Current int64
+	// Total is zero if we don't know how much work there is.
+	Total  int64
+	cancel context.CancelFunc
+}
+
+// Percent returns how far along the task is, or zero if we
+// don't know the total.
+func (task *BackgroundTask) Percent() int {
+	if task.Total <= 0 {
+		return 0
+	}
+	return int(task.Current * 100 / task.Total)
+}
+
+// SetProgress records how far along the task is.
+func (task *BackgroundTask) SetProgress(current, total int64, message string) {
+	backgroundTasksMutex.Lock()
+	defer backgroundTasksMutex.Unlock()
+	task.Current = current
+	task.Total = total
+	task.Message = message
+}
+
+var backgroundTasks = make(map[string]*BackgroundTask)
+var backgroundTasksMutex sync.Mutex
+
+// StartBackgroundTask runs fn in a goroutine as the task for record id,
+// and forgets the task when fn returns. The context passed to fn is
+// canceled if the user cancels the task. This returns false, and does
+// not run fn, if a task for id is already running.
+func StartBackgroundTask(id, message string, fn func(ctx context.Context, task *BackgroundTask)) bool {
+	backgroundTasksMutex.Lock()
+	defer backgroundTasksMutex.Unlock()
+	if _, ok := backgroundTasks[id]; ok {
+		return false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	task := &BackgroundTask{ID: id, Message: message, cancel: cancel}
+	backgroundTasks[id] = task
+	go func() {
+		defer func() {
+			backgroundTasksMutex.Lock()
+			delete(backgroundTasks, id)
+			backgroundTasksMutex.Unlock()
+			cancel()
+		}()
+		fn(ctx, task)
+	}()
+	return true
+}
+
+// FindBackgroundTask returns a copy of the running task for record id,
+// or nil if there is none.
+func FindBackgroundTask(id string) *BackgroundTask {
+	backgroundTasksMutex.Lock()
+	defer backgroundTasksMutex.Unlock()
+	task, ok := backgroundTasks[id]
+	if !ok {
+		return nil
+	}
+	taskCopy := *task
+	taskCopy.cancel = nil
+	return &taskCopy
+}
+
+// BackgroundTaskRunning returns true if a task for record id is running.
+func BackgroundTaskRunning(id string) bool {
+	return FindBackgroundTask(id) != nil
+}
+
+// CancelBackgroundTask cancels the task for record id. It returns
+// false if there is no such task. The task may run a little longer,
+// until it notices.
+func CancelBackgroundTask(id string) bool {
+	backgroundTasksMutex.Lock()
+	defer backgroundTasksMutex.Unlock()
+	task, ok := backgroundTasks[id]
+	if ok {
+		task.cancel()
+	}
+	return ok
+}
+
+// taskStatus returns status, unless status says the task for record id
+// is running and it isn't. Then it returns TaskFailed and an error
+// message saying so. errMsg is the record's own error message.
+func taskStatus(id, status, errMsg string) (string, string) {
+	if status == TaskRunning && !BackgroundTaskRunning(id) {
+		return TaskFailed, taskInterruptedMessage
+	}
+	return status, errMsg
+}
+
+// finishedTaskStatus returns the status of a task that ended with err.
+func finishedTaskStatus(ctx context.Context, err error) string {
+	if ctx.Err() != nil {
+		return TaskCanceled
+	}
+	if err != nil {
+		return TaskFailed
+	}
+	return TaskCompleted
+}
@@ -0,0 +1,38 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /background_tasks/status/:id
+//
+// This is an AJAX call. Running is false once the task is done,
+// and the page should reload to show what the task produced.
+func BackgroundTaskStatus(c *gin.Context) {
+	task := FindBackgroundTask(c.Param("id"))
+	if task == nil {
+		c.JSON(http.StatusOK, gin.H{"running": false})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"running": true,
+		"message": task.Message,
+		"current": task.Current,
+		"total":   task.Total,
+		"percent": task.Percent(),
+	})
+}
+
+// POST /background_tasks/cancel/:id
+//
+// This is an AJAX call. The task stops soon after, and the
+// status call reports it's no longer running.
+func BackgroundTaskCancel(c *gin.Context) {
+	if !CancelBackgroundTask(c.Param("id")) {
+		c.JSON(http.StatusNotFound, gin.H{"result": "error", "error": "Task is not running."})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"result": "ok"})
+}
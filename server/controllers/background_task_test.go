@@ -0,0 +1,65 @@
+package controllers_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/APTrust/dart/v3/server/controllers"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackgroundTask(t *testing.T) {
+	id := uuid.NewString()
+	started := make(chan struct{})
+	var canceled bool
+	ok := controllers.StartBackgroundTask(id, "Starting", func(ctx context.Context, task *controllers.BackgroundTask) {
+		task.SetProgress(1, 4, "One of four")
+		close(started)
+		<-ctx.Done()
+		canceled = true
+	})
+	require.True(t, ok)
+	<-started
+
+	// We can't start a second task for the same record.
+	assert.False(t, controllers.StartBackgroundTask(id, "Again", func(ctx context.Context, task *controllers.BackgroundTask) {}))
+
+	task := controllers.FindBackgroundTask(id)
+	require.NotNil(t, task)
+	assert.Equal(t, "One of four", task.Message)
+	assert.Equal(t, 25, task.Percent())
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/background_tasks/status/"+id, nil)
+	dartServer.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	status := make(map[string]interface{})
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, true, status["running"])
+	assert.Equal(t, "One of four", status["message"])
+	assert.EqualValues(t, 25, status["percent"])
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/background_tasks/cancel/"+id, nil)
+	dartServer.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Eventually(t, func() bool { return !controllers.BackgroundTaskRunning(id) }, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, canceled)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/background_tasks/status/"+id, nil)
+	dartServer.ServeHTTP(w, req)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, false, status["running"])
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/background_tasks/cancel/"+id, nil)
+	dartServer.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,487 @@
+package controllers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrStopBagWalk can be returned by a BagEntryFunc to stop walking
+// a serialized bag early. WalkSerializedBag and WalkTarStream
+// do not treat it as an error.
+var ErrStopBagWalk = errors.New("stop bag walk")
+
+// BagEntry describes one file inside a serialized bag.
+type BagEntry struct {
+	// BagName is the name of the bag's top-level directory.
+	BagName string
+	// Path is the file's path relative to the bag's top-level
+	// directory, with forward slashes. E.g. "bag-info.txt" or
+	// "data/images/photo.jpg".
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// BagEntryFunc is called once for each regular file in a serialized
+// bag. The reader returns the contents of the file, and is valid
+// only until the function returns.
+type BagEntryFunc func(entry BagEntry, reader io.Reader) error
+
+// IsSerializedBag returns true if name looks like a tarred, gzipped
+// or zipped bag, based on its extension.
+func IsSerializedBag(name string) bool {
+	lower := strings.ToLower(name)
+	for _, ext := range []string{".tar", ".tar.gz", ".tgz", ".zip"} {
+		if strings.HasSuffix(lower, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// WalkSerializedBag calls fn for each regular file in the tar, tar.gz
+// or zip file at bagPath. Directories, symlinks and anything else
+// outside of the bag's top-level directory are skipped.
+func WalkSerializedBag(bagPath string, fn BagEntryFunc) error {
+	lower := strings.ToLower(bagPath)
+	if strings.HasSuffix(lower, ".zip") {
+		return walkZip(bagPath, fn)
+	}
+	if !IsSerializedBag(bagPath) {
+		return fmt.Errorf("%s is not a tar or zip file", bagPath)
+	}
+	file, err := os.Open(bagPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var reader io.Reader = file
+	if strings.HasSuffix(lower, ".gz") || strings.HasSuffix(lower, ".tgz") {
+		gzipReader, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+	return WalkTarStream(reader, fn)
+}
+
+// WalkBag calls fn for each regular file in the bag at bagPath, which
+// may be a directory or a tar, tar.gz or zip file. For directories,
+// the bag's name is the name of the directory, and symlinks are
+// skipped.
+func WalkBag(bagPath string, fn BagEntryFunc) error {
+	stat, err := os.Stat(bagPath)
+	if err != nil {
+		return err
+	}
+	if !stat.IsDir() {
+		return WalkSerializedBag(bagPath, fn)
+	}
+	bagName := filepath.Base(bagPath)
+	err = filepath.WalkDir(bagPath, func(filePath string, dirEntry os.DirEntry, err error) error {
+		if err != nil || !dirEntry.Type().IsRegular() {
+			return err
+		}
+		info, err := dirEntry.Info()
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(bagPath, filePath)
+		if err != nil {
+			return err
+		}
+		file, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		entry := BagEntry{
+			BagName: bagName,
+			Path:    filepath.ToSlash(relPath),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		}
+		return fn(entry, file)
+	})
+	if err == ErrStopBagWalk {
+		return nil
+	}
+	return err
+}
+
+// WalkTarStream calls fn for each regular file in the tarred bag
+// that r is reading. It reads r strictly front to back, so r can
+// be a network stream. If fn returns ErrStopBagWalk, this returns
+// nil without reading the rest of the stream.
+func WalkTarStream(r io.Reader, fn BagEntryFunc) error {
+	tarReader := tar.NewReader(r)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !header.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		bagName, relPath, ok := splitBagPath(header.Name)
+		if !ok {
+			continue
+		}
+		entry := BagEntry{
+			BagName: bagName,
+			Path:    relPath,
+			Size:    header.Size,
+			ModTime: header.ModTime,
+		}
+		err = fn(entry, tarReader)
+		if err == ErrStopBagWalk {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func walkZip(bagPath string, fn BagEntryFunc) error {
+	zipReader, err := zip.OpenReader(bagPath)
+	if err != nil {
+		return err
+	}
+	defer zipReader.Close()
+	return walkZipReader(&zipReader.Reader, fn)
+}
+
+func walkZipReader(zipReader *zip.Reader, fn BagEntryFunc) error {
+	for _, zipFile := range zipReader.File {
+		if !zipFile.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		bagName, relPath, ok := splitBagPath(zipFile.Name)
+		if !ok {
+			continue
+		}
+		entry := BagEntry{
+			BagName: bagName,
+			Path:    relPath,
+			Size:    int64(zipFile.UncompressedSize64),
+			ModTime: zipFile.Modified,
+		}
+		reader, err := zipFile.Open()
+		if err != nil {
+			return err
+		}
+		err = fn(entry, reader)
+		reader.Close()
+		if err == ErrStopBagWalk {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitBagPath splits a path from a tar or zip file into the bag's
+// top-level directory name and the path relative to that directory.
+func splitBagPath(name string) (string, string, bool) {
+	name = strings.TrimPrefix(name, "./")
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// BagTag is one name-value pair from a tag file, such as bag-info.txt.
+type BagTag struct {
+	Name  string
+	Value string
+}
+
+// ParseTagFile reads the tags in a tag file in the order they appear.
+// Lines that start with whitespace continue the previous tag's value,
+// as described in section 2.2.2 of RFC 8493. Names may repeat.
+func ParseTagFile(r io.Reader) ([]BagTag, error) {
+	tags := make([]BagTag, 0)
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(tags) == 0 {
+				return tags, fmt.Errorf("line %d continues a tag, but no tag precedes it", lineNumber)
+			}
+			tags[len(tags)-1].Value += " " + strings.TrimSpace(line)
+			continue
+		}
+		name, value, found := strings.Cut(line, ":")
+		if !found {
+			return tags, fmt.Errorf("line %d has no colon: %q", lineNumber, line)
+		}
+		tags = append(tags, BagTag{Name: strings.TrimSpace(name), Value: strings.TrimSpace(value)})
+	}
+	return tags, scanner.Err()
+}
+
+// TagValue returns the value of the first tag named name,
+// ignoring case.
+func TagValue(tags []BagTag, name string) string {
+	for _, tag := range tags {
+		if strings.EqualFold(tag.Name, name) {
+			return tag.Value
+		}
+	}
+	return ""
+}
+
+// UnpackedBag describes the payload that UnpackPayload wrote to disk.
+type UnpackedBag struct {
+	BagName string
+	// PayloadDir is the directory containing the unpacked payload.
+	PayloadDir string
+	// PayloadFiles lists the unpacked files, relative to PayloadDir.
+	PayloadFiles []string
+	// Manifests maps payload manifest file names, like
+	// manifest-sha256.txt, to their contents.
+	Manifests map[string]string
+}
+
+// UnpackPayload extracts the payload of the serialized bag at bagPath
+// into targetDir/<bag name>. Only files under the bag's data directory
+// are extracted, and the "data/" prefix is removed, so data/docs/a.pdf
+// ends up at targetDir/<bag name>/docs/a.pdf. The payload manifests
+// are returned in memory so the caller can verify the unpacked files.
+//
+// This will not overwrite existing files. It refuses bags whose files
+// are not all inside one top-level directory, and top-level directory
+// names like "..", which could put files outside targetDir.
+func UnpackPayload(bagPath, targetDir string) (*UnpackedBag, error) {
+	unpacked := &UnpackedBag{
+		PayloadFiles: make([]string, 0),
+		Manifests:    make(map[string]string),
+	}
+	err := WalkSerializedBag(bagPath, func(entry BagEntry, reader io.Reader) error {
+		if unpacked.BagName == "" {
+			if !isSafeBagName(entry.BagName) {
+				return fmt.Errorf("Bag has illegal top-level directory name %q", entry.BagName)
+			}
+			unpacked.BagName = entry.BagName
+			unpacked.PayloadDir = filepath.Join(targetDir, entry.BagName)
+		} else if entry.BagName != unpacked.BagName {
+			return fmt.Errorf("Bag has more than one top-level directory: %s and %s", unpacked.BagName, entry.BagName)
+		}
+		if isPayloadManifest(entry.Path) {
+			data, err := io.ReadAll(reader)
+			if err != nil {
+				return err
+			}
+			unpacked.Manifests[entry.Path] = string(data)
+			return nil
+		}
+		if !strings.HasPrefix(entry.Path, "data/") {
+			return nil
+		}
+		relPath := path.Clean(strings.TrimPrefix(entry.Path, "data/"))
+		if relPath == ".." || strings.HasPrefix(relPath, "../") || path.IsAbs(relPath) {
+			return fmt.Errorf("Bag contains illegal payload path %s", entry.Path)
+		}
+		outputPath := filepath.Join(unpacked.PayloadDir, filepath.FromSlash(relPath))
+		if err := writeNewFile(outputPath, reader); err != nil {
+			return err
+		}
+		unpacked.PayloadFiles = append(unpacked.PayloadFiles, relPath)
+		return nil
+	})
+	if err == nil && unpacked.BagName == "" {
+		err = fmt.Errorf("%s does not contain a bag", bagPath)
+	}
+	return unpacked, err
+}
+
+// isSafeBagName returns true if name can be used as the name of a
+// directory inside the unpacking target. It must be a single path
+// element, with no separators, and can't be "." or "..".
+func isSafeBagName(name string) bool {
+	if name == "" || name == "." || name == ".." {
+		return false
+	}
+	return !strings.ContainsAny(name, `/\:`) && filepath.Base(name) == name
+}
+
+func isPayloadManifest(relPath string) bool {
+	return strings.HasPrefix(relPath, "manifest-") && strings.HasSuffix(relPath, ".txt")
+}
+
+func writeNewFile(outputPath string, reader io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(outputPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err = io.Copy(file, reader); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// ChecksumResult records the outcome of checking one unpacked
+// payload file against one of the bag's payload manifests.
+type ChecksumResult struct {
+	Path      string
+	Algorithm string
+	Expected  string
+	Actual    string
+}
+
+// OK returns true if the actual checksum matches the expected one.
+func (result ChecksumResult) OK() bool {
+	return result.Actual != "" && strings.EqualFold(result.Expected, result.Actual)
+}
+
+// VerifyPayloadChecksums checks each file in unpacked.PayloadDir
+// against every payload manifest in the bag, reading each file only
+// once. Files listed in a manifest but missing on disk come back
+// with an empty Actual checksum. Manifests using an algorithm we
+// don't support are ignored.
+func VerifyPayloadChecksums(unpacked *UnpackedBag) ([]ChecksumResult, error) {
+	expected := make(map[string]map[string]string)
+	for manifestName, contents := range unpacked.Manifests {
+		algorithm := strings.TrimSuffix(strings.TrimPrefix(manifestName, "manifest-"), ".txt")
+		if newHash(algorithm) == nil {
+			continue
+		}
+		scanner := bufio.NewScanner(strings.NewReader(contents))
+		for scanner.Scan() {
+			digest, filePath, found := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+			if !found {
+				continue
+			}
+			filePath = strings.TrimPrefix(strings.TrimSpace(filePath), "*")
+			relPath := strings.TrimPrefix(filePath, "data/")
+			if expected[relPath] == nil {
+				expected[relPath] = make(map[string]string)
+			}
+			expected[relPath][algorithm] = digest
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	paths := make([]string, 0, len(expected))
+	for relPath := range expected {
+		paths = append(paths, relPath)
+	}
+	sort.Strings(paths)
+
+	results := make([]ChecksumResult, 0)
+	for _, relPath := range paths {
+		algorithms := make([]string, 0, len(expected[relPath]))
+		for algorithm := range expected[relPath] {
+			algorithms = append(algorithms, algorithm)
+		}
+		sort.Strings(algorithms)
+		actual, err := fileDigests(filepath.Join(unpacked.PayloadDir, filepath.FromSlash(relPath)), algorithms)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return results, err
+		}
+		for _, algorithm := range algorithms {
+			results = append(results, ChecksumResult{
+				Path:      "data/" + relPath,
+				Algorithm: algorithm,
+				Expected:  expected[relPath][algorithm],
+				Actual:    actual[algorithm],
+			})
+		}
+	}
+	return results, nil
+}
+
+// ChecksumReport formats checksum results as plain text, one line per
+// result, followed by a summary line. This is what we save as a job
+// artifact.
+func ChecksumReport(results []ChecksumResult) string {
+	var sb strings.Builder
+	failed := 0
+	for _, result := range results {
+		status := "OK"
+		if !result.OK() {
+			status = "FAILED"
+			failed++
+		}
+		actual := result.Actual
+		if actual == "" {
+			actual = "(missing)"
+		}
+		sb.WriteString(fmt.Sprintf("%-6s  %-6s  %s  expected %s, got %s\n", status, result.Algorithm, result.Path, result.Expected, actual))
+	}
+	sb.WriteString(fmt.Sprintf("\n%d checksums verified, %d failed.\n", len(results)-failed, failed))
+	return sb.String()
+}
+
+func fileDigests(filePath string, algorithms []string) (map[string]string, error) {
+	digests := make(map[string]string)
+	file, err := os.Open(filePath)
+	if err != nil {
+		return digests, err
+	}
+	defer file.Close()
+	hashes := make(map[string]hash.Hash)
+	writers := make([]io.Writer, 0, len(algorithms))
+	for _, algorithm := range algorithms {
+		hashes[algorithm] = newHash(algorithm)
+		writers = append(writers, hashes[algorithm])
+	}
+	if _, err = io.Copy(io.MultiWriter(writers...), file); err != nil {
+		return digests, err
+	}
+	for algorithm, h := range hashes {
+		digests[algorithm] = hex.EncodeToString(h.Sum(nil))
+	}
+	return digests, nil
+}
+
+func newHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case "md5":
+		return md5.New()
+	case "sha1":
+		return sha1.New()
+	case "sha256":
+		return sha256.New()
+	case "sha512":
+		return sha512.New()
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package controllers_test
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/APTrust/dart-runner/util"
+	"github.com/APTrust/dart/v3/server/controllers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsSerializedBag(t *testing.T) {
+	assert.True(t, controllers.IsSerializedBag("bag.tar"))
+	assert.True(t, controllers.IsSerializedBag("a/b/BAG.TAR"))
+	assert.True(t, controllers.IsSerializedBag("bag.tar.gz"))
+	assert.True(t, controllers.IsSerializedBag("bag.tgz"))
+	assert.True(t, controllers.IsSerializedBag("bag.zip"))
+	assert.False(t, controllers.IsSerializedBag("bag.txt"))
+	assert.False(t, controllers.IsSerializedBag("tarball"))
+}
+
+func TestWalkSerializedBag(t *testing.T) {
+	for _, ext := range []string{".tar", ".zip"} {
+		bagPath := filepath.Join(util.PathToTestData(), "bags", "example.edu.sample_good"+ext)
+		paths := make([]string, 0)
+		err := controllers.WalkSerializedBag(bagPath, func(entry controllers.BagEntry, reader io.Reader) error {
+			assert.Equal(t, "example.edu.sample_good", entry.BagName)
+			paths = append(paths, entry.Path)
+			return nil
+		})
+		require.NoError(t, err, ext)
+		assert.Contains(t, paths, "bag-info.txt", ext)
+		assert.Contains(t, paths, "manifest-md5.txt", ext)
+		assert.Contains(t, paths, "data/datastream-DC", ext)
+		assert.NotContains(t, paths, "data/", ext)
+	}
+
+	// Make sure we can stop early
+	bagPath := filepath.Join(util.PathToTestData(), "bags", "example.edu.sample_good.tar")
+	count := 0
+	err := controllers.WalkSerializedBag(bagPath, func(entry controllers.BagEntry, reader io.Reader) error {
+		count++
+		return controllers.ErrStopBagWalk
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	err = controllers.WalkSerializedBag(filepath.Join(util.PathToTestData(), "bags", "README.md"), func(entry controllers.BagEntry, reader io.Reader) error {
+		return nil
+	})
+	assert.Error(t, err)
+}
+
+func TestUnpackPayload(t *testing.T) {
+	for _, ext := range []string{".tar", ".zip"} {
+		targetDir := t.TempDir()
+		bagPath := filepath.Join(util.PathToTestData(), "bags", "example.edu.sample_good"+ext)
+		unpacked, err := controllers.UnpackPayload(bagPath, targetDir)
+		require.NoError(t, err, ext)
+		assert.Equal(t, "example.edu.sample_good", unpacked.BagName)
+		assert.Equal(t, filepath.Join(targetDir, "example.edu.sample_good"), unpacked.PayloadDir)
+		assert.Equal(t, 4, len(unpacked.PayloadFiles))
+		assert.Contains(t, unpacked.Manifests, "manifest-md5.txt")
+
+		// Payload goes into the target dir without the data/ prefix,
+		// and tag files are not unpacked.
+		assert.FileExists(t, filepath.Join(unpacked.PayloadDir, "datastream-DC"))
+		assert.NoFileExists(t, filepath.Join(unpacked.PayloadDir, "bag-info.txt"))
+
+		results, err := controllers.VerifyPayloadChecksums(unpacked)
+		require.NoError(t, err)
+		assert.Equal(t, 4, len(results))
+		for _, result := range results {
+			assert.True(t, result.OK(), result.Path)
+			assert.Equal(t, "md5", result.Algorithm)
+		}
+		assert.Contains(t, controllers.ChecksumReport(results), "4 checksums verified, 0 failed.")
+
+		// Unpacking again should not overwrite existing files.
+		_, err = controllers.UnpackPayload(bagPath, targetDir)
+		assert.Error(t, err)
+	}
+}
+
+func TestUnpackPayloadRejectsUnsafeTopLevelDirs(t *testing.T) {
+	for name, entries := range map[string][]string{
+		"parent dir":      {"../data/evil.txt"},
+		"two bag dirs":    {"bag_one/data/a.txt", "bag_two/data/b.txt"},
+		"dot then parent": {"./../data/evil.txt"},
+	} {
+		targetDir := filepath.Join(t.TempDir(), "target")
+		bagPath := filepath.Join(t.TempDir(), "unsafe.tar")
+		writeTestTar(t, bagPath, entries)
+		_, err := controllers.UnpackPayload(bagPath, targetDir)
+		assert.Error(t, err, name)
+		assert.NoFileExists(t, filepath.Join(filepath.Dir(targetDir), "data", "evil.txt"), name)
+	}
+}
+
+// writeTestTar writes a tar file containing one small file
+// for each of the given entry names.
+func writeTestTar(t *testing.T, tarPath string, names []string) {
+	file, err := os.Create(tarPath)
+	require.NoError(t, err)
+	defer file.Close()
+	writer := tar.NewWriter(file)
+	for _, name := range names {
+		contents := []byte("contents of " + name)
+		require.NoError(t, writer.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents)), Typeflag: tar.TypeReg}))
+		_, err = writer.Write(contents)
+		require.NoError(t, err)
+	}
+	require.NoError(t, writer.Close())
+}
+
+func TestVerifyPayloadChecksumsWithBadBag(t *testing.T) {
+	targetDir := t.TempDir()
+	bagPath := filepath.Join(util.PathToTestData(), "bags", "test.edu.btr_bad_checksums.tar")
+	unpacked, err := controllers.UnpackPayload(bagPath, targetDir)
+	require.NoError(t, err)
+
+	results, err := controllers.VerifyPayloadChecksums(unpacked)
+	require.NoError(t, err)
+	failed := 0
+	for _, result := range results {
+		if !result.OK() {
+			failed++
+		}
+	}
+	assert.True(t, failed > 0)
+	assert.Contains(t, controllers.ChecksumReport(results), "FAILED")
+
+	// Missing files should show up as failures too.
+	require.NoError(t, os.Remove(filepath.Join(unpacked.PayloadDir, filepath.FromSlash(unpacked.PayloadFiles[0]))))
+	results, err = controllers.VerifyPayloadChecksums(unpacked)
+	require.NoError(t, err)
+	assert.Contains(t, controllers.ChecksumReport(results), "(missing)")
+}
+
+func TestParseTagFile(t *testing.T) {
+	tagFile := "Source-Organization: example.edu\r\n" +
+		"External-Description: A long description\n" +
+		"  that continues here\n" +
+		"\n" +
+		"Bag-Count: 1 of 2\n" +
+		"Source-Organization:  second value \n"
+	tags, err := controllers.ParseTagFile(strings.NewReader(tagFile))
+	require.NoError(t, err)
+	assert.Equal(t, []controllers.BagTag{
+		{Name: "Source-Organization", Value: "example.edu"},
+		{Name: "External-Description", Value: "A long description that continues here"},
+		{Name: "Bag-Count", Value: "1 of 2"},
+		{Name: "Source-Organization", Value: "second value"},
+	}, tags)
+	assert.Equal(t, "example.edu", controllers.TagValue(tags, "source-organization"))
+	assert.Equal(t, "", controllers.TagValue(tags, "Bagging-Date"))
+
+	_, err = controllers.ParseTagFile(strings.NewReader("  continued\nName: value\n"))
+	assert.Error(t, err)
+	_, err = controllers.ParseTagFile(strings.NewReader("Name value\n"))
+	assert.Error(t, err)
+}
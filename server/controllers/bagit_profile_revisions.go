@@ -0,0 +1,318 @@
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/APTrust/dart-runner/core"
+)
+
+// ProfileRevision is a copy of a BagIt profile as it was after one
+// save. Revisions are numbered from 1 for each profile. The latest
+// revision matches the profile as it is now, unless the profile was
+// changed by something other than the DART UI, such as an import
+// from a settings file.
+//
+// TagValueRules is a copy of the profile's tag value rules, which
+// are stored apart from the profile. It's nil in revisions saved
+// before we kept the rules with them.
+type ProfileRevision struct {
+	ProfileID     string             `json:"profileId"`
+	Number        int                `json:"number"`
+	CreatedAt     time.Time          `json:"createdAt"`
+	Summary       string             `json:"summary"`
+	Profile       *core.BagItProfile `json:"profile"`
+	TagValueRules []TagValueRules    `json:"tagValueRules"`
+}
+
+// JobProfileRevision records which revision of a BagIt profile
+// a job was built with. RevisionNumber is zero if the job's copy
+// of the profile doesn't match any saved revision. That happens
+// when a workflow's copy of a profile predates revision tracking.
+type JobProfileRevision struct {
+	JobID          string    `json:"jobId"`
+	ProfileID      string    `json:"profileId"`
+	ProfileName    string    `json:"profileName"`
+	RevisionNumber int       `json:"revisionNumber"`
+	RecordedAt     time.Time `json:"recordedAt"`
+}
+
+var profileRevisionStore = NewJSONStore[ProfileRevision]("bagit_profile_revisions.json")
+
+var jobProfileRevisionStore = NewJSONStore[JobProfileRevision]("job_profile_revisions.json")
+
+// SaveBagItProfile saves profile and records a new revision of it,
+// along with the profile's tag value rules. If summary is empty, the
+// revision's summary describes what changed since the last save. If
+// the profile has no revisions yet, this first records the profile
+// as it was before this save, so the user can always get back to it.
+// Saves that change nothing don't create revisions. Like core.ObjSave,
+// this returns an error if the profile is invalid, and profile.Errors
+// has the details.
+//
+// Save changes to the profile's tag value rules before calling this,
+// and use changeTagValueRules to make them, so the revisions before
+// and after the change have the right rules.
+func SaveBagItProfile(profile *core.BagItProfile, summary string) error {
+	previous := core.ObjFind(profile.ID).BagItProfile()
+	if err := core.ObjSave(profile); err != nil {
+		return err
+	}
+	rules, err := LoadTagValueRules(profile.ID)
+	if err != nil {
+		return err
+	}
+	return profileRevisionStore.Update(func(revisions []ProfileRevision) ([]ProfileRevision, error) {
+		latest := latestProfileRevision(revisions, profile.ID)
+		if latest == nil && previous != nil {
+			revisions = append(revisions, originalRevision(previous, rules))
+			latest = &revisions[len(revisions)-1]
+		}
+		previousRules := rules
+		if latest != nil {
+			previous = latest.Profile
+			if latest.TagValueRules != nil {
+				previousRules = NewTagValueRuleSet(latest.TagValueRules)
+			}
+		}
+		if summary == "" {
+			summary = profileChangeSummary(previous, profile, previousRules, rules)
+		}
+		if summary == "" {
+			return revisions, nil
+		}
+		number := 1
+		if latest != nil {
+			number = latest.Number + 1
+		}
+		return append(revisions, ProfileRevision{
+			ProfileID:     profile.ID,
+			Number:        number,
+			CreatedAt:     time.Now(),
+			Summary:       summary,
+			Profile:       profile,
+			TagValueRules: rules.List(),
+		}), nil
+	})
+}
+
+// ProfileChangeSummary describes the changes from previous to current
+// in a single line, such as "Changed Serialization; Added tag
+// bag-info.txt/Bag-Group-Identifier". It returns "Created profile" if
+// previous is nil, and an empty string if nothing changed. This
+// doesn't include changes to tag value rules.
+func ProfileChangeSummary(previous, current *core.BagItProfile) string {
+	return profileChangeSummary(previous, current, nil, nil)
+}
+
+// profileChangeSummary is ProfileChangeSummary, plus changes from
+// previousRules to currentRules, which show up as changes to tags.
+func profileChangeSummary(previous, current *core.BagItProfile, previousRules, currentRules TagValueRuleSet) string {
+	if previous == nil {
+		return "Created profile"
+	}
+	changes := make([]string, 0)
+	if strings.TrimSpace(previous.Name) != strings.TrimSpace(current.Name) {
+		changes = append(changes, "Changed Name")
+	}
+	if strings.TrimSpace(previous.Description) != strings.TrimSpace(current.Description) {
+		changes = append(changes, "Changed Description")
+	}
+	diff := CompareBagItProfiles(previous, current)
+	diff.CompareTagValueRules(previousRules, currentRules)
+	for _, setting := range diff.Settings {
+		changes = append(changes, "Changed "+setting.Field)
+	}
+	for _, tag := range diff.Tags {
+		name := tag.TagFile + "/" + tag.TagName
+		switch tag.Status {
+		case TagOnlyInA:
+			changes = append(changes, "Removed tag "+name)
+		case TagOnlyInB:
+			changes = append(changes, "Added tag "+name)
+		default:
+			fields := make([]string, len(tag.Changes))
+			for i, change := range tag.Changes {
+				fields[i] = change.Field
+			}
+			changes = append(changes, fmt.Sprintf("Changed tag %s (%s)", name, strings.Join(fields, ", ")))
+		}
+	}
+	return strings.Join(changes, "; ")
+}
+
+// ProfileRevisions returns all revisions of the profile with the
+// specified ID, newest first.
+func ProfileRevisions(profileID string) ([]ProfileRevision, error) {
+	revisions, err := profileRevisionStore.Load()
+	if err != nil {
+		return nil, err
+	}
+	profileRevisions := make([]ProfileRevision, 0)
+	for _, revision := range revisions {
+		if revision.ProfileID == profileID {
+			profileRevisions = append(profileRevisions, revision)
+		}
+	}
+	sort.Slice(profileRevisions, func(i, j int) bool { return profileRevisions[i].Number > profileRevisions[j].Number })
+	return profileRevisions, nil
+}
+
+// FindProfileRevision returns the specified revision of a profile.
+func FindProfileRevision(profileID string, number int) (*ProfileRevision, error) {
+	revisions, err := ProfileRevisions(profileID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range revisions {
+		if revisions[i].Number == number {
+			return &revisions[i], nil
+		}
+	}
+	return nil, fmt.Errorf("Profile %s has no revision %d", profileID, number)
+}
+
+// RestoreProfileRevision replaces the profile and its tag value rules
+// with their copies in revision. The restore itself becomes a new
+// revision, so the version it replaced can be restored too. Revisions
+// that predate rule snapshots leave the current rules alone.
+func RestoreProfileRevision(revision *ProfileRevision) (*core.BagItProfile, error) {
+	profile := revision.Profile
+	profile.ID = revision.ProfileID
+	if revision.TagValueRules != nil {
+		if err := ReplaceTagValueRules(profile.ID, revision.TagValueRules); err != nil {
+			return nil, err
+		}
+	}
+	err := SaveBagItProfile(profile, fmt.Sprintf("Restored revision %d", revision.Number))
+	return profile, err
+}
+
+// DeleteProfileRevisions deletes all revisions of the profile
+// with the specified ID, if there are any.
+func DeleteProfileRevisions(profileID string) error {
+	return profileRevisionStore.Update(func(revisions []ProfileRevision) ([]ProfileRevision, error) {
+		kept := make([]ProfileRevision, 0, len(revisions))
+		for _, revision := range revisions {
+			if revision.ProfileID != profileID {
+				kept = append(kept, revision)
+			}
+		}
+		return kept, nil
+	})
+}
+
+// RecordJobProfileRevision records which revision of its BagIt
+// profile the job is using. Jobs get their own copy of a profile,
+// so we match the job's copy against saved revisions, newest first.
+// This does nothing for jobs that have no profile.
+func RecordJobProfileRevision(job *core.Job) error {
+	if job.BagItProfile == nil {
+		return nil
+	}
+	revisions, err := ProfileRevisions(job.BagItProfile.ID)
+	if err != nil {
+		return err
+	}
+	if len(revisions) == 0 {
+		// The profile hasn't been saved since we started tracking
+		// revisions, so its current state is the first revision.
+		current := core.ObjFind(job.BagItProfile.ID).BagItProfile()
+		if current != nil {
+			if err := recordOriginalRevision(current); err != nil {
+				return err
+			}
+		}
+		if revisions, err = ProfileRevisions(job.BagItProfile.ID); err != nil {
+			return err
+		}
+	}
+	record := JobProfileRevision{
+		JobID:       job.ID,
+		ProfileID:   job.BagItProfile.ID,
+		ProfileName: job.BagItProfile.Name,
+		RecordedAt:  time.Now(),
+	}
+	for _, revision := range revisions {
+		if revision.Profile.Name == job.BagItProfile.Name && CompareBagItProfiles(revision.Profile, job.BagItProfile).IsEmpty() {
+			record.RevisionNumber = revision.Number
+			break
+		}
+	}
+	return jobProfileRevisionStore.Update(func(records []JobProfileRevision) ([]JobProfileRevision, error) {
+		for i := range records {
+			if records[i].JobID == job.ID {
+				records[i] = record
+				return records, nil
+			}
+		}
+		return append(records, record), nil
+	})
+}
+
+// GetJobProfileRevision returns the profile revision recorded for
+// the job with the specified ID, or nil if there isn't one.
+func GetJobProfileRevision(jobID string) *JobProfileRevision {
+	records, err := jobProfileRevisionStore.Load()
+	if err != nil {
+		core.Dart.Log.Errorf("Cannot load job profile revisions: %v", err)
+	}
+	for i := range records {
+		if records[i].JobID == jobID {
+			return &records[i]
+		}
+	}
+	return nil
+}
+
+// recordOriginalRevision saves profile and its current tag value
+// rules as its first revision, unless it already has revisions.
+func recordOriginalRevision(profile *core.BagItProfile) error {
+	rules, err := LoadTagValueRules(profile.ID)
+	if err != nil {
+		return err
+	}
+	return profileRevisionStore.Update(func(revisions []ProfileRevision) ([]ProfileRevision, error) {
+		if latestProfileRevision(revisions, profile.ID) != nil {
+			return revisions, nil
+		}
+		return append(revisions, originalRevision(profile, rules)), nil
+	})
+}
+
+// changeTagValueRules calls change, which adds, edits or deletes
+// tag value rules of the profile with ID profileID. If the profile
+// has no revisions yet, this first records its original revision,
+// so that revision keeps the rules from before the change. Call
+// SaveBagItProfile afterward to record the change.
+func changeTagValueRules(profileID string, change func() error) error {
+	if profile := core.ObjFind(profileID).BagItProfile(); profile != nil {
+		if err := recordOriginalRevision(profile); err != nil {
+			return err
+		}
+	}
+	return change()
+}
+
+func originalRevision(profile *core.BagItProfile, rules TagValueRuleSet) ProfileRevision {
+	return ProfileRevision{
+		ProfileID:     profile.ID,
+		Number:        1,
+		CreatedAt:     time.Now(),
+		Summary:       "Original version",
+		Profile:       profile,
+		TagValueRules: rules.List(),
+	}
+}
+
+func latestProfileRevision(revisions []ProfileRevision, profileID string) *ProfileRevision {
+	var latest *ProfileRevision
+	for i := range revisions {
+		if revisions[i].ProfileID == profileID && (latest == nil || revisions[i].Number > latest.Number) {
+			latest = &revisions[i]
+		}
+	}
+	return latest
+}
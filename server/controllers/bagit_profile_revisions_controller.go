@@ -0,0 +1,91 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/APTrust/dart-runner/core"
+	"github.com/gin-gonic/gin"
+)
+
+// GET /profiles/revisions/:id
+func BagItProfileRevisions(c *gin.Context) {
+	profile := core.ObjFind(c.Param("id")).BagItProfile()
+	if profile == nil {
+		AbortWithErrorHTML(c, http.StatusNotFound, fmt.Errorf("No BagIt profile with id %s", c.Param("id")))
+		return
+	}
+	revisions, err := ProfileRevisions(profile.ID)
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+		return
+	}
+	data := gin.H{
+		"profile":   profile,
+		"revisions": revisions,
+		"flash":     GetFlashCookie(c),
+		"helpUrl":   GetHelpUrl(c),
+	}
+	c.HTML(http.StatusOK, "bagit_profile/revisions.html", data)
+}
+
+// GET /profiles/revision/:profile_id/:number
+//
+// Shows how the revision differs from the profile as it is now.
+func BagItProfileRevisionShow(c *gin.Context) {
+	profile, revision, err := loadProfileAndRevision(c)
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusNotFound, err)
+		return
+	}
+	diff := CompareBagItProfiles(revision.Profile, profile)
+	if revision.TagValueRules != nil {
+		rules, err := LoadTagValueRules(profile.ID)
+		if err != nil {
+			AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+			return
+		}
+		diff.CompareTagValueRules(NewTagValueRuleSet(revision.TagValueRules), rules)
+	}
+	diff.ProfileAName = fmt.Sprintf("Revision %d", revision.Number)
+	diff.ProfileBName = "Current"
+	data := gin.H{
+		"profile":  profile,
+		"revision": revision,
+		"diff":     diff,
+		"helpUrl":  GetHelpUrl(c),
+	}
+	c.HTML(http.StatusOK, "bagit_profile/revision.html", data)
+}
+
+// POST /profiles/restore_revision/:profile_id/:number
+func BagItProfileRevisionRestore(c *gin.Context) {
+	_, revision, err := loadProfileAndRevision(c)
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusNotFound, err)
+		return
+	}
+	profile, err := RestoreProfileRevision(revision)
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusBadRequest, fmt.Errorf("Cannot restore revision %d: %v", revision.Number, err))
+		return
+	}
+	core.Dart.Log.Infof("Restored revision %d of BagIt profile %s", revision.Number, profile.Name)
+	SetFlashCookie(c, fmt.Sprintf("Restored revision %d of %s", revision.Number, profile.Name))
+	c.Redirect(http.StatusFound, fmt.Sprintf("/profiles/revisions/%s", profile.ID))
+}
+
+func loadProfileAndRevision(c *gin.Context) (*core.BagItProfile, *ProfileRevision, error) {
+	profileID := c.Param("profile_id")
+	profile := core.ObjFind(profileID).BagItProfile()
+	if profile == nil {
+		return nil, nil, fmt.Errorf("No BagIt profile with id %s", profileID)
+	}
+	number, err := strconv.Atoi(c.Param("number"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid revision number %s", c.Param("number"))
+	}
+	revision, err := FindProfileRevision(profileID, number)
+	return profile, revision, err
+}
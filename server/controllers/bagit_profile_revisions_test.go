@@ -0,0 +1,167 @@
+package controllers_test
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart/v3/server/controllers"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProfileChangeSummary(t *testing.T) {
+	a, b := getDiffTestProfiles()
+	assert.Equal(t, "Created profile", controllers.ProfileChangeSummary(nil, a))
+	assert.Empty(t, controllers.ProfileChangeSummary(a, a))
+	assert.Equal(t, "Changed Name; "+
+		"Changed Required Manifests; "+
+		"Changed Accepted Serialization Formats; "+
+		"Changed Serialization; "+
+		"Changed tag aptrust-info.txt/Access (Required, Allowed Values, Help); "+
+		"Added tag bag-info.txt/Bag-Group-Identifier; "+
+		"Removed tag bag-info.txt/Source-Organization",
+		controllers.ProfileChangeSummary(a, b))
+}
+
+func TestBagItProfileRevisions(t *testing.T) {
+	defer core.ClearDartTable()
+	original, _ := getDiffTestProfiles()
+	require.NoError(t, core.ObjSaveWithoutValidation(original))
+
+	// The first save records the original version along with the change.
+	profile := core.ObjFind(original.ID).BagItProfile()
+	profile.Serialization = "optional"
+	profile.Tags = append(profile.Tags, &core.TagDefinition{ID: uuid.NewString(), TagFile: "bag-info.txt", TagName: "Bag-Group-Identifier"})
+	require.NoError(t, controllers.SaveBagItProfile(profile, ""))
+	revisions, err := controllers.ProfileRevisions(original.ID)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(revisions))
+	assert.Equal(t, 2, revisions[0].Number)
+	assert.Equal(t, "Changed Serialization; Added tag bag-info.txt/Bag-Group-Identifier", revisions[0].Summary)
+	assert.Equal(t, "Original version", revisions[1].Summary)
+	assert.Equal(t, "required", revisions[1].Profile.Serialization)
+
+	// Saving without changes doesn't add a revision.
+	require.NoError(t, controllers.SaveBagItProfile(core.ObjFind(original.ID).BagItProfile(), ""))
+	revisions, err = controllers.ProfileRevisions(original.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(revisions))
+
+	DoSimpleGetTest(t, "/profiles/revisions/"+original.ID, []string{
+		"Revisions of Profile A",
+		"Original version",
+		"Changed Serialization",
+		fmt.Sprintf("/profiles/restore_revision/%s/1", original.ID),
+	})
+	DoSimpleGetTest(t, fmt.Sprintf("/profiles/revision/%s/1", original.ID), []string{
+		"Profile A: Revision 1",
+		"Bag-Group-Identifier",
+		"Restore This Revision",
+	})
+
+	DoSimplePostTest(t, PostTestSettings{
+		EndpointUrl:              fmt.Sprintf("/profiles/restore_revision/%s/1", original.ID),
+		ExpectedResponseCode:     http.StatusFound,
+		ExpectedRedirectLocation: "/profiles/revisions/" + original.ID,
+	})
+	restored := core.ObjFind(original.ID).BagItProfile()
+	assert.Equal(t, "required", restored.Serialization)
+	assert.Equal(t, 3, len(restored.Tags))
+	revision, err := controllers.FindProfileRevision(original.ID, 3)
+	require.NoError(t, err)
+	assert.Equal(t, "Restored revision 1", revision.Summary)
+
+	_, err = controllers.FindProfileRevision(original.ID, 9)
+	assert.Error(t, err)
+}
+
+func TestBagItProfileRevisionTagValueRules(t *testing.T) {
+	defer core.ClearDartTable()
+	original, _ := getDiffTestProfiles()
+	require.NoError(t, core.ObjSaveWithoutValidation(original))
+	defer controllers.ReplaceTagValueRules(original.ID, nil)
+
+	// Editing only a tag's rules records a revision,
+	// and the original revision keeps the old rules.
+	tag := original.Tags[1]
+	params := tagDefToFormData(tag)
+	params.Set("MaxLength", "100")
+	DoSimplePostTest(t, PostTestSettings{
+		EndpointUrl:          fmt.Sprintf("/profiles/edit_tag/%s/%s", original.ID, tag.ID),
+		Params:               params,
+		ExpectedResponseCode: http.StatusOK,
+	})
+	revisions, err := controllers.ProfileRevisions(original.ID)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(revisions))
+	assert.Equal(t, "Changed tag bag-info.txt/Source-Organization (Maximum Length)", revisions[0].Summary)
+	require.Equal(t, 1, len(revisions[0].TagValueRules))
+	assert.Equal(t, 100, revisions[0].TagValueRules[0].MaxLength)
+	assert.NotNil(t, revisions[1].TagValueRules)
+	assert.Empty(t, revisions[1].TagValueRules)
+
+	DoSimpleGetTest(t, fmt.Sprintf("/profiles/revision/%s/1", original.ID), []string{
+		"Source-Organization",
+		"Maximum Length",
+	})
+
+	// Restoring a revision restores its rules too.
+	revision, err := controllers.FindProfileRevision(original.ID, 1)
+	require.NoError(t, err)
+	_, err = controllers.RestoreProfileRevision(revision)
+	require.NoError(t, err)
+	ruleSet, err := controllers.LoadTagValueRules(original.ID)
+	require.NoError(t, err)
+	assert.Empty(t, ruleSet)
+	revision, err = controllers.FindProfileRevision(original.ID, 3)
+	require.NoError(t, err)
+	assert.Equal(t, "Restored revision 1", revision.Summary)
+
+	revision, err = controllers.FindProfileRevision(original.ID, 2)
+	require.NoError(t, err)
+	_, err = controllers.RestoreProfileRevision(revision)
+	require.NoError(t, err)
+	ruleSet, err = controllers.LoadTagValueRules(original.ID)
+	require.NoError(t, err)
+	require.NotNil(t, ruleSet.For(tag))
+	assert.Equal(t, 100, ruleSet.For(tag).MaxLength)
+	assert.Equal(t, original.ID, ruleSet.For(tag).ProfileID)
+}
+
+func TestRecordJobProfileRevision(t *testing.T) {
+	defer core.ClearDartTable()
+	profile, _ := getDiffTestProfiles()
+	require.NoError(t, core.ObjSaveWithoutValidation(profile))
+
+	// A job using a profile with no revisions records the
+	// profile's current state as revision 1.
+	job := core.NewJob()
+	job.BagItProfile = core.ObjFind(profile.ID).BagItProfile()
+	require.NoError(t, controllers.RecordJobProfileRevision(job))
+	record := controllers.GetJobProfileRevision(job.ID)
+	require.NotNil(t, record)
+	assert.Equal(t, profile.ID, record.ProfileID)
+	assert.Equal(t, 1, record.RevisionNumber)
+
+	// Jobs keep their copy of the profile, so later edits
+	// don't change the revision they were built with.
+	edited := core.ObjFind(profile.ID).BagItProfile()
+	edited.AllowFetchTxt = true
+	require.NoError(t, controllers.SaveBagItProfile(edited, ""))
+	require.NoError(t, controllers.RecordJobProfileRevision(job))
+	assert.Equal(t, 1, controllers.GetJobProfileRevision(job.ID).RevisionNumber)
+
+	job.BagItProfile = core.ObjFind(profile.ID).BagItProfile()
+	require.NoError(t, controllers.RecordJobProfileRevision(job))
+	assert.Equal(t, 2, controllers.GetJobProfileRevision(job.ID).RevisionNumber)
+
+	// A copy that matches no revision gets revision zero.
+	job.BagItProfile.Tags[0].Help = "Changed outside of the profile editor"
+	require.NoError(t, controllers.RecordJobProfileRevision(job))
+	assert.Equal(t, 0, controllers.GetJobProfileRevision(job.ID).RevisionNumber)
+
+	assert.Nil(t, controllers.GetJobProfileRevision("no-such-job"))
+}
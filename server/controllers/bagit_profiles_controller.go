@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -30,7 +31,13 @@ func BagItProfileCreate(c *gin.Context) {
 	newProfile := core.BagItProfileClone(result.BagItProfile())
 	newProfile.BaseProfileID = baseProfileID
 	newProfile.Name = fmt.Sprintf("New profile based on %s %s", result.BagItProfile().Name, time.Now().Format(time.Stamp))
-	err := core.ObjSave(newProfile)
+	// Value rules are keyed by profile ID, so the clone needs
+	// its own copy. Copy them first, so the clone's first
+	// revision includes them.
+	err := CopyTagValueRules(baseProfileID, newProfile.ID)
+	if err == nil {
+		err = SaveBagItProfile(newProfile, "")
+	}
 	if err != nil {
 		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
 		return
@@ -50,6 +57,15 @@ func BagItProfileDelete(c *gin.Context) {
 	err := core.ObjDelete(profile)
 	if err != nil {
 		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+		return
+	}
+	err = ReplaceTagValueRules(profile.ID, nil)
+	if err != nil {
+		core.Dart.Log.Warningf("Error deleting tag value rules for profile %s: %v", profile.ID, err)
+	}
+	err = DeleteProfileRevisions(profile.ID)
+	if err != nil {
+		core.Dart.Log.Warningf("Error deleting revisions of profile %s: %v", profile.ID, err)
 	}
 	data := map[string]string{
 		"status":   "OK",
@@ -75,6 +91,7 @@ func BagItProfileEdit(c *gin.Context) {
 	request.TemplateData["tagsInFile"] = tagMap
 	request.TemplateData["activeTab"] = c.DefaultQuery("tab", "navAboutTab")
 	request.TemplateData["activeTagFile"] = c.Query("tagFile")
+	request.TemplateData["lintIssues"] = LintBagItProfile(profile)
 	c.HTML(http.StatusOK, "bagit_profile/form.html", request.TemplateData)
 }
 
@@ -105,7 +122,7 @@ func BagItProfileNew(c *gin.Context) {
 
 // GET /profiles/import_start
 func BagItProfileImportStart(c *gin.Context) {
-	form := core.NewBagItProfileImport("", "", nil).ToForm()
+	form := bagItProfileImportForm(core.NewBagItProfileImport("", "", nil), "")
 	data := gin.H{
 		"helpUrl": GetHelpUrl(c),
 		"form":    form,
@@ -123,9 +140,17 @@ func BagItProfileImport(c *gin.Context) {
 	bpi.JsonData = []byte(c.PostForm("JsonData"))
 	bpi.URL = c.PostForm("URL")
 	bpi.ImportSource = c.PostForm("ImportSource")
+	if bpi.ImportSource == ImportSourceBag {
+		bagItProfileImportFromBag(c, bpi)
+		return
+	}
 	convertedProfile, err := bpi.Convert()
+	var rules []TagValueRules
+	if err == nil {
+		rules, err = TagValueRulesFromExport(bpi.JsonData, convertedProfile)
+	}
 	if err != nil {
-		form := bpi.ToForm()
+		form := bagItProfileImportForm(bpi, "")
 		if form.Fields["ImportSource"].Error == "" {
 			form.Fields["ImportSource"].Error = "JSON is invalid or does not represent a recognizable BagIt profile structure: " + err.Error()
 		}
@@ -137,18 +162,79 @@ func BagItProfileImport(c *gin.Context) {
 	}
 	convertedProfile.Name = fmt.Sprintf("%s %s", convertedProfile.Name, time.Now().Format(time.Stamp))
 	convertedProfile.IsBuiltIn = false // profile is imported, not built-in
-	err = core.ObjSave(convertedProfile)
+	err = ReplaceTagValueRules(convertedProfile.ID, rules)
+	if err == nil {
+		err = SaveBagItProfile(convertedProfile, "")
+		if err != nil {
+			// Don't leave rules behind for a profile we didn't save.
+			if deleteErr := ReplaceTagValueRules(convertedProfile.ID, nil); deleteErr != nil {
+				core.Dart.Log.Errorf("Cannot delete tag value rules of unsaved profile %s: %v", convertedProfile.ID, deleteErr)
+			}
+		}
+	}
 	if err != nil {
 		data := gin.H{
-			"form":    bpi.ToForm(),
+			"form":    bagItProfileImportForm(bpi, ""),
 			"helpUrl": GetHelpUrl(c),
 		}
 		c.HTML(http.StatusBadRequest, "bagit_profile/import.html", data)
 		return
 	}
+	setImportLintFlash(c, convertedProfile)
 	c.Redirect(http.StatusFound, fmt.Sprintf("/profiles/edit/%s", convertedProfile.ID))
 }
 
+// bagItProfileImportFromBag creates a draft profile from the bag at
+// the path the user entered, and sends the user to the edit page to
+// review it. See InferBagItProfile.
+func bagItProfileImportFromBag(c *gin.Context, bpi *core.BagItProfileImport) {
+	bagPath := strings.TrimSpace(c.PostForm("BagPath"))
+	form := bagItProfileImportForm(bpi, bagPath)
+	var profile *core.BagItProfile
+	var err error
+	if bagPath == "" {
+		form.Fields["BagPath"].Error = "Please enter the path to a bag."
+	} else if profile, err = InferBagItProfile(bagPath); err == nil {
+		err = SaveBagItProfile(profile, "Inferred from "+bagPath)
+	}
+	if err != nil {
+		form.Fields["BagPath"].Error = err.Error()
+	}
+	if form.Fields["BagPath"].Error != "" {
+		data := gin.H{
+			"form":    form,
+			"helpUrl": GetHelpUrl(c),
+		}
+		c.HTML(http.StatusBadRequest, "bagit_profile/import.html", data)
+		return
+	}
+	core.Dart.Log.Infof("Created draft BagIt profile %s from %s", profile.Name, bagPath)
+	setImportLintFlash(c, profile)
+	c.Redirect(http.StatusFound, fmt.Sprintf("/profiles/edit/%s", profile.ID))
+}
+
+// setImportLintFlash tells the user about lint issues in a profile
+// they just imported. The edit page lists them.
+func setImportLintFlash(c *gin.Context, profile *core.BagItProfile) {
+	if summary := LintSummary(LintBagItProfile(profile)); summary != "" {
+		SetFlashCookie(c, fmt.Sprintf("Imported %s. Its lint report shows %s. See the list below.", profile.Name, summary))
+	}
+}
+
+// bagItProfileImportForm returns the import form with our extra
+// import source for existing bags.
+func bagItProfileImportForm(bpi *core.BagItProfileImport, bagPath string) *core.Form {
+	form := bpi.ToForm()
+	form.Fields["ImportSource"].Choices = append(form.Fields["ImportSource"].Choices, core.Choice{
+		Label:    "Existing Bag",
+		Value:    ImportSourceBag,
+		Selected: bpi.ImportSource == ImportSourceBag,
+	})
+	bagPathField := form.AddField("BagPath", "Path to Bag", bagPath, false)
+	bagPathField.Help = "A bag directory, or a tar, tar.gz or zip file. DART creates a draft profile from the bag's BagIt version, manifests, tag files and tags, which you can then edit."
+	return form
+}
+
 // GET /profiles/export/:id
 func BagItProfileExport(c *gin.Context) {
 	result := core.ObjFind(c.Param("id"))
@@ -162,8 +248,17 @@ func BagItProfileExport(c *gin.Context) {
 		AbortWithErrorHTML(c, http.StatusInternalServerError, result.Error)
 		return
 	}
+	rules, err := LoadTagValueRules(profile.ID)
+	if err == nil {
+		profileJson, err = AddTagValueRulesToExport(profileJson, rules)
+	}
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+		return
+	}
 	templateData := gin.H{
-		"json": profileJson,
+		"json":             profileJson,
+		"hasTagValueRules": len(rules) > 0,
 	}
 	c.HTML(http.StatusOK, "bagit_profile/export.html", templateData)
 }
@@ -205,7 +300,7 @@ func BagItProfileSave(c *gin.Context) {
 		}
 		profile.TagFilesAllowed = allowed
 	}
-	err = core.ObjSave(profile)
+	err = SaveBagItProfile(profile, "")
 	if err != nil {
 		objectExistsInDB, _ := core.ObjExists(profile.ID)
 		data := gin.H{
@@ -213,11 +308,15 @@ func BagItProfileSave(c *gin.Context) {
 			"objectExistsInDB": objectExistsInDB,
 			"errMsg":           "Please correct the following errors",
 			"errors":           profile.Errors,
+			"lintIssues":       LintBagItProfile(profile),
 			"helpUrl":          GetHelpUrl(c),
 		}
 		c.HTML(http.StatusBadRequest, "bagit_profile/form.html", data)
 		return
 	}
+	if summary := LintSummary(LintBagItProfile(profile)); summary != "" {
+		SetFlashCookie(c, fmt.Sprintf("Saved %s, but its lint report shows %s. Open the profile to see them.", profile.Name, summary))
+	}
 	c.Redirect(http.StatusFound, "/profiles")
 }
 
@@ -229,10 +328,12 @@ func BagItProfileNewTag(c *gin.Context) {
 		TagFile:   c.Param("tag_file"),
 		TagName:   "New-Tag",
 	}
+	rules := &TagValueRules{ProfileID: c.Param("profile_id"), TagFile: tag.TagFile}
 	templateData := gin.H{
 		"bagItProfileID": c.Param("profile_id"),
 		"tag":            tag,
 		"form":           tag.ToForm(),
+		"rulesForm":      tagValueRulesForm(rules, nil),
 		"helpUrl":        GetHelpUrl(c),
 	}
 	c.HTML(http.StatusOK, "tag_definition/form.html", templateData)
@@ -246,11 +347,17 @@ func BagItProfileEditTag(c *gin.Context) {
 		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
 		return
 	}
+	rules, err := FindTagValueRules(profile.ID, tag.TagFile, tag.TagName)
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+		return
+	}
 
 	templateData := gin.H{
 		"bagItProfileID": profile.ID,
 		"tag":            tag,
 		"form":           tag.ToForm(),
+		"rulesForm":      tagValueRulesForm(rules, nil),
 		"helpUrl":        GetHelpUrl(c),
 	}
 
@@ -265,8 +372,13 @@ func BagItProfileSaveTag(c *gin.Context) {
 		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
 		return
 	}
+	// Value rules are keyed by tag name, so we need the old
+	// name to move them if the user renames the tag.
+	oldTagName := ""
 	if tag == nil {
 		tag = &core.TagDefinition{}
+	} else {
+		oldTagName = tag.TagName
 	}
 	c.Bind(tag)
 
@@ -275,11 +387,14 @@ func BagItProfileSaveTag(c *gin.Context) {
 	// values.
 	tag.Values = util.SplitAndTrim(tag.Values[0], "\n")
 
-	if !tag.Validate() {
+	rules, ruleErrors := tagValueRulesFromRequest(c, profile.ID, tag)
+	tagIsValid := tag.Validate()
+	if !tagIsValid || len(ruleErrors) > 0 {
 		templateData := gin.H{
 			"bagItProfileID": profile.ID,
 			"tag":            tag,
 			"form":           tag.ToForm(),
+			"rulesForm":      tagValueRulesForm(rules, ruleErrors),
 			"helpUrl":        GetHelpUrl(c),
 		}
 		c.HTML(http.StatusBadRequest, "tag_definition/form.html", templateData)
@@ -301,10 +416,23 @@ func BagItProfileSaveTag(c *gin.Context) {
 		profile.Tags = append(profile.Tags, tag)
 	}
 
+	// Save the rules first, so the profile's new revision
+	// includes them.
+	if oldTagName == "" {
+		oldTagName = tag.TagName
+	}
+	err = changeTagValueRules(profile.ID, func() error {
+		return SaveTagValueRules(rules, oldTagName)
+	})
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+		return
+	}
+
 	// Validation error here should not be possible, since we just
 	// pulled a valid profile from the DB and only altered
 	// or added a single tag, which we know by now is valid.
-	err = core.ObjSave(profile)
+	err = SaveBagItProfile(profile, "")
 	if err != nil {
 		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
 		return
@@ -344,7 +472,14 @@ func BagItProfileDeleteTag(c *gin.Context) {
 		return
 	}
 	profile.Tags = util.RemoveFromSlice[*core.TagDefinition](profile.Tags, tagIndex)
-	err = core.ObjSave(profile)
+	err = changeTagValueRules(profile.ID, func() error {
+		return DeleteTagValueRules(profile.ID, tag.TagFile, tag.TagName)
+	})
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+		return
+	}
+	err = SaveBagItProfile(profile, "")
 	if err != nil {
 		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
 		return
@@ -414,7 +549,7 @@ func BagItProfileCreateTagFile(c *gin.Context) {
 		IsUserAddedTag:  true,
 	}
 	profile.Tags = append(profile.Tags, &newTag)
-	err = core.ObjSave(profile)
+	err = SaveBagItProfile(profile, "")
 	if err != nil {
 		AbortWithErrorHTML(c, http.StatusNotFound, err)
 		return
@@ -451,7 +586,14 @@ func BagItProfileDeleteTagFile(c *gin.Context) {
 		}
 	}
 	profile.Tags = newTagList
-	err := core.ObjSave(profile)
+	err := changeTagValueRules(profile.ID, func() error {
+		return DeleteTagValueRules(profile.ID, tagFileName, "")
+	})
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+		return
+	}
+	err = SaveBagItProfile(profile, "")
 	if err != nil {
 		AbortWithErrorHTML(c, http.StatusNotFound, err)
 		return
@@ -478,6 +620,67 @@ func loadProfileAndTag(c *gin.Context) (*core.BagItProfile, *core.TagDefinition,
 	return profile, tag, err
 }
 
+// tagValueRulesFromRequest reads the value rules from the tag form.
+// It returns the rules and a map of field names to error messages,
+// which is empty if the rules are valid.
+func tagValueRulesFromRequest(c *gin.Context, profileID string, tag *core.TagDefinition) (*TagValueRules, map[string]string) {
+	rules := &TagValueRules{
+		ProfileID:          profileID,
+		TagFile:            tag.TagFile,
+		TagName:            tag.TagName,
+		Pattern:            strings.TrimSpace(c.PostForm("Pattern")),
+		PatternDescription: strings.TrimSpace(c.PostForm("PatternDescription")),
+		DataType:           c.PostForm("DataType"),
+	}
+	parseErrors := make(map[string]string)
+	for name, length := range map[string]*int{"MinLength": &rules.MinLength, "MaxLength": &rules.MaxLength} {
+		value := strings.TrimSpace(c.PostForm(name))
+		if value == "" {
+			continue
+		}
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			parseErrors[name] = "Please enter a whole number, or leave this blank for no limit."
+			continue
+		}
+		*length = number
+	}
+	errors := rules.Validate()
+	for name, message := range parseErrors {
+		errors[name] = message
+	}
+	return rules, errors
+}
+
+// tagValueRulesForm returns the value rules section of the tag form.
+func tagValueRulesForm(rules *TagValueRules, errors map[string]string) *core.Form {
+	form := core.NewForm("TagValueRules", "", errors)
+	patternField := form.AddField("Pattern", "Pattern", rules.Pattern, false)
+	patternField.Help = "A regular expression that the whole value must match. For example, an ORCID is \\d{4}-\\d{4}-\\d{4}-\\d{3}[0-9X]."
+	descriptionField := form.AddField("PatternDescription", "Pattern Description", rules.PatternDescription, false)
+	descriptionField.Help = "Describes the pattern in plain words for error messages, such as 'an ORCID like 0000-0002-1825-0097'."
+	dataTypeField := form.AddField("DataType", "Data Type", rules.DataType, false)
+	for _, option := range TagDataTypes {
+		dataTypeField.Choices = append(dataTypeField.Choices, core.Choice{
+			Label:    option.Label,
+			Value:    option.Value,
+			Selected: option.Value == rules.DataType,
+		})
+	}
+	minLength, maxLength := "", ""
+	if rules.MinLength != 0 {
+		minLength = strconv.Itoa(rules.MinLength)
+	}
+	if rules.MaxLength != 0 {
+		maxLength = strconv.Itoa(rules.MaxLength)
+	}
+	minField := form.AddField("MinLength", "Minimum Length", minLength, false)
+	minField.Help = "The fewest characters a non-empty value can have. Leave blank for no limit."
+	maxField := form.AddField("MaxLength", "Maximum Length", maxLength, false)
+	maxField.Help = "The most characters the value can have. Leave blank for no limit."
+	return form
+}
+
 func getTagFileFormAndID(c *gin.Context) (*core.Form, string) {
 	profileID := c.Param("profile_id")
 	form := core.NewForm("", "", nil)
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"html"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"path/filepath"
 	"strconv"
@@ -14,6 +15,7 @@ import (
 	"github.com/APTrust/dart-runner/constants"
 	"github.com/APTrust/dart-runner/core"
 	"github.com/APTrust/dart-runner/util"
+	"github.com/APTrust/dart/v3/server/controllers"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -46,6 +48,48 @@ func TestBagItProfileCreate(t *testing.T) {
 
 }
 
+func TestBagItProfileCreateCopiesTagValueRules(t *testing.T) {
+	defer core.ClearDartTable()
+	saveTestProfiles(t)
+	rules := &controllers.TagValueRules{
+		ProfileID: constants.ProfileIDAPTrust,
+		TagFile:   "aptrust-info.txt",
+		TagName:   "Title",
+		MaxLength: 200,
+	}
+	require.NoError(t, controllers.SaveTagValueRules(rules, rules.TagName))
+	defer controllers.ReplaceTagValueRules(constants.ProfileIDAPTrust, nil)
+
+	data := url.Values{}
+	data.Set("BaseProfileID", constants.ProfileIDAPTrust)
+	req, err := NewPostRequest("/profiles/new", data)
+	require.Nil(t, err)
+	w := httptest.NewRecorder()
+	dartServer.ServeHTTP(w, req)
+	require.Equal(t, http.StatusFound, w.Code)
+	newProfileID := strings.TrimPrefix(w.Header().Get("Location"), "/profiles/edit/")
+	defer controllers.ReplaceTagValueRules(newProfileID, nil)
+
+	ruleSet, err := controllers.LoadTagValueRules(newProfileID)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(ruleSet))
+	copied := ruleSet["aptrust-info.txt/Title"]
+	require.NotNil(t, copied)
+	assert.Equal(t, newProfileID, copied.ProfileID)
+	assert.Equal(t, 200, copied.MaxLength)
+
+	// The clone's first revision has the rules too.
+	revisions, err := controllers.ProfileRevisions(newProfileID)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(revisions))
+	assert.Equal(t, 1, len(revisions[0].TagValueRules))
+
+	// The base profile keeps its rules.
+	ruleSet, err = controllers.LoadTagValueRules(constants.ProfileIDAPTrust)
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(ruleSet))
+}
+
 func TestBagItProfileDelete(t *testing.T) {
 	// PUT /profiles/delete/:id
 	// POST /profiles/delete/:id
@@ -62,6 +106,18 @@ func TestBagItProfileDelete(t *testing.T) {
 	emptyProfile := loadProfile(t, constants.ProfileIDEmpty)
 	copyOfProfile := core.BagItProfileClone(emptyProfile)
 	require.NoError(t, core.ObjSave(copyOfProfile))
+	rules := &controllers.TagValueRules{
+		ProfileID: copyOfProfile.ID,
+		TagFile:   "bag-info.txt",
+		TagName:   "Source-Organization",
+		MaxLength: 100,
+	}
+	require.NoError(t, controllers.SaveTagValueRules(rules, rules.TagName))
+	copyOfProfile.Description = "Changed before delete"
+	require.NoError(t, controllers.SaveBagItProfile(copyOfProfile, ""))
+	revisions, err := controllers.ProfileRevisions(copyOfProfile.ID)
+	require.NoError(t, err)
+	require.NotEmpty(t, revisions)
 
 	settings := PostTestSettings{
 		EndpointUrl:          fmt.Sprintf("/profiles/delete/%s", copyOfProfile.ID),
@@ -70,6 +126,14 @@ func TestBagItProfileDelete(t *testing.T) {
 		ExpectedContent:      expected,
 	}
 	DoSimplePostTest(t, settings)
+
+	// The profile's tag value rules and revisions go with it.
+	ruleSet, err := controllers.LoadTagValueRules(copyOfProfile.ID)
+	require.NoError(t, err)
+	assert.Empty(t, ruleSet)
+	revisions, err = controllers.ProfileRevisions(copyOfProfile.ID)
+	require.NoError(t, err)
+	assert.Empty(t, revisions)
 }
 
 func TestBagItProfileEdit(t *testing.T) {
@@ -164,6 +228,8 @@ func TestBagItProfileImportStart(t *testing.T) {
 		"JSON Data",
 		"BagItProfileImport_URL",
 		"BagItProfileImport_JsonData",
+		"Existing Bag",
+		"BagItProfileImport_BagPath",
 	}
 	DoSimpleGetTest(t, "/profiles/import", expected)
 }
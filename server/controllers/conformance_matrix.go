@@ -0,0 +1,263 @@
+package controllers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/APTrust/dart-runner/core"
+	"github.com/google/uuid"
+)
+
+// Bag statuses in a ConformanceChange.
+const (
+	ConformancePass    = "pass"
+	ConformanceFail    = "fail"
+	ConformanceMissing = "missing"
+)
+
+// ConformanceMatrix holds the results of validating every bag in a
+// folder of sample bags against one BagIt profile. We keep matrices,
+// so users can compare results before and after a profile change.
+type ConformanceMatrix struct {
+	ID          string `json:"id"`
+	ProfileID   string `json:"profileId"`
+	ProfileName string `json:"profileName"`
+	// ProfileRevision is the profile's latest revision when the
+	// matrix was built, or zero if it has no revisions.
+	ProfileRevision int                 `json:"profileRevision"`
+	BagDir          string              `json:"bagDir"`
+	CreatedAt       time.Time           `json:"createdAt"`
+	Results         []ConformanceResult `json:"results"`
+}
+
+// ConformanceResult is the outcome of validating one sample bag.
+// Failures maps each rule the bag broke to the validator's message.
+// Rule names are the keys of the validator's Errors map.
+type ConformanceResult struct {
+	BagName  string            `json:"bagName"`
+	BagPath  string            `json:"bagPath"`
+	Failures map[string]string `json:"failures"`
+}
+
+// ConformanceChange describes a bag whose result changed from one
+// matrix to another. Before and After are ConformancePass,
+// ConformanceFail or ConformanceMissing, if the bag wasn't in the
+// folder at the time.
+type ConformanceChange struct {
+	BagName     string   `json:"bagName"`
+	Before      string   `json:"before"`
+	After       string   `json:"after"`
+	NewFailures []string `json:"newFailures"`
+	Fixed       []string `json:"fixed"`
+}
+
+var conformanceMatrixStore = NewJSONStore[ConformanceMatrix]("conformance_matrices.json")
+
+// Passed returns true if the bag is valid according to the profile.
+func (result ConformanceResult) Passed() bool {
+	return len(result.Failures) == 0
+}
+
+// Status returns ConformancePass or ConformanceFail.
+func (result ConformanceResult) Status() string {
+	if result.Passed() {
+		return ConformancePass
+	}
+	return ConformanceFail
+}
+
+// Rules returns the failing rules, sorted.
+func (result ConformanceResult) Rules() []string {
+	rules := make([]string, 0, len(result.Failures))
+	for rule := range result.Failures {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+	return rules
+}
+
+// Rules returns every rule that at least one bag failed, sorted.
+// These are the columns of the grid.
+func (matrix *ConformanceMatrix) Rules() []string {
+	seen := make(map[string]bool)
+	rules := make([]string, 0)
+	for _, result := range matrix.Results {
+		for rule := range result.Failures {
+			if !seen[rule] {
+				seen[rule] = true
+				rules = append(rules, rule)
+			}
+		}
+	}
+	sort.Strings(rules)
+	return rules
+}
+
+// PassCount returns the number of bags that passed.
+func (matrix *ConformanceMatrix) PassCount() int {
+	count := 0
+	for _, result := range matrix.Results {
+		if result.Passed() {
+			count++
+		}
+	}
+	return count
+}
+
+// FindSampleBags returns the paths of the bags directly inside dir,
+// sorted by name. A bag is a tar, tar.gz or zip file, or a directory
+// that contains bagit.txt. Everything else is ignored.
+func FindSampleBags(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	bagPaths := make([]string, 0)
+	for _, entry := range entries {
+		bagPath := filepath.Join(dir, entry.Name())
+		if entry.IsDir() {
+			if _, err := os.Stat(filepath.Join(bagPath, "bagit.txt")); err == nil {
+				bagPaths = append(bagPaths, bagPath)
+			}
+		} else if entry.Type().IsRegular() && IsSerializedBag(entry.Name()) {
+			bagPaths = append(bagPaths, bagPath)
+		}
+	}
+	return bagPaths, nil
+}
+
+// RunConformanceMatrix validates every bag in bagDir against profile.
+// This runs all validations before returning, so it's meant for
+// folders of small sample bags, not for production batches.
+func RunConformanceMatrix(profile *core.BagItProfile, bagDir string) (*ConformanceMatrix, error) {
+	bagPaths, err := FindSampleBags(bagDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(bagPaths) == 0 {
+		return nil, fmt.Errorf("%s does not contain any bags", bagDir)
+	}
+	matrix := &ConformanceMatrix{
+		ID:          uuid.NewString(),
+		ProfileID:   profile.ID,
+		ProfileName: profile.Name,
+		BagDir:      bagDir,
+		CreatedAt:   time.Now(),
+		Results:     make([]ConformanceResult, 0, len(bagPaths)),
+	}
+	if revisions, err := ProfileRevisions(profile.ID); err == nil && len(revisions) > 0 {
+		matrix.ProfileRevision = revisions[0].Number
+	}
+	for _, bagPath := range bagPaths {
+		matrix.Results = append(matrix.Results, ConformanceResult{
+			BagName:  filepath.Base(bagPath),
+			BagPath:  bagPath,
+			Failures: validateSampleBag(bagPath, profile),
+		})
+	}
+	return matrix, nil
+}
+
+// validateSampleBag returns the validator's errors for the bag at
+// bagPath, plus any tag values that break the profile's
+// TagValueRules. If the validator can't read the bag at all, the
+// error is reported under the rule "Bag".
+func validateSampleBag(bagPath string, profile *core.BagItProfile) map[string]string {
+	failures := make(map[string]string)
+	validator, err := core.NewValidator(bagPath, profile)
+	if err == nil {
+		err = validator.ScanBag()
+	}
+	if err != nil {
+		failures["Bag"] = err.Error()
+		return failures
+	}
+	// Validate returns an error summarizing validator.Errors.
+	validator.Validate()
+	for rule, message := range validator.Errors {
+		failures[rule] = message
+	}
+	tagErrors, err := ValidateBagTagValues(bagPath, profile)
+	if err != nil {
+		core.Dart.Log.Warningf("Could not check tag values in %s: %v", bagPath, err)
+	}
+	for rule, message := range tagErrors {
+		if _, ok := failures[rule]; !ok {
+			failures[rule] = message
+		}
+	}
+	return failures
+}
+
+// CompareConformanceMatrices lists the bags whose results differ
+// between the before and after matrices, sorted by bag name. Bags
+// are matched by name, so the two matrices can come from different
+// copies of the same sample folder.
+func CompareConformanceMatrices(before, after *ConformanceMatrix) []ConformanceChange {
+	beforeResults := make(map[string]ConformanceResult)
+	for _, result := range before.Results {
+		beforeResults[result.BagName] = result
+	}
+	changes := make([]ConformanceChange, 0)
+	seen := make(map[string]bool)
+	for _, afterResult := range after.Results {
+		seen[afterResult.BagName] = true
+		beforeResult, ok := beforeResults[afterResult.BagName]
+		if !ok {
+			changes = append(changes, ConformanceChange{
+				BagName:     afterResult.BagName,
+				Before:      ConformanceMissing,
+				After:       afterResult.Status(),
+				NewFailures: afterResult.Rules(),
+				Fixed:       make([]string, 0),
+			})
+			continue
+		}
+		newFailures := listDifference(afterResult.Rules(), beforeResult.Rules())
+		fixed := listDifference(beforeResult.Rules(), afterResult.Rules())
+		if len(newFailures) > 0 || len(fixed) > 0 {
+			changes = append(changes, ConformanceChange{
+				BagName:     afterResult.BagName,
+				Before:      beforeResult.Status(),
+				After:       afterResult.Status(),
+				NewFailures: newFailures,
+				Fixed:       fixed,
+			})
+		}
+	}
+	for _, beforeResult := range before.Results {
+		if !seen[beforeResult.BagName] {
+			changes = append(changes, ConformanceChange{
+				BagName:     beforeResult.BagName,
+				Before:      beforeResult.Status(),
+				After:       ConformanceMissing,
+				NewFailures: make([]string, 0),
+				Fixed:       beforeResult.Rules(),
+			})
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].BagName < changes[j].BagName })
+	return changes
+}
+
+func findConformanceMatrix(id string) (*ConformanceMatrix, error) {
+	matrices, err := conformanceMatrixStore.Load()
+	if err != nil {
+		return nil, err
+	}
+	for i := range matrices {
+		if matrices[i].ID == id {
+			return &matrices[i], nil
+		}
+	}
+	return nil, fmt.Errorf("No conformance matrix with id %s", id)
+}
+
+func saveConformanceMatrix(matrix *ConformanceMatrix) error {
+	return conformanceMatrixStore.Update(func(matrices []ConformanceMatrix) ([]ConformanceMatrix, error) {
+		return append(matrices, *matrix), nil
+	})
+}
@@ -0,0 +1,136 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/gin-gonic/gin"
+)
+
+// GET /profiles/conformance?ProfileID=<id>&BagDir=<path>
+//
+// The optional query params prefill the form, so users can rerun
+// a test after changing the profile.
+func ConformanceMatrixIndex(c *gin.Context) {
+	matrices, err := loadConformanceMatrices()
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+		return
+	}
+	data := gin.H{
+		"form":     conformanceMatrixForm(c.Query("ProfileID"), c.Query("BagDir")),
+		"matrices": matrices,
+		"flash":    GetFlashCookie(c),
+		"helpUrl":  GetHelpUrl(c),
+	}
+	c.HTML(http.StatusOK, "bagit_profile/conformance.html", data)
+}
+
+// POST /profiles/conformance
+//
+// Validates the sample bags and redirects to the results.
+func ConformanceMatrixCreate(c *gin.Context) {
+	profileID := c.PostForm("ProfileID")
+	bagDir := strings.TrimSpace(c.PostForm("BagDir"))
+	form := conformanceMatrixForm(profileID, bagDir)
+	profile := core.ObjFind(profileID).BagItProfile()
+	if profile == nil {
+		form.Fields["ProfileID"].Error = "Please choose a BagIt profile."
+	}
+	if stat, err := os.Stat(bagDir); bagDir == "" || err != nil || !stat.IsDir() {
+		form.Fields["BagDir"].Error = "Please enter the path to a folder of sample bags."
+	}
+	var matrix *ConformanceMatrix
+	var err error
+	if profile != nil && form.Fields["BagDir"].Error == "" {
+		if matrix, err = RunConformanceMatrix(profile, bagDir); err != nil {
+			form.Fields["BagDir"].Error = err.Error()
+		}
+	}
+	if form.Fields["ProfileID"].Error != "" || form.Fields["BagDir"].Error != "" {
+		matrices, _ := loadConformanceMatrices()
+		data := gin.H{
+			"form":     form,
+			"matrices": matrices,
+			"helpUrl":  GetHelpUrl(c),
+		}
+		c.HTML(http.StatusBadRequest, "bagit_profile/conformance.html", data)
+		return
+	}
+	if err = saveConformanceMatrix(matrix); err != nil {
+		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+		return
+	}
+	core.Dart.Log.Infof("Validated %d sample bags in %s against %s: %d passed", len(matrix.Results), bagDir, profile.Name, matrix.PassCount())
+	c.Redirect(http.StatusFound, fmt.Sprintf("/profiles/conformance/%s", matrix.ID))
+}
+
+// GET /profiles/conformance/:id?compare=<id>
+//
+// If compare is the ID of another matrix, this also lists the bags
+// whose results changed between that matrix and this one.
+func ConformanceMatrixShow(c *gin.Context) {
+	matrix, err := findConformanceMatrix(c.Param("id"))
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusNotFound, err)
+		return
+	}
+	matrices, err := loadConformanceMatrices()
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+		return
+	}
+	// Users can compare with any other run against the same profile.
+	others := make([]ConformanceMatrix, 0)
+	for _, other := range matrices {
+		if other.ProfileID == matrix.ProfileID && other.ID != matrix.ID {
+			others = append(others, other)
+		}
+	}
+	data := gin.H{
+		"matrix":  matrix,
+		"rules":   matrix.Rules(),
+		"others":  others,
+		"helpUrl": GetHelpUrl(c),
+	}
+	if compareID := c.Query("compare"); compareID != "" {
+		before, err := findConformanceMatrix(compareID)
+		if err != nil {
+			AbortWithErrorHTML(c, http.StatusNotFound, err)
+			return
+		}
+		data["before"] = before
+		data["changes"] = CompareConformanceMatrices(before, matrix)
+	}
+	c.HTML(http.StatusOK, "bagit_profile/conformance_matrix.html", data)
+}
+
+// loadConformanceMatrices returns all saved matrices, newest first.
+func loadConformanceMatrices() ([]ConformanceMatrix, error) {
+	matrices, err := conformanceMatrixStore.Load()
+	sort.Slice(matrices, func(i, j int) bool { return matrices[i].CreatedAt.After(matrices[j].CreatedAt) })
+	return matrices, err
+}
+
+func conformanceMatrixForm(profileID, bagDir string) *core.Form {
+	form := core.NewForm("ConformanceMatrix", "", make(map[string]string))
+	profileField := form.AddField("ProfileID", "BagIt Profile", profileID, true)
+	profileField.Choices = []core.Choice{
+		{Label: "Choose One", Value: "", Selected: false},
+	}
+	for _, item := range core.ObjNameIdList(constants.TypeBagItProfile) {
+		profileField.Choices = append(profileField.Choices, core.Choice{
+			Label:    item.Name,
+			Value:    item.ID,
+			Selected: item.ID == profileID,
+		})
+	}
+	bagDirField := form.AddField("BagDir", "Folder of Sample Bags", bagDir, true)
+	bagDirField.Help = "DART validates every bag directly inside this folder. Bags can be directories or tar, tar.gz or zip files. Other files are ignored."
+	return form
+}
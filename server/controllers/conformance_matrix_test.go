@@ -0,0 +1,113 @@
+package controllers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart-runner/util"
+	"github.com/APTrust/dart/v3/server/controllers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindSampleBags(t *testing.T) {
+	bagDir := filepath.Join(util.PathToTestData(), "bags")
+	bagPaths, err := controllers.FindSampleBags(bagDir)
+	require.NoError(t, err)
+	assert.Contains(t, bagPaths, filepath.Join(bagDir, "example.edu.sample_good.tar"))
+	assert.Contains(t, bagPaths, filepath.Join(bagDir, "example.edu.sample_good.zip"))
+	assert.NotContains(t, bagPaths, filepath.Join(bagDir, "README.md"))
+
+	_, err = controllers.FindSampleBags(filepath.Join(bagDir, "no-such-dir"))
+	assert.Error(t, err)
+}
+
+func TestCompareConformanceMatrices(t *testing.T) {
+	before := &controllers.ConformanceMatrix{
+		Results: []controllers.ConformanceResult{
+			{BagName: "a.tar", Failures: map[string]string{}},
+			{BagName: "b.tar", Failures: map[string]string{"manifest-sha256.txt": "Missing"}},
+			{BagName: "c.tar", Failures: map[string]string{}},
+			{BagName: "d.tar", Failures: map[string]string{}},
+		},
+	}
+	after := &controllers.ConformanceMatrix{
+		Results: []controllers.ConformanceResult{
+			{BagName: "a.tar", Failures: map[string]string{}},
+			{BagName: "b.tar", Failures: map[string]string{}},
+			{BagName: "c.tar", Failures: map[string]string{"bag-info.txt/Title": "Missing"}},
+			{BagName: "e.tar", Failures: map[string]string{}},
+		},
+	}
+	assert.Equal(t, []string{"bag-info.txt/Title"}, after.Rules())
+	assert.Equal(t, 3, after.PassCount())
+
+	changes := controllers.CompareConformanceMatrices(before, after)
+	require.Equal(t, 4, len(changes))
+	assert.Equal(t, controllers.ConformanceChange{BagName: "b.tar", Before: "fail", After: "pass", NewFailures: []string{}, Fixed: []string{"manifest-sha256.txt"}}, changes[0])
+	assert.Equal(t, controllers.ConformanceChange{BagName: "c.tar", Before: "pass", After: "fail", NewFailures: []string{"bag-info.txt/Title"}, Fixed: []string{}}, changes[1])
+	assert.Equal(t, "d.tar", changes[2].BagName)
+	assert.Equal(t, controllers.ConformanceMissing, changes[2].After)
+	assert.Equal(t, "e.tar", changes[3].BagName)
+	assert.Equal(t, controllers.ConformanceMissing, changes[3].Before)
+
+	assert.Empty(t, controllers.CompareConformanceMatrices(after, after))
+}
+
+func TestConformanceMatrixCreateAndShow(t *testing.T) {
+	defer core.ClearDartTable()
+	profile, _ := getDiffTestProfiles()
+	profile.ManifestsRequired = []string{"md5"}
+	require.NoError(t, core.ObjSaveWithoutValidation(profile))
+
+	bagDir := t.TempDir()
+	for _, name := range []string{"example.edu.sample_good.tar", "example.edu.sample_no_bag_info.tar"} {
+		data, err := os.ReadFile(filepath.Join(util.PathToTestData(), "bags", name))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(bagDir, name), data, 0644))
+	}
+	DoSimpleGetTest(t, "/profiles/conformance", []string{"Profile Conformance Tests", "Profile A", "Folder of Sample Bags"})
+
+	params := url.Values{}
+	params.Set("ProfileID", profile.ID)
+	params.Set("BagDir", filepath.Join(bagDir, "no-such-dir"))
+	DoSimplePostTest(t, PostTestSettings{
+		EndpointUrl:          "/profiles/conformance",
+		Params:               params,
+		ExpectedResponseCode: http.StatusBadRequest,
+		ExpectedContent:      []string{"Please enter the path to a folder of sample bags."},
+	})
+
+	params.Set("BagDir", bagDir)
+	firstUrl := postConformanceMatrix(t, params)
+	html := GetUrl(t, firstUrl)
+	assert.Contains(t, html, "1 of 2 bags")
+	assert.Contains(t, html, "example.edu.sample_no_bag_info.tar")
+
+	// Requiring sha256 manifests breaks the good bag.
+	profile.ManifestsRequired = []string{"md5", "sha256"}
+	require.NoError(t, controllers.SaveBagItProfile(profile, ""))
+	secondUrl := postConformanceMatrix(t, params)
+	firstID := strings.TrimPrefix(firstUrl, "/profiles/conformance/")
+	DoSimpleGetTest(t, secondUrl+"?compare="+firstID, []string{
+		"0 of 2 bags",
+		"conformanceChanges",
+		"example.edu.sample_good.tar",
+		"Compare With an Earlier Run",
+	})
+}
+
+func postConformanceMatrix(t *testing.T, params url.Values) string {
+	w := httptest.NewRecorder()
+	req, err := NewPostRequest("/profiles/conformance", params)
+	require.NoError(t, err)
+	dartServer.ServeHTTP(w, req)
+	require.Equal(t, http.StatusFound, w.Code, w.Body.String())
+	return w.Header().Get("Location")
+}
@@ -0,0 +1,540 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+)
+
+// DiagnosticTimeout is the maximum time we allow for each network
+// step of a connection diagnosis.
+const DiagnosticTimeout = 15 * time.Second
+
+// DiagnosticTestObjectPrefix is the prefix of the object we write,
+// read back and delete to check that a storage service is writable.
+const DiagnosticTestObjectPrefix = ".dart-connection-test-"
+
+// Names of connection diagnostic steps.
+const (
+	StepCredentials = "Credentials"
+	StepDNS         = "DNS Lookup"
+	StepTCP         = "TCP Connection"
+	StepTLS         = "TLS Handshake"
+	StepAuth        = "Authentication"
+	StepBucket      = "Bucket"
+	StepRoundTrip   = "Write, Read and Delete"
+)
+
+// DiagnosticStep describes the result of one step of a connection
+// diagnosis. Details holds informational messages, such as the IP
+// addresses a host resolved to or the server's certificate chain.
+// Error holds the exact error returned by the failed operation.
+type DiagnosticStep struct {
+	Name      string
+	Succeeded bool
+	Skipped   bool
+	Duration  time.Duration
+	Details   []string
+	Error     string
+}
+
+// ConnectionDiagnosis is a step-by-step account of connecting to a
+// storage service. Steps run in order, and once one fails, the
+// remaining steps are skipped.
+type ConnectionDiagnosis struct {
+	StorageService *core.StorageService
+	Steps          []*DiagnosticStep
+}
+
+// Succeeded returns true if no diagnostic step failed.
+func (d *ConnectionDiagnosis) Succeeded() bool {
+	return d.FailedStep() == nil
+}
+
+// FailedStep returns the step that failed, or nil if none did.
+func (d *ConnectionDiagnosis) FailedStep() *DiagnosticStep {
+	for _, step := range d.Steps {
+		if !step.Succeeded && !step.Skipped {
+			return step
+		}
+	}
+	return nil
+}
+
+// Summary returns a one-line description of the diagnosis.
+func (d *ConnectionDiagnosis) Summary() string {
+	failedStep := d.FailedStep()
+	if failedStep == nil {
+		return "Connection succeeded!"
+	}
+	return fmt.Sprintf("Connection failed at step %s: %s", failedStep.Name, failedStep.Error)
+}
+
+// run runs fn as the named step and records its duration and result.
+// If an earlier step failed, it records the step as skipped instead.
+func (d *ConnectionDiagnosis) run(name string, fn func(step *DiagnosticStep) error) {
+	if !d.Succeeded() {
+		d.skip(name, "Skipped because a previous step failed.")
+		return
+	}
+	step := &DiagnosticStep{Name: name}
+	d.Steps = append(d.Steps, step)
+	start := time.Now()
+	err := fn(step)
+	step.Duration = time.Since(start)
+	if err != nil {
+		step.Error = err.Error()
+		return
+	}
+	step.Succeeded = true
+}
+
+// skip records the named step as skipped for the specified reason.
+func (d *ConnectionDiagnosis) skip(name, reason string) {
+	d.Steps = append(d.Steps, &DiagnosticStep{
+		Name:    name,
+		Skipped: true,
+		Details: []string{reason},
+	})
+}
+
+// DiagnoseConnection probes the connection to ss one step at a time:
+// DNS, TCP, TLS, authentication, bucket existence, and finally a
+// round trip that writes, reads and deletes a small test object.
+// The round trip is skipped for services that don't allow uploads.
+// Filesystem services have only the last two steps, and WebDAV
+// services check credentials with a PROPFIND request.
+//
+// If the login or password is a credential reference, a first step
+// checks that the reference can be resolved.
+//
+// Other protocols get a single step that runs ss.TestConnection.
+func DiagnoseConnection(ss *core.StorageService) *ConnectionDiagnosis {
+	diagnosis := &ConnectionDiagnosis{StorageService: ss}
+	if UsesCredentialReferences(ss) {
+		diagnosis.run(StepCredentials, func(step *DiagnosticStep) error {
+			return diagnoseCredentials(step, ss)
+		})
+	}
+	switch ss.Protocol {
+	case constants.ProtocolS3:
+		diagnoseS3(diagnosis, ss)
+	case constants.ProtocolSFTP:
+		diagnoseSFTP(diagnosis, ss)
+	case ProtocolFilesystem:
+		diagnoseFilesystem(diagnosis, ss)
+	case ProtocolWebDAV:
+		diagnoseWebDAV(diagnosis, ss)
+	default:
+		diagnosis.run("Connection Test", func(step *DiagnosticStep) error {
+			return ss.TestConnection()
+		})
+	}
+	return diagnosis
+}
+
+// diagnoseCredentials checks that the credential references in
+// the login and password of ss can be resolved.
+func diagnoseCredentials(step *DiagnosticStep, ss *core.StorageService) error {
+	for _, field := range []struct{ name, value string }{
+		{"Login", ss.Login},
+		{"Password", ss.Password},
+	} {
+		if _, err := ResolveCredential(field.value); err != nil {
+			return fmt.Errorf("%s: %v", field.name, err)
+		}
+		if field.value != "" {
+			step.Details = append(step.Details, describeCredentialSource(field.name, field.value))
+		}
+	}
+	return nil
+}
+
+func diagnoseS3(diagnosis *ConnectionDiagnosis, ss *core.StorageService) {
+	opts := GetStorageServiceOptions(ss)
+	port := ss.Port
+	if port == 0 {
+		port = 80
+		if opts.UseTLS {
+			port = 443
+		}
+	}
+	diagnoseNetwork(diagnosis, ss.Host, port)
+	if opts.UseTLS {
+		diagnosis.run(StepTLS, func(step *DiagnosticStep) error {
+			return diagnoseTLS(step, ss.Host, port, opts)
+		})
+	} else {
+		diagnosis.skip(StepTLS, "TLS is turned off for this service.")
+	}
+
+	var client *minio.Client
+	diagnosis.run(StepAuth, func(step *DiagnosticStep) error {
+		var err error
+		client, err = NewMinioClient(ss)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), DiagnosticTimeout)
+		defer cancel()
+		buckets, err := client.ListBuckets(ctx)
+		if err != nil {
+			// Keys scoped to a single bucket often may not list
+			// buckets. AccessDenied means the server recognized
+			// the credentials, which is all we're checking here.
+			if minio.ToErrorResponse(err).Code == "AccessDenied" {
+				step.Details = append(step.Details, "Credentials accepted, but they do not permit listing buckets.")
+				return nil
+			}
+			return err
+		}
+		step.Details = append(step.Details, fmt.Sprintf("Credentials accepted. Account can see %d buckets.", len(buckets)))
+		return nil
+	})
+
+	diagnosis.run(StepBucket, func(step *DiagnosticStep) error {
+		ctx, cancel := context.WithTimeout(context.Background(), DiagnosticTimeout)
+		defer cancel()
+		exists, err := client.BucketExists(ctx, ss.Bucket)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("Bucket %s does not exist", ss.Bucket)
+		}
+		step.Details = append(step.Details, fmt.Sprintf("Bucket %s exists.", ss.Bucket))
+		return nil
+	})
+
+	if !ss.AllowsUpload {
+		diagnosis.skip(StepRoundTrip, "This service does not allow uploads.")
+		return
+	}
+	diagnosis.run(StepRoundTrip, func(step *DiagnosticStep) error {
+		key := DiagnosticTestObjectPrefix + uuid.NewString()
+		content := diagnosticTestContent()
+		ctx, cancel := context.WithTimeout(context.Background(), 3*DiagnosticTimeout)
+		defer cancel()
+		_, err := client.PutObject(ctx, ss.Bucket, key, bytes.NewReader(content), int64(len(content)), minio.PutObjectOptions{ContentType: "text/plain"})
+		if err != nil {
+			return fmt.Errorf("Write failed: %v", err)
+		}
+		step.Details = append(step.Details, fmt.Sprintf("Wrote %s (%d bytes).", key, len(content)))
+		err = readAndCompare(step, content, func() (io.ReadCloser, error) {
+			return client.GetObject(ctx, ss.Bucket, key, minio.GetObjectOptions{})
+		})
+		removeErr := client.RemoveObject(ctx, ss.Bucket, key, minio.RemoveObjectOptions{})
+		if err != nil {
+			return err
+		}
+		if removeErr != nil {
+			return fmt.Errorf("Delete failed: %v", removeErr)
+		}
+		step.Details = append(step.Details, fmt.Sprintf("Deleted %s.", key))
+		return nil
+	})
+}
+
+func diagnoseSFTP(diagnosis *ConnectionDiagnosis, ss *core.StorageService) {
+	port := ss.Port
+	if port == 0 {
+		port = 22
+	}
+	diagnoseNetwork(diagnosis, ss.Host, port)
+	diagnosis.skip(StepTLS, "SFTP connections are encrypted by SSH, not TLS.")
+
+	var conn *SFTPConnection
+	diagnosis.run(StepAuth, func(step *DiagnosticStep) error {
+		var err error
+		conn, err = NewSFTPConnection(ss)
+		if err != nil {
+			return err
+		}
+		step.Details = append(step.Details, fmt.Sprintf("Logged in as %s.", ss.Login))
+		return nil
+	})
+	if conn != nil {
+		defer conn.Close()
+	}
+
+	remoteDir := ss.Bucket
+	if remoteDir == "" {
+		remoteDir = "."
+	}
+	diagnosis.run(StepBucket, func(step *DiagnosticStep) error {
+		stat, err := conn.Stat(remoteDir)
+		if err != nil {
+			return err
+		}
+		if !stat.IsDir() {
+			return fmt.Errorf("%s is not a directory", remoteDir)
+		}
+		step.Details = append(step.Details, fmt.Sprintf("Directory %s exists.", remoteDir))
+		return nil
+	})
+
+	if !ss.AllowsUpload {
+		diagnosis.skip(StepRoundTrip, "This service does not allow uploads.")
+		return
+	}
+	diagnosis.run(StepRoundTrip, func(step *DiagnosticStep) error {
+		remotePath := path.Join(remoteDir, DiagnosticTestObjectPrefix+uuid.NewString())
+		content := diagnosticTestContent()
+		file, err := conn.OpenFile(remotePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+		if err != nil {
+			return fmt.Errorf("Write failed: %v", err)
+		}
+		_, err = file.Write(content)
+		closeErr := file.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			conn.Remove(remotePath)
+			return fmt.Errorf("Write failed: %v", err)
+		}
+		step.Details = append(step.Details, fmt.Sprintf("Wrote %s (%d bytes).", remotePath, len(content)))
+		err = readAndCompare(step, content, func() (io.ReadCloser, error) {
+			return conn.Open(remotePath)
+		})
+		removeErr := conn.Remove(remotePath)
+		if err != nil {
+			return err
+		}
+		if removeErr != nil {
+			return fmt.Errorf("Delete failed: %v", removeErr)
+		}
+		step.Details = append(step.Details, fmt.Sprintf("Deleted %s.", remotePath))
+		return nil
+	})
+}
+
+func diagnoseWebDAV(diagnosis *ConnectionDiagnosis, ss *core.StorageService) {
+	opts := GetStorageServiceOptions(ss)
+	port := ss.Port
+	if port == 0 {
+		port = 80
+		if opts.UseTLS {
+			port = 443
+		}
+	}
+	diagnoseNetwork(diagnosis, ss.Host, port)
+	if opts.UseTLS {
+		diagnosis.run(StepTLS, func(step *DiagnosticStep) error {
+			return diagnoseTLS(step, ss.Host, port, opts)
+		})
+	} else {
+		diagnosis.skip(StepTLS, "TLS is turned off for this service.")
+	}
+
+	var client *WebDAVClient
+	bucketPath := path.Join("/", ss.Bucket)
+	diagnosis.run(StepAuth, func(step *DiagnosticStep) error {
+		var err error
+		client, err = NewWebDAVClient(ss)
+		if err != nil {
+			return err
+		}
+		// We check credentials with a PROPFIND because many servers
+		// answer OPTIONS without authentication. A 404 here still
+		// means the server accepted our credentials.
+		resp, err := client.Do("PROPFIND", bucketPath, strings.NewReader(propfindBody), map[string]string{"Depth": "0"})
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			return fmt.Errorf("Server rejected credentials for %s: %s", ss.Login, resp.Status)
+		}
+		step.Details = append(step.Details, fmt.Sprintf("Server accepted the request with status %s.", resp.Status))
+		return nil
+	})
+
+	diagnosis.run(StepBucket, func(step *DiagnosticStep) error {
+		entry, err := client.Stat(bucketPath)
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir {
+			return fmt.Errorf("%s is not a collection", bucketPath)
+		}
+		step.Details = append(step.Details, fmt.Sprintf("Collection %s exists.", bucketPath))
+		return nil
+	})
+
+	if !ss.AllowsUpload {
+		diagnosis.skip(StepRoundTrip, "This service does not allow uploads.")
+		return
+	}
+	diagnosis.run(StepRoundTrip, func(step *DiagnosticStep) error {
+		remotePath := path.Join(bucketPath, DiagnosticTestObjectPrefix+uuid.NewString())
+		content := diagnosticTestContent()
+		if err := client.Put(remotePath, bytes.NewReader(content), int64(len(content))); err != nil {
+			return fmt.Errorf("Write failed: %v", err)
+		}
+		step.Details = append(step.Details, fmt.Sprintf("Wrote %s (%d bytes).", remotePath, len(content)))
+		err := readAndCompare(step, content, func() (io.ReadCloser, error) {
+			return client.Open(remotePath, 0)
+		})
+		removeErr := client.Delete(remotePath)
+		if err != nil {
+			return err
+		}
+		if removeErr != nil {
+			return fmt.Errorf("Delete failed: %v", removeErr)
+		}
+		step.Details = append(step.Details, fmt.Sprintf("Deleted %s.", remotePath))
+		return nil
+	})
+}
+
+func diagnoseFilesystem(diagnosis *ConnectionDiagnosis, ss *core.StorageService) {
+	diagnosis.run(StepBucket, func(step *DiagnosticStep) error {
+		if !filepath.IsAbs(ss.Bucket) {
+			return fmt.Errorf("Target directory %q is not an absolute path", ss.Bucket)
+		}
+		stat, err := os.Stat(ss.Bucket)
+		if err != nil {
+			return err
+		}
+		if !stat.IsDir() {
+			return fmt.Errorf("%s is not a directory", ss.Bucket)
+		}
+		step.Details = append(step.Details, fmt.Sprintf("Directory %s exists.", ss.Bucket))
+		return nil
+	})
+	if !ss.AllowsUpload {
+		diagnosis.skip(StepRoundTrip, "This service does not allow uploads.")
+		return
+	}
+	diagnosis.run(StepRoundTrip, func(step *DiagnosticStep) error {
+		filePath := filepath.Join(ss.Bucket, DiagnosticTestObjectPrefix+uuid.NewString())
+		content := diagnosticTestContent()
+		if err := os.WriteFile(filePath, content, 0644); err != nil {
+			return fmt.Errorf("Write failed: %v", err)
+		}
+		step.Details = append(step.Details, fmt.Sprintf("Wrote %s (%d bytes).", filePath, len(content)))
+		err := readAndCompare(step, content, func() (io.ReadCloser, error) {
+			return os.Open(filePath)
+		})
+		removeErr := os.Remove(filePath)
+		if err != nil {
+			return err
+		}
+		if removeErr != nil {
+			return fmt.Errorf("Delete failed: %v", removeErr)
+		}
+		step.Details = append(step.Details, fmt.Sprintf("Deleted %s.", filePath))
+		return nil
+	})
+}
+
+// diagnoseNetwork adds the DNS and TCP steps for host and port.
+func diagnoseNetwork(diagnosis *ConnectionDiagnosis, host string, port int) {
+	diagnosis.run(StepDNS, func(step *DiagnosticStep) error {
+		if host == "" {
+			return fmt.Errorf("Storage service has no host")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), DiagnosticTimeout)
+		defer cancel()
+		addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil {
+			return err
+		}
+		step.Details = append(step.Details, fmt.Sprintf("%s resolves to %s", host, strings.Join(addrs, ", ")))
+		return nil
+	})
+	diagnosis.run(StepTCP, func(step *DiagnosticStep) error {
+		address := net.JoinHostPort(host, strconv.Itoa(port))
+		conn, err := net.DialTimeout("tcp", address, DiagnosticTimeout)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		step.Details = append(step.Details, fmt.Sprintf("Connected to %s from %s", conn.RemoteAddr(), conn.LocalAddr()))
+		return nil
+	})
+}
+
+// diagnoseTLS performs a TLS handshake with host and records the
+// negotiated protocol and the server's certificates. If verification
+// fails, we handshake again without verifying, so we can still show
+// the user the certificate that caused the failure.
+func diagnoseTLS(step *DiagnosticStep, host string, port int, opts *StorageServiceOptions) error {
+	tlsConfig, err := opts.TLSConfig()
+	if err != nil {
+		return err
+	}
+	tlsConfig.ServerName = host
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	dialer := &net.Dialer{Timeout: DiagnosticTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	if err != nil {
+		tlsConfig.InsecureSkipVerify = true
+		if insecureConn, insecureErr := tls.DialWithDialer(dialer, "tcp", address, tlsConfig); insecureErr == nil {
+			describeCertificates(step, insecureConn.ConnectionState().PeerCertificates)
+			insecureConn.Close()
+		}
+		return err
+	}
+	defer conn.Close()
+	state := conn.ConnectionState()
+	step.Details = append(step.Details, fmt.Sprintf("Negotiated %s with %s", tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite)))
+	describeCertificates(step, state.PeerCertificates)
+	return nil
+}
+
+func describeCertificates(step *DiagnosticStep, certs []*x509.Certificate) {
+	for i, cert := range certs {
+		desc := fmt.Sprintf("Certificate %d: subject %s, issued by %s, valid %s to %s",
+			i+1,
+			cert.Subject.String(),
+			cert.Issuer.String(),
+			cert.NotBefore.Format(time.RFC3339),
+			cert.NotAfter.Format(time.RFC3339))
+		if len(cert.DNSNames) > 0 {
+			desc += fmt.Sprintf(", names %s", strings.Join(cert.DNSNames, ", "))
+		}
+		step.Details = append(step.Details, desc)
+	}
+}
+
+// readAndCompare reads the test object opened by open and makes
+// sure its content matches what we wrote.
+func readAndCompare(step *DiagnosticStep, expected []byte, open func() (io.ReadCloser, error)) error {
+	reader, err := open()
+	if err != nil {
+		return fmt.Errorf("Read failed: %v", err)
+	}
+	defer reader.Close()
+	actual, err := io.ReadAll(reader)
+	if err != nil {
+		return fmt.Errorf("Read failed: %v", err)
+	}
+	if !bytes.Equal(expected, actual) {
+		return errors.New("Read failed: content read back does not match content written")
+	}
+	step.Details = append(step.Details, fmt.Sprintf("Read back %d bytes. Content matches.", len(actual)))
+	return nil
+}
+
+func diagnosticTestContent() []byte {
+	return []byte(fmt.Sprintf("DART connection test written at %s\n", time.Now().UTC().Format(time.RFC3339)))
+}
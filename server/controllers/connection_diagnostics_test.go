@@ -0,0 +1,86 @@
+package controllers_test
+
+import (
+	"testing"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart/v3/server/controllers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiagnoseConnectionBadHost(t *testing.T) {
+	ss := core.NewStorageService()
+	ss.Protocol = constants.ProtocolS3
+	ss.Host = "no-such-host.invalid"
+	ss.Bucket = "test"
+	ss.AllowsUpload = true
+
+	diagnosis := controllers.DiagnoseConnection(ss)
+	assert.False(t, diagnosis.Succeeded())
+	require.Equal(t, 6, len(diagnosis.Steps))
+
+	failedStep := diagnosis.FailedStep()
+	require.NotNil(t, failedStep)
+	assert.Equal(t, controllers.StepDNS, failedStep.Name)
+	assert.NotEmpty(t, failedStep.Error)
+	assert.Contains(t, diagnosis.Summary(), "Connection failed at step DNS Lookup")
+
+	// Every step after the failure should be skipped.
+	for _, step := range diagnosis.Steps[1:] {
+		assert.True(t, step.Skipped, step.Name)
+		assert.False(t, step.Succeeded, step.Name)
+	}
+}
+
+// This test assumes the local minio service is running.
+// ./scripts/run.sh tests starts it for you.
+func TestDiagnoseConnectionS3(t *testing.T) {
+	ss, err := core.LoadStorageServiceFixture("storage_service_local_minio.json")
+	require.NoError(t, err)
+
+	diagnosis := controllers.DiagnoseConnection(ss)
+	assert.True(t, diagnosis.Succeeded(), diagnosis.Summary())
+	assert.Equal(t, "Connection succeeded!", diagnosis.Summary())
+
+	stepNames := make([]string, len(diagnosis.Steps))
+	for i, step := range diagnosis.Steps {
+		stepNames[i] = step.Name
+	}
+	assert.Equal(t, []string{
+		controllers.StepDNS,
+		controllers.StepTCP,
+		controllers.StepTLS,
+		controllers.StepAuth,
+		controllers.StepBucket,
+		controllers.StepRoundTrip,
+	}, stepNames)
+
+	// Local minio doesn't use TLS.
+	assert.True(t, diagnosis.Steps[2].Skipped)
+	roundTrip := diagnosis.Steps[5]
+	assert.True(t, roundTrip.Succeeded)
+	assert.Equal(t, 3, len(roundTrip.Details))
+}
+
+// This test assumes the local SFTP service is running.
+func TestDiagnoseConnectionSFTP(t *testing.T) {
+	defer core.ClearDartTable()
+	ss := loadSFTPStorageService(t)
+	ss.AllowsUpload = true
+
+	diagnosis := controllers.DiagnoseConnection(ss)
+	assert.True(t, diagnosis.Succeeded(), diagnosis.Summary())
+	require.Equal(t, 6, len(diagnosis.Steps))
+	assert.True(t, diagnosis.Steps[5].Succeeded)
+
+	// With a bad password, we should get past the network
+	// steps and fail at authentication.
+	ss.Password = "this-is-not-the-password"
+	ss.LoginExtra = ""
+	diagnosis = controllers.DiagnoseConnection(ss)
+	failedStep := diagnosis.FailedStep()
+	require.NotNil(t, failedStep)
+	assert.Equal(t, controllers.StepAuth, failedStep.Name)
+}
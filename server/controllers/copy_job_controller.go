@@ -0,0 +1,342 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// CopyJob describes a request to copy one object, typically a bag that
+// has already been deposited, from one storage service to another.
+// See CopyObjectBetweenServices for how the copy works.
+type CopyJob struct {
+	ID              string            `json:"id"`
+	SourceServiceID string            `json:"sourceServiceId"`
+	SourceBucket    string            `json:"sourceBucket"`
+	SourceKey       string            `json:"sourceKey"`
+	TargetServiceID string            `json:"targetServiceId"`
+	TargetKey       string            `json:"targetKey"`
+	Overwrite       bool              `json:"overwrite"`
+	CreatedAt       time.Time         `json:"createdAt"`
+	CompletedAt     time.Time         `json:"completedAt"`
+	Succeeded       bool              `json:"succeeded"`
+	Result          *ObjectCopyResult `json:"result"`
+	Error           string            `json:"error"`
+}
+
+var copyJobStore = NewJSONStore[CopyJob]("copy_jobs.json")
+
+// copyTargetProtocols lists the protocols CopyObjectBetweenServices
+// can write to.
+var copyTargetProtocols = []string{constants.ProtocolS3, constants.ProtocolSFTP, ProtocolWebDAV, ProtocolFilesystem}
+
+// GET /copy_jobs/new?ssid=<id>&bucket=<name>&key=<key>
+func CopyJobNew(c *gin.Context) {
+	copyJob := &CopyJob{
+		SourceServiceID: c.Query("ssid"),
+		SourceBucket:    c.Query("bucket"),
+		SourceKey:       c.Query("key"),
+		TargetKey:       c.Query("key"),
+	}
+	source := core.ObjFind(copyJob.SourceServiceID).StorageService()
+	if source == nil {
+		AbortWithErrorHTML(c, http.StatusNotFound, fmt.Errorf("No such storage service: %s", copyJob.SourceServiceID))
+		return
+	}
+	data := gin.H{
+		"form":    copyJobForm(copyJob),
+		"copyJob": copyJob,
+		"source":  source,
+		"helpUrl": GetHelpUrl(c),
+	}
+	c.HTML(http.StatusOK, "copy_job/new.html", data)
+}
+
+// POST /copy_jobs/new
+func CopyJobCreate(c *gin.Context) {
+	copyJob := &CopyJob{
+		ID:              uuid.NewString(),
+		SourceServiceID: c.PostForm("ssid"),
+		SourceBucket:    c.PostForm("bucket"),
+		SourceKey:       c.PostForm("key"),
+		TargetServiceID: c.PostForm("TargetServiceID"),
+		TargetKey:       c.PostForm("TargetKey"),
+		Overwrite:       c.PostForm("Overwrite") == "true",
+		CreatedAt:       time.Now(),
+	}
+	source := core.ObjFind(copyJob.SourceServiceID).StorageService()
+	if source == nil {
+		AbortWithErrorHTML(c, http.StatusNotFound, fmt.Errorf("No such storage service: %s", copyJob.SourceServiceID))
+		return
+	}
+	form := copyJobForm(copyJob)
+	errors := copyJob.Validate()
+	if len(errors) > 0 {
+		for fieldName, message := range errors {
+			form.Fields[fieldName].Error = message
+		}
+		data := gin.H{
+			"form":    form,
+			"copyJob": copyJob,
+			"source":  source,
+			"helpUrl": GetHelpUrl(c),
+		}
+		c.HTML(http.StatusBadRequest, "copy_job/new.html", data)
+		return
+	}
+	err := saveCopyJob(copyJob)
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.Redirect(http.StatusFound, fmt.Sprintf("/copy_jobs/review/%s", copyJob.ID))
+}
+
+// GET /copy_jobs/review/:id
+func CopyJobReview(c *gin.Context) {
+	copyJob, err := findCopyJob(c.Param("id"))
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusNotFound, err)
+		return
+	}
+	uploadJob, err := copyJob.uploadJob()
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusNotFound, err)
+		return
+	}
+	jobSummary := core.NewUploadJobSummary(uploadJob)
+	jobSummaryJson, _ := json.MarshalIndent(jobSummary, "", "  ")
+
+	values := url.Values{}
+	values.Set("ssid", copyJob.SourceServiceID)
+	values.Set("bucket", copyJob.SourceBucket)
+	values.Set("key", copyJob.SourceKey)
+
+	data := gin.H{
+		"jobID":          copyJob.ID,
+		"workflowID":     "-",
+		"copyJob":        copyJob,
+		"source":         uploadJob.UploadOps[0].SourceFiles[0],
+		"target":         uploadJob.UploadOps[0].StorageService,
+		"jobSummary":     jobSummary,
+		"jobSummaryJson": string(jobSummaryJson),
+		"jobRunUrl":      "/copy_jobs/run/",
+		"backButtonUrl":  fmt.Sprintf("/copy_jobs/new?%s", values.Encode()),
+		"helpUrl":        GetHelpUrl(c),
+	}
+	c.HTML(http.StatusOK, "copy_job/review.html", data)
+}
+
+// GET /copy_jobs/run/:id
+//
+// By REST standards, this should be a POST. However, the Server
+// Send Events standard for JavaScript only supports GET.
+func CopyJobRun(c *gin.Context) {
+	copyJob, err := findCopyJob(c.Param("id"))
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusNotFound, err)
+		return
+	}
+	uploadJob, err := copyJob.uploadJob()
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusNotFound, err)
+		return
+	}
+
+	messageChannel := make(chan *core.EventMessage)
+	go func() {
+
+		// Give the listeners below a chance to attach.
+		time.Sleep(200 * time.Millisecond)
+
+		// The front end already knows how to show upload jobs,
+		// so we describe the copy as an upload to the target.
+		jobSummary := core.NewUploadJobSummary(uploadJob)
+		messageChannel <- core.InitEvent(jobSummary)
+
+		exitCode := RunCopyJob(copyJob, messageChannel)
+
+		status := constants.StatusFailed
+		if exitCode == constants.ExitOK {
+			status = constants.StatusSuccess
+		}
+		if err := saveCopyJob(copyJob); err != nil {
+			core.Dart.Log.Errorf("Error saving copy job %s: %v", copyJob.ID, err)
+		}
+		eventMessage := &core.EventMessage{
+			EventType: constants.EventTypeDisconnect,
+			Message:   fmt.Sprintf("Job completed with exit code %d (%s)", exitCode, status),
+			Status:    status,
+		}
+		messageChannel <- eventMessage
+	}()
+
+	streamer := func(w io.Writer) bool {
+		if msg, ok := <-messageChannel; ok {
+			c.SSEvent("message", msg)
+			if msg.EventType != constants.EventTypeDisconnect {
+				return true
+			}
+		}
+		return false
+	}
+	c.Stream(streamer)
+	c.Writer.Flush()
+}
+
+// RunCopyJob copies the object, sending progress messages through
+// messageChannel, and records the outcome in copyJob. It returns an
+// exit code, like the job runners in DART Runner.
+func RunCopyJob(copyJob *CopyJob, messageChannel chan *core.EventMessage) int {
+	copyJob.Result = nil
+	copyJob.Error = ""
+	copyJob.Succeeded = false
+	defer func() { copyJob.CompletedAt = time.Now() }()
+
+	source := core.ObjFind(copyJob.SourceServiceID).StorageService()
+	target := core.ObjFind(copyJob.TargetServiceID).StorageService()
+	if source == nil || target == nil {
+		return copyJobFailed(copyJob, messageChannel, fmt.Errorf("Source or target storage service no longer exists"))
+	}
+	messageChannel <- core.StartEvent(constants.StageUpload, fmt.Sprintf("Copying %s from %s to %s", copyJob.SourceKey, source.Name, target.Name))
+	progress := func(copied, total int64) {
+		msg := core.InfoEvent(constants.StageUpload, fmt.Sprintf("Copied %d of %d bytes", copied, total))
+		msg.Total = total
+		msg.Current = copied
+		msg.Percent = uploadPercent(copied, total, 0, 0)
+		messageChannel <- msg
+	}
+	result, err := CopyObjectBetweenServices(source, copyJob.SourceBucket, copyJob.SourceKey, target, copyJob.TargetKey, copyJob.Overwrite, progress)
+	copyJob.Result = result
+	if err != nil {
+		return copyJobFailed(copyJob, messageChannel, err)
+	}
+	copyJob.Succeeded = true
+	message := fmt.Sprintf("Copied %s to %s on %s. Source: %s. Copy: %s.", result.SourcePath, result.TargetPath, target.Name, result.SourceCheck, result.TargetCheck)
+	core.Dart.Log.Info(message)
+	messageChannel <- core.InfoEvent(constants.StageUpload, message)
+	return constants.ExitOK
+}
+
+func copyJobFailed(copyJob *CopyJob, messageChannel chan *core.EventMessage, err error) int {
+	core.Dart.Log.Errorf("Copy job %s (%s): %v", copyJob.ID, copyJob.SourceKey, err)
+	copyJob.Error = err.Error()
+	messageChannel <- core.WarningEvent(constants.StageUpload, err.Error())
+	return constants.ExitRuntimeErr
+}
+
+// Validate returns a map of field names to error messages. The map
+// is empty if the job is valid.
+func (copyJob *CopyJob) Validate() map[string]string {
+	errors := make(map[string]string)
+	target := core.ObjFind(copyJob.TargetServiceID).StorageService()
+	if target == nil {
+		errors["TargetServiceID"] = "Please choose a storage service to copy to."
+	} else if !target.AllowsUpload {
+		errors["TargetServiceID"] = fmt.Sprintf("%s does not allow uploads.", target.Name)
+	} else if !isCopyTarget(target) {
+		errors["TargetServiceID"] = fmt.Sprintf("DART cannot copy to %s services.", target.Protocol)
+	}
+	if err := ValidateObjectKey(copyJob.TargetKey); err != nil {
+		errors["TargetKey"] = err.Error()
+	} else if target != nil && target.ID == copyJob.SourceServiceID && target.Bucket == copyJob.SourceBucket && copyJob.TargetKey == copyJob.SourceKey {
+		errors["TargetKey"] = "The copy can't have the same name as the original."
+	}
+	return errors
+}
+
+// uploadJob returns an upload job that describes the copy, so the job
+// run page can show it the way it shows uploads. The job is not saved.
+func (copyJob *CopyJob) uploadJob() (*core.UploadJob, error) {
+	source := core.ObjFind(copyJob.SourceServiceID).StorageService()
+	if source == nil {
+		return nil, fmt.Errorf("No such storage service: %s", copyJob.SourceServiceID)
+	}
+	target := core.ObjFind(copyJob.TargetServiceID).StorageService()
+	if target == nil {
+		return nil, fmt.Errorf("No such storage service: %s", copyJob.TargetServiceID)
+	}
+	uploadJob := core.NewUploadJob()
+	uploadJob.ID = copyJob.ID
+	uploadJob.PathsToUpload = []string{fmt.Sprintf("%s: %s", source.Name, path.Join(copyJob.SourceBucket, copyJob.SourceKey))}
+	uploadJob.StorageServiceIDs = []string{target.ID}
+	uploadJob.UploadOps = []*core.UploadOperation{core.NewUploadOperation(target, uploadJob.PathsToUpload)}
+	return uploadJob, nil
+}
+
+func isCopyTarget(ss *core.StorageService) bool {
+	for _, protocol := range copyTargetProtocols {
+		if ss.Protocol == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+func copyJobForm(copyJob *CopyJob) *core.Form {
+	form := core.NewForm("CopyJob", copyJob.ID, make(map[string]string))
+	form.AddField("ssid", "", copyJob.SourceServiceID, true)
+	form.AddField("bucket", "", copyJob.SourceBucket, true)
+	form.AddField("key", "", copyJob.SourceKey, true)
+
+	targetField := form.AddField("TargetServiceID", "Copy To", copyJob.TargetServiceID, true)
+	targetField.Choices = []core.Choice{
+		{Label: "Choose One", Value: "", Selected: false},
+	}
+	targets, err := GetAvailableUploadTargets([]string{copyJob.TargetServiceID})
+	if err != nil {
+		core.Dart.Log.Errorf("Cannot list copy targets: %v", err)
+	}
+	for _, choice := range targets {
+		ss := core.ObjFind(choice.Value).StorageService()
+		if ss != nil && isCopyTarget(ss) {
+			targetField.Choices = append(targetField.Choices, choice)
+		}
+	}
+
+	keyField := form.AddField("TargetKey", "Copy As", copyJob.TargetKey, true)
+	keyField.Help = "The key of the copy, relative to the target's bucket or folder."
+
+	overwriteField := form.AddField("Overwrite", "Replace Existing Copy", strconv.FormatBool(copyJob.Overwrite), false)
+	overwriteField.Choices = []core.Choice{
+		{Label: "Yes", Value: "true", Selected: copyJob.Overwrite},
+		{Label: "No", Value: "false", Selected: !copyJob.Overwrite},
+	}
+	overwriteField.Help = "If No, the job stops without copying anything if the target already has an object with this key."
+	return form
+}
+
+func findCopyJob(id string) (*CopyJob, error) {
+	copyJobs, err := copyJobStore.Load()
+	if err != nil {
+		return nil, err
+	}
+	for i := range copyJobs {
+		if copyJobs[i].ID == id {
+			return &copyJobs[i], nil
+		}
+	}
+	return nil, fmt.Errorf("No copy job with id %s", id)
+}
+
+func saveCopyJob(copyJob *CopyJob) error {
+	return copyJobStore.Update(func(copyJobs []CopyJob) ([]CopyJob, error) {
+		for i := range copyJobs {
+			if copyJobs[i].ID == copyJob.ID {
+				copyJobs[i] = *copyJob
+				return copyJobs, nil
+			}
+		}
+		return append(copyJobs, *copyJob), nil
+	})
+}
@@ -0,0 +1,202 @@
+package controllers_test
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart/v3/server/controllers"
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// saveCopyTestFile creates a filesystem storage service holding
+// bags/bag.tar and saves it, so copy jobs can find it.
+func saveCopyTestFile(t *testing.T, content string) *core.StorageService {
+	ss := getFilesystemService(t)
+	ss.Name = "Source NAS"
+	ss.AllowsDownload = true
+	require.NoError(t, os.MkdirAll(filepath.Join(ss.Bucket, "bags"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(ss.Bucket, "bags", "bag.tar"), []byte(content), 0644))
+	require.NoError(t, core.ObjSaveWithoutValidation(ss))
+	return ss
+}
+
+func TestCopyObjectBetweenServices(t *testing.T) {
+	defer core.ClearDartTable()
+	source := saveCopyTestFile(t, "Bag contents")
+	target := getFilesystemService(t)
+
+	lastCopied := int64(0)
+	progress := func(copied, total int64) {
+		assert.EqualValues(t, 12, total)
+		lastCopied = copied
+	}
+	result, err := controllers.CopyObjectBetweenServices(source, source.Bucket, "bags/bag.tar", target, "copies/bag.tar", false, progress)
+	require.NoError(t, err)
+	assert.EqualValues(t, 12, lastCopied)
+	assert.EqualValues(t, 12, result.BytesCopied)
+	assert.Equal(t, filepath.Join(target.Bucket, "copies", "bag.tar"), result.TargetPath)
+	assert.Equal(t, "size and SHA-256 match", result.TargetCheck)
+	data, err := os.ReadFile(result.TargetPath)
+	require.NoError(t, err)
+	assert.Equal(t, "Bag contents", string(data))
+
+	// We shouldn't replace the copy unless asked.
+	_, err = controllers.CopyObjectBetweenServices(source, source.Bucket, "bags/bag.tar", target, "copies/bag.tar", false, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "already exists")
+	_, err = controllers.CopyObjectBetweenServices(source, source.Bucket, "bags/bag.tar", target, "copies/bag.tar", true, nil)
+	require.NoError(t, err)
+
+	_, err = controllers.CopyObjectBetweenServices(source, source.Bucket, "bags/missing.tar", target, "copies/missing.tar", false, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Cannot find bags/missing.tar")
+}
+
+// StatObject reports the storage class only in the object's metadata,
+// and restored copies of archived objects can be read like any other.
+func TestCheckCopySource(t *testing.T) {
+	objInfo := minio.ObjectInfo{Metadata: http.Header{}}
+	assert.NoError(t, controllers.CheckCopySource("bag.tar", objInfo))
+
+	objInfo.Metadata.Set("X-Amz-Storage-Class", "GLACIER")
+	err := controllers.CheckCopySource("bag.tar", objInfo)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "bag.tar is in GLACIER storage")
+
+	objInfo.Restore = &minio.RestoreInfo{OngoingRestore: true}
+	err = controllers.CheckCopySource("bag.tar", objInfo)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "still being restored")
+
+	objInfo.Restore = &minio.RestoreInfo{ExpiryTime: time.Now().Add(24 * time.Hour)}
+	assert.NoError(t, controllers.CheckCopySource("bag.tar", objInfo))
+}
+
+func TestCopyObjectToWebDAV(t *testing.T) {
+	defer core.ClearDartTable()
+	source := saveCopyTestFile(t, "Bag contents")
+	target, rootDir := startWebDAVServer(t)
+
+	result, err := controllers.CopyObjectBetweenServices(source, source.Bucket, "bags/bag.tar", target, "bags/bag.tar", false, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "/deposits/bags/bag.tar", result.TargetPath)
+	assert.Equal(t, "size matches", result.TargetCheck)
+	data, err := os.ReadFile(filepath.Join(rootDir, "deposits", "bags", "bag.tar"))
+	require.NoError(t, err)
+	assert.Equal(t, "Bag contents", string(data))
+
+	// The temporary file should be gone.
+	entries, err := os.ReadDir(filepath.Join(rootDir, "deposits", "bags"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(entries))
+}
+
+func TestCopyJobNew(t *testing.T) {
+	defer core.ClearDartTable()
+	source := saveCopyTestFile(t, "Bag contents")
+	params := url.Values{}
+	params.Set("ssid", source.ID)
+	params.Set("bucket", source.Bucket)
+	params.Set("key", "bags/bag.tar")
+	expected := []string{
+		"Copy Object",
+		"bags/bag.tar",
+		"Copy To",
+		"Copy As",
+		"Replace Existing Copy",
+	}
+	DoSimpleGetTest(t, "/copy_jobs/new?"+params.Encode(), expected)
+}
+
+func TestCopyJobCreate(t *testing.T) {
+	defer core.ClearDartTable()
+	source := saveCopyTestFile(t, "Bag contents")
+	params := url.Values{}
+	params.Set("ssid", source.ID)
+	params.Set("bucket", source.Bucket)
+	params.Set("key", "bags/bag.tar")
+	params.Set("TargetServiceID", "")
+	params.Set("TargetKey", "../bag.tar")
+	DoSimplePostTest(t, PostTestSettings{
+		EndpointUrl:          "/copy_jobs/new",
+		Params:               params,
+		ExpectedResponseCode: http.StatusBadRequest,
+		ExpectedContent: []string{
+			"Please choose a storage service to copy to.",
+		},
+	})
+
+	// Copying an object onto itself would destroy it.
+	params.Set("TargetServiceID", source.ID)
+	params.Set("TargetKey", "bags/bag.tar")
+	DoSimplePostTest(t, PostTestSettings{
+		EndpointUrl:          "/copy_jobs/new",
+		Params:               params,
+		ExpectedResponseCode: http.StatusBadRequest,
+		ExpectedContent: []string{
+			"The copy can&#39;t have the same name as the original.",
+		},
+	})
+
+	params.Set("TargetKey", "copies/bag.tar")
+	DoSimplePostTest(t, PostTestSettings{
+		EndpointUrl:          "/copy_jobs/new",
+		Params:               params,
+		ExpectedResponseCode: http.StatusFound,
+	})
+}
+
+// NOTE: This test assumes that the local SFTP server is running.
+// See the note on TestUploadJobNew.
+func TestRunCopyJobFromSFTP(t *testing.T) {
+	defer core.ClearDartTable()
+	source := loadSFTPStorageService(t)
+	putSFTPTestFiles(t, source)
+	target := getFilesystemService(t)
+	require.NoError(t, core.ObjSaveWithoutValidation(target))
+
+	copyJob := &controllers.CopyJob{
+		ID:              "copy-job-test",
+		SourceServiceID: source.ID,
+		SourceBucket:    source.Bucket,
+		SourceKey:       path.Join(sftpTestDir, "sub", "c.txt"),
+		TargetServiceID: target.ID,
+		TargetKey:       "c.txt",
+	}
+	assert.Empty(t, copyJob.Validate())
+
+	messageChannel := make(chan *core.EventMessage)
+	messages := make([]*core.EventMessage, 0)
+	done := make(chan bool)
+	go func() {
+		for msg := range messageChannel {
+			messages = append(messages, msg)
+		}
+		done <- true
+	}()
+	exitCode := controllers.RunCopyJob(copyJob, messageChannel)
+	close(messageChannel)
+	<-done
+
+	require.Equal(t, constants.ExitOK, exitCode, copyJob.Error)
+	assert.True(t, copyJob.Succeeded)
+	assert.False(t, copyJob.CompletedAt.IsZero())
+	require.NotNil(t, copyJob.Result)
+	assert.Equal(t, "size and SHA-256 match", copyJob.Result.TargetCheck)
+	data, err := os.ReadFile(filepath.Join(target.Bucket, "c.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "File c", string(data))
+
+	last := messages[len(messages)-2]
+	assert.EqualValues(t, 6, last.Total)
+	assert.Equal(t, 100, last.Percent)
+}
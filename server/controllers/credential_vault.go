@@ -0,0 +1,480 @@
+package controllers
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"golang.org/x/crypto/argon2"
+)
+
+// EncryptedCredentialPrefix marks a credential field that holds a
+// secret encrypted with the key from the credential vault.
+const EncryptedCredentialPrefix = "enc:v1:"
+
+// MinPassphraseLength is the minimum length of the master passphrase.
+const MinPassphraseLength = 10
+
+// ErrCredentialsLocked means a stored credential is encrypted and the
+// user hasn't entered the master passphrase in this session.
+var ErrCredentialsLocked = errors.New("Stored credentials are locked. Unlock them under Settings > Credential Encryption, then try again.")
+
+// ErrWrongPassphrase means the passphrase does not unlock the vault.
+var ErrWrongPassphrase = errors.New("Incorrect passphrase.")
+
+// CredentialVault describes how stored credentials are encrypted.
+// Credentials are encrypted with AES-256-GCM using a random data key.
+// The data key itself is encrypted with a key derived from the user's
+// passphrase with Argon2id, so changing the passphrase only means
+// re-encrypting the data key, not every credential.
+//
+// We never store the passphrase or the data key in the clear. While
+// unlocked, the data key lives in memory until the user locks the
+// vault or quits DART.
+type CredentialVault struct {
+	Salt       string    `json:"salt"`
+	Time       uint32    `json:"time"`
+	Memory     uint32    `json:"memory"`
+	Threads    uint8     `json:"threads"`
+	WrappedKey string    `json:"wrappedKey"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+var credentialVaultStore = NewJSONStore[CredentialVault]("credential_vault.json")
+
+// credentialSession holds the data key while the vault is unlocked.
+var credentialSession struct {
+	sync.RWMutex
+	key []byte
+}
+
+// IsEncryptedCredential returns true if value was encrypted with the
+// credential vault's key.
+func IsEncryptedCredential(value string) bool {
+	return strings.HasPrefix(value, EncryptedCredentialPrefix)
+}
+
+// isPlaintextSecret returns true if value is a secret stored as is,
+// rather than a reference or an encrypted value.
+func isPlaintextSecret(value string) bool {
+	return value != "" && !IsCredentialReference(value) && !IsEncryptedCredential(value)
+}
+
+func loadCredentialVault() (*CredentialVault, error) {
+	vaults, err := credentialVaultStore.Load()
+	if err != nil || len(vaults) == 0 {
+		return nil, err
+	}
+	return &vaults[0], nil
+}
+
+// CredentialEncryptionEnabled returns true if the user has set a
+// master passphrase.
+func CredentialEncryptionEnabled() bool {
+	vault, err := loadCredentialVault()
+	if err != nil {
+		core.Dart.Log.Errorf("Cannot load credential vault: %v", err)
+	}
+	return vault != nil
+}
+
+// CredentialsUnlocked returns true if the user has entered the
+// master passphrase in this session.
+func CredentialsUnlocked() bool {
+	credentialSession.RLock()
+	defer credentialSession.RUnlock()
+	return credentialSession.key != nil
+}
+
+// LockCredentials forgets the data key. Encrypted credentials
+// can't be used until the user unlocks them again.
+func LockCredentials() {
+	credentialSession.Lock()
+	defer credentialSession.Unlock()
+	credentialSession.key = nil
+}
+
+// EnableCredentialEncryption sets the master passphrase, unlocks the
+// vault, and encrypts all passwords and API tokens already stored in
+// plain text. It returns the number of records it encrypted.
+func EnableCredentialEncryption(passphrase string) (int, error) {
+	if CredentialEncryptionEnabled() {
+		return 0, fmt.Errorf("Credential encryption is already turned on.")
+	}
+	if len(passphrase) < MinPassphraseLength {
+		return 0, fmt.Errorf("Passphrase must be at least %d characters long.", MinPassphraseLength)
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return 0, err
+	}
+	vault, err := newCredentialVault(passphrase, dataKey)
+	if err != nil {
+		return 0, err
+	}
+	vault.CreatedAt = vault.UpdatedAt
+	if err = credentialVaultStore.Save([]CredentialVault{*vault}); err != nil {
+		return 0, err
+	}
+	setSessionKey(dataKey)
+	return EncryptStoredCredentials()
+}
+
+// UnlockCredentials checks passphrase and, if it's correct, keeps the
+// data key in memory so that encrypted credentials can be used. It
+// also encrypts any plaintext credentials that have arrived since the
+// last unlock, such as those in imported settings.
+func UnlockCredentials(passphrase string) error {
+	vault, err := loadCredentialVault()
+	if err != nil {
+		return err
+	}
+	if vault == nil {
+		return fmt.Errorf("Credential encryption is not turned on.")
+	}
+	dataKey, err := vault.unwrap(passphrase)
+	if err != nil {
+		return err
+	}
+	setSessionKey(dataKey)
+	if _, err = EncryptStoredCredentials(); err != nil {
+		core.Dart.Log.Errorf("Error encrypting stored credentials: %v", err)
+	}
+	return nil
+}
+
+// ChangeCredentialPassphrase replaces the master passphrase. Stored
+// credentials don't change, because they are encrypted with the data
+// key, not the passphrase.
+func ChangeCredentialPassphrase(currentPassphrase, newPassphrase string) error {
+	if len(newPassphrase) < MinPassphraseLength {
+		return fmt.Errorf("Passphrase must be at least %d characters long.", MinPassphraseLength)
+	}
+	return credentialVaultStore.Update(func(vaults []CredentialVault) ([]CredentialVault, error) {
+		if len(vaults) == 0 {
+			return nil, fmt.Errorf("Credential encryption is not turned on.")
+		}
+		dataKey, err := vaults[0].unwrap(currentPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		vault, err := newCredentialVault(newPassphrase, dataKey)
+		if err != nil {
+			return nil, err
+		}
+		vault.CreatedAt = vaults[0].CreatedAt
+		setSessionKey(dataKey)
+		return []CredentialVault{*vault}, nil
+	})
+}
+
+// DisableCredentialEncryption decrypts all stored credentials and
+// deletes the vault. The vault must be unlocked.
+func DisableCredentialEncryption() error {
+	if !CredentialsUnlocked() {
+		return ErrCredentialsLocked
+	}
+	_, err := updateStoredCredentials(func(value string) (string, bool, error) {
+		if !IsEncryptedCredential(value) {
+			return value, false, nil
+		}
+		plaintext, err := decryptCredential(value)
+		return plaintext, true, err
+	})
+	if err != nil {
+		return err
+	}
+	if err = credentialVaultStore.Save([]CredentialVault{}); err != nil {
+		return err
+	}
+	LockCredentials()
+	return nil
+}
+
+// EncryptStoredCredentials encrypts every plaintext password and API
+// token in the DART database, including the copies of storage services
+// saved with jobs and workflows. It returns the number of records it
+// changed. The vault must be unlocked.
+func EncryptStoredCredentials() (int, error) {
+	return updateStoredCredentials(func(value string) (string, bool, error) {
+		if !isPlaintextSecret(value) {
+			return value, false, nil
+		}
+		ciphertext, err := EncryptCredential(value)
+		return ciphertext, true, err
+	})
+}
+
+// EncryptCredential encrypts plaintext with the vault's data key.
+func EncryptCredential(plaintext string) (string, error) {
+	dataKey := getSessionKey()
+	if dataKey == nil {
+		return "", ErrCredentialsLocked
+	}
+	sealed, err := seal(dataKey, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+	return EncryptedCredentialPrefix + sealed, nil
+}
+
+func decryptCredential(value string) (string, error) {
+	dataKey := getSessionKey()
+	if dataKey == nil {
+		return "", ErrCredentialsLocked
+	}
+	plaintext, err := unseal(dataKey, strings.TrimPrefix(value, EncryptedCredentialPrefix))
+	if err != nil {
+		return "", fmt.Errorf("Cannot decrypt stored credential: %v", err)
+	}
+	return string(plaintext), nil
+}
+
+// protectStorageServiceCredentials encrypts the password of ss before
+// we save it, if credential encryption is on. It returns
+// ErrCredentialsLocked if the password needs encrypting but
+// the vault is locked.
+func protectStorageServiceCredentials(ss *core.StorageService) error {
+	if !isPlaintextSecret(ss.Password) || !CredentialEncryptionEnabled() {
+		return nil
+	}
+	ciphertext, err := EncryptCredential(ss.Password)
+	if err != nil {
+		return err
+	}
+	ss.Password = ciphertext
+	return nil
+}
+
+// protectRemoteRepositoryCredentials is the remote repository
+// equivalent of protectStorageServiceCredentials.
+func protectRemoteRepositoryCredentials(repo *core.RemoteRepository) error {
+	if !isPlaintextSecret(repo.APIToken) || !CredentialEncryptionEnabled() {
+		return nil
+	}
+	ciphertext, err := EncryptCredential(repo.APIToken)
+	if err != nil {
+		return err
+	}
+	repo.APIToken = ciphertext
+	return nil
+}
+
+// updateStoredCredentials passes every stored password and API token
+// to transform, and saves the records for which transform reports a
+// change. It returns the number of records saved.
+func updateStoredCredentials(transform func(value string) (string, bool, error)) (int, error) {
+	count := 0
+	transformService := func(ss *core.StorageService) (bool, error) {
+		if ss == nil {
+			return false, nil
+		}
+		value, changed, err := transform(ss.Password)
+		if changed && err == nil {
+			ss.Password = value
+		}
+		return changed, err
+	}
+	transformOps := func(ops []*core.UploadOperation) (bool, error) {
+		anyChanged := false
+		for _, op := range ops {
+			changed, err := transformService(op.StorageService)
+			if err != nil {
+				return false, err
+			}
+			anyChanged = anyChanged || changed
+		}
+		return anyChanged, nil
+	}
+	save := func(obj core.PersistentObject, changed bool, err error) error {
+		if err != nil || !changed {
+			return err
+		}
+		count++
+		return core.ObjSaveWithoutValidation(obj)
+	}
+
+	services, err := listAllObjects(constants.TypeStorageService, func(r *core.QueryResult) []*core.StorageService { return r.StorageServices })
+	if err != nil {
+		return count, err
+	}
+	for _, ss := range services {
+		changed, err := transformService(ss)
+		if err = save(ss, changed, err); err != nil {
+			return count, err
+		}
+	}
+
+	repos, err := listAllObjects(constants.TypeRemoteRepository, func(r *core.QueryResult) []*core.RemoteRepository { return r.RemoteRepositories })
+	if err != nil {
+		return count, err
+	}
+	for _, repo := range repos {
+		value, changed, err := transform(repo.APIToken)
+		if changed && err == nil {
+			repo.APIToken = value
+		}
+		if err = save(repo, changed, err); err != nil {
+			return count, err
+		}
+	}
+
+	workflows, err := listAllObjects(constants.TypeWorkflow, func(r *core.QueryResult) []*core.Workflow { return r.Workflows })
+	if err != nil {
+		return count, err
+	}
+	for _, workflow := range workflows {
+		anyChanged := false
+		for _, ss := range workflow.StorageServices {
+			changed, err := transformService(ss)
+			if err != nil {
+				return count, err
+			}
+			anyChanged = anyChanged || changed
+		}
+		if err = save(workflow, anyChanged, nil); err != nil {
+			return count, err
+		}
+	}
+
+	jobs, err := listAllObjects(constants.TypeJob, func(r *core.QueryResult) []*core.Job { return r.Jobs })
+	if err != nil {
+		return count, err
+	}
+	for _, job := range jobs {
+		changed, err := transformOps(job.UploadOps)
+		if err = save(job, changed, err); err != nil {
+			return count, err
+		}
+	}
+
+	uploadJobs, err := listAllObjects(constants.TypeUploadJob, func(r *core.QueryResult) []*core.UploadJob { return r.UploadJobs })
+	if err != nil {
+		return count, err
+	}
+	for _, uploadJob := range uploadJobs {
+		changed, err := transformOps(uploadJob.UploadOps)
+		if err = save(uploadJob, changed, err); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// listAllObjects returns all objects of objType, reading them from
+// the database one page at a time. The items function picks the
+// objects out of each page of results.
+func listAllObjects[T any](objType string, items func(*core.QueryResult) []T) ([]T, error) {
+	const pageSize = 500
+	all := make([]T, 0)
+	for offset := 0; ; offset += pageSize {
+		result := core.ObjList(objType, "obj_name", pageSize, offset)
+		if result.Error != nil {
+			return all, result.Error
+		}
+		page := items(result)
+		all = append(all, page...)
+		if len(page) < pageSize {
+			return all, nil
+		}
+	}
+}
+
+func newCredentialVault(passphrase string, dataKey []byte) (*CredentialVault, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	vault := &CredentialVault{
+		Salt:      base64.StdEncoding.EncodeToString(salt),
+		Time:      3,
+		Memory:    64 * 1024,
+		Threads:   4,
+		UpdatedAt: time.Now(),
+	}
+	wrappedKey, err := seal(vault.deriveKey(passphrase, salt), dataKey)
+	if err != nil {
+		return nil, err
+	}
+	vault.WrappedKey = wrappedKey
+	return vault, nil
+}
+
+func (vault *CredentialVault) deriveKey(passphrase string, salt []byte) []byte {
+	return argon2.IDKey([]byte(passphrase), salt, vault.Time, vault.Memory, vault.Threads, 32)
+}
+
+// unwrap returns the data key, or ErrWrongPassphrase if the
+// passphrase is not the one that wrapped the key.
+func (vault *CredentialVault) unwrap(passphrase string) ([]byte, error) {
+	salt, err := base64.StdEncoding.DecodeString(vault.Salt)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := unseal(vault.deriveKey(passphrase, salt), vault.WrappedKey)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return dataKey, nil
+}
+
+func setSessionKey(dataKey []byte) {
+	credentialSession.Lock()
+	defer credentialSession.Unlock()
+	credentialSession.key = dataKey
+}
+
+func getSessionKey() []byte {
+	credentialSession.RLock()
+	defer credentialSession.RUnlock()
+	return credentialSession.key
+}
+
+// seal encrypts plaintext with AES-256-GCM and returns the
+// nonce and ciphertext, base64-encoded.
+func seal(key, plaintext []byte) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, plaintext, nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// unseal reverses seal.
+func unseal(key []byte, encoded string) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext is too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,106 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/APTrust/dart-runner/core"
+	"github.com/gin-gonic/gin"
+)
+
+// GET /credentials
+func CredentialVaultShow(c *gin.Context) {
+	renderCredentialVault(c, http.StatusOK, credentialVaultForm())
+}
+
+// POST /credentials/enable
+func CredentialVaultEnable(c *gin.Context) {
+	form := credentialVaultForm()
+	passphrase := c.PostForm("Passphrase")
+	if passphrase != c.PostForm("ConfirmPassphrase") {
+		form.Fields["ConfirmPassphrase"].Error = "Passphrases do not match."
+		renderCredentialVault(c, http.StatusBadRequest, form)
+		return
+	}
+	count, err := EnableCredentialEncryption(passphrase)
+	if err != nil {
+		form.Fields["Passphrase"].Error = err.Error()
+		renderCredentialVault(c, http.StatusBadRequest, form)
+		return
+	}
+	SetFlashCookie(c, fmt.Sprintf("Credential encryption is on. Encrypted credentials in %d records.", count))
+	c.Redirect(http.StatusFound, "/credentials")
+}
+
+// POST /credentials/unlock
+func CredentialVaultUnlock(c *gin.Context) {
+	form := credentialVaultForm()
+	err := UnlockCredentials(c.PostForm("Passphrase"))
+	if err != nil {
+		form.Fields["Passphrase"].Error = err.Error()
+		renderCredentialVault(c, http.StatusBadRequest, form)
+		return
+	}
+	SetFlashCookie(c, "Stored credentials are unlocked.")
+	c.Redirect(http.StatusFound, "/credentials")
+}
+
+// POST /credentials/lock
+func CredentialVaultLock(c *gin.Context) {
+	LockCredentials()
+	SetFlashCookie(c, "Stored credentials are locked.")
+	c.Redirect(http.StatusFound, "/credentials")
+}
+
+// POST /credentials/change_passphrase
+func CredentialVaultChangePassphrase(c *gin.Context) {
+	form := credentialVaultForm()
+	newPassphrase := c.PostForm("NewPassphrase")
+	if newPassphrase != c.PostForm("ConfirmPassphrase") {
+		form.Fields["ConfirmPassphrase"].Error = "Passphrases do not match."
+		renderCredentialVault(c, http.StatusBadRequest, form)
+		return
+	}
+	err := ChangeCredentialPassphrase(c.PostForm("CurrentPassphrase"), newPassphrase)
+	if err != nil {
+		fieldName := "NewPassphrase"
+		if errors.Is(err, ErrWrongPassphrase) {
+			fieldName = "CurrentPassphrase"
+		}
+		form.Fields[fieldName].Error = err.Error()
+		renderCredentialVault(c, http.StatusBadRequest, form)
+		return
+	}
+	SetFlashCookie(c, "Passphrase changed.")
+	c.Redirect(http.StatusFound, "/credentials")
+}
+
+// POST /credentials/disable
+func CredentialVaultDisable(c *gin.Context) {
+	err := DisableCredentialEncryption()
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusBadRequest, err)
+		return
+	}
+	SetFlashCookie(c, "Credential encryption is off. Stored credentials are no longer encrypted.")
+	c.Redirect(http.StatusFound, "/credentials")
+}
+
+func credentialVaultForm() *core.Form {
+	form := core.NewForm("Credentials", "", make(map[string]string))
+	passphraseField := form.AddField("Passphrase", "Passphrase", "", true)
+	passphraseField.Help = fmt.Sprintf("At least %d characters. DART cannot recover your stored credentials if you forget this.", MinPassphraseLength)
+	form.AddField("ConfirmPassphrase", "Confirm Passphrase", "", true)
+	form.AddField("CurrentPassphrase", "Current Passphrase", "", true)
+	form.AddField("NewPassphrase", "New Passphrase", "", true)
+	return form
+}
+
+func renderCredentialVault(c *gin.Context, status int, form *core.Form) {
+	data := DefaultTemplateData(c)
+	data["form"] = form
+	data["enabled"] = CredentialEncryptionEnabled()
+	data["unlocked"] = CredentialsUnlocked()
+	c.HTML(status, "credentials/index.html", data)
+}
@@ -0,0 +1,199 @@
+package controllers_test
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart/v3/server/controllers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPassphrase = "correct horse battery staple"
+
+// turnOffCredentialEncryption makes sure a failed test
+// doesn't leave credential encryption on for other tests.
+func turnOffCredentialEncryption(t *testing.T, passphrase string) {
+	t.Cleanup(func() {
+		if controllers.CredentialEncryptionEnabled() {
+			controllers.UnlockCredentials(passphrase)
+			require.NoError(t, controllers.DisableCredentialEncryption())
+		}
+	})
+}
+
+func saveServiceWithPassword(t *testing.T, password string) *core.StorageService {
+	ss := core.NewStorageService()
+	ss.Name = "Encrypted Service"
+	ss.Protocol = constants.ProtocolS3
+	ss.Host = "s3.example.com"
+	ss.Bucket = "bucket"
+	ss.Login = "login"
+	ss.Password = password
+	ss.AllowsUpload = true
+	require.NoError(t, core.ObjSaveWithoutValidation(ss))
+	return ss
+}
+
+func TestCredentialEncryptionLifecycle(t *testing.T) {
+	defer core.ClearDartTable()
+	turnOffCredentialEncryption(t, "a different passphrase")
+	ss := saveServiceWithPassword(t, "plaintext-secret")
+	refService := saveServiceWithPassword(t, "env:DART_TEST_SECRET")
+
+	_, err := controllers.EnableCredentialEncryption("short")
+	assert.ErrorContains(t, err, "at least")
+	assert.False(t, controllers.CredentialEncryptionEnabled())
+
+	// Turning encryption on migrates existing plaintext secrets,
+	// but leaves references alone.
+	count, err := controllers.EnableCredentialEncryption(testPassphrase)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, count, 1)
+	assert.True(t, controllers.CredentialEncryptionEnabled())
+	assert.True(t, controllers.CredentialsUnlocked())
+	saved := core.ObjFind(ss.ID).StorageService()
+	require.NotNil(t, saved)
+	assert.True(t, controllers.IsEncryptedCredential(saved.Password))
+	assert.NotContains(t, saved.Password, "plaintext-secret")
+	assert.Equal(t, "env:DART_TEST_SECRET", core.ObjFind(refService.ID).StorageService().Password)
+
+	secret, err := controllers.ResolveCredential(saved.Password)
+	require.NoError(t, err)
+	assert.Equal(t, "plaintext-secret", secret)
+
+	// While locked, encrypted credentials can't be used.
+	controllers.LockCredentials()
+	_, err = controllers.ResolveCredential(saved.Password)
+	assert.ErrorIs(t, err, controllers.ErrCredentialsLocked)
+	assert.ErrorIs(t, controllers.UnlockCredentials("wrong passphrase"), controllers.ErrWrongPassphrase)
+	require.NoError(t, controllers.UnlockCredentials(testPassphrase))
+
+	// Changing the passphrase doesn't change stored credentials.
+	ciphertext := saved.Password
+	assert.ErrorIs(t, controllers.ChangeCredentialPassphrase("wrong passphrase", "a different passphrase"), controllers.ErrWrongPassphrase)
+	require.NoError(t, controllers.ChangeCredentialPassphrase(testPassphrase, "a different passphrase"))
+	controllers.LockCredentials()
+	assert.ErrorIs(t, controllers.UnlockCredentials(testPassphrase), controllers.ErrWrongPassphrase)
+	require.NoError(t, controllers.UnlockCredentials("a different passphrase"))
+	assert.Equal(t, ciphertext, core.ObjFind(ss.ID).StorageService().Password)
+	secret, err = controllers.ResolveCredential(ciphertext)
+	require.NoError(t, err)
+	assert.Equal(t, "plaintext-secret", secret)
+
+	// Turning encryption off decrypts everything.
+	require.NoError(t, controllers.DisableCredentialEncryption())
+	assert.False(t, controllers.CredentialEncryptionEnabled())
+	assert.Equal(t, "plaintext-secret", core.ObjFind(ss.ID).StorageService().Password)
+}
+
+func TestLockedCredentialsStopJobs(t *testing.T) {
+	defer core.ClearDartTable()
+	turnOffCredentialEncryption(t, testPassphrase)
+	ss := saveServiceWithPassword(t, "plaintext-secret")
+	_, err := controllers.EnableCredentialEncryption(testPassphrase)
+	require.NoError(t, err)
+	ss = core.ObjFind(ss.ID).StorageService()
+	controllers.LockCredentials()
+
+	uploadJob := &core.UploadJob{
+		PathsToUpload: []string{"/does/not/matter"},
+		UploadOps:     []*core.UploadOperation{core.NewUploadOperation(ss, []string{"/does/not/matter"})},
+	}
+	messageChannel := make(chan *core.EventMessage, 10)
+	exitCode := controllers.RunUploadJobWithExtendedUploads(uploadJob, messageChannel)
+	assert.Equal(t, constants.ExitRuntimeErr, exitCode)
+	// The job keeps the encrypted password.
+	assert.Equal(t, ss.Password, uploadJob.UploadOps[0].StorageService.Password)
+
+	diagnosis := controllers.DiagnoseConnection(ss)
+	failedStep := diagnosis.FailedStep()
+	require.NotNil(t, failedStep)
+	assert.Equal(t, controllers.StepCredentials, failedStep.Name)
+	assert.Contains(t, failedStep.Error, "Stored credentials are locked")
+}
+
+func TestCredentialVaultPages(t *testing.T) {
+	defer core.ClearDartTable()
+	turnOffCredentialEncryption(t, testPassphrase)
+
+	DoSimpleGetTest(t, "/credentials", []string{
+		"Credential Encryption",
+		"/credentials/enable",
+		"Confirm Passphrase",
+	})
+
+	params := url.Values{}
+	params.Set("Passphrase", testPassphrase)
+	params.Set("ConfirmPassphrase", "something else")
+	DoSimplePostTest(t, PostTestSettings{
+		EndpointUrl:          "/credentials/enable",
+		Params:               params,
+		ExpectedResponseCode: http.StatusBadRequest,
+		ExpectedContent:      []string{"Passphrases do not match."},
+	})
+
+	params.Set("ConfirmPassphrase", testPassphrase)
+	DoSimplePostTest(t, PostTestSettings{
+		EndpointUrl:              "/credentials/enable",
+		Params:                   params,
+		ExpectedResponseCode:     http.StatusFound,
+		ExpectedRedirectLocation: "/credentials",
+	})
+	assert.True(t, controllers.CredentialEncryptionEnabled())
+	DoSimpleGetTest(t, "/credentials", []string{
+		"Stored credentials are unlocked",
+		"/credentials/change_passphrase",
+		"/credentials/lock",
+	})
+
+	DoSimplePostTest(t, PostTestSettings{
+		EndpointUrl:              "/credentials/lock",
+		Params:                   url.Values{},
+		ExpectedResponseCode:     http.StatusFound,
+		ExpectedRedirectLocation: "/credentials",
+	})
+	DoSimpleGetTest(t, "/credentials", []string{
+		"Stored credentials are locked",
+		"/credentials/unlock",
+	})
+
+	params = url.Values{}
+	params.Set("Passphrase", "wrong passphrase")
+	DoSimplePostTest(t, PostTestSettings{
+		EndpointUrl:          "/credentials/unlock",
+		Params:               params,
+		ExpectedResponseCode: http.StatusBadRequest,
+		ExpectedContent:      []string{"Incorrect passphrase."},
+	})
+	params.Set("Passphrase", testPassphrase)
+	DoSimplePostTest(t, PostTestSettings{
+		EndpointUrl:              "/credentials/unlock",
+		Params:                   params,
+		ExpectedResponseCode:     http.StatusFound,
+		ExpectedRedirectLocation: "/credentials",
+	})
+	assert.True(t, controllers.CredentialsUnlocked())
+
+	params = url.Values{}
+	params.Set("CurrentPassphrase", testPassphrase)
+	params.Set("NewPassphrase", "brand new passphrase")
+	params.Set("ConfirmPassphrase", "brand new passphrase")
+	DoSimplePostTest(t, PostTestSettings{
+		EndpointUrl:              "/credentials/change_passphrase",
+		Params:                   params,
+		ExpectedResponseCode:     http.StatusFound,
+		ExpectedRedirectLocation: "/credentials",
+	})
+
+	DoSimplePostTest(t, PostTestSettings{
+		EndpointUrl:              "/credentials/disable",
+		Params:                   url.Values{},
+		ExpectedResponseCode:     http.StatusFound,
+		ExpectedRedirectLocation: "/credentials",
+	})
+	assert.False(t, controllers.CredentialEncryptionEnabled())
+}
@@ -0,0 +1,240 @@
+package controllers
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/APTrust/dart-runner/core"
+)
+
+// Credential fields such as a storage service's password or a remote
+// repository's API token may hold a reference instead of the secret
+// itself. We resolve references each time we connect, so the secret
+// is never written to the DART database or to exported settings.
+//
+//	env:WASABI_SECRET   reads environment variable WASABI_SECRET
+//	keyring:dart/wasabi reads account "wasabi" of service "dart"
+//	                    from the OS secret store
+const (
+	CredentialRefEnv     = "env:"
+	CredentialRefKeyring = "keyring:"
+)
+
+// DefaultKeyringService is the keyring service name we use for
+// references that name only an account, such as keyring:wasabi.
+const DefaultKeyringService = "dart"
+
+// IsCredentialReference returns true if value refers to a secret
+// stored elsewhere rather than containing the secret itself.
+func IsCredentialReference(value string) bool {
+	return strings.HasPrefix(value, CredentialRefEnv) || strings.HasPrefix(value, CredentialRefKeyring)
+}
+
+// ResolveCredential returns the secret that value refers to, or the
+// decrypted secret if value was encrypted with the credential vault.
+// Other values are returned unchanged. The error says which reference
+// could not be resolved, but never includes a secret.
+func ResolveCredential(value string) (string, error) {
+	switch {
+	case IsEncryptedCredential(value):
+		return decryptCredential(value)
+	case strings.HasPrefix(value, CredentialRefEnv):
+		name := strings.TrimPrefix(value, CredentialRefEnv)
+		if name == "" {
+			return "", fmt.Errorf("Credential reference %q does not name an environment variable", value)
+		}
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("Cannot resolve credential reference %q: environment variable %s is not set", value, name)
+		}
+		return secret, nil
+	case strings.HasPrefix(value, CredentialRefKeyring):
+		service, account := parseKeyringReference(strings.TrimPrefix(value, CredentialRefKeyring))
+		if account == "" {
+			return "", fmt.Errorf("Credential reference %q does not name a keyring account", value)
+		}
+		secret, err := lookupKeyring(service, account)
+		if err != nil {
+			return "", fmt.Errorf("Cannot resolve credential reference %q: %v", value, err)
+		}
+		return secret, nil
+	}
+	return value, nil
+}
+
+// parseKeyringReference splits a keyring reference such as
+// dart/wasabi into its service and account.
+func parseKeyringReference(ref string) (service, account string) {
+	service, account, found := strings.Cut(ref, "/")
+	if !found {
+		return DefaultKeyringService, ref
+	}
+	return service, account
+}
+
+// describeCredentialSource returns a description of where the
+// value of a credential field comes from, for diagnostics.
+func describeCredentialSource(fieldName, value string) string {
+	switch {
+	case IsEncryptedCredential(value):
+		return fmt.Sprintf("%s decrypted with the master passphrase.", fieldName)
+	case strings.HasPrefix(value, CredentialRefEnv):
+		return fmt.Sprintf("%s read from environment variable %s.", fieldName, strings.TrimPrefix(value, CredentialRefEnv))
+	case strings.HasPrefix(value, CredentialRefKeyring):
+		service, account := parseKeyringReference(strings.TrimPrefix(value, CredentialRefKeyring))
+		return fmt.Sprintf("%s read from account %s of keyring service %s.", fieldName, account, service)
+	}
+	return fmt.Sprintf("%s is stored in the DART database.", fieldName)
+}
+
+// UsesCredentialReferences returns true if the login or password
+// of ss is a credential reference or an encrypted credential.
+func UsesCredentialReferences(ss *core.StorageService) bool {
+	return needsResolving(ss.Login) || needsResolving(ss.Password)
+}
+
+func needsResolving(value string) bool {
+	return IsCredentialReference(value) || IsEncryptedCredential(value)
+}
+
+// ResolveStorageServiceCredentials returns a copy of ss whose Login
+// and Password hold the secrets they refer to. It returns ss itself
+// if neither is a reference. Don't save the copy.
+func ResolveStorageServiceCredentials(ss *core.StorageService) (*core.StorageService, error) {
+	if ss == nil || !UsesCredentialReferences(ss) {
+		return ss, nil
+	}
+	login, err := ResolveCredential(ss.Login)
+	if err != nil {
+		return nil, fmt.Errorf("Login for %s: %v", ss.Name, err)
+	}
+	password, err := ResolveCredential(ss.Password)
+	if err != nil {
+		return nil, fmt.Errorf("Password for %s: %v", ss.Name, err)
+	}
+	resolved := *ss
+	resolved.Login = login
+	resolved.Password = password
+	return &resolved, nil
+}
+
+// ResolveRemoteRepositoryCredentials returns a copy of repo whose
+// UserID and APIToken hold the secrets they refer to. It returns
+// repo itself if neither is a reference. Don't save the copy.
+func ResolveRemoteRepositoryCredentials(repo *core.RemoteRepository) (*core.RemoteRepository, error) {
+	if repo == nil || !(needsResolving(repo.UserID) || needsResolving(repo.APIToken)) {
+		return repo, nil
+	}
+	userID, err := ResolveCredential(repo.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("User ID for %s: %v", repo.Name, err)
+	}
+	apiToken, err := ResolveCredential(repo.APIToken)
+	if err != nil {
+		return nil, fmt.Errorf("API token for %s: %v", repo.Name, err)
+	}
+	resolved := *repo
+	resolved.UserID = userID
+	resolved.APIToken = apiToken
+	return &resolved, nil
+}
+
+// resolveUploadCredentials points each of ops at a copy of its storage
+// service with credential references resolved, so DART Runner can
+// connect. Call the returned function when the run is done to point
+// the ops back at the original services, so that the job is saved
+// with references rather than secrets.
+func resolveUploadCredentials(ops []*core.UploadOperation) (restore func(), err error) {
+	originals := make([]*core.StorageService, len(ops))
+	restore = func() {
+		for i, op := range ops {
+			if originals[i] != nil {
+				op.StorageService = originals[i]
+			}
+		}
+	}
+	for i, op := range ops {
+		resolved, err := ResolveStorageServiceCredentials(op.StorageService)
+		if err != nil {
+			restore()
+			return nil, err
+		}
+		originals[i] = op.StorageService
+		op.StorageService = resolved
+	}
+	return restore, nil
+}
+
+// ExportContainsPlaintextPassword returns true if any storage service
+// in settings has a password that is neither a credential reference
+// nor encrypted. Call StripEncryptedSecrets first, since encrypted
+// passwords can't be used elsewhere either.
+func ExportContainsPlaintextPassword(settings *core.ExportSettings) bool {
+	for _, ss := range settings.StorageServices {
+		if isPlaintextSecret(ss.Password) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExportContainsPlaintextAPIToken returns true if any remote repository
+// in settings has an API token that is neither a credential reference
+// nor encrypted.
+func ExportContainsPlaintextAPIToken(settings *core.ExportSettings) bool {
+	for _, repo := range settings.RemoteRepositories {
+		if isPlaintextSecret(repo.APIToken) {
+			return true
+		}
+	}
+	return false
+}
+
+// EncryptedSecretPlaceholder replaces encrypted passwords and API
+// tokens in exported settings. Only the master passphrase of the DART
+// installation that encrypted them can decrypt them, so they would be
+// useless anywhere else.
+const EncryptedSecretPlaceholder = "RE-ENTER-SECRET-AFTER-IMPORT"
+
+// StripEncryptedSecrets replaces the encrypted passwords and API tokens
+// in settings with EncryptedSecretPlaceholder. It replaces the affected
+// records with copies, so the originals are left alone. It returns the
+// names of the records whose secrets it replaced.
+func StripEncryptedSecrets(settings *core.ExportSettings) []string {
+	names := stripEncryptedPasswords(settings.StorageServices)
+	for i, repo := range settings.RemoteRepositories {
+		if IsEncryptedCredential(repo.APIToken) {
+			stripped := *repo
+			stripped.APIToken = EncryptedSecretPlaceholder
+			settings.RemoteRepositories[i] = &stripped
+			names = append(names, repo.Name)
+		}
+	}
+	return names
+}
+
+// stripEncryptedPasswords is the storage service part of
+// StripEncryptedSecrets.
+func stripEncryptedPasswords(services []*core.StorageService) []string {
+	names := make([]string, 0)
+	for i, ss := range services {
+		if IsEncryptedCredential(ss.Password) {
+			stripped := *ss
+			stripped.Password = EncryptedSecretPlaceholder
+			services[i] = &stripped
+			names = append(names, ss.Name)
+		}
+	}
+	return names
+}
+
+// AddCredentialReferenceHelp explains credential references in the
+// help text of the named form fields.
+func AddCredentialReferenceHelp(form *core.Form, fieldNames ...string) {
+	for _, fieldName := range fieldNames {
+		if field, ok := form.Fields[fieldName]; ok {
+			field.Help = "To keep the secret out of DART's database, enter env:VARIABLE_NAME to read it from an environment variable, or keyring:service/account to read it from your system's keychain or secret store."
+		}
+	}
+}
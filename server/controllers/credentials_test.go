@@ -0,0 +1,151 @@
+package controllers_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart/v3/server/controllers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveCredential(t *testing.T) {
+	t.Setenv("DART_TEST_SECRET", "s3cr3t")
+
+	assert.True(t, controllers.IsCredentialReference("env:DART_TEST_SECRET"))
+	assert.True(t, controllers.IsCredentialReference("keyring:dart/wasabi"))
+	assert.False(t, controllers.IsCredentialReference("plain-password"))
+
+	secret, err := controllers.ResolveCredential("plain-password")
+	require.NoError(t, err)
+	assert.Equal(t, "plain-password", secret)
+
+	secret, err = controllers.ResolveCredential("env:DART_TEST_SECRET")
+	require.NoError(t, err)
+	assert.Equal(t, "s3cr3t", secret)
+
+	_, err = controllers.ResolveCredential("env:DART_TEST_VARIABLE_THAT_IS_NOT_SET")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "DART_TEST_VARIABLE_THAT_IS_NOT_SET is not set")
+
+	_, err = controllers.ResolveCredential("env:")
+	assert.Error(t, err)
+
+	_, err = controllers.ResolveCredential("keyring:dart-test-service/no-such-account")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "keyring:dart-test-service/no-such-account")
+}
+
+func TestResolveStorageServiceCredentials(t *testing.T) {
+	t.Setenv("DART_TEST_LOGIN", "the-login")
+	t.Setenv("DART_TEST_PASSWORD", "the-password")
+	ss := core.NewStorageService()
+	ss.Name = "Referenced"
+	ss.Login = "env:DART_TEST_LOGIN"
+	ss.Password = "env:DART_TEST_PASSWORD"
+
+	resolved, err := controllers.ResolveStorageServiceCredentials(ss)
+	require.NoError(t, err)
+	assert.Equal(t, "the-login", resolved.Login)
+	assert.Equal(t, "the-password", resolved.Password)
+	// The original keeps its references.
+	assert.Equal(t, "env:DART_TEST_LOGIN", ss.Login)
+	assert.Equal(t, "env:DART_TEST_PASSWORD", ss.Password)
+
+	ss.Password = "env:DART_TEST_VARIABLE_THAT_IS_NOT_SET"
+	_, err = controllers.ResolveStorageServiceCredentials(ss)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Password for Referenced")
+
+	repo := core.NewRemoteRepository()
+	repo.UserID = "user@example.com"
+	repo.APIToken = "env:DART_TEST_PASSWORD"
+	resolvedRepo, err := controllers.ResolveRemoteRepositoryCredentials(repo)
+	require.NoError(t, err)
+	assert.Equal(t, "the-password", resolvedRepo.APIToken)
+	assert.Equal(t, "env:DART_TEST_PASSWORD", repo.APIToken)
+}
+
+func TestExportContainsPlaintextSecrets(t *testing.T) {
+	ss := core.NewStorageService()
+	ss.Password = "env:DART_TEST_PASSWORD"
+	repo := core.NewRemoteRepository()
+	repo.APIToken = "keyring:dart/registry"
+	settings := &core.ExportSettings{
+		StorageServices:    []*core.StorageService{ss},
+		RemoteRepositories: []*core.RemoteRepository{repo},
+	}
+	assert.False(t, controllers.ExportContainsPlaintextPassword(settings))
+	assert.False(t, controllers.ExportContainsPlaintextAPIToken(settings))
+
+	ss.Password = "plain-password"
+	repo.APIToken = "plain-token"
+	assert.True(t, controllers.ExportContainsPlaintextPassword(settings))
+	assert.True(t, controllers.ExportContainsPlaintextAPIToken(settings))
+}
+
+func TestStripEncryptedSecrets(t *testing.T) {
+	encrypted := core.NewStorageService()
+	encrypted.Name = "Encrypted"
+	encrypted.Password = controllers.EncryptedCredentialPrefix + "bm90IHJlYWxseSBlbmNyeXB0ZWQ="
+	reference := core.NewStorageService()
+	reference.Name = "Reference"
+	reference.Password = "env:DART_TEST_PASSWORD"
+	repo := core.NewRemoteRepository()
+	repo.Name = "Registry"
+	repo.APIToken = controllers.EncryptedCredentialPrefix + "dG9rZW4="
+	settings := &core.ExportSettings{
+		StorageServices:    []*core.StorageService{encrypted, reference},
+		RemoteRepositories: []*core.RemoteRepository{repo},
+	}
+
+	stripped := controllers.StripEncryptedSecrets(settings)
+	assert.Equal(t, []string{"Encrypted", "Registry"}, stripped)
+	assert.Equal(t, controllers.EncryptedSecretPlaceholder, settings.StorageServices[0].Password)
+	assert.Equal(t, "env:DART_TEST_PASSWORD", settings.StorageServices[1].Password)
+	assert.Equal(t, controllers.EncryptedSecretPlaceholder, settings.RemoteRepositories[0].APIToken)
+
+	// The original records keep their encrypted secrets.
+	assert.True(t, controllers.IsEncryptedCredential(encrypted.Password))
+	assert.True(t, controllers.IsEncryptedCredential(repo.APIToken))
+}
+
+func TestDiagnoseConnectionUnresolvedCredential(t *testing.T) {
+	ss := core.NewStorageService()
+	ss.Name = "Unresolved"
+	ss.Protocol = "s3"
+	ss.Host = "localhost"
+	ss.Port = 9899
+	ss.Login = "env:DART_TEST_VARIABLE_THAT_IS_NOT_SET"
+	ss.Password = "secret"
+
+	diagnosis := controllers.DiagnoseConnection(ss)
+	failedStep := diagnosis.FailedStep()
+	require.NotNil(t, failedStep)
+	assert.Equal(t, controllers.StepCredentials, failedStep.Name)
+	assert.Contains(t, failedStep.Error, "DART_TEST_VARIABLE_THAT_IS_NOT_SET is not set")
+	for _, step := range diagnosis.Steps[1:] {
+		assert.True(t, step.Skipped, step.Name)
+	}
+}
+
+func TestWebDAVWithCredentialReference(t *testing.T) {
+	defer core.ClearDartTable()
+	ss, rootDir := startWebDAVServer(t)
+	t.Setenv("DART_TEST_WEBDAV_PASSWORD", ss.Password)
+	ss.Password = "env:DART_TEST_WEBDAV_PASSWORD"
+
+	diagnosis := controllers.DiagnoseConnection(ss)
+	require.True(t, diagnosis.Succeeded(), diagnosis.Summary())
+	assert.Equal(t, controllers.StepCredentials, diagnosis.Steps[0].Name)
+	assert.Contains(t, diagnosis.Steps[0].Details, "Password read from environment variable DART_TEST_WEBDAV_PASSWORD.")
+
+	sourceFile := filepath.Join(t.TempDir(), "bag.tar")
+	require.NoError(t, os.WriteFile(sourceFile, []byte("tarred bag"), 0644))
+	_, err := controllers.UploadToWebDAV(ss, sourceFile)
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(rootDir, "deposits", "bag.tar"))
+	assert.Equal(t, "env:DART_TEST_WEBDAV_PASSWORD", ss.Password)
+}
@@ -38,11 +38,17 @@ func DashboardShow(c *gin.Context) {
 		reportListJson, err = json.Marshal(reports)
 	}
 
+	finishedRestores, restoresErr := UnseenGlacierRestores()
+	if restoresErr != nil {
+		core.Dart.Log.Errorf("Cannot load Glacier restores: %v", restoresErr)
+	}
+
 	data := gin.H{
-		"jobs":           result.Jobs,
-		"reportListJson": string(reportListJson),
-		"reportsErr":     err,
-		"helpUrl":        GetHelpUrl(c),
+		"jobs":             result.Jobs,
+		"reportListJson":   string(reportListJson),
+		"reportsErr":       err,
+		"finishedRestores": finishedRestores,
+		"helpUrl":          GetHelpUrl(c),
 	}
 
 	c.HTML(http.StatusOK, "dashboard/show.html", data)
@@ -117,6 +123,10 @@ func getRepoReport(remoteRepoID, reportName string) (string, error) {
 		message := "User name or API key is missing from remote repository configuration."
 		return message, fmt.Errorf("User name or API key is missing from remote repository configuration.")
 	}
+	repo, err := ResolveRemoteRepositoryCredentials(repo)
+	if err != nil {
+		return err.Error(), err
+	}
 	client, err := core.GetRemoteRepoClient(repo)
 	if err != nil {
 		return "", err
@@ -0,0 +1,555 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart-runner/util"
+	"github.com/minio/minio-go/v7"
+)
+
+// DART Runner uploads each of an upload job's paths as a single
+// object named after the path, which doesn't work for directories.
+// When an upload job includes a directory, or has a key prefix, DART
+// runs all of its uploads itself. It walks each directory, uploads
+// every file under a key that mirrors the file's path relative to
+// the directory, and reports progress after each file.
+
+// UploadItem is one file, or one empty directory, that an upload
+// job copies to each of its storage services.
+type UploadItem struct {
+	LocalPath string
+	Key       string
+	Size      int64
+	IsDir     bool
+}
+
+// UploadJobPlan lists everything an upload job will upload, along
+// with the items it leaves out and why.
+type UploadJobPlan struct {
+	Items      []*UploadItem
+	Skipped    []string
+	TotalBytes int64
+	s3Options  map[*core.UploadOperation]minio.PutObjectOptions
+}
+
+// FileCount returns the number of files in the plan.
+func (plan *UploadJobPlan) FileCount() int {
+	count := 0
+	for _, item := range plan.Items {
+		if !item.IsDir {
+			count++
+		}
+	}
+	return count
+}
+
+// DirCount returns the number of empty directories in the plan.
+func (plan *UploadJobPlan) DirCount() int {
+	return len(plan.Items) - plan.FileCount()
+}
+
+// uploadPlanner walks the paths of an upload job to build a plan.
+type uploadPlanner struct {
+	opts     *UploadJobOptions
+	plan     *UploadJobPlan
+	keys     map[string]string
+	visiting map[string]bool
+}
+
+// PlanUploadItems lists the files and empty directories under paths
+// and the key of each, relative to the bucket. The key of a file is
+// prefix, then the name of the path it's under, then its path
+// relative to that. opts decides what happens to symbolic links and
+// empty directories inside the paths. The paths themselves are always
+// followed if they're links, since the user chose them.
+//
+// It returns an error if a file would get an illegal key, if two
+// files would get the same key, if a link points back into a
+// directory that contains it, or if opts says to fail on links
+// and there are any.
+func PlanUploadItems(paths []string, opts *UploadJobOptions, prefix string) (*UploadJobPlan, error) {
+	planner := &uploadPlanner{
+		opts: opts,
+		plan: &UploadJobPlan{
+			Items:   make([]*UploadItem, 0),
+			Skipped: make([]string, 0),
+		},
+		keys:     make(map[string]string),
+		visiting: make(map[string]bool),
+	}
+	for _, localPath := range paths {
+		key := filepath.Base(localPath)
+		if prefix != "" {
+			key = prefix + "/" + key
+		}
+		if err := planner.add(localPath, key, true); err != nil {
+			return nil, err
+		}
+	}
+	return planner.plan, nil
+}
+
+func (planner *uploadPlanner) add(localPath, key string, chosenByUser bool) error {
+	info, err := os.Lstat(localPath)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		if !chosenByUser {
+			switch planner.opts.SymlinkPolicy {
+			case SymlinkFollow:
+			case SymlinkFail:
+				return fmt.Errorf("%s is a symbolic link. Skip or follow links to upload this directory.", localPath)
+			default:
+				planner.skip(localPath, "symbolic link")
+				return nil
+			}
+		}
+		if info, err = os.Stat(localPath); err != nil {
+			return fmt.Errorf("Symbolic link %s is broken: %v", localPath, err)
+		}
+	}
+	switch {
+	case info.IsDir():
+		return planner.addDir(localPath, key)
+	case info.Mode().IsRegular():
+		return planner.addItem(&UploadItem{LocalPath: localPath, Key: key, Size: info.Size()})
+	}
+	planner.skip(localPath, "not a regular file")
+	return nil
+}
+
+func (planner *uploadPlanner) addDir(localPath, key string) error {
+	realPath, err := filepath.EvalSymlinks(localPath)
+	if err != nil {
+		return err
+	}
+	if planner.visiting[realPath] {
+		return fmt.Errorf("%s links back to %s, which contains it.", localPath, realPath)
+	}
+	planner.visiting[realPath] = true
+	defer delete(planner.visiting, realPath)
+
+	entries, err := os.ReadDir(localPath)
+	if err != nil {
+		return err
+	}
+	itemCount := len(planner.plan.Items)
+	for _, entry := range entries {
+		if err := planner.add(filepath.Join(localPath, entry.Name()), key+"/"+entry.Name(), false); err != nil {
+			return err
+		}
+	}
+	if len(planner.plan.Items) > itemCount {
+		return nil
+	}
+	if planner.opts.EmptyDirPolicy == EmptyDirCreate {
+		return planner.addItem(&UploadItem{LocalPath: localPath, Key: key, IsDir: true})
+	}
+	planner.skip(localPath, "empty directory")
+	return nil
+}
+
+func (planner *uploadPlanner) addItem(item *UploadItem) error {
+	if err := ValidateObjectKey(item.Key); err != nil {
+		return fmt.Errorf("Cannot upload %s: %v", item.LocalPath, err)
+	}
+	if other, ok := planner.keys[item.Key]; ok {
+		return fmt.Errorf("%s and %s would both be uploaded as %s.", other, item.LocalPath, item.Key)
+	}
+	planner.keys[item.Key] = item.LocalPath
+	planner.plan.Items = append(planner.plan.Items, item)
+	planner.plan.TotalBytes += item.Size
+	return nil
+}
+
+func (planner *uploadPlanner) skip(localPath, reason string) {
+	planner.plan.Skipped = append(planner.plan.Skipped, fmt.Sprintf("%s (%s)", localPath, reason))
+}
+
+// uploadJobKeyLookup returns a function that looks up placeholders in
+// upload job key prefixes and S3 upload options. Upload jobs have no
+// bag or tags, so only the date placeholders have values.
+func uploadJobKeyLookup(now time.Time) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		switch name {
+		case KeyVarYear:
+			return now.Format("2006"), true
+		case KeyVarMonth:
+			return now.Format("01"), true
+		case KeyVarDay:
+			return now.Format("02"), true
+		}
+		return "", false
+	}
+}
+
+// planUploadJob builds the plan for uploadJob, expanding the key
+// prefix in opts and the S3 upload options of each S3 service.
+func planUploadJob(uploadJob *core.UploadJob, opts *UploadJobOptions, now time.Time) (*UploadJobPlan, error) {
+	lookup := uploadJobKeyLookup(now)
+	prefix, err := opts.ExpandKeyPrefix(lookup)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := PlanUploadItems(uploadJob.PathsToUpload, opts, prefix)
+	if err != nil {
+		return nil, err
+	}
+	plan.s3Options = make(map[*core.UploadOperation]minio.PutObjectOptions)
+	for _, op := range uploadJob.UploadOps {
+		if op.StorageService == nil || op.StorageService.Protocol != constants.ProtocolS3 {
+			continue
+		}
+		putOpts, err := GetStorageServiceOptions(op.StorageService).S3.PutObjectOptions(lookup)
+		if err != nil {
+			return nil, fmt.Errorf("Upload options for %s: %v", op.StorageService.Name, err)
+		}
+		plan.s3Options[op] = putOpts
+	}
+	return plan, nil
+}
+
+// UploadJobHasDirectories returns true if any of
+// uploadJob's paths is a directory.
+func UploadJobHasDirectories(uploadJob *core.UploadJob) bool {
+	for _, localPath := range uploadJob.PathsToUpload {
+		if stat, err := os.Stat(localPath); err == nil && stat.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// uploadJobRunsInDART returns true if DART must run all of
+// uploadJob's uploads because DART Runner can't.
+func uploadJobRunsInDART(uploadJob *core.UploadJob, opts *UploadJobOptions) bool {
+	if opts.KeyPrefix != "" || UploadJobHasDirectories(uploadJob) {
+		return true
+	}
+	for _, op := range uploadJob.UploadOps {
+		if needsDARTUploader(op.StorageService, "") {
+			return true
+		}
+	}
+	return false
+}
+
+// validateDirectoryUploadJob validates an upload job that DART runs
+// itself, setting uploadJob.Errors. Problems with the plan, such as
+// illegal or duplicate keys, go under PathsToUpload.
+func validateDirectoryUploadJob(uploadJob *core.UploadJob, opts *UploadJobOptions) bool {
+	uploadJob.Errors = make(map[string]string)
+	if len(uploadJob.PathsToUpload) == 0 {
+		uploadJob.Errors["PathsToUpload"] = "Please choose at least one file or directory to upload."
+	}
+	if len(uploadJob.UploadOps) == 0 {
+		uploadJob.Errors["StorageServiceIDs"] = "Please choose at least one storage service."
+	}
+	for _, op := range uploadJob.UploadOps {
+		ss := op.StorageService
+		if ss == nil {
+			continue
+		}
+		if !ValidateStorageService(ss) {
+			for field, message := range ss.Errors {
+				uploadJob.Errors[ss.Name+"."+field] = message
+			}
+		}
+	}
+	for _, localPath := range uploadJob.PathsToUpload {
+		if !util.FileExists(localPath) {
+			uploadJob.Errors[localPath] = fmt.Sprintf("File to upload does not exist: %s", localPath)
+		}
+	}
+	for field, message := range opts.Validate() {
+		uploadJob.Errors[field] = message
+	}
+	if len(uploadJob.Errors) == 0 {
+		if _, err := planUploadJob(uploadJob, opts, time.Now()); err != nil {
+			uploadJob.Errors["PathsToUpload"] = err.Error()
+		}
+	}
+	return len(uploadJob.Errors) == 0
+}
+
+// runDirectoryUploadJob uploads everything in uploadJob's plan to
+// each of its storage services, reporting progress through
+// messageChannel after each file. Each file is verified against its
+// local copy: S3 and SFTP uploads after the upload, filesystem and
+// WebDAV uploads as they're copied. It saves a verification report
+// and returns ExitOK if all uploads succeeded.
+func runDirectoryUploadJob(uploadJob *core.UploadJob, opts *UploadJobOptions, messageChannel chan *core.EventMessage) int {
+	plan, err := planUploadJob(uploadJob, opts, time.Now())
+	if err != nil {
+		messageChannel <- core.WarningEvent(constants.StageUpload, fmt.Sprintf("Job cannot start: %v", err))
+		return constants.ExitRuntimeErr
+	}
+	for _, skipped := range plan.Skipped {
+		messageChannel <- core.InfoEvent(constants.StageUpload, fmt.Sprintf("Skipping %s", skipped))
+	}
+	verifications := make([]*UploadVerification, 0)
+	exitCode := constants.ExitOK
+	for _, op := range uploadJob.UploadOps {
+		opVerifications, opExitCode := uploadPlanItems(op, plan, messageChannel)
+		verifications = append(verifications, opVerifications...)
+		if opExitCode != constants.ExitOK {
+			exitCode = opExitCode
+		}
+	}
+	if len(verifications) > 0 {
+		saveUploadVerificationReport(uploadJobName(uploadJob), uploadJob.ID, verifications)
+	}
+	return exitCode
+}
+
+// uploadPlanItems uploads the items in plan to op's storage
+// service, recording the outcome in op.Result.
+func uploadPlanItems(op *core.UploadOperation, plan *UploadJobPlan, messageChannel chan *core.EventMessage) ([]*UploadVerification, int) {
+	ss := op.StorageService
+	target, provider, err := openUploadTarget(ss, plan.s3Options[op])
+	op.Result = core.NewOperationResult("upload", provider)
+	op.Result.Start()
+	if err != nil {
+		op.Result.Finish(map[string]string{ss.Name: err.Error()})
+		messageChannel <- core.WarningEvent(constants.StageUpload, fmt.Sprintf("Cannot upload to %s: %v", ss.Name, err))
+		return nil, constants.ExitRuntimeErr
+	}
+	defer target.Close()
+
+	fileCount := plan.FileCount()
+	messageChannel <- core.StartEvent(constants.StageUpload, fmt.Sprintf("Uploading %d files (%d bytes) to %s", fileCount, plan.TotalBytes, ss.Name))
+	verifications := make([]*UploadVerification, 0)
+	errors := make(map[string]string)
+	filesDone := 0
+	var bytesDone int64
+	for _, item := range plan.Items {
+		if item.IsDir {
+			if _, err := target.MakeDir(item.Key); err != nil {
+				errors[item.LocalPath] = err.Error()
+				messageChannel <- core.WarningEvent(constants.StageUpload, fmt.Sprintf("Cannot create directory %s on %s: %v", item.Key, ss.Name, err))
+			}
+			continue
+		}
+		remotePath, err := target.PutFile(item.LocalPath, item.Key)
+		filesDone++
+		bytesDone += item.Size
+		if err == nil {
+			if v := target.Verify(item.LocalPath, item.Key); v != nil {
+				verifications = append(verifications, v)
+				if !v.OK() {
+					err = fmt.Errorf("Upload verification failed: %s", v.Error)
+				}
+			}
+		}
+		if err != nil {
+			errors[item.LocalPath] = err.Error()
+			messageChannel <- core.WarningEvent(constants.StageUpload, fmt.Sprintf("Upload of %s to %s failed: %v", item.LocalPath, ss.Name, err))
+			continue
+		}
+		op.Result.RemoteTargetName = remotePath
+		progress := core.InfoEvent(constants.StageUpload, fmt.Sprintf("Uploaded %d of %d files to %s: %s", filesDone, fileCount, ss.Name, item.Key))
+		progress.Total = plan.TotalBytes
+		progress.Current = bytesDone
+		progress.Percent = uploadPercent(bytesDone, plan.TotalBytes, filesDone, fileCount)
+		messageChannel <- progress
+	}
+	op.Result.Info = fmt.Sprintf("Uploaded %d files and %d empty directories to %s.", fileCount-countFileErrors(plan, errors), plan.DirCount(), ss.Name)
+	op.Result.Finish(errors)
+	if len(errors) > 0 {
+		return verifications, constants.ExitRuntimeErr
+	}
+	return verifications, constants.ExitOK
+}
+
+// uploadPercent returns the percentage of an upload that's done, by
+// bytes, or by files if all the files are empty.
+func uploadPercent(bytesDone, totalBytes int64, filesDone, totalFiles int) int {
+	if totalBytes > 0 {
+		return int(bytesDone * 100 / totalBytes)
+	}
+	if totalFiles > 0 {
+		return filesDone * 100 / totalFiles
+	}
+	return 100
+}
+
+func countFileErrors(plan *UploadJobPlan, errors map[string]string) int {
+	count := 0
+	for _, item := range plan.Items {
+		if _, failed := errors[item.LocalPath]; failed && !item.IsDir {
+			count++
+		}
+	}
+	return count
+}
+
+// uploadTarget uploads the items of an upload job plan to one
+// storage service over a single connection.
+type uploadTarget interface {
+	// PutFile uploads the file at localPath under key and
+	// returns the remote path of the copy.
+	PutFile(localPath, key string) (string, error)
+	// MakeDir creates an empty directory at key.
+	MakeDir(key string) (string, error)
+	// Verify checks an uploaded file against its local copy. It
+	// returns nil if PutFile already verified the file.
+	Verify(localPath, key string) *UploadVerification
+	Close()
+}
+
+// openUploadTarget connects to ss and returns an uploadTarget for it,
+// along with the provider name for the operation's result. putOpts
+// applies only to S3 services.
+func openUploadTarget(ss *core.StorageService, putOpts minio.PutObjectOptions) (uploadTarget, string, error) {
+	switch ss.Protocol {
+	case constants.ProtocolS3:
+		client, err := NewMinioClient(ss)
+		return &s3UploadTarget{ss: ss, client: client, putOpts: putOpts}, S3UploadProvider, err
+	case constants.ProtocolSFTP:
+		conn, err := NewSFTPConnection(ss)
+		return &sftpUploadTarget{ss: ss, conn: conn}, SFTPUploadProvider, err
+	case ProtocolWebDAV:
+		client, err := NewWebDAVClient(ss)
+		return &webDAVUploadTarget{ss: ss, client: client}, WebDAVUploadProvider, err
+	case ProtocolFilesystem:
+		return &filesystemUploadTarget{ss: ss}, FilesystemUploadProvider, nil
+	}
+	return nil, "", fmt.Errorf("DART cannot upload to %s using protocol %s", ss.Name, ss.Protocol)
+}
+
+// newItemVerification returns a verification for localPath with its
+// local size filled in, or with an error if we can't stat the file.
+func newItemVerification(ss *core.StorageService, localPath string) *UploadVerification {
+	v := &UploadVerification{
+		StorageServiceName: ss.Name,
+		LocalPath:          localPath,
+	}
+	stat, err := os.Stat(localPath)
+	if err != nil {
+		v.Error = err.Error()
+		return v
+	}
+	v.LocalSize = stat.Size()
+	return v
+}
+
+type s3UploadTarget struct {
+	ss      *core.StorageService
+	client  *minio.Client
+	putOpts minio.PutObjectOptions
+}
+
+func (target *s3UploadTarget) PutFile(localPath, key string) (string, error) {
+	_, err := target.client.FPutObject(context.Background(), target.ss.Bucket, key, localPath, target.putOpts)
+	return key, err
+}
+
+// MakeDir creates a folder marker: an empty object whose key ends
+// with a slash.
+func (target *s3UploadTarget) MakeDir(key string) (string, error) {
+	_, err := target.client.PutObject(context.Background(), target.ss.Bucket, key+"/", bytes.NewReader(nil), 0, target.putOpts)
+	return key + "/", err
+}
+
+func (target *s3UploadTarget) Verify(localPath, key string) *UploadVerification {
+	v := newItemVerification(target.ss, localPath)
+	if v.OK() {
+		verifyS3Object(v, target.client, target.ss.Bucket, key)
+	}
+	return v
+}
+
+func (target *s3UploadTarget) Close() {}
+
+type sftpUploadTarget struct {
+	ss   *core.StorageService
+	conn *SFTPConnection
+}
+
+func (target *sftpUploadTarget) PutFile(localPath, key string) (string, error) {
+	remotePath, err := SFTPRemotePath(target.ss.Bucket, key)
+	if err != nil {
+		return "", err
+	}
+	return remotePath, uploadFileToSFTP(target.conn, localPath, remotePath)
+}
+
+func (target *sftpUploadTarget) MakeDir(key string) (string, error) {
+	remotePath, err := SFTPRemotePath(target.ss.Bucket, key)
+	if err != nil {
+		return "", err
+	}
+	return remotePath, target.conn.MkdirAll(remotePath)
+}
+
+func (target *sftpUploadTarget) Verify(localPath, key string) *UploadVerification {
+	v := newItemVerification(target.ss, localPath)
+	if !v.OK() {
+		return v
+	}
+	remotePath, err := SFTPRemotePath(target.ss.Bucket, key)
+	if err != nil {
+		v.Error = err.Error()
+		return v
+	}
+	verifySFTPFile(v, target.conn, remotePath)
+	return v
+}
+
+func (target *sftpUploadTarget) Close() {
+	target.conn.Close()
+}
+
+type webDAVUploadTarget struct {
+	ss     *core.StorageService
+	client *WebDAVClient
+}
+
+func (target *webDAVUploadTarget) PutFile(localPath, key string) (string, error) {
+	return uploadToWebDAVKey(target.client, target.ss.Bucket, localPath, key)
+}
+
+func (target *webDAVUploadTarget) MakeDir(key string) (string, error) {
+	remotePath, err := WebDAVRemotePath(target.ss.Bucket, key)
+	if err != nil {
+		return "", err
+	}
+	return remotePath, target.client.MkdirAll(remotePath)
+}
+
+func (target *webDAVUploadTarget) Verify(localPath, key string) *UploadVerification {
+	return nil
+}
+
+func (target *webDAVUploadTarget) Close() {}
+
+type filesystemUploadTarget struct {
+	ss *core.StorageService
+}
+
+func (target *filesystemUploadTarget) PutFile(localPath, key string) (string, error) {
+	return CopyToFilesystemAs(target.ss, localPath, key)
+}
+
+func (target *filesystemUploadTarget) MakeDir(key string) (string, error) {
+	if err := checkKeySegments(key); err != nil {
+		return "", err
+	}
+	targetPath := filepath.Join(target.ss.Bucket, filepath.FromSlash(key))
+	return targetPath, os.MkdirAll(targetPath, 0755)
+}
+
+func (target *filesystemUploadTarget) Verify(localPath, key string) *UploadVerification {
+	return nil
+}
+
+func (target *filesystemUploadTarget) Close() {}
@@ -0,0 +1,265 @@
+package controllers_test
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart/v3/server/controllers"
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// makeUploadDir creates a directory to upload with this layout:
+//
+//	photos/a.txt
+//	photos/sub/b.txt
+//	photos/empty/
+//	photos/link.txt -> a.txt
+func makeUploadDir(t *testing.T) string {
+	dir := filepath.Join(t.TempDir(), "photos")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "empty"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("File A"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "b.txt"), []byte("File B, longer"), 0644))
+	require.NoError(t, os.Symlink("a.txt", filepath.Join(dir, "link.txt")))
+	return dir
+}
+
+func uploadItemKeys(plan *controllers.UploadJobPlan) []string {
+	keys := make([]string, len(plan.Items))
+	for i, item := range plan.Items {
+		keys[i] = item.Key
+	}
+	return keys
+}
+
+func TestPlanUploadItems(t *testing.T) {
+	dir := makeUploadDir(t)
+	opts := &controllers.UploadJobOptions{
+		SymlinkPolicy:  controllers.SymlinkSkip,
+		EmptyDirPolicy: controllers.EmptyDirSkip,
+	}
+	plan, err := controllers.PlanUploadItems([]string{dir}, opts, "transfers/2026")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"transfers/2026/photos/a.txt", "transfers/2026/photos/sub/b.txt"}, uploadItemKeys(plan))
+	assert.Equal(t, 2, plan.FileCount())
+	assert.Equal(t, 0, plan.DirCount())
+	assert.EqualValues(t, 20, plan.TotalBytes)
+	assert.Equal(t, 2, len(plan.Skipped))
+
+	opts.SymlinkPolicy = controllers.SymlinkFollow
+	opts.EmptyDirPolicy = controllers.EmptyDirCreate
+	plan, err = controllers.PlanUploadItems([]string{dir}, opts, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"photos/a.txt", "photos/empty", "photos/link.txt", "photos/sub/b.txt"}, uploadItemKeys(plan))
+	assert.Equal(t, 3, plan.FileCount())
+	assert.Equal(t, 1, plan.DirCount())
+	assert.Empty(t, plan.Skipped)
+
+	opts.SymlinkPolicy = controllers.SymlinkFail
+	_, err = controllers.PlanUploadItems([]string{dir}, opts, "")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "link.txt is a symbolic link")
+
+	// A link back to a parent directory would never end.
+	require.NoError(t, os.Remove(filepath.Join(dir, "link.txt")))
+	require.NoError(t, os.Symlink("..", filepath.Join(dir, "sub", "loop")))
+	opts.SymlinkPolicy = controllers.SymlinkFollow
+	_, err = controllers.PlanUploadItems([]string{dir}, opts, "")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "links back to")
+
+	// Two paths with the same name would overwrite each other.
+	require.NoError(t, os.Remove(filepath.Join(dir, "sub", "loop")))
+	otherFile := filepath.Join(t.TempDir(), "a.txt")
+	require.NoError(t, os.WriteFile(otherFile, []byte("Other A"), 0644))
+	_, err = controllers.PlanUploadItems([]string{filepath.Join(dir, "a.txt"), otherFile}, opts, "")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "would both be uploaded as a.txt")
+
+	// Names must make legal keys.
+	badFile := filepath.Join(dir, "what?.txt")
+	require.NoError(t, os.WriteFile(badFile, []byte("?"), 0644))
+	_, err = controllers.PlanUploadItems([]string{dir}, opts, "")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "illegal character")
+}
+
+func TestUploadJobOptionsValidate(t *testing.T) {
+	opts := &controllers.UploadJobOptions{
+		KeyPrefix:      "transfers/{yyyy}/",
+		SymlinkPolicy:  controllers.SymlinkSkip,
+		EmptyDirPolicy: controllers.EmptyDirCreate,
+	}
+	assert.Empty(t, opts.Validate())
+
+	opts.KeyPrefix = "transfers/{Source-Organization}"
+	opts.SymlinkPolicy = "ignore"
+	opts.EmptyDirPolicy = ""
+	errors := opts.Validate()
+	assert.Contains(t, errors["KeyPrefix"], "{Source-Organization}")
+	assert.Equal(t, `Unknown symlink policy "ignore".`, errors["SymlinkPolicy"])
+	assert.Equal(t, `Unknown empty directory policy "".`, errors["EmptyDirPolicy"])
+}
+
+// runTestUploadJob runs an upload job that uploads dir to ss,
+// and returns the job's exit code and the messages it sent.
+func runTestUploadJob(t *testing.T, dir string, ss *core.StorageService, opts *controllers.UploadJobOptions) (*core.UploadJob, int, []*core.EventMessage) {
+	uploadJob := core.NewUploadJob()
+	uploadJob.PathsToUpload = []string{dir}
+	uploadJob.StorageServiceIDs = []string{ss.ID}
+	uploadJob.UploadOps = []*core.UploadOperation{core.NewUploadOperation(ss, uploadJob.PathsToUpload)}
+	opts.UploadJobID = uploadJob.ID
+	require.NoError(t, controllers.SaveUploadJobOptions(opts))
+	require.True(t, controllers.ValidateUploadJob(uploadJob), uploadJob.Errors)
+
+	messageChannel := make(chan *core.EventMessage)
+	messages := make([]*core.EventMessage, 0)
+	done := make(chan bool)
+	go func() {
+		for msg := range messageChannel {
+			messages = append(messages, msg)
+		}
+		done <- true
+	}()
+	exitCode := controllers.RunUploadJobWithExtendedUploads(uploadJob, messageChannel)
+	close(messageChannel)
+	<-done
+	return uploadJob, exitCode, messages
+}
+
+func TestRunUploadJobWithDirectoryToFilesystem(t *testing.T) {
+	defer core.ClearDartTable()
+	dir := makeUploadDir(t)
+	ss := getFilesystemService(t)
+	opts := &controllers.UploadJobOptions{
+		KeyPrefix:      "transfers",
+		SymlinkPolicy:  controllers.SymlinkSkip,
+		EmptyDirPolicy: controllers.EmptyDirCreate,
+	}
+	uploadJob, exitCode, messages := runTestUploadJob(t, dir, ss, opts)
+	require.Equal(t, constants.ExitOK, exitCode)
+	require.NotNil(t, uploadJob.UploadOps[0].Result)
+	assert.Empty(t, uploadJob.UploadOps[0].Result.Errors)
+	assert.Equal(t, controllers.FilesystemUploadProvider, uploadJob.UploadOps[0].Result.Provider)
+
+	targetDir := filepath.Join(ss.Bucket, "transfers", "photos")
+	data, err := os.ReadFile(filepath.Join(targetDir, "sub", "b.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "File B, longer", string(data))
+	assert.DirExists(t, filepath.Join(targetDir, "empty"))
+	assert.NoFileExists(t, filepath.Join(targetDir, "link.txt"))
+
+	// We should get a progress message for each file,
+	// and the last should say we're done.
+	progress := make([]*core.EventMessage, 0)
+	for _, msg := range messages {
+		if msg.Total > 0 {
+			progress = append(progress, msg)
+		}
+	}
+	require.Equal(t, 2, len(progress))
+	assert.EqualValues(t, 20, progress[1].Total)
+	assert.EqualValues(t, 20, progress[1].Current)
+	assert.Equal(t, 100, progress[1].Percent)
+}
+
+// NOTE: This test assumes that the local SFTP server is running.
+// See the note on TestUploadJobNew.
+func TestRunUploadJobWithDirectoryToSFTP(t *testing.T) {
+	defer core.ClearDartTable()
+	dir := makeUploadDir(t)
+	ss := loadSFTPStorageService(t)
+	opts := &controllers.UploadJobOptions{
+		SymlinkPolicy:  controllers.SymlinkFollow,
+		EmptyDirPolicy: controllers.EmptyDirSkip,
+	}
+	uploadJob, exitCode, _ := runTestUploadJob(t, dir, ss, opts)
+	require.Equal(t, constants.ExitOK, exitCode, uploadJob.UploadOps[0].Result.Errors)
+
+	conn, err := controllers.NewSFTPConnection(ss)
+	require.NoError(t, err)
+	defer conn.Close()
+	remoteDir := path.Join(ss.Bucket, "photos")
+	defer conn.RemoveAll(remoteDir)
+	for _, key := range []string{"a.txt", "link.txt", "sub/b.txt"} {
+		_, err := conn.Stat(path.Join(remoteDir, key))
+		assert.NoError(t, err, key)
+	}
+	_, err = conn.Stat(path.Join(remoteDir, "empty"))
+	assert.Error(t, err, "empty directories should be skipped")
+}
+
+// NOTE: This test assumes that the local Minio server is running.
+// DART Runner ignores storage service options, so a single file
+// going to a service with non-default options should go through
+// DART's own S3 uploader.
+func TestRunUploadJobWithStorageServiceOptions(t *testing.T) {
+	defer core.ClearDartTable()
+	ss := loadMinioStorageService(t)
+	ssOpts := controllers.DefaultStorageServiceOptions(ss)
+	ssOpts.BucketLookup = controllers.BucketLookupPath
+	require.NoError(t, controllers.SaveStorageServiceOptions(ssOpts))
+	defer controllers.DeleteStorageServiceOptions(ss.ID)
+
+	file := filepath.Join(t.TempDir(), "options-test.txt")
+	require.NoError(t, os.WriteFile(file, []byte("Uploaded with path-style addressing"), 0644))
+	opts := &controllers.UploadJobOptions{
+		SymlinkPolicy:  controllers.SymlinkSkip,
+		EmptyDirPolicy: controllers.EmptyDirSkip,
+	}
+	uploadJob, exitCode, _ := runTestUploadJob(t, file, ss, opts)
+	require.Equal(t, constants.ExitOK, exitCode, uploadJob.UploadOps[0].Result.Errors)
+	assert.Equal(t, controllers.S3UploadProvider, uploadJob.UploadOps[0].Result.Provider)
+
+	client, err := controllers.NewMinioClient(ss)
+	require.NoError(t, err)
+	ctx := context.Background()
+	defer client.RemoveObject(ctx, ss.Bucket, "options-test.txt", minio.RemoveObjectOptions{})
+	objInfo, err := client.StatObject(ctx, ss.Bucket, "options-test.txt", minio.StatObjectOptions{})
+	require.NoError(t, err)
+	assert.EqualValues(t, 35, objInfo.Size)
+}
+
+// NOTE: This test assumes that the local Minio server is running.
+// DART Runner would drop the service's tags and metadata, so a
+// single file going to it should go through DART's S3 uploader
+// with those settings.
+func TestRunUploadJobWithS3UploadOptions(t *testing.T) {
+	defer core.ClearDartTable()
+	ss := loadMinioStorageService(t)
+	ssOpts := controllers.GetStorageServiceOptions(ss)
+	ssOpts.S3 = controllers.S3UploadOptions{
+		Tags:     "Project=Upload Options",
+		Metadata: "Collection=coll-7",
+	}
+	require.NoError(t, controllers.SaveStorageServiceOptions(ssOpts))
+	defer controllers.DeleteStorageServiceOptions(ss.ID)
+
+	file := filepath.Join(t.TempDir(), "s3-options-test.txt")
+	require.NoError(t, os.WriteFile(file, []byte("Uploaded with tags and metadata"), 0644))
+	opts := &controllers.UploadJobOptions{
+		SymlinkPolicy:  controllers.SymlinkSkip,
+		EmptyDirPolicy: controllers.EmptyDirSkip,
+	}
+	uploadJob, exitCode, _ := runTestUploadJob(t, file, ss, opts)
+	require.Equal(t, constants.ExitOK, exitCode, uploadJob.UploadOps[0].Result.Errors)
+	assert.Equal(t, controllers.S3UploadProvider, uploadJob.UploadOps[0].Result.Provider)
+
+	client, err := controllers.NewMinioClient(ss)
+	require.NoError(t, err)
+	ctx := context.Background()
+	defer client.RemoveObject(ctx, ss.Bucket, "s3-options-test.txt", minio.RemoveObjectOptions{})
+	objInfo, err := client.StatObject(ctx, ss.Bucket, "s3-options-test.txt", minio.StatObjectOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "coll-7", objInfo.UserMetadata["Collection"])
+	tags, err := client.GetObjectTagging(ctx, ss.Bucket, "s3-options-test.txt", minio.GetObjectTaggingOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"Project": "Upload Options"}, tags.ToMap())
+}
@@ -1,10 +1,12 @@
 package controllers
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -17,9 +19,14 @@ import (
 
 var IsRunningWails = false
 
+// PartialDownloadSuffix is appended to the names of files that are
+// still being downloaded. If a download is interrupted, the partial
+// file stays in the downloads folder so we can resume it later.
+const PartialDownloadSuffix = ".partial"
+
 // GET /download_jobs/new
 func DownloadJobNew(c *gin.Context) {
-	form, _ := GetS3DownloadForm(c)
+	form, _ := GetDownloadForm(c)
 	if form == nil {
 		// An error occurred and request was redirected.
 		return
@@ -35,7 +42,7 @@ func DownloadJobNew(c *gin.Context) {
 
 // POST /download_jobs/browse
 func DownloadJobBrowse(c *gin.Context) {
-	form, s3Objects := GetS3DownloadForm(c)
+	form, s3Objects := GetDownloadForm(c)
 	if form == nil {
 		// An error occurred and request was redirected.
 		return
@@ -50,6 +57,15 @@ func DownloadJobBrowse(c *gin.Context) {
 
 	hasPreviousPage := form.Fields["hasPreviousPage"].Value == "true"
 	hasNextPage := form.Fields["hasNextPage"].Value == "true"
+
+	// directory is set only when browsing an SFTP service.
+	directory := form.Fields["directory"].Value
+	parentDirectory := path.Dir(directory)
+	if parentDirectory == "." {
+		parentDirectory = ""
+	}
+	// Only S3 objects can be shared with presigned links.
+	ss := core.ObjFind(form.Fields["ssid"].Value).StorageService()
 	templateData := gin.H{
 		"form":                form,
 		"s3Objects":           s3Objects,
@@ -57,6 +73,9 @@ func DownloadJobBrowse(c *gin.Context) {
 		"helpUrl":             GetHelpUrl(c),
 		"hasPreviousPage":     hasPreviousPage,
 		"hasNextPage":         hasNextPage,
+		"directory":           directory,
+		"parentDirectory":     parentDirectory,
+		"isS3":                ss != nil && ss.Protocol == constants.ProtocolS3,
 	}
 	c.HTML(http.StatusOK, "download_job/index.html", templateData)
 }
@@ -68,116 +87,346 @@ func DownloadJobDownload(c *gin.Context) {
 	s3Key := c.PostForm("s3Key")
 	s3ObjectSize, _ := strconv.ParseInt(c.PostForm("s3ObjectSize"), 10, 64)
 	s3ContentType := c.PostForm("s3ContentType")
-	readCloser, err := GetDownloadFile(ssid, s3Bucket, s3Key, s3ObjectSize)
+
+	if IsRunningWails {
+		// We're running in a Wails window, so we have to save this
+		// file directly from the back end. When Wails adds JS support
+		// for SaveFileDialog, we can open a dialog on the front end
+		// instead. Check https://wails.io/docs/reference/runtime/dialog/
+		// periodically to see when support for SaveFileDialog is
+		// available.
+		downloadFolder := core.Dart.Paths.Downloads
+		downloadFile, err := LocalPathForKey(downloadFolder, s3Key)
+		if err == nil {
+			_, err = DownloadToFile(ssid, s3Bucket, s3Key, downloadFile)
+		}
+		if err != nil {
+			core.Dart.Log.Errorf("S3 download error: %v", err)
+			data := gin.H{
+				"error": err.Error(),
+			}
+			c.HTML(http.StatusInternalServerError, "download_job/error.html", data)
+			return
+		}
+		message := fmt.Sprintf("Downloaded %s to %s", s3Key, downloadFile)
+		core.Dart.Log.Infof(message)
+		templateData := gin.H{
+			"downloadFile":   downloadFile,
+			"downloadFolder": downloadFolder,
+		}
+		c.HTML(http.StatusOK, "download_job/completed.html", templateData)
+		return
+	}
+
+	// We're running in a browser.
+	readCloser, err := GetDownloadFile(ssid, s3Bucket, s3Key)
 	if err != nil {
 		core.Dart.Log.Errorf("S3 download error: %v", err)
 		data := gin.H{
 			"error": err.Error(),
 		}
 		c.HTML(http.StatusInternalServerError, "download_job/error.html", data)
-	} else {
-		if IsRunningWails {
-			// We're running in a Wails window, so we have to save this
-			// file directly from the back end. When Wails adds JS support
-			// for SaveFileDialog, we can open a dialog on the front end
-			// instead. Check https://wails.io/docs/reference/runtime/dialog/
-			// periodically to see when support for SaveFileDialog is
-			// available.
-			downloadFolder := core.Dart.Paths.Downloads
-			fileName := strings.ReplaceAll(s3Key, "/", "_")
-			fileName = strings.ReplaceAll(fileName, "\\", "_")
-			downloadFile := filepath.Join(downloadFolder, fileName)
-
-			// Create the destination file
-			destFile, err := os.Create(downloadFile)
-			if err != nil {
-				core.Dart.Log.Errorf("Failed to create file: %v", err)
-				c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to create file: %v", err))
-				return
-			}
-			defer destFile.Close()
-
-			// Copy s3Object contents to the file
-			_, err = io.Copy(destFile, readCloser)
-			if err != nil {
-				core.Dart.Log.Errorf("Failed to write file: %v", err)
-				c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to write file: %v", err))
-				return
-			}
+		return
+	}
+	// Note: Setting content-type to application/octet-stream is a hack
+	// to prevent Wails from opening the file in the current window.
+	// Without this setting, text files, images, and some other will open
+	// in the main application window on Mac.
+	attachmentName := fmt.Sprintf("attachment; filename=%s", s3Key)
+	c.DataFromReader(
+		http.StatusOK,
+		s3ObjectSize,
+		s3ContentType,
+		readCloser,
+		map[string]string{
+			"Content-Disposition": attachmentName,
+			"Content-Type":        "application/octet-stream",
+		},
+	)
+}
 
-			message := fmt.Sprintf("Downloaded %s to %s", s3Key, downloadFile)
-			core.Dart.Log.Infof(message)
-			templateData := gin.H{
-				"downloadFile":   downloadFile,
-				"downloadFolder": downloadFolder,
-			}
-			c.HTML(http.StatusOK, "download_job/completed.html", templateData)
-			return
-		} else {
-			// We're running in a browser.
-			// Note: Setting content-type to application/octet-stream is a hack
-			// to prevent Wails from opening the file in the current window.
-			// Without this setting, text files, images, and some other will open
-			// in the main application window on Mac.
-			attachmentName := fmt.Sprintf("attachment; filename=%s", s3Key)
-			c.DataFromReader(
-				http.StatusOK,
-				s3ObjectSize,
-				s3ContentType,
-				readCloser,
-				map[string]string{
-					"Content-Disposition": attachmentName,
-					"Content-Type":        "application/octet-stream",
-				},
-			)
+// GET /download_jobs/details?ssid=<id>&bucket=<name>&key=<key>
+//
+// Returns an HTML fragment for the object details modal.
+func DownloadJobDetails(c *gin.Context) {
+	ss := core.ObjFind(c.Query("ssid")).StorageService()
+	if ss == nil {
+		data := gin.H{
+			"error": fmt.Sprintf("No such storage service: %s", c.Query("ssid")),
 		}
+		c.HTML(http.StatusNotFound, "download_job/details.html", data)
+		return
 	}
+	details, err := GetObjectDetails(ss, c.Query("bucket"), c.Query("key"))
+	if err != nil {
+		core.Dart.Log.Errorf("Object details error: %v", err)
+		data := gin.H{
+			"error": err.Error(),
+		}
+		c.HTML(http.StatusInternalServerError, "download_job/details.html", data)
+		return
+	}
+	c.HTML(http.StatusOK, "download_job/details.html", gin.H{"details": details})
 }
 
-func GetDownloadFile(ssid, s3Bucket, s3Key string, objectSize int64) (io.ReadCloser, error) {
+// GetDownloadFile opens the specified file on an S3, SFTP or WebDAV
+// storage service for reading. The caller must close the returned
+// ReadCloser.
+func GetDownloadFile(ssid, s3Bucket, s3Key string) (io.ReadCloser, error) {
 	ss := core.ObjFind(ssid).StorageService()
 	if ss == nil {
 		return nil, fmt.Errorf("No such storage service: %s", ssid)
 	}
-	useSSL := ss.Host != "localhost" && ss.Host != "127.0.0.1"
-	s3Client, err := core.NewS3Client(ss, useSSL, nil)
+	switch ss.Protocol {
+	case constants.ProtocolSFTP:
+		return GetSFTPDownloadFile(ssid, s3Bucket, s3Key)
+	case ProtocolWebDAV:
+		return GetWebDAVDownloadFile(ssid, s3Bucket, s3Key)
+	}
+	client, err := NewMinioClient(ss)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := client.GetObject(context.Background(), s3Bucket, s3Key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// GetObject is lazy: it returns a handle without making a network
+	// request, so a missing key produces no error until you read from it.
+	// Stat() forces the real request now so we catch errors here.
+	objInfo, err := obj.Stat()
+	if err == nil && IsArchivedS3Object(objInfo) {
+		err = archivedObjectError(s3Key, objInfo)
+	}
 	if err != nil {
+		obj.Close()
 		return nil, err
 	}
+	return obj, nil
+}
 
-	// Choose GetObject or GetLargeObject here.
-	if objectSize > constants.MaxS3RequestSize {
-		// Note that GetLargeObject calls Stat() internally and will
-		// return an error if the remote file does not exist.
-		return s3Client.GetLargeObject(s3Bucket, s3Key)
-	} else {
-		obj, err := s3Client.GetObject(s3Bucket, s3Key, minio.GetObjectOptions{})
-		if err != nil {
-			return nil, err
+// DownloadS3ObjectToFile downloads an S3 object to localPath and returns
+// the number of bytes written during this call.
+//
+// Data is written first to localPath + PartialDownloadSuffix. If a
+// previous download of the same object was interrupted, this picks up
+// where the last one left off with a ranged GET, as long as the object's
+// ETag hasn't changed in the meantime. If the ETag has changed, the partial
+// file is discarded and the download starts over. The partial file is
+// renamed to localPath only after all bytes have arrived.
+func DownloadS3ObjectToFile(ssid, s3Bucket, s3Key, localPath string) (int64, error) {
+	return DownloadS3ObjectWithProgress(context.Background(), ssid, s3Bucket, s3Key, localPath, nil)
+}
+
+// DownloadS3ObjectWithProgress is like DownloadS3ObjectToFile, but
+// canceling ctx stops the download and leaves the partial file for
+// the next attempt to resume. If progress is not nil, we call it after
+// each whole percent of the object arrives, with the number of bytes
+// downloaded so far, including any resumed bytes, and the object's size.
+func DownloadS3ObjectWithProgress(ctx context.Context, ssid, s3Bucket, s3Key, localPath string, progress func(downloaded, total int64)) (int64, error) {
+	ss := core.ObjFind(ssid).StorageService()
+	if ss == nil {
+		return 0, fmt.Errorf("No such storage service: %s", ssid)
+	}
+	client, err := NewMinioClient(ss)
+	if err != nil {
+		return 0, err
+	}
+	objInfo, err := client.StatObject(ctx, s3Bucket, s3Key, minio.StatObjectOptions{})
+	if err != nil {
+		return 0, err
+	}
+	if IsArchivedS3Object(objInfo) {
+		return 0, archivedObjectError(s3Key, objInfo)
+	}
+
+	partialFile := localPath + PartialDownloadSuffix
+	etagFile := partialFile + ".etag"
+	offset := resumeOffset(partialFile, etagFile, objInfo)
+	if err = os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return 0, err
+	}
+	if err = os.WriteFile(etagFile, []byte(objInfo.ETag), 0644); err != nil {
+		return 0, err
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		core.Dart.Log.Infof("Resuming download of %s/%s at byte %d of %d", s3Bucket, s3Key, offset, objInfo.Size)
+	}
+	bytesWritten, err := copyObjectRange(ctx, client, objInfo, s3Bucket, partialFile, flags, offset, progress)
+	if err != nil {
+		// Leave the partial file and the ETag in place,
+		// so the next attempt can resume.
+		return bytesWritten, err
+	}
+
+	return bytesWritten, finishPartialDownload(partialFile, etagFile, localPath, objInfo.Size)
+}
+
+// DownloadToFile downloads a file from an S3, SFTP or WebDAV storage
+// service to localPath, resuming an earlier partial download
+// if possible. It returns the number of bytes written.
+func DownloadToFile(ssid, bucket, key, localPath string) (int64, error) {
+	ss := core.ObjFind(ssid).StorageService()
+	if ss == nil {
+		return 0, fmt.Errorf("No such storage service: %s", ssid)
+	}
+	switch ss.Protocol {
+	case constants.ProtocolSFTP:
+		return DownloadSFTPFileToFile(ssid, bucket, key, localPath)
+	case ProtocolWebDAV:
+		return DownloadWebDAVFileToFile(ssid, bucket, key, localPath)
+	}
+	return DownloadS3ObjectToFile(ssid, bucket, key, localPath)
+}
+
+// finishPartialDownload makes sure the partial file has the expected
+// size and then moves it to localPath. If the size is wrong, the
+// partial file is useless for resuming, so we delete it.
+func finishPartialDownload(partialFile, etagFile, localPath string, expectedSize int64) error {
+	stat, err := os.Stat(partialFile)
+	if err != nil {
+		return err
+	}
+	if stat.Size() != expectedSize {
+		os.Remove(partialFile)
+		os.Remove(etagFile)
+		return fmt.Errorf("Downloaded file %s has size %d, expected %d", partialFile, stat.Size(), expectedSize)
+	}
+	if err = os.Rename(partialFile, localPath); err != nil {
+		return err
+	}
+	os.Remove(etagFile)
+	return nil
+}
+
+// copyObjectRange copies the bytes of the object described by objInfo,
+// starting at offset, into the file at filePath. The GET request is
+// conditional on the object's ETag, so if someone overwrites the
+// object mid-download, S3 returns an error instead of a mix of old
+// and new bytes. If progress is not nil, it reports the bytes in the
+// file so far after each whole percent of the object.
+func copyObjectRange(ctx context.Context, client *minio.Client, objInfo minio.ObjectInfo, s3Bucket, filePath string, flags int, offset int64, progress func(downloaded, total int64)) (int64, error) {
+	file, err := os.OpenFile(filePath, flags, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	if offset >= objInfo.Size {
+		return 0, nil
+	}
+	opts := minio.GetObjectOptions{}
+	if err = opts.SetMatchETag(objInfo.ETag); err != nil {
+		return 0, err
+	}
+	if offset > 0 {
+		if err = opts.SetRange(offset, 0); err != nil {
+			return 0, err
 		}
-		// GetObject is lazy: it returns a handle without making a network
-		// request, so a missing key produces no error until you read from it.
-		// Stat() forces the real request now so we catch errors here.
-		if _, err = obj.Stat(); err != nil {
-			obj.Close()
-			return nil, err
+	}
+	obj, err := client.GetObject(ctx, s3Bucket, objInfo.Key, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer obj.Close()
+	reader := &progressReader{
+		reader:   obj,
+		total:    objInfo.Size,
+		copied:   offset,
+		progress: progress,
+	}
+	bytesWritten, err := io.Copy(file, reader)
+	if err != nil {
+		return bytesWritten, err
+	}
+	return bytesWritten, file.Sync()
+}
+
+// resumeOffset returns the byte offset at which to resume downloading
+// the object described by objInfo. It returns zero if there is no
+// partial file, if the partial file was for a different version of
+// the object (i.e. the ETag changed), or if the partial file is
+// somehow larger than the object itself.
+func resumeOffset(partialFile, etagFile string, objInfo minio.ObjectInfo) int64 {
+	stat, err := os.Stat(partialFile)
+	if err != nil {
+		return 0
+	}
+	savedETag, err := os.ReadFile(etagFile)
+	if err != nil || strings.TrimSpace(string(savedETag)) != objInfo.ETag {
+		core.Dart.Log.Infof("Discarding partial download %s because the remote object has changed", partialFile)
+		return 0
+	}
+	if stat.Size() > objInfo.Size {
+		return 0
+	}
+	return stat.Size()
+}
+
+// LocalPathForKey returns the path under baseDir where we should save
+// the S3 object with the specified key. Slashes in the key become
+// directories on the local file system, so a/b/bag.tar is saved as
+// baseDir/a/b/bag.tar. Characters that are not legal in file names
+// on all of our supported platforms are percent-encoded, which keeps
+// the mapping reversible. "." and ".." segments are rejected so a key
+// can never write outside of baseDir. Empty segments, as in a//b.tar,
+// x/ or /a.tar, are rejected too, since dropping them would save two
+// keys to the same file.
+func LocalPathForKey(baseDir, s3Key string) (string, error) {
+	segments := strings.Split(s3Key, "/")
+	cleanSegments := make([]string, 0, len(segments))
+	for _, segment := range segments {
+		if segment == "" {
+			return "", fmt.Errorf("Key '%s' contains an empty path segment", s3Key)
+		}
+		if segment == "." || segment == ".." {
+			return "", fmt.Errorf("Key %s contains illegal path segment '%s'", s3Key, segment)
+		}
+		cleanSegments = append(cleanSegments, escapeFileName(segment))
+	}
+	return filepath.Join(append([]string{baseDir}, cleanSegments...)...), nil
+}
+
+// escapeFileName percent-encodes characters that Windows, Mac or Linux
+// won't accept in a file name. The percent sign itself is also escaped,
+// so that the encoding is unambiguous.
+func escapeFileName(name string) string {
+	var sb strings.Builder
+	for _, r := range name {
+		if r < 0x20 || strings.ContainsRune(`%\:*?"<>|`, r) {
+			sb.WriteString(fmt.Sprintf("%%%02X", r))
+		} else {
+			sb.WriteRune(r)
 		}
-		return obj, nil
 	}
+	return sb.String()
 }
 
-func GetS3DownloadForm(c *gin.Context) (*core.Form, []minio.ObjectInfo) {
+// GetDownloadForm returns the form for the download browser, along
+// with one page of objects from the selected bucket. For SFTP and WebDAV
+// services, the bucket is the service's configured directory, and the
+// form's directory field says which subdirectory we're browsing.
+func GetDownloadForm(c *gin.Context) (*core.Form, []minio.ObjectInfo) {
 	s3Objects := make([]minio.ObjectInfo, 0)
 	ssid := c.PostForm("ssid")
 	originalSource := c.PostForm("originalSource")
 	selectedBucket := c.PostForm("bucket")
 	originalBucket := c.PostForm("originalBucket")
 	startAfter := c.PostForm("startAfter")
+	directory := c.PostForm("directory")
+	originalDirectory := c.PostForm("originalDirectory")
 
-	// If user changed the S3 service or the bucket name, clear out
-	// startAfter, because that applied to the old S3 bucket.
+	// If user changed the storage service or the bucket name, clear out
+	// startAfter and directory, because those applied to the old bucket.
 	if ssid != originalSource || selectedBucket != originalBucket {
 		startAfter = ""
+		directory = ""
+	}
+	// Likewise, a new directory means starting from its first page.
+	if directory != originalDirectory {
+		startAfter = ""
 	}
 
 	storageServices := core.ObjList(constants.TypeStorageService, "obj_name", 100, 0).StorageServices
@@ -185,7 +434,7 @@ func GetS3DownloadForm(c *gin.Context) (*core.Form, []minio.ObjectInfo) {
 		{Label: "Choose One", Value: "", Selected: false},
 	}
 	for _, ss := range storageServices {
-		if ss.Protocol == constants.ProtocolS3 {
+		if ss.Protocol == constants.ProtocolS3 || ss.Protocol == constants.ProtocolSFTP || ss.Protocol == ProtocolWebDAV {
 			choices = append(choices, core.Choice{Label: ss.Name, Value: ss.ID, Selected: ssid == ss.ID})
 		}
 	}
@@ -195,6 +444,7 @@ func GetS3DownloadForm(c *gin.Context) (*core.Form, []minio.ObjectInfo) {
 	ssidField := form.AddField("ssid", "Download From", ssid, true)
 	ssidField.Choices = choices
 	bucketField := form.AddField("bucket", "Bucket", selectedBucket, false)
+	form.AddField("directory", "", directory, false)
 
 	// startAfter will tell us where to start the list of objects
 	// when the user clicks Next to view the next page of results.
@@ -212,9 +462,12 @@ func GetS3DownloadForm(c *gin.Context) (*core.Form, []minio.ObjectInfo) {
 	hasNextPageField := form.AddField("hasNextPage", "", "true", false)
 
 	// Keep track of the user's current selection, so we'll know if
-	// the source or bucket changed on the next request.
+	// the source, bucket or directory changed on the next request.
 	form.AddField("originalSource", "", ssid, false)
 	form.AddField("originalBucket", "", selectedBucket, false)
+	form.AddField("originalDirectory", "", directory, false)
+
+	maxKeys := 200
 
 	// If user did not select a storage service (ssid), don't show
 	// the bucket drop-down. If they did select a storage service,
@@ -224,63 +477,67 @@ func GetS3DownloadForm(c *gin.Context) (*core.Form, []minio.ObjectInfo) {
 	} else {
 		ss := core.ObjFind(ssid).StorageService()
 		if ss == nil {
-			SetFlashCookie(c, "S3 endpoint not found.")
+			SetFlashCookie(c, "Storage service not found.")
 			c.Redirect(http.StatusTemporaryRedirect, c.Request.Referer())
 			return nil, nil
 		}
-		useSSL := ss.Host != "localhost" && ss.Host != "127.0.0.1"
-		s3Client, err := core.NewS3Client(ss, useSSL, nil)
+		if ss.Protocol == constants.ProtocolSFTP || ss.Protocol == ProtocolWebDAV {
+			// SFTP and WebDAV services have no buckets. We browse
+			// the directory configured for the service.
+			bucketField.Label = "Directory"
+			bucketField.Value = ss.Bucket
+			bucketField.Choices = []core.Choice{
+				{Label: directoryBucketLabel(ss), Value: ss.Bucket, Selected: true},
+			}
+			listDirectory := ListSFTPDirectory
+			if ss.Protocol == ProtocolWebDAV {
+				listDirectory = ListWebDAVDirectory
+			}
+			objects, hasMore, err := listDirectory(ss, ss.Bucket, directory, startAfter, maxKeys)
+			if err != nil {
+				core.Dart.Log.Errorf("Error listing %s directory %s: %v", ss.Protocol, path.Join(ss.Bucket, directory), err)
+				bucketField.Error = err.Error()
+			}
+			s3Objects = objects
+			startAfterField.Value = ""
+			if len(s3Objects) > 0 {
+				startAfterField.Value = s3Objects[len(s3Objects)-1].Key
+			}
+			hasNextPageField.Value = strconv.FormatBool(hasMore)
+			return form, s3Objects
+		}
+		client, err := NewMinioClient(ss)
 		if err != nil {
 			bucketField.Error = err.Error()
 			return form, s3Objects
+		}
+		buckets, err := client.ListBuckets(context.Background())
+		if err != nil {
+			core.Dart.Log.Warningf("Cannot list buckets: %v. Will list only configured bucket for this storage service.", err)
+			bucketChoices := []core.Choice{
+				{Label: ss.Bucket, Value: ss.Bucket, Selected: true},
+			}
+			bucketField.Choices = bucketChoices
+			// Since we have only one choice, select it.
+			selectedBucket = ss.Bucket
 		} else {
-			buckets, err := s3Client.ListBuckets()
-			if err != nil {
-				core.Dart.Log.Warningf("Cannot list buckets: %v. Will list only configured bucket for this storage service.")
-				bucketChoices := []core.Choice{
-					{Label: ss.Bucket, Value: ss.Bucket, Selected: true},
-				}
-				bucketField.Choices = bucketChoices
-				// Since we have only one choice, select it.
-				selectedBucket = ss.Bucket
-			} else {
-				// Show all available buckets, if possible.
-				bucketChoices := []core.Choice{
-					{Label: "Choose One", Value: "", Selected: false},
-				}
-				for _, bucket := range buckets {
-					choice := core.Choice{
-						Label:    bucket.Name,
-						Value:    bucket.Name,
-						Selected: bucket.Name == selectedBucket,
-					}
-					bucketChoices = append(bucketChoices, choice)
+			// Show all available buckets, if possible.
+			bucketChoices := []core.Choice{
+				{Label: "Choose One", Value: "", Selected: false},
+			}
+			for _, bucket := range buckets {
+				choice := core.Choice{
+					Label:    bucket.Name,
+					Value:    bucket.Name,
+					Selected: bucket.Name == selectedBucket,
 				}
-				bucketField.Choices = bucketChoices
+				bucketChoices = append(bucketChoices, choice)
 			}
+			bucketField.Choices = bucketChoices
 		}
 
-		maxKeys := 200
 		if selectedBucket != "" {
-			// Note that ListObjects should honor the MaxKeys option.
-			for _, s3Obj := range s3Client.ListObjects(selectedBucket, startAfter, minio.ListObjectsOptions{
-				Recursive:  true,
-				MaxKeys:    maxKeys,
-				StartAfter: startAfter,
-			}) {
-				// If the minio client can't get a list of objects, in some cases
-				// it returns a single s3Obj containing an error explaining why it
-				// can't get the object. We don't want to return that because it
-				// shows up on the front end as a zero-byte object with no name, and
-				// it can't be downloaded. So, lets log that as an error instead of
-				// making the user puzzle over the presence of a non-name, zero-byte,
-				// inaccessible object.
-				if s3Obj.Err != nil {
-					core.Dart.Log.Errorf("Error listing objects for bucket %s: %v", selectedBucket, s3Obj.Err)
-				} else {
-					s3Objects = append(s3Objects, s3Obj)
-				}
-			}
+			s3Objects = ListS3ObjectsPage(client, selectedBucket, startAfter, maxKeys)
 
 			// Set the value of the startAfter form field, so when the
 			// requests the next page of results, we know where to start.
@@ -298,3 +555,15 @@ func GetS3DownloadForm(c *gin.Context) (*core.Form, []minio.ObjectInfo) {
 	}
 	return form, s3Objects
 }
+
+// directoryBucketLabel returns the label to show in the download
+// form's directory list for an SFTP or WebDAV service.
+func directoryBucketLabel(ss *core.StorageService) string {
+	if ss.Bucket == "" || ss.Bucket == "." || ss.Bucket == "/" {
+		if ss.Protocol == constants.ProtocolSFTP {
+			return "Home directory"
+		}
+		return "Top level"
+	}
+	return ss.Bucket
+}
@@ -2,15 +2,19 @@ package controllers_test
 
 import (
 	"bytes"
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
 
 	"github.com/APTrust/dart-runner/constants"
 	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart-runner/util"
 	"github.com/APTrust/dart/v3/server/controllers"
 	"github.com/minio/minio-go/v7"
 	"github.com/stretchr/testify/assert"
@@ -171,7 +175,7 @@ func TestGetDownloadFile(t *testing.T) {
 	testFileName := s3Objects[0].Key
 
 	// Test GetDownloadFile
-	obj, err := controllers.GetDownloadFile(ss.ID, bucketName, testFileName, s3Objects[0].Size)
+	obj, err := controllers.GetDownloadFile(ss.ID, bucketName, testFileName)
 	require.NoError(t, err)
 	require.NotNil(t, obj)
 
@@ -182,44 +186,39 @@ func TestGetDownloadFile(t *testing.T) {
 	assert.NotEmpty(t, buf.String())
 }
 
-// TestGetDownloadFileLarge tests the GetDownloadFile helper function,
-// forcing it to call GetLargeObject
+// TestGetDownloadFileLarge tests the GetDownloadFile helper function
+// with an object large enough that minio reads it in several chunks.
+// GetDownloadFile no longer chooses between GetObject and
+// GetLargeObject, so we make sure the whole object comes through.
 func TestGetDownloadFileLarge(t *testing.T) {
 	defer core.ClearDartTable()
 
 	// Set up storage service
 	ss := loadMinioStorageService(t)
+	client, err := controllers.NewMinioClient(ss)
+	require.NoError(t, err)
 
-	// Use the existing "test" bucket
-	s3Client := setupMinioClient(t, ss)
+	// Upload a large object to the "test" bucket
 	bucketName := "test"
+	testFileName := "get-download-file-large.bin"
+	data := bytes.Repeat([]byte("0123456789abcdef"), 512*1024)
+	ctx := context.Background()
+	_, err = client.PutObject(ctx, bucketName, testFileName, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{})
+	require.NoError(t, err)
+	defer client.RemoveObject(ctx, bucketName, testFileName, minio.RemoveObjectOptions{})
 
-	// Get list of objects in bucket
-	s3Objects := s3Client.ListObjects(bucketName, "", minio.ListObjectsOptions{
-		Recursive: true,
-		MaxKeys:   1,
-	})
-
-	// Skip test if no files exist
-	if len(s3Objects) == 0 {
-		t.Skip("No files in test bucket, skipping GetDownloadFile test")
-		return
-	}
-
-	testFileName := s3Objects[0].Key
-
-	// Test GetDownloadFile. Pass in a bogus file size so the
-	// back-end code thinks it's a huge object and calls
-	// GetLargeObject.
-	obj, err := controllers.GetDownloadFile(ss.ID, bucketName, testFileName, 2*constants.MaxS3RequestSize)
+	// Test GetDownloadFile
+	obj, err := controllers.GetDownloadFile(ss.ID, bucketName, testFileName)
 	require.NoError(t, err)
 	require.NotNil(t, obj)
+	defer obj.Close()
 
-	// Read and verify we can get content
+	// Read and verify we got all of the content
 	buf := new(bytes.Buffer)
 	_, err = buf.ReadFrom(obj)
 	require.NoError(t, err)
-	assert.NotEmpty(t, buf.String())
+	assert.Equal(t, len(data), buf.Len())
+	assert.True(t, bytes.Equal(data, buf.Bytes()))
 }
 
 // TestGetDownloadFileInvalidStorageService tests error handling
@@ -227,7 +226,7 @@ func TestGetDownloadFileInvalidStorageService(t *testing.T) {
 	defer core.ClearDartTable()
 
 	// Try to get a file with an invalid storage service ID
-	obj, err := controllers.GetDownloadFile("invalid-id", "bucket", "key", 999)
+	obj, err := controllers.GetDownloadFile("invalid-id", "bucket", "key")
 	assert.Error(t, err)
 	assert.Nil(t, obj)
 }
@@ -815,3 +814,87 @@ func TestDownloadJobBrowsePaginationButtons(t *testing.T) {
 		assert.Contains(t, html, `&lt;&lt; Back`, "Back button text should be present")
 	}
 }
+
+func TestLocalPathForKey(t *testing.T) {
+	baseDir := filepath.Join("downloads", "dart")
+
+	localPath, err := controllers.LocalPathForKey(baseDir, "bag.tar")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(baseDir, "bag.tar"), localPath)
+
+	// Slashes become directories instead of underscores,
+	// so a/b_c.tar and a_b/c.tar no longer collide.
+	localPath, err = controllers.LocalPathForKey(baseDir, "a/b_c.tar")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(baseDir, "a", "b_c.tar"), localPath)
+	localPath, err = controllers.LocalPathForKey(baseDir, "a_b/c.tar")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(baseDir, "a_b", "c.tar"), localPath)
+
+	// Characters illegal on Windows are percent-encoded.
+	localPath, err = controllers.LocalPathForKey(baseDir, `dir/what?:50%.tar`)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(baseDir, "dir", "what%3F%3A50%25.tar"), localPath)
+
+	// Keys must not escape the base directory.
+	_, err = controllers.LocalPathForKey(baseDir, "../../etc/passwd")
+	assert.Error(t, err)
+	_, err = controllers.LocalPathForKey(baseDir, "a/./b.tar")
+	assert.Error(t, err)
+	_, err = controllers.LocalPathForKey(baseDir, "///")
+	assert.Error(t, err)
+
+	// Empty segments would make a//b.tar and a/b.tar, or x/ and x,
+	// map to the same file, so they're rejected too.
+	_, err = controllers.LocalPathForKey(baseDir, "a//b.tar")
+	assert.Error(t, err)
+	_, err = controllers.LocalPathForKey(baseDir, "x/")
+	assert.Error(t, err)
+	_, err = controllers.LocalPathForKey(baseDir, "/a/b.tar")
+	assert.Error(t, err)
+}
+
+func TestDownloadS3ObjectToFileResume(t *testing.T) {
+	defer core.ClearDartTable()
+	ss := loadMinioStorageService(t)
+	client, err := controllers.NewMinioClient(ss)
+	require.NoError(t, err)
+
+	// Put an object whose content we know.
+	content := []byte(strings.Repeat("0123456789", 10000))
+	s3Key := "resume-test/object.bin"
+	_, err = client.PutObject(context.Background(), ss.Bucket, s3Key, bytes.NewReader(content), int64(len(content)), minio.PutObjectOptions{})
+	require.NoError(t, err)
+	objInfo, err := client.StatObject(context.Background(), ss.Bucket, s3Key, minio.StatObjectOptions{})
+	require.NoError(t, err)
+
+	// Simulate an interrupted download: first half of
+	// the object, plus the ETag of the object.
+	localPath := filepath.Join(t.TempDir(), "resume-test", "object.bin")
+	partialFile := localPath + controllers.PartialDownloadSuffix
+	require.NoError(t, os.MkdirAll(filepath.Dir(localPath), 0755))
+	require.NoError(t, os.WriteFile(partialFile, content[:len(content)/2], 0644))
+	require.NoError(t, os.WriteFile(partialFile+".etag", []byte(objInfo.ETag), 0644))
+
+	// Should fetch only the second half.
+	bytesWritten, err := controllers.DownloadS3ObjectToFile(ss.ID, ss.Bucket, s3Key, localPath)
+	require.NoError(t, err)
+	assert.EqualValues(t, len(content)-len(content)/2, bytesWritten)
+	downloaded, err := os.ReadFile(localPath)
+	require.NoError(t, err)
+	assert.Equal(t, content, downloaded)
+	assert.False(t, util.FileExists(partialFile))
+	assert.False(t, util.FileExists(partialFile+".etag"))
+
+	// If the ETag changed, the partial file is stale and
+	// we should download the whole object again.
+	require.NoError(t, os.Remove(localPath))
+	require.NoError(t, os.WriteFile(partialFile, []byte("stale data"), 0644))
+	require.NoError(t, os.WriteFile(partialFile+".etag", []byte("not-the-etag"), 0644))
+	bytesWritten, err = controllers.DownloadS3ObjectToFile(ss.ID, ss.Bucket, s3Key, localPath)
+	require.NoError(t, err)
+	assert.EqualValues(t, len(content), bytesWritten)
+	downloaded, err = os.ReadFile(localPath)
+	require.NoError(t, err)
+	assert.Equal(t, content, downloaded)
+}
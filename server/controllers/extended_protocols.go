@@ -0,0 +1,474 @@
+package controllers
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart-runner/util"
+	"github.com/minio/minio-go/v7"
+)
+
+// extendedProtocol describes a storage protocol that DART Runner
+// doesn't support, so we validate services that use it and run
+// their uploads ourselves.
+type extendedProtocol struct {
+	Name     string
+	Label    string
+	Provider string
+	Validate func(ss *core.StorageService) bool
+	// Upload copies the file or directory at sourcePath to ss under
+	// key and returns the name of the copy on the remote side.
+	Upload func(ss *core.StorageService, sourcePath, key string) (string, error)
+}
+
+var extendedProtocols = []extendedProtocol{
+	{
+		Name:     ProtocolFilesystem,
+		Label:    "Local Filesystem / Network Share",
+		Provider: FilesystemUploadProvider,
+		Validate: validateFilesystemService,
+		Upload:   CopyToFilesystemAs,
+	},
+	{
+		Name:     ProtocolWebDAV,
+		Label:    "WebDAV",
+		Provider: WebDAVUploadProvider,
+		Validate: validateWebDAVService,
+		Upload:   UploadToWebDAVAs,
+	},
+}
+
+func findExtendedProtocol(protocol string) *extendedProtocol {
+	for i := range extendedProtocols {
+		if extendedProtocols[i].Name == protocol {
+			return &extendedProtocols[i]
+		}
+	}
+	return nil
+}
+
+// IsExtendedProtocol returns true if protocol is one that DART
+// implements itself rather than through DART Runner.
+func IsExtendedProtocol(protocol string) bool {
+	return findExtendedProtocol(protocol) != nil
+}
+
+// ValidateStorageService validates ss, setting ss.Errors. We validate
+// services that use extended protocols, and DART Runner validates
+// the rest.
+func ValidateStorageService(ss *core.StorageService) bool {
+	if protocol := findExtendedProtocol(ss.Protocol); protocol != nil {
+		return protocol.Validate(ss)
+	}
+	return ss.Validate()
+}
+
+// ValidateWorkflow validates workflow, setting workflow.Errors. DART
+// Runner validates the workflow and its usual storage services, and
+// we validate the services that use extended protocols.
+func ValidateWorkflow(workflow *core.Workflow) bool {
+	extended, restore := hideExtendedServices(workflow)
+	workflow.Validate()
+	restore()
+	workflow.Errors = addStorageServiceErrors(workflow.Errors, extended)
+	return len(workflow.Errors) == 0
+}
+
+// ValidateWorkflowBatch is the batch equivalent of ValidateWorkflow.
+func ValidateWorkflowBatch(wb *core.WorkflowBatch) bool {
+	if wb.Workflow == nil {
+		return wb.Validate()
+	}
+	extended, restore := hideExtendedServices(wb.Workflow)
+	wb.Validate()
+	restore()
+	wb.Errors = addStorageServiceErrors(wb.Errors, extended)
+	return len(wb.Errors) == 0
+}
+
+// hideExtendedServices removes the storage services that use extended
+// protocols from workflow, so DART Runner's validation won't reject
+// them. It returns the services it removed and a function that puts
+// them back.
+func hideExtendedServices(workflow *core.Workflow) ([]*core.StorageService, func()) {
+	allIDs := workflow.StorageServiceIDs
+	extended := make([]*core.StorageService, 0)
+	others := make([]*core.StorageService, 0, len(workflow.StorageServices))
+	extendedIDs := make(map[string]bool)
+	for _, ss := range workflow.StorageServices {
+		if ss != nil && IsExtendedProtocol(ss.Protocol) {
+			extended = append(extended, ss)
+			extendedIDs[ss.ID] = true
+		} else {
+			others = append(others, ss)
+		}
+	}
+	otherIDs := make([]string, 0, len(allIDs))
+	for _, id := range allIDs {
+		if extendedIDs[id] {
+			continue
+		}
+		ss := core.ObjFind(id).StorageService()
+		if ss != nil && IsExtendedProtocol(ss.Protocol) {
+			extended = append(extended, ss)
+			extendedIDs[id] = true
+		} else {
+			otherIDs = append(otherIDs, id)
+		}
+	}
+	workflow.StorageServiceIDs = otherIDs
+	workflow.StorageServices = others
+	return extended, func() {
+		workflow.StorageServiceIDs = allIDs
+		workflow.StorageServices = append(workflow.StorageServices, extended...)
+	}
+}
+
+// addStorageServiceErrors validates each of services with
+// ValidateStorageService and adds their errors to errors.
+func addStorageServiceErrors(errors map[string]string, services []*core.StorageService) map[string]string {
+	if errors == nil {
+		errors = make(map[string]string)
+	}
+	for _, ss := range services {
+		if !ValidateStorageService(ss) {
+			for field, message := range ss.Errors {
+				errors[ss.Name+"."+field] = message
+			}
+		}
+	}
+	return errors
+}
+
+// AddExtendedProtocolChoices adds the extended protocols to the
+// protocol list on a storage service form.
+func AddExtendedProtocolChoices(form *core.Form) {
+	field, ok := form.Fields["Protocol"]
+	if !ok {
+		return
+	}
+	for _, protocol := range extendedProtocols {
+		alreadyListed := false
+		for _, choice := range field.Choices {
+			if choice.Value == protocol.Name {
+				alreadyListed = true
+				break
+			}
+		}
+		if !alreadyListed {
+			field.Choices = append(field.Choices, core.Choice{
+				Label:    protocol.Label,
+				Value:    protocol.Name,
+				Selected: field.Value == protocol.Name,
+			})
+		}
+	}
+}
+
+// SplitExtendedUploads separates upload operations that use extended
+// protocols from those that DART Runner can run.
+func SplitExtendedUploads(ops []*core.UploadOperation) (others, extendedOps []*core.UploadOperation) {
+	others = make([]*core.UploadOperation, 0, len(ops))
+	extendedOps = make([]*core.UploadOperation, 0)
+	for _, op := range ops {
+		if op.StorageService != nil && IsExtendedProtocol(op.StorageService.Protocol) {
+			extendedOps = append(extendedOps, op)
+		} else {
+			others = append(others, op)
+		}
+	}
+	return others, extendedOps
+}
+
+// uploadPlan holds what we need to run the uploads that DART Runner
+// can't: object keys from key templates, and S3 put options for
+// storage class, encryption, tags and metadata.
+type uploadPlan struct {
+	workflowID string
+	keys       UploadKeys
+	s3Options  map[*core.UploadOperation]minio.PutObjectOptions
+}
+
+// planJobUploads expands the key templates and S3 upload options that
+// apply to job's uploads. It returns an error if any of them can't be
+// expanded, for example because a tag they refer to has no value.
+func planJobUploads(job *core.Job) (*uploadPlan, error) {
+	keys, err := JobUploadKeys(job)
+	if err != nil {
+		return nil, err
+	}
+	s3Options, err := s3UploadSettings(job, jobKeyLookup(job, jobWorkflowName(job), time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	return &uploadPlan{workflowID: job.WorkflowID, keys: keys, s3Options: s3Options}, nil
+}
+
+// runsInDART returns true if op needs something DART Runner can't do.
+func (plan *uploadPlan) runsInDART(op *core.UploadOperation) bool {
+	if plan == nil {
+		return needsDARTUploader(op.StorageService, "")
+	}
+	if needsDARTUploader(op.StorageService, plan.workflowID) {
+		return true
+	}
+	_, hasS3Options := plan.s3Options[op]
+	return len(plan.keys[op]) > 0 || hasS3Options
+}
+
+// needsDARTUploader returns true if ss is an S3 service with settings
+// DART Runner would ignore: TLS or bucket addressing options that
+// differ from the defaults, or storage class, encryption, tag or
+// metadata settings for uploads in the specified workflow. DART must
+// upload to these services itself.
+func needsDARTUploader(ss *core.StorageService, workflowID string) bool {
+	if ss == nil || ss.Protocol != constants.ProtocolS3 {
+		return false
+	}
+	return GetStorageServiceOptions(ss).ChangesConnection(ss) ||
+		!S3UploadOptionsFor(workflowID, ss).IsEmpty()
+}
+
+// splitUploads separates the upload operations that DART Runner can
+// run from those we must run ourselves: operations that use extended
+// protocols, operations that plan gives keys or S3 options, and
+// operations with S3 settings DART Runner would ignore.
+func splitUploads(ops []*core.UploadOperation, plan *uploadPlan) (runnerOps, dartOps []*core.UploadOperation) {
+	others, extendedOps := SplitExtendedUploads(ops)
+	runnerOps = make([]*core.UploadOperation, 0, len(others))
+	for _, op := range others {
+		if plan.runsInDART(op) {
+			extendedOps = append(extendedOps, op)
+		} else {
+			runnerOps = append(runnerOps, op)
+		}
+	}
+	return runnerOps, extendedOps
+}
+
+// dartUploader returns the function we use to upload files to
+// services that use protocol when DART Runner can't do the job,
+// along with the provider name for the operation's result.
+func dartUploader(protocol string) (string, func(ss *core.StorageService, sourcePath, key string) (string, error)) {
+	if extended := findExtendedProtocol(protocol); extended != nil {
+		return extended.Provider, extended.Upload
+	}
+	switch protocol {
+	case constants.ProtocolS3:
+		return S3UploadProvider, UploadToS3
+	case constants.ProtocolSFTP:
+		return SFTPUploadProvider, UploadToSFTP
+	}
+	return "", nil
+}
+
+// ValidateUploadJob validates uploadJob. DART Runner validates the
+// upload operations it knows about, and we validate the rest. If DART
+// runs all of the job's uploads, as it does for jobs that include
+// directories, a key prefix or S3 settings DART Runner would ignore,
+// we validate all of them, along with the job's plan.
+func ValidateUploadJob(uploadJob *core.UploadJob) bool {
+	if opts := GetUploadJobOptions(uploadJob.ID); uploadJobRunsInDART(uploadJob, opts) {
+		return validateDirectoryUploadJob(uploadJob, opts)
+	}
+	allOps := uploadJob.UploadOps
+	others, extendedOps := SplitExtendedUploads(allOps)
+	if len(extendedOps) == 0 {
+		return uploadJob.Validate()
+	}
+	if len(others) > 0 {
+		uploadJob.UploadOps = others
+		uploadJob.Validate()
+		uploadJob.UploadOps = allOps
+	} else {
+		uploadJob.Errors = make(map[string]string)
+		if len(uploadJob.PathsToUpload) == 0 {
+			uploadJob.Errors["PathsToUpload"] = "Please choose at least one file or directory to upload."
+		}
+	}
+	if uploadJob.Errors == nil {
+		uploadJob.Errors = make(map[string]string)
+	}
+	for _, op := range extendedOps {
+		ss := op.StorageService
+		if !ValidateStorageService(ss) {
+			for field, message := range ss.Errors {
+				uploadJob.Errors[ss.Name+"."+field] = message
+			}
+		}
+		for _, sourcePath := range op.SourceFiles {
+			if !util.FileExists(sourcePath) {
+				uploadJob.Errors[ss.Name+"."+sourcePath] = fmt.Sprintf("File to upload does not exist: %s", sourcePath)
+			}
+		}
+	}
+	return len(uploadJob.Errors) == 0
+}
+
+// RunJobWithExtendedUploads runs job through DART Runner, leaving out
+// uploads that use extended protocols, key templates or S3 upload
+// options, then runs those uploads if the rest of the job succeeded.
+// It returns the job's exit code.
+//
+// Key templates and S3 tag and metadata values are expanded before
+// the job starts, so a job whose keys would be missing tag values or
+// contain illegal characters fails before it starts bagging.
+//
+// After the uploads finish, we verify each file uploaded to S3 or
+// SFTP against its local copy. A mismatch fails the job.
+//
+// Credentials are resolved before anything else runs, so a job whose
+// credentials are missing or locked fails before it starts bagging.
+// Uploads get copies of the storage services with the resolved
+// credentials. The job keeps the references.
+func RunJobWithExtendedUploads(job *core.Job, messageChannel chan *core.EventMessage) int {
+	allOps := job.UploadOps
+	plan, err := planJobUploads(job)
+	if err != nil {
+		messageChannel <- core.WarningEvent(constants.StageUpload, fmt.Sprintf("Job cannot start: %v", err))
+		return constants.ExitRuntimeErr
+	}
+	restoreCredentials, err := resolveUploadCredentials(allOps)
+	if err != nil {
+		messageChannel <- core.WarningEvent(constants.StageUpload, fmt.Sprintf("Job cannot start: %v", err))
+		return constants.ExitRuntimeErr
+	}
+	defer restoreCredentials()
+	runnerOps, dartOps := splitUploads(allOps, plan)
+	job.UploadOps = runnerOps
+	exitCode := core.RunJobWithMessageChannel(job, false, messageChannel)
+	job.UploadOps = allOps
+	verifications := make([]*UploadVerification, 0)
+	if exitCode == constants.ExitOK && len(runnerOps) > 0 {
+		verifications, exitCode = VerifyUploadOperations(runnerOps, messageChannel)
+	}
+	if exitCode == constants.ExitOK && len(dartOps) > 0 {
+		var dartVerifications []*UploadVerification
+		dartVerifications, exitCode = runDARTUploads(dartOps, plan, messageChannel)
+		verifications = append(verifications, dartVerifications...)
+	}
+	if len(verifications) > 0 {
+		saveUploadVerificationReport(job.Name(), job.ID, verifications)
+	}
+	return exitCode
+}
+
+// RunUploadJobWithExtendedUploads is the upload-only job equivalent
+// of RunJobWithExtendedUploads. If the job includes directories, a
+// key prefix or S3 services with settings DART Runner would ignore,
+// DART runs all of its uploads. See runDirectoryUploadJob.
+func RunUploadJobWithExtendedUploads(uploadJob *core.UploadJob, messageChannel chan *core.EventMessage) int {
+	allOps := uploadJob.UploadOps
+	restoreCredentials, err := resolveUploadCredentials(allOps)
+	if err != nil {
+		messageChannel <- core.WarningEvent(constants.StageUpload, fmt.Sprintf("Job cannot start: %v", err))
+		return constants.ExitRuntimeErr
+	}
+	defer restoreCredentials()
+	if opts := GetUploadJobOptions(uploadJob.ID); uploadJobRunsInDART(uploadJob, opts) {
+		return runDirectoryUploadJob(uploadJob, opts, messageChannel)
+	}
+	others, extendedOps := SplitExtendedUploads(allOps)
+	exitCode := constants.ExitOK
+	if len(others) > 0 {
+		uploadJob.UploadOps = others
+		exitCode = uploadJob.Run(messageChannel)
+		uploadJob.UploadOps = allOps
+		if exitCode == constants.ExitOK {
+			var verifications []*UploadVerification
+			verifications, exitCode = VerifyUploadOperations(others, messageChannel)
+			saveUploadVerificationReport(uploadJobName(uploadJob), uploadJob.ID, verifications)
+		}
+	}
+	if exitCode != constants.ExitOK || len(extendedOps) == 0 {
+		return exitCode
+	}
+	return RunExtendedUploads(extendedOps, messageChannel)
+}
+
+// RunExtendedUploads uploads each operation's source files to its
+// storage service, recording the outcome in the operation's Result.
+// It reports progress through messageChannel and returns ExitOK
+// if all uploads succeeded.
+func RunExtendedUploads(ops []*core.UploadOperation, messageChannel chan *core.EventMessage) int {
+	_, exitCode := runDARTUploads(ops, nil, messageChannel)
+	return exitCode
+}
+
+// runDARTUploads uploads each operation's source files under the
+// keys in plan, or under their own names if plan has none for them.
+// Filesystem and WebDAV uploads verify each file as they go. S3 and
+// SFTP uploads are verified afterwards, and runDARTUploads returns
+// those verifications along with the exit code. A nil plan means
+// every file goes under its own name with default settings.
+func runDARTUploads(ops []*core.UploadOperation, plan *uploadPlan, messageChannel chan *core.EventMessage) ([]*UploadVerification, int) {
+	if plan == nil {
+		plan = &uploadPlan{}
+	}
+	verifications := make([]*UploadVerification, 0)
+	exitCode := constants.ExitOK
+	for _, op := range ops {
+		ss := op.StorageService
+		provider, upload := dartUploader(ss.Protocol)
+		if upload == nil {
+			messageChannel <- core.WarningEvent(constants.StageUpload, fmt.Sprintf("DART cannot upload to %s using protocol %s", ss.Name, ss.Protocol))
+			exitCode = constants.ExitRuntimeErr
+			continue
+		}
+		if putOpts, ok := plan.s3Options[op]; ok {
+			upload = func(ss *core.StorageService, sourcePath, key string) (string, error) {
+				return UploadToS3WithOptions(ss, sourcePath, key, putOpts)
+			}
+			messageChannel <- core.InfoEvent(constants.StageUpload, fmt.Sprintf("Uploading to %s with %s", ss.Name, describeS3PutOptions(putOpts)))
+		}
+		verifiesAfterUpload := !IsExtendedProtocol(ss.Protocol)
+		op.Result = core.NewOperationResult("upload", provider)
+		op.Result.Start()
+		errors := make(map[string]string)
+		for _, sourcePath := range op.SourceFiles {
+			key := plan.keys.Key(op, sourcePath)
+			messageChannel <- core.InfoEvent(constants.StageUpload, fmt.Sprintf("Copying %s to %s as %s", sourcePath, ss.Name, key))
+			targetPath, err := upload(ss, sourcePath, key)
+			if err != nil {
+				errors[sourcePath] = err.Error()
+				messageChannel <- core.WarningEvent(constants.StageUpload, fmt.Sprintf("Copy of %s to %s failed: %v", sourcePath, ss.Name, err))
+				continue
+			}
+			op.Result.RemoteTargetName = targetPath
+			if !verifiesAfterUpload {
+				messageChannel <- core.InfoEvent(constants.StageUpload, fmt.Sprintf("Copied %s to %s and verified the copy", sourcePath, targetPath))
+				continue
+			}
+			v := VerifyUploadAs(ss, sourcePath, key)
+			verifications = append(verifications, v)
+			if !v.OK() {
+				errors[sourcePath] = fmt.Sprintf("Upload verification failed: %s", v.Error)
+				messageChannel <- core.WarningEvent(constants.StageUpload, fmt.Sprintf("Upload verification failed for %s on %s: %s", sourcePath, ss.Name, v.Error))
+				continue
+			}
+			if v.Actual != "" {
+				op.Result.RemoteChecksum = v.Actual
+			}
+			op.Result.Info = strings.TrimSpace(op.Result.Info + " " + v.Summary())
+			messageChannel <- core.InfoEvent(constants.StageUpload, fmt.Sprintf("Copied %s to %s. %s", sourcePath, targetPath, v.Summary()))
+		}
+		op.Result.Finish(errors)
+		if len(errors) > 0 {
+			exitCode = constants.ExitRuntimeErr
+		}
+	}
+	return verifications, exitCode
+}
+
+// uploadJobName returns a name for uploadJob to use in artifacts.
+// Upload jobs have no bag, so we use the name of the first file.
+func uploadJobName(uploadJob *core.UploadJob) string {
+	if len(uploadJob.PathsToUpload) == 0 {
+		return "Upload Job"
+	}
+	return filepath.Base(uploadJob.PathsToUpload[0])
+}
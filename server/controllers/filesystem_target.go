@@ -0,0 +1,162 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/APTrust/dart-runner/core"
+	"github.com/google/uuid"
+)
+
+// ProtocolFilesystem is the protocol for storage services that copy
+// bags to a local directory, which is typically a mounted network
+// share. The service's Bucket is the absolute path of the directory.
+const ProtocolFilesystem = "filesystem"
+
+// FilesystemUploadProvider is the provider name we record in the
+// results of filesystem uploads.
+const FilesystemUploadProvider = "DART filesystem copier"
+
+// IsFilesystemService returns true if ss copies to a local directory.
+func IsFilesystemService(ss *core.StorageService) bool {
+	return ss != nil && ss.Protocol == ProtocolFilesystem
+}
+
+// validateFilesystemService checks that ss has a name and an existing
+// target directory, setting ss.Errors.
+func validateFilesystemService(ss *core.StorageService) bool {
+	ss.Errors = make(map[string]string)
+	if strings.TrimSpace(ss.Name) == "" {
+		ss.Errors["Name"] = "StorageService requires a name."
+	}
+	if !filepath.IsAbs(ss.Bucket) {
+		ss.Errors["Bucket"] = "Target directory must be an absolute path."
+	} else if stat, err := os.Stat(ss.Bucket); err != nil || !stat.IsDir() {
+		ss.Errors["Bucket"] = fmt.Sprintf("Target directory %s does not exist.", ss.Bucket)
+	}
+	return len(ss.Errors) == 0
+}
+
+// CopyToFilesystem copies the file or directory at sourcePath into the
+// target directory of filesystem service ss and returns the path of
+// the copy. We copy to a temporary name first and verify a SHA-256
+// checksum of every file before renaming, so the target directory
+// never contains a partial or corrupt bag under its real name.
+// An existing file or directory with the same name is replaced.
+func CopyToFilesystem(ss *core.StorageService, sourcePath string) (string, error) {
+	return CopyToFilesystemAs(ss, sourcePath, filepath.Base(sourcePath))
+}
+
+// CopyToFilesystemAs is like CopyToFilesystem, but it copies to key,
+// a slash-separated path relative to the target directory. It creates
+// any directories the key names.
+func CopyToFilesystemAs(ss *core.StorageService, sourcePath, key string) (string, error) {
+	if !IsFilesystemService(ss) {
+		return "", fmt.Errorf("Storage service %s is not a filesystem service", ss.Name)
+	}
+	if err := checkKeySegments(key); err != nil {
+		return "", err
+	}
+	sourceInfo, err := os.Stat(sourcePath)
+	if err != nil {
+		return "", err
+	}
+	targetPath := filepath.Join(ss.Bucket, filepath.FromSlash(key))
+	targetDir := filepath.Dir(targetPath)
+	if err = os.MkdirAll(targetDir, 0755); err != nil {
+		return "", err
+	}
+	tempPath := filepath.Join(targetDir, fmt.Sprintf(".%s.dart-tmp-%s", filepath.Base(targetPath), uuid.NewString()))
+	if sourceInfo.IsDir() {
+		err = copyDirVerified(sourcePath, tempPath)
+	} else {
+		err = copyFileVerified(sourcePath, tempPath)
+	}
+	if err != nil {
+		os.RemoveAll(tempPath)
+		return "", err
+	}
+	if err = os.RemoveAll(targetPath); err != nil {
+		os.RemoveAll(tempPath)
+		return "", err
+	}
+	if err = os.Rename(tempPath, targetPath); err != nil {
+		os.RemoveAll(tempPath)
+		return "", err
+	}
+	return targetPath, nil
+}
+
+func copyDirVerified(sourceDir, targetDir string) error {
+	return filepath.WalkDir(sourceDir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(sourceDir, filePath)
+		if err != nil {
+			return err
+		}
+		targetPath := filepath.Join(targetDir, relPath)
+		if entry.IsDir() {
+			return os.MkdirAll(targetPath, 0755)
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		return copyFileVerified(filePath, targetPath)
+	})
+}
+
+// copyFileVerified copies sourcePath to targetPath, then reads the copy
+// back and compares its SHA-256 checksum to the source's.
+func copyFileVerified(sourcePath, targetPath string) error {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	target, err := os.OpenFile(targetPath, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	sourceHash := sha256.New()
+	_, err = io.Copy(target, io.TeeReader(source, sourceHash))
+	if err == nil {
+		err = target.Sync()
+	}
+	closeErr := target.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	expected := hex.EncodeToString(sourceHash.Sum(nil))
+	actual, err := sha256File(targetPath)
+	if err != nil {
+		return err
+	}
+	if actual != expected {
+		return fmt.Errorf("Checksum mismatch for %s: source sha256 %s, copy sha256 %s", sourcePath, expected, actual)
+	}
+	return nil
+}
+
+func sha256File(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,130 @@
+package controllers_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart/v3/server/controllers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getFilesystemService(t *testing.T) *core.StorageService {
+	ss := core.NewStorageService()
+	ss.Name = "NAS"
+	ss.Protocol = controllers.ProtocolFilesystem
+	ss.Bucket = t.TempDir()
+	ss.AllowsUpload = true
+	return ss
+}
+
+func TestValidateFilesystemStorageService(t *testing.T) {
+	ss := getFilesystemService(t)
+	assert.True(t, controllers.ValidateStorageService(ss))
+	assert.Empty(t, ss.Errors)
+
+	ss.Name = ""
+	ss.Bucket = "relative/path"
+	assert.False(t, controllers.ValidateStorageService(ss))
+	assert.Equal(t, "StorageService requires a name.", ss.Errors["Name"])
+	assert.Equal(t, "Target directory must be an absolute path.", ss.Errors["Bucket"])
+
+	ss.Bucket = filepath.Join(t.TempDir(), "does-not-exist")
+	assert.False(t, controllers.ValidateStorageService(ss))
+	assert.Contains(t, ss.Errors["Bucket"], "does not exist")
+}
+
+func TestSplitExtendedUploads(t *testing.T) {
+	fsService := getFilesystemService(t)
+	s3Service := core.NewStorageService()
+	s3Service.Protocol = constants.ProtocolS3
+	ops := []*core.UploadOperation{
+		{StorageService: s3Service},
+		{StorageService: fsService},
+	}
+	others, filesystemOps := controllers.SplitExtendedUploads(ops)
+	require.Equal(t, 1, len(others))
+	require.Equal(t, 1, len(filesystemOps))
+	assert.Equal(t, s3Service, others[0].StorageService)
+	assert.Equal(t, fsService, filesystemOps[0].StorageService)
+}
+
+func TestCopyToFilesystem(t *testing.T) {
+	ss := getFilesystemService(t)
+
+	// Serialized bag
+	sourceDir := t.TempDir()
+	tarFile := filepath.Join(sourceDir, "bag.tar")
+	require.NoError(t, os.WriteFile(tarFile, []byte("pretend this is a tarred bag"), 0644))
+	targetPath, err := controllers.CopyToFilesystem(ss, tarFile)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(ss.Bucket, "bag.tar"), targetPath)
+	data, err := os.ReadFile(targetPath)
+	require.NoError(t, err)
+	assert.Equal(t, "pretend this is a tarred bag", string(data))
+
+	// Copying again replaces the existing copy.
+	require.NoError(t, os.WriteFile(tarFile, []byte("version two"), 0644))
+	_, err = controllers.CopyToFilesystem(ss, tarFile)
+	require.NoError(t, err)
+	data, err = os.ReadFile(targetPath)
+	require.NoError(t, err)
+	assert.Equal(t, "version two", string(data))
+
+	// Unserialized bag
+	bagDir := filepath.Join(sourceDir, "my_bag")
+	require.NoError(t, os.MkdirAll(filepath.Join(bagDir, "data", "sub"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(bagDir, "bagit.txt"), []byte("BagIt-Version: 1.0"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(bagDir, "data", "sub", "file.txt"), []byte("payload"), 0644))
+	targetPath, err = controllers.CopyToFilesystem(ss, bagDir)
+	require.NoError(t, err)
+	data, err = os.ReadFile(filepath.Join(targetPath, "data", "sub", "file.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "payload", string(data))
+
+	// No temp files should be left behind.
+	entries, err := os.ReadDir(ss.Bucket)
+	require.NoError(t, err)
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+	assert.ElementsMatch(t, []string{"bag.tar", "my_bag"}, names)
+
+	// Missing source file
+	_, err = controllers.CopyToFilesystem(ss, filepath.Join(sourceDir, "nope.tar"))
+	assert.Error(t, err)
+}
+
+func TestRunExtendedUploads(t *testing.T) {
+	ss := getFilesystemService(t)
+	sourceFile := filepath.Join(t.TempDir(), "bag.tar")
+	require.NoError(t, os.WriteFile(sourceFile, []byte("bag"), 0644))
+	op := core.NewUploadOperation(ss, []string{sourceFile})
+
+	messageChannel := make(chan *core.EventMessage, 10)
+	exitCode := controllers.RunExtendedUploads([]*core.UploadOperation{op}, messageChannel)
+	assert.Equal(t, constants.ExitOK, exitCode)
+	assert.Empty(t, op.Result.Errors)
+	assert.Equal(t, controllers.FilesystemUploadProvider, op.Result.Provider)
+	assert.FileExists(t, filepath.Join(ss.Bucket, "bag.tar"))
+
+	// Missing source file should fail.
+	op = core.NewUploadOperation(ss, []string{sourceFile + ".missing"})
+	exitCode = controllers.RunExtendedUploads([]*core.UploadOperation{op}, messageChannel)
+	assert.Equal(t, constants.ExitRuntimeErr, exitCode)
+	assert.Equal(t, 1, len(op.Result.Errors))
+}
+
+func TestDiagnoseFilesystemConnection(t *testing.T) {
+	ss := getFilesystemService(t)
+	diagnosis := controllers.DiagnoseConnection(ss)
+	assert.True(t, diagnosis.Succeeded(), diagnosis.Summary())
+	require.Equal(t, 2, len(diagnosis.Steps))
+	entries, err := os.ReadDir(ss.Bucket)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
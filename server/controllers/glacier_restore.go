@@ -0,0 +1,368 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart-runner/util"
+	"github.com/minio/minio-go/v7"
+)
+
+// Statuses of a GlacierRestore.
+const (
+	// GlacierRestorePending means S3 is still restoring the object.
+	GlacierRestorePending = "pending"
+	// GlacierRestoreDownloading means the restore finished and DART
+	// is downloading the restored copy in a BackgroundTask.
+	GlacierRestoreDownloading = "downloading"
+	// GlacierRestoreDownloaded means the restore finished and DART
+	// downloaded the restored copy.
+	GlacierRestoreDownloaded = "downloaded"
+	// GlacierRestoreFailed means the restore or the download
+	// that follows it failed. See GlacierRestore.Error.
+	GlacierRestoreFailed = "failed"
+)
+
+// GlacierRestoreCheckInterval is how often MonitorGlacierRestores
+// checks on pending restores. Even expedited restores take a few
+// minutes, and most take hours, so there's no use checking more often.
+const GlacierRestoreCheckInterval = 15 * time.Minute
+
+// MaxGlacierRestoreDays is the longest we let a restored copy live.
+// S3 charges for restored copies at the Standard rate, on top of the
+// archived original.
+const MaxGlacierRestoreDays = 365
+
+// glacierRestoreTierChoices are the S3 retrieval tiers. Deep Archive
+// does not offer Expedited retrieval.
+var glacierRestoreTierChoices = []core.Choice{
+	{Label: "Standard (3-5 hours, or 12 hours from Deep Archive)", Value: string(minio.TierStandard)},
+	{Label: "Bulk (5-12 hours, or 48 hours from Deep Archive)", Value: string(minio.TierBulk)},
+	{Label: "Expedited (1-5 minutes, Glacier only)", Value: string(minio.TierExpedited)},
+}
+
+// GlacierRestore tracks a request to restore an object from Glacier
+// or Deep Archive. When S3 finishes the restore, DART downloads the
+// restored copy. See CheckGlacierRestores.
+type GlacierRestore struct {
+	ID                 string    `json:"id"`
+	StorageServiceID   string    `json:"storageServiceId"`
+	StorageServiceName string    `json:"storageServiceName"`
+	Bucket             string    `json:"bucket"`
+	Key                string    `json:"key"`
+	StorageClass       string    `json:"storageClass"`
+	Size               int64     `json:"size"`
+	Tier               string    `json:"tier"`
+	Days               int       `json:"days"`
+	Status             string    `json:"status"`
+	RequestedAt        time.Time `json:"requestedAt"`
+	// RestoredAt is when DART noticed the restore had finished.
+	RestoredAt time.Time `json:"restoredAt"`
+	// ExpiresAt is when S3 deletes the restored copy.
+	ExpiresAt    time.Time `json:"expiresAt"`
+	DownloadPath string    `json:"downloadPath"`
+	Error        string    `json:"error"`
+	// Seen is true once the user has seen the outcome of the restore.
+	Seen bool `json:"seen"`
+}
+
+var glacierRestoreStore = NewJSONStore[GlacierRestore]("glacier_restores.json")
+
+// glacierCheckMutex keeps the monitor and the user from checking
+// restores at the same time. We hold it only while updating statuses,
+// never while downloading.
+var glacierCheckMutex sync.Mutex
+
+// Finished returns true if the restore and the download
+// that follows it are done, or if either one failed.
+func (restore *GlacierRestore) Finished() bool {
+	return restore.Status == GlacierRestoreDownloaded || restore.Status == GlacierRestoreFailed
+}
+
+// DownloadRunning returns true if a BackgroundTask is downloading
+// the restored copy right now.
+func (restore *GlacierRestore) DownloadRunning() bool {
+	return restore.Status == GlacierRestoreDownloading && BackgroundTaskRunning(restore.ID)
+}
+
+// Validate returns a map of field names to error messages. The map
+// is empty if the restore request is valid.
+func (restore *GlacierRestore) Validate() map[string]string {
+	errors := make(map[string]string)
+	validTier := false
+	for _, choice := range glacierRestoreTierChoices {
+		validTier = validTier || choice.Value == restore.Tier
+	}
+	if !validTier {
+		errors["Tier"] = "Please choose a retrieval tier."
+	} else if restore.Tier == string(minio.TierExpedited) && restore.StorageClass == "DEEP_ARCHIVE" {
+		errors["Tier"] = "Expedited retrieval is not available for objects in Deep Archive."
+	}
+	if restore.Days < 1 || restore.Days > MaxGlacierRestoreDays {
+		errors["Days"] = fmt.Sprintf("Days must be a whole number from 1 to %d.", MaxGlacierRestoreDays)
+	}
+	return errors
+}
+
+// S3StorageClass returns the storage class of an S3 object. Listings
+// fill in objInfo.StorageClass, but a stat returns the storage class
+// only as a header, and leaves even that out for standard storage.
+func S3StorageClass(objInfo minio.ObjectInfo) string {
+	if objInfo.StorageClass != "" {
+		return objInfo.StorageClass
+	}
+	if storageClass := objInfo.Metadata.Get("X-Amz-Storage-Class"); storageClass != "" {
+		return storageClass
+	}
+	return "STANDARD"
+}
+
+// IsArchiveStorageClass returns true for the S3 storage classes
+// whose objects must be restored before anyone can read them.
+func IsArchiveStorageClass(storageClass string) bool {
+	return storageClass == "GLACIER" || storageClass == "DEEP_ARCHIVE"
+}
+
+// IsArchivedS3Object returns true if the object described by objInfo,
+// which must come from a stat, is in Glacier or Deep Archive and has
+// no restored copy we can read.
+func IsArchivedS3Object(objInfo minio.ObjectInfo) bool {
+	if !IsArchiveStorageClass(S3StorageClass(objInfo)) {
+		return false
+	}
+	return objInfo.Restore == nil || objInfo.Restore.OngoingRestore
+}
+
+// archivedObjectError explains why we can't download an object that
+// IsArchivedS3Object says is archived.
+func archivedObjectError(key string, objInfo minio.ObjectInfo) error {
+	if objInfo.Restore != nil && objInfo.Restore.OngoingRestore {
+		return fmt.Errorf("%s is still being restored from %s storage. Please try again when the restore finishes.", key, S3StorageClass(objInfo))
+	}
+	return fmt.Errorf("%s is in %s storage. Please request a restore before downloading it.", key, S3StorageClass(objInfo))
+}
+
+// RequestGlacierRestore asks S3 to restore restore.Key for restore.Days
+// at restore.Tier, and fills in the object's storage class and size.
+// Asking again while a restore is in progress is not an error.
+func RequestGlacierRestore(ss *core.StorageService, restore *GlacierRestore) error {
+	client, err := NewMinioClient(ss)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DiagnosticTimeout)
+	defer cancel()
+	objInfo, err := client.StatObject(ctx, restore.Bucket, restore.Key, minio.StatObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("Cannot find %s in bucket %s: %v", restore.Key, restore.Bucket, err)
+	}
+	restore.StorageClass = S3StorageClass(objInfo)
+	restore.Size = objInfo.Size
+	if !IsArchiveStorageClass(restore.StorageClass) {
+		return fmt.Errorf("%s is in %s storage and can be downloaded without a restore.", restore.Key, restore.StorageClass)
+	}
+	if message, ok := restore.Validate()["Tier"]; ok {
+		return fmt.Errorf("%s", message)
+	}
+	req := minio.RestoreRequest{}
+	req.SetDays(restore.Days)
+	req.SetGlacierJobParameters(minio.GlacierJobParameters{Tier: minio.TierType(restore.Tier)})
+	err = client.RestoreObject(ctx, restore.Bucket, restore.Key, objInfo.VersionID, req)
+	if err != nil {
+		// S3 answers a new restore request with 202 Accepted and no
+		// body. RestoreObject accepts 202, but minio-go's request layer
+		// counts only 200, 204 and 206 as success, so the 202 reaches
+		// us as an error before RestoreObject can check it.
+		errResponse := minio.ToErrorResponse(err)
+		if errResponse.StatusCode != http.StatusAccepted && errResponse.Code != "RestoreAlreadyInProgress" {
+			return fmt.Errorf("S3 refused to restore %s: %v", restore.Key, err)
+		}
+	}
+	restore.StorageServiceName = ss.Name
+	restore.Status = GlacierRestorePending
+	restore.RequestedAt = time.Now()
+	return nil
+}
+
+// CheckGlacierRestores checks whether S3 has finished any pending
+// restores, and starts a BackgroundTask to download each restored copy
+// into DART's downloads folder. It doesn't wait for the downloads. It
+// returns the number of restores that finished since the last check.
+func CheckGlacierRestores() (int, error) {
+	downloads, finished, err := updateGlacierRestores()
+	for _, restore := range downloads {
+		startGlacierRestoreDownload(restore)
+	}
+	return finished, err
+}
+
+// updateGlacierRestores saves the new status of each pending restore,
+// and returns the restores whose restored copies need downloading.
+// Those include downloads that stopped when DART quit.
+func updateGlacierRestores() ([]GlacierRestore, int, error) {
+	glacierCheckMutex.Lock()
+	defer glacierCheckMutex.Unlock()
+	downloads := make([]GlacierRestore, 0)
+	restores, err := glacierRestoreStore.Load()
+	if err != nil {
+		return downloads, 0, err
+	}
+	finished := 0
+	for i := range restores {
+		restore := &restores[i]
+		if restore.Status == GlacierRestorePending {
+			if !checkGlacierRestore(restore) {
+				continue
+			}
+			finished++
+			if err = saveGlacierRestore(restore); err != nil {
+				return downloads, finished, err
+			}
+		}
+		if restore.Status == GlacierRestoreDownloading {
+			downloads = append(downloads, *restore)
+		}
+	}
+	return downloads, finished, nil
+}
+
+// MonitorGlacierRestores checks pending restores every interval for
+// as long as DART is running.
+func MonitorGlacierRestores(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := CheckGlacierRestores(); err != nil {
+			core.Dart.Log.Errorf("Error checking Glacier restores: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+// UnseenGlacierRestores returns finished restores whose outcome the
+// user hasn't seen yet.
+func UnseenGlacierRestores() ([]GlacierRestore, error) {
+	restores, err := glacierRestoreStore.Load()
+	if err != nil {
+		return nil, err
+	}
+	unseen := make([]GlacierRestore, 0)
+	for _, restore := range restores {
+		if restore.Finished() && !restore.Seen {
+			unseen = append(unseen, restore)
+		}
+	}
+	return unseen, nil
+}
+
+// checkGlacierRestore updates a pending restore and returns true if
+// S3 finished restoring it. If S3 can't be reached, the restore stays
+// pending until the next check. If the restored copy expired before
+// we saw it, the restore fails.
+func checkGlacierRestore(restore *GlacierRestore) bool {
+	ss := core.ObjFind(restore.StorageServiceID).StorageService()
+	if ss == nil {
+		restore.Status = GlacierRestoreFailed
+		restore.Error = fmt.Sprintf("Storage service %s no longer exists.", restore.StorageServiceName)
+		return true
+	}
+	client, err := NewMinioClient(ss)
+	if err != nil {
+		core.Dart.Log.Warningf("Cannot check restore of %s: %v", restore.Key, err)
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DiagnosticTimeout)
+	defer cancel()
+	objInfo, err := client.StatObject(ctx, restore.Bucket, restore.Key, minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			restore.Status = GlacierRestoreFailed
+			restore.Error = fmt.Sprintf("%s is no longer in bucket %s.", restore.Key, restore.Bucket)
+			return true
+		}
+		core.Dart.Log.Warningf("Cannot check restore of %s: %v", restore.Key, err)
+		return false
+	}
+	if objInfo.Restore == nil && IsArchiveStorageClass(S3StorageClass(objInfo)) {
+		// S3 reports an ongoing restore as soon as we request it, so
+		// an archived object with neither an ongoing restore nor an
+		// expiry date had a restored copy that expired before we
+		// could download it, probably while DART was closed.
+		restore.Status = GlacierRestoreFailed
+		restore.Error = fmt.Sprintf("The restored copy of %s expired before DART could download it. Please request the restore again.", restore.Key)
+		return true
+	}
+	if IsArchivedS3Object(objInfo) {
+		return false
+	}
+	restore.RestoredAt = time.Now()
+	if objInfo.Restore != nil {
+		restore.ExpiresAt = objInfo.Restore.ExpiryTime
+	}
+	restore.Status = GlacierRestoreDownloading
+	return true
+}
+
+// startGlacierRestoreDownload downloads the restored copy of restore
+// in a BackgroundTask, unless a task is already downloading it. The
+// download resumes from any partial file an earlier attempt left.
+func startGlacierRestoreDownload(restore GlacierRestore) {
+	StartBackgroundTask(restore.ID, fmt.Sprintf("Downloading %s", restore.Key), func(ctx context.Context, task *BackgroundTask) {
+		// An earlier task may have finished the download
+		// after our caller loaded the restore.
+		if current, err := findGlacierRestore(restore.ID); err != nil || current.Status != GlacierRestoreDownloading {
+			return
+		}
+		localPath, err := LocalPathForKey(core.Dart.Paths.Downloads, restore.Key)
+		if err == nil {
+			_, err = DownloadS3ObjectWithProgress(ctx, restore.StorageServiceID, restore.Bucket, restore.Key, localPath, func(downloaded, total int64) {
+				task.SetProgress(downloaded, total, fmt.Sprintf("Downloaded %s of %s.", util.HumanSize(downloaded), util.HumanSize(total)))
+			})
+		}
+		switch finishedTaskStatus(ctx, err) {
+		case TaskCompleted:
+			restore.Status = GlacierRestoreDownloaded
+			restore.DownloadPath = localPath
+			core.Dart.Log.Infof("Downloaded restored object %s to %s", restore.Key, localPath)
+		case TaskCanceled:
+			restore.Status = GlacierRestoreFailed
+			restore.Error = "Restore finished, but the download was canceled."
+		default:
+			restore.Status = GlacierRestoreFailed
+			restore.Error = fmt.Sprintf("Restore finished, but the download failed: %v", err)
+			core.Dart.Log.Errorf("Download of restored object %s failed: %v", restore.Key, err)
+		}
+		if err := saveGlacierRestore(&restore); err != nil {
+			core.Dart.Log.Errorf("Cannot save restore of %s: %v", restore.Key, err)
+		}
+	})
+}
+
+func findGlacierRestore(id string) (*GlacierRestore, error) {
+	restores, err := glacierRestoreStore.Load()
+	if err != nil {
+		return nil, err
+	}
+	for i := range restores {
+		if restores[i].ID == id {
+			return &restores[i], nil
+		}
+	}
+	return nil, fmt.Errorf("No Glacier restore with id %s", id)
+}
+
+func saveGlacierRestore(restore *GlacierRestore) error {
+	return glacierRestoreStore.Update(func(restores []GlacierRestore) ([]GlacierRestore, error) {
+		for i := range restores {
+			if restores[i].ID == restore.ID {
+				restores[i] = *restore
+				return restores, nil
+			}
+		}
+		return append(restores, *restore), nil
+	})
+}
@@ -0,0 +1,134 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// GET /glacier_restores
+func GlacierRestoreIndex(c *gin.Context) {
+	restores, err := glacierRestoreStore.Load()
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+		return
+	}
+	sort.Slice(restores, func(i, j int) bool { return restores[i].RequestedAt.After(restores[j].RequestedAt) })
+	data := gin.H{
+		"restores":       restores,
+		"downloadFolder": core.Dart.Paths.Downloads,
+		"flash":          GetFlashCookie(c),
+		"helpUrl":        GetHelpUrl(c),
+	}
+	c.HTML(http.StatusOK, "glacier_restore/index.html", data)
+
+	// The user has now seen the outcome of every finished restore,
+	// so the dashboard can stop mentioning them.
+	err = glacierRestoreStore.Update(func(restores []GlacierRestore) ([]GlacierRestore, error) {
+		for i := range restores {
+			restores[i].Seen = restores[i].Seen || restores[i].Finished()
+		}
+		return restores, nil
+	})
+	if err != nil {
+		core.Dart.Log.Errorf("Cannot mark Glacier restores as seen: %v", err)
+	}
+}
+
+// GET /glacier_restores/new?ssid=<id>&bucket=<name>&key=<key>
+func GlacierRestoreNew(c *gin.Context) {
+	restore := &GlacierRestore{
+		StorageServiceID: c.Query("ssid"),
+		Bucket:           c.Query("bucket"),
+		Key:              c.Query("key"),
+		Tier:             glacierRestoreTierChoices[0].Value,
+		Days:             7,
+	}
+	data := gin.H{
+		"restore": restore,
+		"form":    glacierRestoreForm(restore, strconv.Itoa(restore.Days)),
+		"helpUrl": GetHelpUrl(c),
+	}
+	c.HTML(http.StatusOK, "glacier_restore/new.html", data)
+}
+
+// POST /glacier_restores/new
+func GlacierRestoreCreate(c *gin.Context) {
+	restore := &GlacierRestore{
+		ID:               uuid.NewString(),
+		StorageServiceID: c.PostForm("ssid"),
+		Bucket:           c.PostForm("bucket"),
+		Key:              c.PostForm("key"),
+		Tier:             c.PostForm("Tier"),
+	}
+	days := c.PostForm("Days")
+	restore.Days, _ = strconv.Atoi(days)
+	form := glacierRestoreForm(restore, days)
+	errors := restore.Validate()
+	ss := core.ObjFind(restore.StorageServiceID).StorageService()
+	if ss == nil || ss.Protocol != constants.ProtocolS3 {
+		errors["Tier"] = "Restores are available only for objects on S3 services."
+	}
+	if len(errors) == 0 {
+		if err := RequestGlacierRestore(ss, restore); err != nil {
+			errors["Tier"] = err.Error()
+		}
+	}
+	if len(errors) > 0 {
+		for fieldName, message := range errors {
+			form.Fields[fieldName].Error = message
+		}
+		data := gin.H{
+			"restore": restore,
+			"form":    form,
+			"helpUrl": GetHelpUrl(c),
+		}
+		c.HTML(http.StatusBadRequest, "glacier_restore/new.html", data)
+		return
+	}
+	if err := saveGlacierRestore(restore); err != nil {
+		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+		return
+	}
+	core.Dart.Log.Infof("Requested %s restore of %s/%s for %d days", restore.Tier, restore.Bucket, restore.Key, restore.Days)
+	SetFlashCookie(c, fmt.Sprintf("Requested restore of %s. DART will download it to %s when the restore finishes.", restore.Key, core.Dart.Paths.Downloads))
+	c.Redirect(http.StatusFound, "/glacier_restores")
+}
+
+// POST /glacier_restores/check
+//
+// This doesn't wait for downloads of restored copies. They run
+// in the background, and the index page shows their progress.
+func GlacierRestoreCheck(c *gin.Context) {
+	finished, err := CheckGlacierRestores()
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+		return
+	}
+	SetFlashCookie(c, fmt.Sprintf("Checked pending restores. Restores finished since the last check: %d.", finished))
+	c.Redirect(http.StatusFound, "/glacier_restores")
+}
+
+func glacierRestoreForm(restore *GlacierRestore, days string) *core.Form {
+	form := core.NewForm("GlacierRestore", restore.ID, make(map[string]string))
+	form.AddField("ssid", "", restore.StorageServiceID, true)
+	form.AddField("bucket", "", restore.Bucket, true)
+	form.AddField("key", "", restore.Key, true)
+
+	tierField := form.AddField("Tier", "Retrieval Tier", restore.Tier, true)
+	for _, choice := range glacierRestoreTierChoices {
+		choice.Selected = choice.Value == restore.Tier
+		tierField.Choices = append(tierField.Choices, choice)
+	}
+	tierField.Help = "Faster tiers cost more. Times are typical, not guaranteed."
+
+	daysField := form.AddField("Days", "Keep Restored Copy For (Days)", days, true)
+	daysField.Help = "S3 deletes the restored copy after this many days. The archived original stays where it is. You pay Standard storage rates for the restored copy while it lasts."
+	return form
+}
@@ -0,0 +1,267 @@
+package controllers_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart/v3/server/controllers"
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGlacierRestoreValidate(t *testing.T) {
+	restore := &controllers.GlacierRestore{
+		Tier:         "Standard",
+		Days:         7,
+		StorageClass: "DEEP_ARCHIVE",
+	}
+	assert.Empty(t, restore.Validate())
+
+	restore.Tier = "Expedited"
+	restore.Days = 0
+	errors := restore.Validate()
+	assert.Equal(t, "Expedited retrieval is not available for objects in Deep Archive.", errors["Tier"])
+	assert.Equal(t, "Days must be a whole number from 1 to 365.", errors["Days"])
+
+	restore.StorageClass = "GLACIER"
+	restore.Days = 366
+	errors = restore.Validate()
+	assert.Empty(t, errors["Tier"])
+	assert.NotEmpty(t, errors["Days"])
+
+	restore.Tier = "Fast"
+	assert.Equal(t, "Please choose a retrieval tier.", restore.Validate()["Tier"])
+}
+
+func TestIsArchivedS3Object(t *testing.T) {
+	objInfo := minio.ObjectInfo{Metadata: http.Header{}}
+	assert.Equal(t, "STANDARD", controllers.S3StorageClass(objInfo))
+	assert.False(t, controllers.IsArchivedS3Object(objInfo))
+
+	objInfo.Metadata.Set("X-Amz-Storage-Class", "DEEP_ARCHIVE")
+	assert.Equal(t, "DEEP_ARCHIVE", controllers.S3StorageClass(objInfo))
+	assert.True(t, controllers.IsArchivedS3Object(objInfo))
+
+	objInfo.Restore = &minio.RestoreInfo{OngoingRestore: true}
+	assert.True(t, controllers.IsArchivedS3Object(objInfo))
+
+	objInfo.Restore = &minio.RestoreInfo{ExpiryTime: time.Now().Add(24 * time.Hour)}
+	assert.False(t, controllers.IsArchivedS3Object(objInfo))
+
+	// Listings report the storage class directly.
+	assert.True(t, controllers.IsArchivedS3Object(minio.ObjectInfo{StorageClass: "GLACIER"}))
+	assert.False(t, controllers.IsArchivedS3Object(minio.ObjectInfo{StorageClass: "GLACIER_IR"}))
+}
+
+func TestGlacierRestoreCreateWithoutS3Service(t *testing.T) {
+	defer core.ClearDartTable()
+	ss := getFilesystemService(t)
+	require.NoError(t, core.ObjSaveWithoutValidation(ss))
+	params := url.Values{}
+	params.Set("ssid", ss.ID)
+	params.Set("bucket", ss.Bucket)
+	params.Set("key", "bag.tar")
+	DoSimpleGetTest(t, "/glacier_restores/new?"+params.Encode(), []string{"Restore Archived Object", "Retrieval Tier", "bag.tar"})
+
+	params.Set("Tier", "Standard")
+	params.Set("Days", "none")
+	DoSimplePostTest(t, PostTestSettings{
+		EndpointUrl:          "/glacier_restores/new",
+		Params:               params,
+		ExpectedResponseCode: http.StatusBadRequest,
+		ExpectedContent: []string{
+			"Restores are available only for objects on S3 services.",
+			"Days must be a whole number from 1 to 365.",
+		},
+	})
+}
+
+// NOTE: This test assumes that local Minio server is running.
+// See the note at the top of download_job_controller_test.go.
+func TestRequestGlacierRestoreStandardObject(t *testing.T) {
+	defer core.ClearDartTable()
+	ss := loadMinioStorageService(t)
+	client, err := controllers.NewMinioClient(ss)
+	require.NoError(t, err)
+	key := "glacier-test/standard.tar"
+	content := "Not archived"
+	_, err = client.PutObject(context.Background(), ss.Bucket, key, strings.NewReader(content), int64(len(content)), minio.PutObjectOptions{})
+	require.NoError(t, err)
+
+	restore := &controllers.GlacierRestore{
+		StorageServiceID: ss.ID,
+		Bucket:           ss.Bucket,
+		Key:              key,
+		Tier:             "Standard",
+		Days:             7,
+	}
+	err = controllers.RequestGlacierRestore(ss, restore)
+	require.Error(t, err)
+	assert.Equal(t, "glacier-test/standard.tar is in STANDARD storage and can be downloaded without a restore.", err.Error())
+	assert.EqualValues(t, len(content), restore.Size)
+
+	// Nothing to check yet.
+	finished, err := controllers.CheckGlacierRestores()
+	require.NoError(t, err)
+	assert.Equal(t, 0, finished)
+	DoSimpleGetTest(t, "/glacier_restores", []string{"Archive Restores", "Check Now"})
+}
+
+// startArchiveS3Server starts an S3 stand-in that holds one object in
+// Deep Archive and answers restore requests. It returns a storage
+// service that points to it and a function that sets the object's
+// x-amz-restore header. An empty header means no restore. Every key
+// names the same object, whose content is archivedObjectContent.
+const archivedObjectContent = "restored bag"
+
+func startArchiveS3Server(t *testing.T) (*core.StorageService, func(string)) {
+	var mutex sync.Mutex
+	restoreHeader := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch {
+		case r.Method == http.MethodGet && r.URL.Query().Has("location"):
+			w.Header().Set("Content-Type", "application/xml")
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/"></LocationConstraint>`))
+		case r.Method == http.MethodHead || r.Method == http.MethodGet:
+			w.Header().Set("Content-Length", strconv.Itoa(len(archivedObjectContent)))
+			w.Header().Set("ETag", `"0123456789abcdef0123456789abcdef"`)
+			w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+			w.Header().Set("X-Amz-Storage-Class", "DEEP_ARCHIVE")
+			if restoreHeader != "" {
+				w.Header().Set("X-Amz-Restore", restoreHeader)
+			}
+			w.WriteHeader(http.StatusOK)
+			if r.Method == http.MethodGet {
+				w.Write([]byte(archivedObjectContent))
+			}
+		case r.Method == http.MethodPost && r.URL.Query().Has("restore"):
+			restoreHeader = `ongoing-request="true"`
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	}))
+	t.Cleanup(server.Close)
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(serverURL.Port())
+	require.NoError(t, err)
+
+	ss := core.NewStorageService()
+	ss.Name = "Archive S3"
+	ss.Protocol = constants.ProtocolS3
+	ss.Host = serverURL.Hostname()
+	ss.Port = port
+	ss.Bucket = "archive"
+	ss.Login = "login"
+	ss.Password = "password"
+	ss.AllowsDownload = true
+	require.NoError(t, core.ObjSaveWithoutValidation(ss))
+	return ss, func(header string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		restoreHeader = header
+	}
+}
+
+// If the restored copy expires while DART is closed, S3 reports the
+// object as archived with no restore at all. The request shouldn't
+// stay pending forever.
+func TestCheckGlacierRestoreExpiredCopy(t *testing.T) {
+	defer core.ClearDartTable()
+	ss, setRestoreHeader := startArchiveS3Server(t)
+
+	params := url.Values{}
+	params.Set("ssid", ss.ID)
+	params.Set("bucket", ss.Bucket)
+	params.Set("key", "bags/bag.tar")
+	params.Set("Tier", "Standard")
+	params.Set("Days", "3")
+	DoSimplePostTest(t, PostTestSettings{
+		EndpointUrl:              "/glacier_restores/new",
+		Params:                   params,
+		ExpectedResponseCode:     http.StatusFound,
+		ExpectedRedirectLocation: "/glacier_restores",
+	})
+
+	// S3 is still restoring the object.
+	finished, err := controllers.CheckGlacierRestores()
+	require.NoError(t, err)
+	assert.Equal(t, 0, finished)
+
+	// The restore finished and its copy expired before we checked again.
+	setRestoreHeader("")
+	finished, err = controllers.CheckGlacierRestores()
+	require.NoError(t, err)
+	assert.Equal(t, 1, finished)
+
+	unseen, err := controllers.UnseenGlacierRestores()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(unseen))
+	assert.Equal(t, controllers.GlacierRestoreFailed, unseen[0].Status)
+	assert.Contains(t, unseen[0].Error, "expired before DART could download it")
+}
+
+// Checking a finished restore only updates its status. The download
+// runs in the background, and the restore is finished when it's done.
+func TestCheckGlacierRestoreDownload(t *testing.T) {
+	defer core.ClearDartTable()
+	ss, setRestoreHeader := startArchiveS3Server(t)
+	key := "glacier-restore-test/bag.tar"
+	localPath, err := controllers.LocalPathForKey(core.Dart.Paths.Downloads, key)
+	require.NoError(t, err)
+	defer os.RemoveAll(filepath.Dir(localPath))
+
+	params := url.Values{}
+	params.Set("ssid", ss.ID)
+	params.Set("bucket", ss.Bucket)
+	params.Set("key", key)
+	params.Set("Tier", "Standard")
+	params.Set("Days", "3")
+	DoSimplePostTest(t, PostTestSettings{
+		EndpointUrl:              "/glacier_restores/new",
+		Params:                   params,
+		ExpectedResponseCode:     http.StatusFound,
+		ExpectedRedirectLocation: "/glacier_restores",
+	})
+
+	setRestoreHeader(fmt.Sprintf(`ongoing-request="false", expiry-date="%s"`, time.Now().Add(72*time.Hour).UTC().Format(http.TimeFormat)))
+	finished, err := controllers.CheckGlacierRestores()
+	require.NoError(t, err)
+	assert.Equal(t, 1, finished)
+
+	findRestore := func() *controllers.GlacierRestore {
+		unseen, err := controllers.UnseenGlacierRestores()
+		require.NoError(t, err)
+		for i := range unseen {
+			if unseen[i].Key == key {
+				return &unseen[i]
+			}
+		}
+		return nil
+	}
+	require.Eventually(t, func() bool { return findRestore() != nil }, 10*time.Second, 50*time.Millisecond)
+	restore := findRestore()
+	assert.Equal(t, controllers.GlacierRestoreDownloaded, restore.Status, restore.Error)
+	assert.Equal(t, localPath, restore.DownloadPath)
+	assert.False(t, restore.ExpiresAt.IsZero())
+	data, err := os.ReadFile(localPath)
+	require.NoError(t, err)
+	assert.Equal(t, archivedObjectContent, string(data))
+	DoSimpleGetTest(t, "/glacier_restores", []string{"Downloaded to " + localPath})
+}
@@ -12,6 +12,8 @@ var HelpUrlFor = map[string]string{
 	"AppSettingIndex":                "users/settings/app_settings/",
 	"AppSettingNew":                  "users/settings/app_settings/",
 	"AppSettingSave":                 "users/settings/app_settings/",
+	"BackgroundTaskCancel":           "",
+	"BackgroundTaskStatus":           "",
 	"BagItProfileCreate":             "users/bagit/creating/",
 	"BagItProfileCreateTagFile":      "users/bagit/customizing/#adding-a-new-tag-file",
 	"BagItProfileDelete":             "users/bagit/",
@@ -64,6 +66,11 @@ var HelpUrlFor = map[string]string{
 	"RemoteRepositoryNew":            "users/settings/remote_repositories/",
 	"RemoteRepositorySave":           "users/settings/remote_repositories/",
 	"RemoteRepositoryTestConnection": "users/settings/remote_repositories/", // We need to add info to the page for this
+	"RestoreJobCreate":               "users/jobs/download_jobs",
+	"RestoreJobNew":                  "users/jobs/download_jobs",
+	"RestoreJobReview":               "users/jobs/download_jobs",
+	"RestoreJobRun":                  "users/jobs/download_jobs",
+	"RestoreJobShowResult":           "users/jobs/download_jobs",
 	"SettingsExportDelete":           "users/settings/export/",
 	"SettingsExportDeleteQuestion":   "users/settings/export/#export-questions",
 	"SettingsExportEdit":             "users/settings/export/",
@@ -84,6 +91,7 @@ var HelpUrlFor = map[string]string{
 	"StorageServiceSave":             "users/settings/storage_services/#editing-storage-services",
 	"StorageServiceTestConnection":   "users/settings/storage_services/", // need to add documentation for this
 	"UploadJobAddFile":               "users/jobs/upload_jobs",
+	"UploadJobDelete":                "users/jobs/upload_jobs",
 	"UploadJobDeleteFile":            "users/jobs/upload_jobs",
 	"UploadJobNew":                   "users/jobs/upload_jobs",
 	"UploadJobReview":                "users/jobs/upload_jobs",
@@ -0,0 +1,507 @@
+package controllers
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/minio/minio-go/v7"
+)
+
+// InventoryEntry describes one serialized bag found in a bucket.
+type InventoryEntry struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+	ETag         string    `json:"etag"`
+	StorageClass string    `json:"storageClass"`
+	// BagName and the tag values come from the bag itself.
+	// They're empty if the report didn't look inside bags,
+	// or if InspectError says why we couldn't.
+	BagName                  string `json:"bagName"`
+	ProfileIdentifier        string `json:"profileIdentifier"`
+	SourceOrganization       string `json:"sourceOrganization"`
+	BaggingDate              string `json:"baggingDate"`
+	PayloadOxum              string `json:"payloadOxum"`
+	InternalSenderIdentifier string `json:"internalSenderIdentifier"`
+	InspectError             string `json:"inspectError"`
+	// UploadedByDART is true if a job in this copy of DART put the
+	// object here. JobID and JobName identify the job, and MatchedBy
+	// says how we recognized the object: by "key" or by "etag".
+	UploadedByDART bool   `json:"uploadedByDart"`
+	JobID          string `json:"jobId"`
+	JobName        string `json:"jobName"`
+	MatchedBy      string `json:"matchedBy"`
+}
+
+// InventoryReport lists the serialized bags under a prefix in an S3
+// bucket, with what we could learn about each one.
+//
+// Reports are built by a BackgroundTask. Status is one of the Task
+// constants, and Error says why a failed report failed. We save the
+// entries of each report in their own file, so listing reports doesn't
+// mean reading every entry of every report. See LoadEntries.
+type InventoryReport struct {
+	ID                 string    `json:"id"`
+	StorageServiceID   string    `json:"storageServiceId"`
+	StorageServiceName string    `json:"storageServiceName"`
+	Bucket             string    `json:"bucket"`
+	Prefix             string    `json:"prefix"`
+	InspectBags        bool      `json:"inspectBags"`
+	CreatedAt          time.Time `json:"createdAt"`
+	Status             string    `json:"status"`
+	Error              string    `json:"error"`
+	ObjectCount        int       `json:"objectCount"`
+	// BagCount and UnknownBagCount are len(Entries) and UnknownCount,
+	// saved with the report for pages that don't load the entries.
+	BagCount        int              `json:"bagCount"`
+	UnknownBagCount int              `json:"unknownBagCount"`
+	Entries         []InventoryEntry `json:"-"`
+}
+
+// entryStore returns the store that holds the report's entries.
+func (report *InventoryReport) entryStore() *JSONStore[InventoryEntry] {
+	return NewJSONStore[InventoryEntry](filepath.Join("inventory_reports", report.ID+".json"))
+}
+
+// LoadEntries reads the report's entries into Entries.
+func (report *InventoryReport) LoadEntries() error {
+	entries, err := report.entryStore().Load()
+	report.Entries = entries
+	return err
+}
+
+// SaveEntries writes the report's entries to their own file,
+// and updates BagCount and UnknownBagCount to match.
+func (report *InventoryReport) SaveEntries() error {
+	report.BagCount = len(report.Entries)
+	report.UnknownBagCount = report.UnknownCount()
+	return report.entryStore().Save(report.Entries)
+}
+
+// UnknownCount returns the number of bags that no
+// DART job in this installation uploaded.
+func (report *InventoryReport) UnknownCount() int {
+	count := 0
+	for _, entry := range report.Entries {
+		if !entry.UploadedByDART {
+			count++
+		}
+	}
+	return count
+}
+
+// inventoryCSVHeaders are the column names of WriteCSV's output.
+var inventoryCSVHeaders = []string{
+	"Key",
+	"Size",
+	"Last Modified",
+	"ETag",
+	"Storage Class",
+	"Bag Name",
+	"BagIt-Profile-Identifier",
+	"Source-Organization",
+	"Bagging-Date",
+	"Payload-Oxum",
+	"Internal-Sender-Identifier",
+	"Uploaded By DART",
+	"Job ID",
+	"Job Name",
+	"Matched By",
+	"Inspect Error",
+}
+
+// WriteCSV writes the report's entries to w as CSV, with a header row.
+func (report *InventoryReport) WriteCSV(w io.Writer) error {
+	csvWriter := csv.NewWriter(w)
+	if err := csvWriter.Write(inventoryCSVHeaders); err != nil {
+		return err
+	}
+	for _, entry := range report.Entries {
+		record := []string{
+			entry.Key,
+			strconv.FormatInt(entry.Size, 10),
+			entry.LastModified.UTC().Format(time.RFC3339),
+			entry.ETag,
+			entry.StorageClass,
+			entry.BagName,
+			entry.ProfileIdentifier,
+			entry.SourceOrganization,
+			entry.BaggingDate,
+			entry.PayloadOxum,
+			entry.InternalSenderIdentifier,
+			strconv.FormatBool(entry.UploadedByDART),
+			entry.JobID,
+			entry.JobName,
+			entry.MatchedBy,
+			entry.InspectError,
+		}
+		if err := csvWriter.Write(record); err != nil {
+			return err
+		}
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+// BuildInventoryReport lists every object under prefix in bucket on
+// S3 service ss, and adds each one that looks like a serialized bag
+// to the report. If inspectBags is true, it reads bag-info.txt from
+// each bag. See ReadSerializedBagInfo.
+//
+// It calls onProgress, if it's not nil, after each object. Canceling
+// ctx stops the listing, and BuildInventoryReport returns ctx's error.
+func BuildInventoryReport(ctx context.Context, ss *core.StorageService, bucket, prefix string, inspectBags bool, onProgress func(*InventoryReport)) (*InventoryReport, error) {
+	report := &InventoryReport{
+		StorageServiceID:   ss.ID,
+		StorageServiceName: ss.Name,
+		Bucket:             bucket,
+		Prefix:             prefix,
+		InspectBags:        inspectBags,
+		CreatedAt:          time.Now(),
+		Entries:            make([]InventoryEntry, 0),
+	}
+	if ss.Protocol != constants.ProtocolS3 {
+		return report, fmt.Errorf("Inventory reports are available only for S3 services.")
+	}
+	client, err := NewMinioClient(ss)
+	if err != nil {
+		return report, err
+	}
+	uploads, err := loadDARTUploads()
+	if err != nil {
+		return report, fmt.Errorf("Cannot read job history: %v", err)
+	}
+
+	// Unlike ListS3ObjectsPage, we stop on errors,
+	// because a partial inventory is misleading.
+	opts := minio.ListObjectsOptions{Prefix: prefix, Recursive: true}
+	err = WalkS3Objects(ctx, client, bucket, opts, func(s3Obj minio.ObjectInfo) error {
+		report.ObjectCount++
+		if onProgress != nil {
+			defer onProgress(report)
+		}
+		if !IsSerializedBag(s3Obj.Key) {
+			return nil
+		}
+		entry := InventoryEntry{
+			Key:          s3Obj.Key,
+			Size:         s3Obj.Size,
+			LastModified: s3Obj.LastModified,
+			ETag:         s3Obj.ETag,
+			StorageClass: s3Obj.StorageClass,
+		}
+		uploads.match(ss, bucket, &entry)
+		if inspectBags {
+			inspectS3Bag(ctx, client, bucket, &entry)
+		}
+		report.Entries = append(report.Entries, entry)
+		return nil
+	})
+	return report, err
+}
+
+// inspectS3Bag fills in entry's bag name and tag values from the
+// bag's bag-info.txt, or records why it couldn't.
+func inspectS3Bag(ctx context.Context, client *minio.Client, bucket string, entry *InventoryEntry) {
+	// Listings don't say whether an archived object has been
+	// restored, so we stat those to find out.
+	if IsArchiveStorageClass(entry.StorageClass) {
+		objInfo, err := client.StatObject(ctx, bucket, entry.Key, minio.StatObjectOptions{})
+		if err != nil {
+			entry.InspectError = err.Error()
+			return
+		}
+		if IsArchivedS3Object(objInfo) {
+			entry.InspectError = archivedObjectError(entry.Key, objInfo).Error()
+			return
+		}
+	}
+	object, err := client.GetObject(ctx, bucket, entry.Key, minio.GetObjectOptions{})
+	if err != nil {
+		entry.InspectError = err.Error()
+		return
+	}
+	defer object.Close()
+	bagInfo, err := ReadSerializedBagInfo(entry.Key, object, entry.Size)
+	if err != nil {
+		entry.InspectError = err.Error()
+		return
+	}
+	entry.BagName = bagInfo.BagName
+	entry.ProfileIdentifier = TagValue(bagInfo.Tags, "BagIt-Profile-Identifier")
+	entry.SourceOrganization = TagValue(bagInfo.Tags, "Source-Organization")
+	entry.BaggingDate = TagValue(bagInfo.Tags, "Bagging-Date")
+	entry.PayloadOxum = TagValue(bagInfo.Tags, "Payload-Oxum")
+	entry.InternalSenderIdentifier = TagValue(bagInfo.Tags, "Internal-Sender-Identifier")
+}
+
+// SerializedBagInfo holds what we read from a serialized bag
+// without unpacking it.
+type SerializedBagInfo struct {
+	BagName string
+	// Tags and BagInfo are the parsed and raw contents of
+	// bag-info.txt, if HasBagInfo is true.
+	HasBagInfo bool
+	Tags       []BagTag
+	BagInfo    string
+	// TopLevel lists what's directly inside the bag's top-level
+	// directory, if TopLevelListed is true. See InspectSerializedBag.
+	TopLevel       []BagTopLevelEntry
+	TopLevelListed bool
+}
+
+// BagTopLevelEntry is a file or directory directly inside a bag's
+// top-level directory. For directories, Size and FileCount cover
+// all the files under it.
+type BagTopLevelEntry struct {
+	Name      string
+	IsDir     bool
+	Size      int64
+	FileCount int
+}
+
+// RandomAccessObject is an object we can read in any order, such as
+// an open file or a minio.Object.
+type RandomAccessObject interface {
+	io.ReadSeeker
+	io.ReaderAt
+}
+
+// ReadSerializedBagInfo reads bag-info.txt from the tar, tar.gz or
+// zip file name, whose contents obj reads, while reading as little
+// of obj as it can.
+//
+// For zip files, that's the central directory at the end of the file
+// and bag-info.txt itself. Tar files have no directory, so we read
+// each file header in turn, seeking past the contents of large files.
+// For a minio.Object, each seek costs a new request, so we read
+// through smaller files instead. Gzipped tar files can't seek at all,
+// so we read them from the start until we find bag-info.txt.
+func ReadSerializedBagInfo(name string, obj RandomAccessObject, size int64) (*SerializedBagInfo, error) {
+	bagInfo, err := readSerializedBag(name, obj, size, false)
+	if err != nil {
+		return nil, err
+	}
+	if !bagInfo.HasBagInfo {
+		return nil, fmt.Errorf("Bag has no bag-info.txt")
+	}
+	return bagInfo, nil
+}
+
+// InspectSerializedBag is like ReadSerializedBagInfo, but it also lists
+// the bag's top-level entries, and a missing bag-info.txt is not an
+// error. Listing a tar file means reading every file header, so this
+// can take many requests for bags with many large files. Listing a
+// gzipped tar file would mean reading all of it, so for those we
+// read only bag-info.txt and leave TopLevelListed false.
+func InspectSerializedBag(name string, obj RandomAccessObject, size int64) (*SerializedBagInfo, error) {
+	lower := strings.ToLower(name)
+	listTopLevel := !strings.HasSuffix(lower, ".gz") && !strings.HasSuffix(lower, ".tgz")
+	return readSerializedBag(name, obj, size, listTopLevel)
+}
+
+func readSerializedBag(name string, obj RandomAccessObject, size int64, listTopLevel bool) (*SerializedBagInfo, error) {
+	bagInfo := &SerializedBagInfo{TopLevelListed: listTopLevel}
+	topLevel := make(map[string]int)
+	fn := func(entry BagEntry, reader io.Reader) error {
+		bagInfo.BagName = entry.BagName
+		if listTopLevel {
+			name, _, isDir := strings.Cut(entry.Path, "/")
+			index, ok := topLevel[name]
+			if !ok {
+				index = len(bagInfo.TopLevel)
+				topLevel[name] = index
+				bagInfo.TopLevel = append(bagInfo.TopLevel, BagTopLevelEntry{Name: name, IsDir: isDir})
+			}
+			bagInfo.TopLevel[index].Size += entry.Size
+			bagInfo.TopLevel[index].FileCount++
+		}
+		if entry.Path != "bag-info.txt" {
+			return nil
+		}
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+		bagInfo.HasBagInfo = true
+		bagInfo.BagInfo = string(data)
+		bagInfo.Tags, err = ParseTagFile(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("Cannot parse bag-info.txt: %v", err)
+		}
+		if !listTopLevel {
+			return ErrStopBagWalk
+		}
+		return nil
+	}
+
+	lower := strings.ToLower(name)
+	var err error
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		var zipReader *zip.Reader
+		zipReader, err = zip.NewReader(obj, size)
+		if err == nil {
+			err = walkZipReader(zipReader, fn)
+		}
+	case strings.HasSuffix(lower, ".tar"):
+		err = WalkTarStream(&lazySeeker{ReadSeeker: obj}, fn)
+	case strings.HasSuffix(lower, ".tar.gz") || strings.HasSuffix(lower, ".tgz"):
+		var gzipReader *gzip.Reader
+		gzipReader, err = gzip.NewReader(obj)
+		if err == nil {
+			defer gzipReader.Close()
+			err = WalkTarStream(gzipReader, fn)
+		}
+	default:
+		return nil, fmt.Errorf("%s is not a tar or zip file", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(bagInfo.TopLevel, func(i, j int) bool { return bagInfo.TopLevel[i].Name < bagInfo.TopLevel[j].Name })
+	return bagInfo, nil
+}
+
+// lazySeekThreshold is the smallest forward skip for which
+// lazySeeker actually seeks.
+const lazySeekThreshold = 1024 * 1024
+
+// lazySeeker reads through short forward skips instead of seeking.
+// archive/tar skips the contents of each file by seeking if it can.
+type lazySeeker struct {
+	io.ReadSeeker
+}
+
+func (s *lazySeeker) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekCurrent && offset > 0 && offset < lazySeekThreshold {
+		if _, err := io.CopyN(io.Discard, s.ReadSeeker, offset); err != nil {
+			return 0, err
+		}
+		offset = 0
+	}
+	return s.ReadSeeker.Seek(offset, whence)
+}
+
+// dartUpload identifies the job that uploaded an object.
+type dartUpload struct {
+	JobID   string
+	JobName string
+}
+
+// dartUploads indexes the objects that jobs in this installation of
+// DART uploaded or copied, by storage service, bucket and key, and
+// by storage service, bucket and ETag.
+type dartUploads struct {
+	byKey  map[string]dartUpload
+	byETag map[string]dartUpload
+}
+
+func dartUploadKey(ssid, bucket, value string) string {
+	return ssid + "\x00" + bucket + "\x00" + value
+}
+
+// loadDARTUploads reads the job history: workflow jobs, upload jobs
+// and copy jobs.
+func loadDARTUploads() (*dartUploads, error) {
+	uploads := &dartUploads{
+		byKey:  make(map[string]dartUpload),
+		byETag: make(map[string]dartUpload),
+	}
+	jobs, err := listAllObjects(constants.TypeJob, func(r *core.QueryResult) []*core.Job { return r.Jobs })
+	if err != nil {
+		return uploads, err
+	}
+	for _, job := range jobs {
+		uploads.addOps(job.UploadOps, dartUpload{JobID: job.ID, JobName: job.Name()})
+	}
+	uploadJobs, err := listAllObjects(constants.TypeUploadJob, func(r *core.QueryResult) []*core.UploadJob { return r.UploadJobs })
+	if err != nil {
+		return uploads, err
+	}
+	for _, uploadJob := range uploadJobs {
+		uploads.addOps(uploadJob.UploadOps, dartUpload{JobID: uploadJob.ID, JobName: uploadJob.ObjName()})
+	}
+	copyJobs, err := copyJobStore.Load()
+	if err != nil {
+		return uploads, err
+	}
+	for _, copyJob := range copyJobs {
+		if !copyJob.Succeeded {
+			continue
+		}
+		target := core.ObjFind(copyJob.TargetServiceID).StorageService()
+		if target == nil {
+			continue
+		}
+		upload := dartUpload{JobID: copyJob.ID, JobName: "Copy of " + copyJob.SourceKey}
+		uploads.byKey[dartUploadKey(target.ID, target.Bucket, copyJob.TargetKey)] = upload
+		if copyJob.Result != nil && copyJob.Result.TargetETag != "" {
+			uploads.byETag[dartUploadKey(target.ID, target.Bucket, copyJob.Result.TargetETag)] = upload
+		}
+	}
+	return uploads, nil
+}
+
+// addOps records the objects that successful upload operations to S3
+// services created. DART's own uploads record the object key in
+// RemoteTargetName. DART Runner names objects after the files it
+// uploads, at the top of the bucket.
+func (uploads *dartUploads) addOps(ops []*core.UploadOperation, upload dartUpload) {
+	for _, op := range ops {
+		ss := op.StorageService
+		if ss == nil || ss.Protocol != constants.ProtocolS3 || op.Result == nil || !op.Result.Succeeded() {
+			continue
+		}
+		keys := make([]string, 0)
+		if op.Result.RemoteTargetName != "" {
+			keys = append(keys, strings.TrimPrefix(strings.TrimPrefix(op.Result.RemoteTargetName, ss.Bucket+"/"), "/"))
+		}
+		if remoteURL, err := url.Parse(op.Result.RemoteURL); err == nil && remoteURL.Path != "" {
+			keys = append(keys, strings.TrimPrefix(strings.TrimPrefix(remoteURL.Path, "/"), ss.Bucket+"/"))
+		}
+		if op.Result.Provider != S3UploadProvider {
+			for _, sourceFile := range op.SourceFiles {
+				keys = append(keys, path.Base(strings.ReplaceAll(sourceFile, "\\", "/")))
+			}
+		}
+		for _, key := range keys {
+			uploads.byKey[dartUploadKey(ss.ID, ss.Bucket, key)] = upload
+		}
+		if op.Result.RemoteChecksum != "" {
+			uploads.byETag[dartUploadKey(ss.ID, ss.Bucket, strings.Trim(op.Result.RemoteChecksum, `"`))] = upload
+		}
+	}
+}
+
+// match marks entry as uploaded by DART if a job uploaded an object
+// with the same key or ETag to the same bucket on ss.
+func (uploads *dartUploads) match(ss *core.StorageService, bucket string, entry *InventoryEntry) {
+	matchedBy := "key"
+	upload, found := uploads.byKey[dartUploadKey(ss.ID, bucket, entry.Key)]
+	if !found && entry.ETag != "" {
+		matchedBy = "etag"
+		upload, found = uploads.byETag[dartUploadKey(ss.ID, bucket, entry.ETag)]
+	}
+	if !found {
+		return
+	}
+	entry.UploadedByDART = true
+	entry.JobID = upload.JobID
+	entry.JobName = upload.JobName
+	entry.MatchedBy = matchedBy
+}
@@ -0,0 +1,246 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+var inventoryReportStore = NewJSONStore[InventoryReport]("inventory_reports.json")
+
+// GET /inventory_reports
+func InventoryReportIndex(c *gin.Context) {
+	reports, err := inventoryReportStore.Load()
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+		return
+	}
+	for i := range reports {
+		reports[i].Status, reports[i].Error = taskStatus(reports[i].ID, reports[i].Status, reports[i].Error)
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].CreatedAt.After(reports[j].CreatedAt) })
+	data := gin.H{
+		"reports": reports,
+		"helpUrl": GetHelpUrl(c),
+	}
+	c.HTML(http.StatusOK, "inventory_report/index.html", data)
+}
+
+// GET /inventory_reports/new?ssid=<id>&bucket=<name>
+func InventoryReportNew(c *gin.Context) {
+	report := &InventoryReport{
+		StorageServiceID: c.Query("ssid"),
+		Bucket:           c.Query("bucket"),
+		InspectBags:      true,
+	}
+	if report.Bucket == "" {
+		if ss := core.ObjFind(report.StorageServiceID).StorageService(); ss != nil {
+			report.Bucket = ss.Bucket
+		}
+	}
+	data := gin.H{
+		"form":    inventoryReportForm(report),
+		"helpUrl": GetHelpUrl(c),
+	}
+	c.HTML(http.StatusOK, "inventory_report/new.html", data)
+}
+
+// POST /inventory_reports/new
+//
+// This saves the report and builds it in a BackgroundTask, since
+// listing a bucket with many objects can take a while. The show
+// page reports progress until the report is done.
+func InventoryReportCreate(c *gin.Context) {
+	report := &InventoryReport{
+		StorageServiceID: c.PostForm("StorageServiceID"),
+		Bucket:           strings.TrimSpace(c.PostForm("Bucket")),
+		Prefix:           strings.TrimSpace(c.PostForm("Prefix")),
+		InspectBags:      c.PostForm("InspectBags") == "true",
+	}
+	form := inventoryReportForm(report)
+	ss := core.ObjFind(report.StorageServiceID).StorageService()
+	if ss == nil {
+		form.Fields["StorageServiceID"].Error = "Please choose a storage service."
+	} else if ss.Protocol != constants.ProtocolS3 {
+		form.Fields["StorageServiceID"].Error = "Inventory reports are available only for S3 services."
+	}
+	if report.Bucket == "" {
+		form.Fields["Bucket"].Error = "Please enter a bucket name."
+	}
+	if form.Fields["StorageServiceID"].Error != "" || form.Fields["Bucket"].Error != "" {
+		data := gin.H{
+			"form":    form,
+			"helpUrl": GetHelpUrl(c),
+		}
+		c.HTML(http.StatusBadRequest, "inventory_report/new.html", data)
+		return
+	}
+	report.ID = uuid.NewString()
+	report.StorageServiceName = ss.Name
+	report.CreatedAt = time.Now()
+	report.Status = TaskRunning
+	if err := saveInventoryReport(report); err != nil {
+		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+		return
+	}
+	StartBackgroundTask(report.ID, "Listing objects...", func(ctx context.Context, task *BackgroundTask) {
+		built, err := BuildInventoryReport(ctx, ss, report.Bucket, report.Prefix, report.InspectBags, func(built *InventoryReport) {
+			task.SetProgress(int64(built.ObjectCount), 0, fmt.Sprintf("Listed %d objects. Found %d bags.", built.ObjectCount, len(built.Entries)))
+		})
+		finishInventoryReport(ctx, report, built, err)
+	})
+	c.Redirect(http.StatusFound, fmt.Sprintf("/inventory_reports/show/%s", report.ID))
+}
+
+// finishInventoryReport saves what BuildInventoryReport built for
+// report. We don't keep the entries of failed or canceled reports,
+// because a partial inventory is misleading.
+func finishInventoryReport(ctx context.Context, report, built *InventoryReport, err error) {
+	report.Status = finishedTaskStatus(ctx, err)
+	if report.Status == TaskCompleted {
+		report.ObjectCount = built.ObjectCount
+		report.Entries = built.Entries
+		err = report.SaveEntries()
+		if err != nil {
+			report.Status = TaskFailed
+		}
+	}
+	if report.Status == TaskFailed {
+		report.Error = err.Error()
+	}
+	if err := saveInventoryReport(report); err != nil {
+		core.Dart.Log.Errorf("Cannot save inventory report %s: %v", report.ID, err)
+	}
+}
+
+// GET /inventory_reports/show/:id
+//
+// While the report is being built, this shows its progress.
+func InventoryReportShow(c *gin.Context) {
+	report, err := findInventoryReport(c.Param("id"))
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusNotFound, err)
+		return
+	}
+	if report.Status == TaskCompleted {
+		if err := report.LoadEntries(); err != nil {
+			AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	data := gin.H{
+		"report":  report,
+		"flash":   GetFlashCookie(c),
+		"helpUrl": GetHelpUrl(c),
+	}
+	c.HTML(http.StatusOK, "inventory_report/show.html", data)
+}
+
+// GET /inventory_reports/export/:id
+//
+// In a browser, this sends the report as a CSV attachment. Wails can't
+// save attachments, so there we write the file to the Downloads folder
+// instead. See DownloadJobDownload.
+func InventoryReportExport(c *gin.Context) {
+	report, err := findInventoryReport(c.Param("id"))
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusNotFound, err)
+		return
+	}
+	if report.Status != TaskCompleted {
+		AbortWithErrorHTML(c, http.StatusBadRequest, fmt.Errorf("Inventory report %s is not complete.", report.ID))
+		return
+	}
+	if err := report.LoadEntries(); err != nil {
+		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+		return
+	}
+	var buf bytes.Buffer
+	if err := report.WriteCSV(&buf); err != nil {
+		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+		return
+	}
+	fileName := report.CSVFileName()
+	if IsRunningWails {
+		csvPath := filepath.Join(core.Dart.Paths.Downloads, fileName)
+		if err := os.WriteFile(csvPath, buf.Bytes(), 0644); err != nil {
+			AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+			return
+		}
+		SetFlashCookie(c, fmt.Sprintf("Saved the report to %s", csvPath))
+		c.Redirect(http.StatusFound, fmt.Sprintf("/inventory_reports/show/%s", report.ID))
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", fileName))
+	c.Data(http.StatusOK, "text/csv; charset=utf-8", buf.Bytes())
+}
+
+// CSVFileName returns the name we give the report's CSV file.
+func (report *InventoryReport) CSVFileName() string {
+	return fmt.Sprintf("inventory-%s-%s.csv", escapeFileName(report.Bucket), report.CreatedAt.Format("20060102-150405"))
+}
+
+func inventoryReportForm(report *InventoryReport) *core.Form {
+	form := core.NewForm("InventoryReport", report.ID, make(map[string]string))
+	ssField := form.AddField("StorageServiceID", "Storage Service", report.StorageServiceID, true)
+	ssField.Choices = []core.Choice{
+		{Label: "Choose One", Value: "", Selected: false},
+	}
+	for _, ss := range core.ObjList(constants.TypeStorageService, "obj_name", 100, 0).StorageServices {
+		if ss.Protocol == constants.ProtocolS3 {
+			ssField.Choices = append(ssField.Choices, core.Choice{Label: ss.Name, Value: ss.ID, Selected: ss.ID == report.StorageServiceID})
+		}
+	}
+
+	form.AddField("Bucket", "Bucket", report.Bucket, true)
+
+	prefixField := form.AddField("Prefix", "Prefix", report.Prefix, false)
+	prefixField.Help = "Optional. List only objects whose keys start with this, such as deposits/2026/."
+
+	inspectField := form.AddField("InspectBags", "Read bag-info.txt", strconv.FormatBool(report.InspectBags), false)
+	inspectField.Choices = []core.Choice{
+		{Label: "Yes", Value: "true", Selected: report.InspectBags},
+		{Label: "No", Value: "false", Selected: !report.InspectBags},
+	}
+	inspectField.Help = "Read the bag name, profile identifier and other tags from each bag. DART reads only the start of each file where it can, but this still means one or more requests per bag."
+	return form
+}
+
+func findInventoryReport(id string) (*InventoryReport, error) {
+	reports, err := inventoryReportStore.Load()
+	if err != nil {
+		return nil, err
+	}
+	for i := range reports {
+		if reports[i].ID == id {
+			report := &reports[i]
+			report.Status, report.Error = taskStatus(report.ID, report.Status, report.Error)
+			return report, nil
+		}
+	}
+	return nil, fmt.Errorf("No inventory report with id %s", id)
+}
+
+func saveInventoryReport(report *InventoryReport) error {
+	return inventoryReportStore.Update(func(reports []InventoryReport) ([]InventoryReport, error) {
+		for i := range reports {
+			if reports[i].ID == report.ID {
+				reports[i] = *report
+				return reports, nil
+			}
+		}
+		return append(reports, *report), nil
+	})
+}
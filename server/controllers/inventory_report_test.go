@@ -0,0 +1,213 @@
+package controllers_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart-runner/util"
+	"github.com/APTrust/dart/v3/server/controllers"
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadSerializedBagInfo(t *testing.T) {
+	bagsDir := filepath.Join(util.PathToTestData(), "bags")
+
+	// Make a gzipped copy of the good tar file.
+	tarData, err := os.ReadFile(filepath.Join(bagsDir, "example.edu.sample_good.tar"))
+	require.NoError(t, err)
+	var gzipped bytes.Buffer
+	gzipWriter := gzip.NewWriter(&gzipped)
+	_, err = gzipWriter.Write(tarData)
+	require.NoError(t, err)
+	require.NoError(t, gzipWriter.Close())
+	tgzPath := filepath.Join(t.TempDir(), "example.edu.sample_good.tar.gz")
+	require.NoError(t, os.WriteFile(tgzPath, gzipped.Bytes(), 0644))
+
+	for _, bagPath := range []string{
+		filepath.Join(bagsDir, "example.edu.sample_good.tar"),
+		filepath.Join(bagsDir, "example.edu.sample_good.zip"),
+		tgzPath,
+	} {
+		file, err := os.Open(bagPath)
+		require.NoError(t, err)
+		stat, err := file.Stat()
+		require.NoError(t, err)
+		bagInfo, err := controllers.ReadSerializedBagInfo(bagPath, file, stat.Size())
+		file.Close()
+		require.NoError(t, err, bagPath)
+		assert.Equal(t, "example.edu.sample_good", bagInfo.BagName, bagPath)
+		assert.Equal(t, "virginia.edu", controllers.TagValue(bagInfo.Tags, "Source-Organization"), bagPath)
+		assert.Equal(t, "uva-internal-id-0001", controllers.TagValue(bagInfo.Tags, "Internal-Sender-Identifier"), bagPath)
+	}
+
+	file, err := os.Open(filepath.Join(bagsDir, "test.edu.btr_good_sha256.tar"))
+	require.NoError(t, err)
+	defer file.Close()
+	bagInfo, err := controllers.ReadSerializedBagInfo(file.Name(), file, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "https://raw.githubusercontent.com/dpscollaborative/btr_bagit_profile/master/btr-bagit-profile.json", controllers.TagValue(bagInfo.Tags, "BagIt-Profile-Identifier"))
+
+	noBagInfo, err := os.Open(filepath.Join(bagsDir, "example.edu.sample_no_bag_info.tar"))
+	require.NoError(t, err)
+	defer noBagInfo.Close()
+	_, err = controllers.ReadSerializedBagInfo(noBagInfo.Name(), noBagInfo, 0)
+	require.Error(t, err)
+	assert.Equal(t, "Bag has no bag-info.txt", err.Error())
+
+	_, err = controllers.ReadSerializedBagInfo("README.md", file, 0)
+	assert.Error(t, err)
+}
+
+func TestInspectSerializedBag(t *testing.T) {
+	bagsDir := filepath.Join(util.PathToTestData(), "bags")
+	for _, name := range []string{"example.edu.sample_good.tar", "example.edu.sample_good.zip"} {
+		file, err := os.Open(filepath.Join(bagsDir, name))
+		require.NoError(t, err)
+		stat, err := file.Stat()
+		require.NoError(t, err)
+		bag, err := controllers.InspectSerializedBag(name, file, stat.Size())
+		file.Close()
+		require.NoError(t, err, name)
+		assert.True(t, bag.TopLevelListed, name)
+		assert.True(t, bag.HasBagInfo, name)
+		assert.Contains(t, bag.BagInfo, "Source-Organization: virginia.edu", name)
+
+		names := make([]string, len(bag.TopLevel))
+		for i, entry := range bag.TopLevel {
+			names[i] = entry.Name
+		}
+		assert.Equal(t, []string{"aptrust-info.txt", "bag-info.txt", "bagit.txt", "data", "manifest-md5.txt"}, names, name)
+		data := bag.TopLevel[3]
+		assert.True(t, data.IsDir, name)
+		assert.Equal(t, 4, data.FileCount, name)
+		assert.False(t, bag.TopLevel[2].IsDir, name)
+		assert.Equal(t, 1, bag.TopLevel[2].FileCount, name)
+	}
+
+	// A bag without bag-info.txt can still be listed.
+	noBagInfo, err := os.Open(filepath.Join(bagsDir, "example.edu.sample_no_bag_info.tar"))
+	require.NoError(t, err)
+	defer noBagInfo.Close()
+	bag, err := controllers.InspectSerializedBag(noBagInfo.Name(), noBagInfo, 0)
+	require.NoError(t, err)
+	assert.False(t, bag.HasBagInfo)
+	assert.NotEmpty(t, bag.TopLevel)
+}
+
+func TestInventoryReportWriteCSV(t *testing.T) {
+	report := &controllers.InventoryReport{
+		Bucket:    "deposits",
+		CreatedAt: time.Date(2026, 10, 19, 14, 30, 0, 0, time.UTC),
+		Entries: []controllers.InventoryEntry{
+			{Key: "a/bag1.tar", Size: 2048, LastModified: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC), ETag: "abc", BagName: "bag1", SourceOrganization: "example.edu", UploadedByDART: true, JobID: "job-1", MatchedBy: "key"},
+			{Key: "a/bag2.zip", Size: 10, InspectError: "Bag has no bag-info.txt"},
+		},
+	}
+	assert.Equal(t, 1, report.UnknownCount())
+	assert.Equal(t, "inventory-deposits-20261019-143000.csv", report.CSVFileName())
+
+	var buf bytes.Buffer
+	require.NoError(t, report.WriteCSV(&buf))
+	records, err := csv.NewReader(&buf).ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(records))
+	assert.Equal(t, "Key", records[0][0])
+	assert.Equal(t, []string{"a/bag1.tar", "2048", "2026-01-02T03:04:05Z", "abc", "", "bag1", "", "example.edu", "", "", "", "true", "job-1", "", "key", ""}, records[1])
+	assert.Equal(t, "false", records[2][11])
+	assert.Equal(t, "Bag has no bag-info.txt", records[2][15])
+}
+
+func TestInventoryReportCreateWithMissingFields(t *testing.T) {
+	defer core.ClearDartTable()
+	params := url.Values{}
+	params.Set("StorageServiceID", "")
+	params.Set("Bucket", " ")
+	DoSimplePostTest(t, PostTestSettings{
+		EndpointUrl:          "/inventory_reports/new",
+		Params:               params,
+		ExpectedResponseCode: http.StatusBadRequest,
+		ExpectedContent: []string{
+			"Please choose a storage service.",
+			"Please enter a bucket name.",
+		},
+	})
+}
+
+// NOTE: This test assumes that local Minio server is running.
+// See the note at the top of download_job_controller_test.go.
+func TestBuildInventoryReport(t *testing.T) {
+	defer core.ClearDartTable()
+	ss := loadMinioStorageService(t)
+	DoSimpleGetTest(t, "/inventory_reports/new?ssid="+ss.ID, []string{"New Inventory Report", ss.Name, "Read bag-info.txt"})
+
+	client, err := controllers.NewMinioClient(ss)
+	require.NoError(t, err)
+	bagsDir := filepath.Join(util.PathToTestData(), "bags")
+	prefix := "inventory-test/"
+	for _, name := range []string{"example.edu.sample_good.tar", "example.edu.sample_good.zip", "README.md"} {
+		_, err = client.FPutObject(context.Background(), ss.Bucket, prefix+name, filepath.Join(bagsDir, name), minio.PutObjectOptions{})
+		require.NoError(t, err)
+	}
+
+	// Pretend a job uploaded the tar file.
+	job := core.NewJob()
+	op := core.NewUploadOperation(ss, []string{filepath.Join(bagsDir, "example.edu.sample_good.tar")})
+	op.Result.Provider = controllers.S3UploadProvider
+	op.Result.Start()
+	op.Result.RemoteTargetName = prefix + "example.edu.sample_good.tar"
+	op.Result.Finish(nil)
+	job.UploadOps = []*core.UploadOperation{op}
+	require.NoError(t, core.ObjSaveWithoutValidation(job))
+
+	report, err := controllers.BuildInventoryReport(context.Background(), ss, ss.Bucket, prefix, true, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 3, report.ObjectCount)
+	require.Equal(t, 2, len(report.Entries))
+	assert.Equal(t, 1, report.UnknownCount())
+
+	tarEntry, zipEntry := report.Entries[0], report.Entries[1]
+	assert.Equal(t, prefix+"example.edu.sample_good.tar", tarEntry.Key)
+	assert.True(t, tarEntry.UploadedByDART)
+	assert.Equal(t, job.ID, tarEntry.JobID)
+	assert.Equal(t, "key", tarEntry.MatchedBy)
+	assert.Equal(t, "example.edu.sample_good", tarEntry.BagName)
+	assert.Equal(t, "virginia.edu", tarEntry.SourceOrganization)
+	assert.Empty(t, tarEntry.InspectError)
+	assert.False(t, zipEntry.UploadedByDART)
+	assert.Equal(t, "example.edu.sample_good", zipEntry.BagName)
+
+	// Create, show and export the report through the UI.
+	params := url.Values{}
+	params.Set("StorageServiceID", ss.ID)
+	params.Set("Bucket", ss.Bucket)
+	params.Set("Prefix", prefix)
+	params.Set("InspectBags", "true")
+	w := httptest.NewRecorder()
+	req, err := NewPostRequest("/inventory_reports/new", params)
+	require.NoError(t, err)
+	dartServer.ServeHTTP(w, req)
+	require.Equal(t, http.StatusFound, w.Code)
+	showUrl := w.Header().Get("Location")
+	reportID := path.Base(showUrl)
+	require.Eventually(t, func() bool { return !controllers.BackgroundTaskRunning(reportID) }, 30*time.Second, 100*time.Millisecond)
+	DoSimpleGetTest(t, showUrl, []string{"2 bags among 3 objects", "1 not uploaded by DART", "example.edu.sample_good.zip"})
+
+	csvData := GetUrl(t, strings.Replace(showUrl, "/show/", "/export/", 1))
+	records, err := csv.NewReader(strings.NewReader(csvData)).ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, 3, len(records))
+}
@@ -82,7 +82,12 @@ func JobSaveMetadata(c *gin.Context) {
 		nextPage = fmt.Sprintf("/jobs/packaging/%s", job.ID)
 		c.Redirect(http.StatusFound, nextPage)
 	}
-	if TagErrorsExist(job.BagItProfile.Tags) && direction == "next" {
+	ruleSet, err := LoadTagValueRules(job.BagItProfile.ID)
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+		return
+	}
+	if TagErrorsExist(job.BagItProfile.Tags, ruleSet) && direction == "next" {
 		tagFiles := GetTagFileForms(job, true)
 		data := gin.H{
 			"job":      job,
@@ -91,6 +96,7 @@ func JobSaveMetadata(c *gin.Context) {
 			"helpUrl":  GetHelpUrl(c),
 		}
 		c.HTML(http.StatusOK, "job/metadata.html", data)
+		return
 	}
 	c.Redirect(http.StatusFound, nextPage)
 }
@@ -188,6 +194,10 @@ func JobDeleteTag(c *gin.Context) {
 func GetTagFileForms(job *core.Job, withErrors bool) []TagFileForms {
 	// Get the list of tag files, in alpha order.
 	tagFileNames := job.BagItProfile.TagFileNames()
+	ruleSet, err := LoadTagValueRules(job.BagItProfile.ID)
+	if err != nil {
+		core.Dart.Log.Warningf("Could not load tag value rules for profile %s: %v", job.BagItProfile.ID, err)
+	}
 	tagFiles := make([]TagFileForms, len(tagFileNames))
 	for i, tagFileName := range tagFileNames {
 		// Get list of tags in this file, in alpha order
@@ -212,8 +222,12 @@ func GetTagFileForms(job *core.Job, withErrors bool) []TagFileForms {
 				Help:           tagDef.Help,
 				FormGroupClass: formGroupClass,
 			}
+			rules := ruleSet.For(tagDef)
+			if description := rules.Describe(); description != "" {
+				field.Help = strings.TrimSpace(field.Help + " " + description)
+			}
 			if withErrors {
-				field.Error = ValidateTagValue(tagDef)
+				field.Error = ValidateTagValue(tagDef, rules)
 			}
 			if strings.Contains(strings.ToLower(tagDef.TagName), "description") {
 				field.Attrs["ControlType"] = "textarea"
@@ -251,7 +265,10 @@ func ShouldHideTag(tagDef *core.TagDefinition) bool {
 	return tagDef.SystemMustSet() || !util.IsEmpty(tagDef.DefaultValue)
 }
 
-func ValidateTagValue(tagDef *core.TagDefinition) string {
+// ValidateTagValue returns a message explaining what's wrong with
+// the tag's value, or an empty string if the value is OK. rules may
+// be nil if the tag has no TagValueRules.
+func ValidateTagValue(tagDef *core.TagDefinition, rules *TagValueRules) string {
 	tagValue := tagDef.GetValue()
 	if !tagDef.IsLegalValue(tagValue) {
 		return fmt.Sprintf("Tag has illegal value '%s'. Allowed values are: %s", tagValue, strings.Join(tagDef.Values, ","))
@@ -259,12 +276,12 @@ func ValidateTagValue(tagDef *core.TagDefinition) string {
 	if tagDef.Required && !tagDef.EmptyOK && util.IsEmpty(tagValue) && !tagDef.SystemMustSet() {
 		return "This tag requires a value."
 	}
-	return ""
+	return rules.Check(tagValue)
 }
 
-func TagErrorsExist(tags []*core.TagDefinition) bool {
+func TagErrorsExist(tags []*core.TagDefinition, ruleSet TagValueRuleSet) bool {
 	for _, tagDef := range tags {
-		if ValidateTagValue(tagDef) != "" {
+		if ValidateTagValue(tagDef, ruleSet.For(tagDef)) != "" {
 			return true
 		}
 	}
@@ -164,3 +164,37 @@ func TestShouldHideTag(t *testing.T) {
 	// Default should be false (do not hide)
 	assert.False(t, controllers.ShouldHideTag(&core.TagDefinition{}))
 }
+
+func TestJobSaveMetadataWithTagValueRules(t *testing.T) {
+	defer core.ClearDartTable()
+	job := loadTestJob(t)
+	assert.NoError(t, core.ObjSave(job))
+	rules := &controllers.TagValueRules{
+		ProfileID: job.BagItProfile.ID,
+		TagFile:   "bag-info.txt",
+		TagName:   "Source-Organization",
+		DataType:  controllers.TagTypeEmail,
+	}
+	require.NoError(t, controllers.SaveTagValueRules(rules, rules.TagName))
+	defer controllers.DeleteTagValueRules(rules.ProfileID, rules.TagFile, rules.TagName)
+
+	params := url.Values{}
+	params.Add("direction", "next")
+	params.Add("aptrust-info.txt/Title", "This is the new title")
+	params.Add("aptrust-info.txt/Description", "This is the new description")
+	params.Add("bag-info.txt/Source-Organization", "The Krusty Krab")
+	DoSimplePostTest(t, PostTestSettings{
+		EndpointUrl:          fmt.Sprintf("/jobs/metadata/%s", job.ID),
+		Params:               params,
+		ExpectedResponseCode: http.StatusOK,
+		ExpectedContent:      []string{"This value must be an email address, such as archivist@example.com."},
+	})
+
+	params.Set("bag-info.txt/Source-Organization", "krabby@example.com")
+	DoSimplePostTest(t, PostTestSettings{
+		EndpointUrl:              fmt.Sprintf("/jobs/metadata/%s", job.ID),
+		Params:                   params,
+		ExpectedResponseCode:     http.StatusFound,
+		ExpectedRedirectLocation: fmt.Sprintf("/jobs/upload/%s", job.ID),
+	})
+}
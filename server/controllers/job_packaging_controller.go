@@ -100,6 +100,9 @@ func JobSavePackaging(c *gin.Context) {
 			return
 		}
 		job.BagItProfile = profile
+		if err := RecordJobProfileRevision(job); err != nil {
+			core.Dart.Log.Errorf("Cannot record BagIt profile revision for job %s: %v", job.ID, err)
+		}
 	}
 
 	if job.ValidationOp == nil {
@@ -45,6 +45,13 @@ func JobRunShow(c *gin.Context) {
 		backButtonUrl = fmt.Sprintf("/jobs/metadata/%s", job.ID)
 	}
 
+	uploadKeys := PreviewJobUploadKeys(job)
+	keyTemplatesUsed, uploadKeyErrors := false, false
+	for _, preview := range uploadKeys {
+		keyTemplatesUsed = keyTemplatesUsed || preview.Template != ""
+		uploadKeyErrors = uploadKeyErrors || preview.Error != ""
+	}
+
 	data := gin.H{
 		"jobID":          job.ID,
 		"workflowID":     job.WorkflowID,
@@ -55,6 +62,12 @@ func JobRunShow(c *gin.Context) {
 		"helpUrl":        GetHelpUrl(c),
 		"workflow":       workflow,
 		"staleBagExists": StaleUnserializedBagExists(job),
+		// Where each upload will go, if any of them use key templates.
+		"uploadKeys":       uploadKeys,
+		"keyTemplatesUsed": keyTemplatesUsed,
+		"uploadKeyErrors":  uploadKeyErrors,
+		// Which revision of its BagIt profile the job was built with.
+		"profileRevision": GetJobProfileRevision(job.ID),
 	}
 	c.HTML(http.StatusOK, "job/run.html", data)
 }
@@ -109,7 +122,10 @@ func JobRunExecute(c *gin.Context) {
 		// It will not return until it's done. An exit code of zero
 		// indicates success. See constants.go for the meanings of
 		// other exit codes.
-		exitCode := core.RunJobWithMessageChannel(job, false, messageChannel)
+		//
+		// RunJobWithExtendedUploads wraps it so we can also upload
+		// to targets whose protocols DART Runner doesn't support.
+		exitCode := RunJobWithExtendedUploads(job, messageChannel)
 
 		// At this point, the job has completed, and we need to create
 		// the final disconnect event to tell the front end to stop
@@ -141,7 +157,14 @@ func JobRunExecute(c *gin.Context) {
 				return true
 			}
 		}
-		err := core.ObjSave(job)
+		// DART Runner's job validation rejects upload targets with
+		// extended protocols, so jobs that have them are saved without it.
+		var err error
+		if _, extendedOps := SplitExtendedUploads(job.UploadOps); len(extendedOps) > 0 {
+			err = core.ObjSaveWithoutValidation(job)
+		} else {
+			err = core.ObjSave(job)
+		}
 		if err != nil {
 			core.Dart.Log.Error("Error saving job %s after run: %v", job.ID, err)
 		}
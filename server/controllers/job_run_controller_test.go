@@ -139,6 +139,39 @@ func TestJobRunExecute(t *testing.T) {
 	testPostRunJobResult(t, jobResult, "Result from database")
 }
 
+// DART Runner ignores storage service options, so uploads to a
+// service whose options differ from the defaults should go through
+// DART's own S3 uploader. Like TestJobRunExecute, this needs the
+// local Minio server.
+func TestJobRunExecuteWithStorageServiceOptions(t *testing.T) {
+	defer core.ClearDartTable()
+	job := loadTestJob(t)
+	require.NoError(t, core.ObjSave(job))
+	ss := job.UploadOps[0].StorageService
+	ssOpts := controllers.DefaultStorageServiceOptions(ss)
+	ssOpts.BucketLookup = controllers.BucketLookupPath
+	require.NoError(t, controllers.SaveStorageServiceOptions(ssOpts))
+	defer controllers.DeleteStorageServiceOptions(ss.ID)
+
+	recorder := NewStreamRecorder()
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("/jobs/run/%s", job.ID), nil)
+	dartServer.ServeHTTP(recorder, req)
+
+	for !recorder.Flushed {
+		time.Sleep(250 * time.Millisecond)
+	}
+	assert.Equal(t, "Job completed with exit code 0 (success)", recorder.LastEvent.Message)
+
+	job = core.ObjFind(job.ID).Job()
+	require.NotNil(t, job)
+	jobResult := core.NewJobResult(job)
+	testPostRunJobResult(t, jobResult, "Result from database")
+	require.NotEmpty(t, jobResult.UploadResults)
+	for _, uploadResult := range jobResult.UploadResults {
+		assert.Equal(t, controllers.S3UploadProvider, uploadResult.Provider)
+	}
+}
+
 func testPostRunJobResult(t *testing.T, jobResult *core.JobResult, whence string) {
 	// Check some basic details...
 	assert.Equal(t, "APTrust-S3-Bag-01.tar", jobResult.JobName, whence)
@@ -100,7 +100,7 @@ func GetAvailableUploadTargets(selectedTargets []string) ([]core.Choice, error)
 	}
 	targets := make([]core.Choice, 0)
 	for _, ss := range result.StorageServices {
-		isValid := ss.Validate()
+		isValid := ValidateStorageService(ss)
 		if !isValid {
 			core.Dart.Log.Warningf("Omitting storage service '%s' from upload targets due to validation errors: %v", ss.Name, ss.Errors)
 			continue
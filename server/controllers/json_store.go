@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/APTrust/dart-runner/core"
+)
+
+// JSONStore persists a small list of records to a JSON file in DART's
+// data directory. We use this for records that belong to the DART UI
+// and that DART Runner has no reason to know about, such as restore
+// jobs. Records are read and written as a whole, so this is suitable
+// only for collections of a few thousand items or less.
+type JSONStore[T any] struct {
+	fileName string
+	mutex    sync.Mutex
+}
+
+// NewJSONStore returns a store that reads and writes fileName
+// inside of core.Dart.Paths.DataDir.
+func NewJSONStore[T any](fileName string) *JSONStore[T] {
+	return &JSONStore[T]{
+		fileName: fileName,
+	}
+}
+
+// Path returns the full path to the JSON file backing this store.
+func (store *JSONStore[T]) Path() string {
+	return filepath.Join(core.Dart.Paths.DataDir, store.fileName)
+}
+
+// Load returns all records in the store. It returns an empty
+// list if nothing has been saved yet.
+func (store *JSONStore[T]) Load() ([]T, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.load()
+}
+
+// Save replaces the contents of the store with records.
+func (store *JSONStore[T]) Save(records []T) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.save(records)
+}
+
+// Update loads all records, passes them to fn, and saves whatever
+// fn returns. No other reads or writes can happen on this store
+// while fn is running. If fn returns an error, nothing is saved.
+func (store *JSONStore[T]) Update(fn func([]T) ([]T, error)) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	records, err := store.load()
+	if err != nil {
+		return err
+	}
+	records, err = fn(records)
+	if err != nil {
+		return err
+	}
+	return store.save(records)
+}
+
+func (store *JSONStore[T]) load() ([]T, error) {
+	records := make([]T, 0)
+	data, err := os.ReadFile(store.Path())
+	if errors.Is(err, os.ErrNotExist) {
+		return records, nil
+	}
+	if err != nil {
+		return records, err
+	}
+	err = json.Unmarshal(data, &records)
+	return records, err
+}
+
+// save writes to a temp file and then renames it, so a crash
+// mid-write can't leave us with a truncated JSON file.
+func (store *JSONStore[T]) save(records []T) error {
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(store.Path()), 0755); err != nil {
+		return err
+	}
+	tempFile := store.Path() + ".tmp"
+	if err = os.WriteFile(tempFile, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tempFile, store.Path())
+}
@@ -0,0 +1,38 @@
+//go:build !windows
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// lookupKeyring reads the secret for account from service in the OS
+// secret store. On macOS, that's the login keychain, where entries
+// can be added with
+//
+//	security add-generic-password -s dart -a wasabi -w
+//
+// On Linux, it's the Secret Service (GNOME Keyring or KWallet), where
+// entries can be added with
+//
+//	secret-tool store --label="DART wasabi" service dart account wasabi
+func lookupKeyring(service, account string) (string, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		cmd = exec.Command("security", "find-generic-password", "-s", service, "-a", account, "-w")
+	} else {
+		cmd = exec.Command("secret-tool", "lookup", "service", service, "account", account)
+	}
+	output, err := cmd.Output()
+	if errors.Is(err, exec.ErrNotFound) {
+		return "", fmt.Errorf("%s is not installed, so DART cannot read the system keyring", cmd.Path)
+	}
+	if err != nil || len(output) == 0 {
+		return "", fmt.Errorf("no entry for account %s in keyring service %s", account, service)
+	}
+	return strings.TrimRight(string(output), "\r\n"), nil
+}
@@ -0,0 +1,66 @@
+package controllers
+
+import (
+	"fmt"
+	"syscall"
+	"unicode/utf16"
+	"unsafe"
+)
+
+var (
+	advapi32     = syscall.NewLazyDLL("advapi32.dll")
+	procCredRead = advapi32.NewProc("CredReadW")
+	procCredFree = advapi32.NewProc("CredFree")
+)
+
+const credTypeGeneric = 1
+
+// winCredential mirrors the CREDENTIALW struct from wincred.h.
+type winCredential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        syscall.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+// lookupKeyring reads the secret for account from service in the
+// Windows Credential Manager. The credential's target name is
+// service/account, so entries can be added with
+//
+//	cmdkey /generic:dart/wasabi /user:wasabi /pass
+func lookupKeyring(service, account string) (string, error) {
+	targetName := service + "/" + account
+	target, err := syscall.UTF16PtrFromString(targetName)
+	if err != nil {
+		return "", err
+	}
+	var cred *winCredential
+	ret, _, callErr := procCredRead.Call(
+		uintptr(unsafe.Pointer(target)),
+		credTypeGeneric,
+		0,
+		uintptr(unsafe.Pointer(&cred)),
+	)
+	if ret == 0 {
+		return "", fmt.Errorf("no entry for %s in Windows Credential Manager: %v", targetName, callErr)
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+	if cred.CredentialBlobSize == 0 {
+		return "", nil
+	}
+	// Credential Manager and cmdkey store secrets as UTF-16.
+	blob := unsafe.Slice(cred.CredentialBlob, cred.CredentialBlobSize)
+	chars := make([]uint16, len(blob)/2)
+	for i := range chars {
+		chars[i] = uint16(blob[2*i]) | uint16(blob[2*i+1])<<8
+	}
+	return string(utf16.Decode(chars)), nil
+}
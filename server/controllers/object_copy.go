@@ -0,0 +1,582 @@
+package controllers
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+)
+
+// ObjectCopyResult describes a copy of one object from one storage
+// service to another, and how we verified each side.
+type ObjectCopyResult struct {
+	SourcePath  string `json:"sourcePath"`
+	TargetPath  string `json:"targetPath"`
+	Size        int64  `json:"size"`
+	BytesCopied int64  `json:"bytesCopied"`
+	SourceETag  string `json:"sourceETag"`
+	TargetETag  string `json:"targetETag"`
+	MD5         string `json:"md5"`
+	SHA256      string `json:"sha256"`
+	SourceCheck string `json:"sourceCheck"`
+	TargetCheck string `json:"targetCheck"`
+}
+
+// CopyObjectBetweenServices copies the object stored under srcKey in
+// srcBucket on src to dstKey in the bucket of dst. It streams the
+// object from one service to the other without saving it locally,
+// and computes its MD5 and SHA-256 digests along the way. It calls
+// progress as bytes arrive.
+//
+// Afterwards, it checks that we read exactly what the source holds,
+// by size and, for S3, ETag, and that the target holds exactly what
+// we read, by size and, depending on the target, ETag or SHA-256.
+// Reads from S3 are conditional on the ETag, so an object that
+// changes mid-copy fails the copy.
+//
+// Unless overwrite is true, it returns an error if dstKey exists.
+func CopyObjectBetweenServices(src *core.StorageService, srcBucket, srcKey string, dst *core.StorageService, dstKey string, overwrite bool, progress func(copied, total int64)) (*ObjectCopyResult, error) {
+	if err := ValidateObjectKey(dstKey); err != nil {
+		return nil, err
+	}
+	srcInfo, sourcePath, err := StatStoredObject(src, srcBucket, srcKey)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot find %s on %s: %v", srcKey, src.Name, err)
+	}
+	if err := CheckCopySource(srcKey, srcInfo); err != nil {
+		return nil, err
+	}
+	if !overwrite {
+		if _, targetPath, err := StatStoredObject(dst, dst.Bucket, dstKey); err == nil {
+			return nil, fmt.Errorf("%s already exists on %s.", targetPath, dst.Name)
+		}
+	}
+	result := &ObjectCopyResult{
+		SourcePath: sourcePath,
+		Size:       srcInfo.Size,
+		SourceETag: srcInfo.ETag,
+	}
+
+	// Track the part sizes that may have produced the source's
+	// multipart ETag, along with the one we'll use for the target.
+	partSizes := make([]int64, 0)
+	if _, partCount, ok := parseMultipartETag(srcInfo.ETag); ok && src.Protocol == constants.ProtocolS3 {
+		partSizes = append(partSizes, MultipartPartSizeCandidates(srcInfo.Size, partCount)...)
+	}
+	targetPartSize := int64(0)
+	if dst.Protocol == constants.ProtocolS3 {
+		_, targetPartSize, _, err = minio.OptimalPartInfo(srcInfo.Size, 0)
+		if err != nil {
+			return nil, err
+		}
+		partSizes = append(partSizes, targetPartSize)
+	}
+	digests := newStreamDigests(partSizes)
+
+	reader, err := openStoredObject(src, srcBucket, srcKey, srcInfo)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read %s from %s: %v", srcKey, src.Name, err)
+	}
+	defer reader.Close()
+	stream := &progressReader{
+		reader:   io.TeeReader(reader, digests),
+		total:    srcInfo.Size,
+		progress: progress,
+	}
+	result.TargetPath, err = writeStoredObject(dst, dstKey, stream, srcInfo.Size, targetPartSize)
+	result.BytesCopied = stream.copied
+	if err != nil {
+		return result, fmt.Errorf("Cannot write %s to %s: %v", dstKey, dst.Name, err)
+	}
+	result.MD5 = digests.MD5()
+	result.SHA256 = digests.SHA256()
+
+	result.SourceCheck, err = checkCopySource(src, srcBucket, srcKey, srcInfo, digests)
+	if err != nil {
+		return result, fmt.Errorf("Source check failed for %s: %v", sourcePath, err)
+	}
+	result.TargetCheck, result.TargetETag, err = checkCopyTarget(dst, dstKey, digests, targetPartSize)
+	if err != nil {
+		return result, fmt.Errorf("Target check failed for %s: %v", result.TargetPath, err)
+	}
+	return result, nil
+}
+
+// CheckCopySource returns an error if the object described by srcInfo
+// can't be read yet because it's in archive storage and hasn't been
+// restored. StatObject reports the storage class only in the object's
+// metadata, so we check that through IsArchivedS3Object.
+func CheckCopySource(srcKey string, srcInfo minio.ObjectInfo) error {
+	if IsArchivedS3Object(srcInfo) {
+		return archivedObjectError(srcKey, srcInfo)
+	}
+	return nil
+}
+
+// StatStoredObject returns the size and ETag of the object stored
+// under key in bucket on ss, along with a display path for it.
+// For SFTP and WebDAV services, the ETag is a stand-in built from
+// the file's size and modification time. See SFTPFileETag.
+func StatStoredObject(ss *core.StorageService, bucket, key string) (minio.ObjectInfo, string, error) {
+	info := minio.ObjectInfo{Key: key}
+	switch ss.Protocol {
+	case constants.ProtocolS3:
+		displayPath := bucket + "/" + key
+		client, err := NewMinioClient(ss)
+		if err != nil {
+			return info, displayPath, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), DiagnosticTimeout)
+		defer cancel()
+		info, err = client.StatObject(ctx, bucket, key, minio.StatObjectOptions{})
+		info.ETag = strings.Trim(info.ETag, `"`)
+		return info, displayPath, err
+	case constants.ProtocolSFTP:
+		remotePath, err := SFTPRemotePath(bucket, key)
+		if err != nil {
+			return info, key, err
+		}
+		conn, err := NewSFTPConnection(ss)
+		if err != nil {
+			return info, remotePath, err
+		}
+		defer conn.Close()
+		stat, err := conn.Stat(remotePath)
+		if err != nil {
+			return info, remotePath, err
+		}
+		if stat.IsDir() {
+			return info, remotePath, fmt.Errorf("%s is a directory", remotePath)
+		}
+		info.Size = stat.Size()
+		info.ETag = SFTPFileETag(stat)
+		return info, remotePath, nil
+	case ProtocolWebDAV:
+		remotePath, err := WebDAVRemotePath(bucket, key)
+		if err != nil {
+			return info, key, err
+		}
+		client, err := NewWebDAVClient(ss)
+		if err != nil {
+			return info, remotePath, err
+		}
+		entry, err := client.Stat(remotePath)
+		if err != nil {
+			return info, remotePath, err
+		}
+		if entry.IsDir {
+			return info, remotePath, fmt.Errorf("%s is a directory", remotePath)
+		}
+		info.Size = entry.Size
+		info.ETag = webDAVETag(entry)
+		return info, remotePath, nil
+	case ProtocolFilesystem:
+		if err := checkKeySegments(key); err != nil {
+			return info, key, err
+		}
+		localPath := filepath.Join(bucket, filepath.FromSlash(key))
+		stat, err := os.Stat(localPath)
+		if err != nil {
+			return info, localPath, err
+		}
+		if stat.IsDir() {
+			return info, localPath, fmt.Errorf("%s is a directory", localPath)
+		}
+		info.Size = stat.Size()
+		return info, localPath, nil
+	}
+	return info, key, fmt.Errorf("DART cannot read from %s services", ss.Protocol)
+}
+
+// openStoredObject opens the object described by info for reading.
+// S3 reads are conditional on info's ETag.
+func openStoredObject(ss *core.StorageService, bucket, key string, info minio.ObjectInfo) (io.ReadCloser, error) {
+	switch ss.Protocol {
+	case constants.ProtocolS3:
+		client, err := NewMinioClient(ss)
+		if err != nil {
+			return nil, err
+		}
+		opts := minio.GetObjectOptions{}
+		if err = opts.SetMatchETag(info.ETag); err != nil {
+			return nil, err
+		}
+		return client.GetObject(context.Background(), bucket, key, opts)
+	case constants.ProtocolSFTP:
+		remotePath, err := SFTPRemotePath(bucket, key)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := NewSFTPConnection(ss)
+		if err != nil {
+			return nil, err
+		}
+		file, err := conn.Open(remotePath)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return &sftpReadCloser{File: file, conn: conn}, nil
+	case ProtocolWebDAV:
+		remotePath, err := WebDAVRemotePath(bucket, key)
+		if err != nil {
+			return nil, err
+		}
+		client, err := NewWebDAVClient(ss)
+		if err != nil {
+			return nil, err
+		}
+		return client.Open(remotePath, 0)
+	case ProtocolFilesystem:
+		return os.Open(filepath.Join(bucket, filepath.FromSlash(key)))
+	}
+	return nil, fmt.Errorf("DART cannot read from %s services", ss.Protocol)
+}
+
+// writeStoredObject writes size bytes from reader to key in the bucket
+// of ss and returns the path of the copy. S3 uploads use partSize,
+// so we know what the multipart ETag should be. Other protocols write
+// under a temporary name and rename the file once it's complete.
+func writeStoredObject(ss *core.StorageService, key string, reader io.Reader, size, partSize int64) (string, error) {
+	switch ss.Protocol {
+	case constants.ProtocolS3:
+		client, err := NewMinioClient(ss)
+		if err != nil {
+			return "", err
+		}
+		putOpts, err := GetStorageServiceOptions(ss).S3.PutObjectOptions(uploadJobKeyLookup(time.Now()))
+		if err != nil {
+			return "", err
+		}
+		putOpts.PartSize = uint64(partSize)
+		_, err = client.PutObject(context.Background(), ss.Bucket, key, reader, size, putOpts)
+		return ss.Bucket + "/" + key, err
+	case constants.ProtocolSFTP:
+		remotePath, err := SFTPRemotePath(ss.Bucket, key)
+		if err != nil {
+			return "", err
+		}
+		conn, err := NewSFTPConnection(ss)
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		return remotePath, writeSFTPFile(conn, reader, remotePath)
+	case ProtocolWebDAV:
+		remotePath, err := WebDAVRemotePath(ss.Bucket, key)
+		if err != nil {
+			return "", err
+		}
+		client, err := NewWebDAVClient(ss)
+		if err != nil {
+			return "", err
+		}
+		return remotePath, writeWebDAVFile(client, reader, size, remotePath)
+	case ProtocolFilesystem:
+		return writeFilesystemFile(ss, reader, key)
+	}
+	return "", fmt.Errorf("DART cannot write to %s services", ss.Protocol)
+}
+
+// writeWebDAVFile writes size bytes from reader to a temporary name
+// next to remotePath, then moves the file to remotePath.
+func writeWebDAVFile(client *WebDAVClient, reader io.Reader, size int64, remotePath string) error {
+	if err := client.MkdirAll(path.Dir(remotePath)); err != nil {
+		return err
+	}
+	tempPath := path.Join(path.Dir(remotePath), fmt.Sprintf(".%s.dart-tmp-%s", path.Base(remotePath), uuid.NewString()))
+	err := client.Put(tempPath, reader, size)
+	if err == nil {
+		err = client.Move(tempPath, remotePath)
+	}
+	if err != nil {
+		if deleteErr := client.Delete(tempPath); deleteErr != nil && !errors.Is(deleteErr, fs.ErrNotExist) {
+			core.Dart.Log.Warningf("Could not delete temporary upload %s: %v", tempPath, deleteErr)
+		}
+	}
+	return err
+}
+
+// writeFilesystemFile writes everything from reader to key in the
+// target directory of filesystem service ss, under a temporary name
+// until the file is complete, and returns the path of the file.
+func writeFilesystemFile(ss *core.StorageService, reader io.Reader, key string) (string, error) {
+	if err := checkKeySegments(key); err != nil {
+		return "", err
+	}
+	targetPath := filepath.Join(ss.Bucket, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+		return "", err
+	}
+	tempPath := filepath.Join(filepath.Dir(targetPath), fmt.Sprintf(".%s.dart-tmp-%s", filepath.Base(targetPath), uuid.NewString()))
+	target, err := os.OpenFile(tempPath, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(target, reader)
+	if err == nil {
+		err = target.Sync()
+	}
+	closeErr := target.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, targetPath)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return "", err
+	}
+	return targetPath, nil
+}
+
+// checkCopySource checks that the bytes we read match what the source
+// holds. We always compare sizes. For S3 sources, we also compare the
+// ETag, and for SFTP sources, the SHA-256 if the server can compute it.
+func checkCopySource(ss *core.StorageService, bucket, key string, info minio.ObjectInfo, digests *streamDigests) (string, error) {
+	if digests.size != info.Size {
+		return "", fmt.Errorf("Read %d bytes, but the source is %d bytes", digests.size, info.Size)
+	}
+	switch ss.Protocol {
+	case constants.ProtocolS3:
+		return checkStreamedETag(info, digests)
+	case constants.ProtocolSFTP:
+		remotePath, err := SFTPRemotePath(bucket, key)
+		if err != nil {
+			return "", err
+		}
+		conn, err := NewSFTPConnection(ss)
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		return checkSFTPChecksum(conn, remotePath, digests)
+	}
+	return "size matches", nil
+}
+
+// checkCopyTarget checks that the copy on ss matches the bytes we
+// read, and returns a description of the check and the copy's ETag.
+func checkCopyTarget(ss *core.StorageService, key string, digests *streamDigests, partSize int64) (string, string, error) {
+	info, targetPath, err := StatStoredObject(ss, ss.Bucket, key)
+	if err != nil {
+		return "", "", fmt.Errorf("Cannot find the copy: %v", err)
+	}
+	if info.Size != digests.size {
+		return "", info.ETag, fmt.Errorf("Size mismatch: copied %d bytes, but the copy is %d bytes", digests.size, info.Size)
+	}
+	switch ss.Protocol {
+	case constants.ProtocolS3:
+		check, err := checkStreamedETag(info, digests)
+		return check, info.ETag, err
+	case constants.ProtocolSFTP:
+		conn, err := NewSFTPConnection(ss)
+		if err != nil {
+			return "", info.ETag, err
+		}
+		defer conn.Close()
+		check, err := checkSFTPChecksum(conn, targetPath, digests)
+		return check, info.ETag, err
+	case ProtocolFilesystem:
+		actual, err := sha256File(targetPath)
+		if err != nil {
+			return "", info.ETag, err
+		}
+		if actual != digests.SHA256() {
+			return "", info.ETag, fmt.Errorf("Checksum mismatch: copied sha256 %s, copy has sha256 %s", digests.SHA256(), actual)
+		}
+		return "size and SHA-256 match", info.ETag, nil
+	}
+	return "size matches", info.ETag, nil
+}
+
+// checkStreamedETag compares an S3 object's ETag with the digests of
+// the bytes we streamed. See verifyS3Object for why encrypted objects
+// can be checked only by size.
+func checkStreamedETag(info minio.ObjectInfo, digests *streamDigests) (string, error) {
+	encryption := info.Metadata.Get("X-Amz-Server-Side-Encryption")
+	if encryption == "aws:kms" || encryption == "aws:kms:dsse" || info.Metadata.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") != "" {
+		return "size matches (ETags of objects encrypted with KMS or customer keys are not checksums)", nil
+	}
+	partCount, isMultipart := 0, false
+	if _, count, ok := parseMultipartETag(info.ETag); ok {
+		partCount, isMultipart = count, true
+	} else if strings.Contains(info.ETag, "-") || len(info.ETag) != 32 {
+		return fmt.Sprintf("size matches (unrecognized ETag %s)", info.ETag), nil
+	}
+	if !isMultipart {
+		if digests.MD5() != info.ETag {
+			return "", fmt.Errorf("ETag mismatch: streamed MD5 is %s, ETag is %s", digests.MD5(), info.ETag)
+		}
+		return "size and ETag (MD5) match", nil
+	}
+	for partSize, etag := range digests.MultipartETags() {
+		if (info.Size+partSize-1)/partSize == int64(partCount) && etag == info.ETag {
+			return fmt.Sprintf("size and multipart ETag match (part size %d)", partSize), nil
+		}
+	}
+	return "", fmt.Errorf("Multipart ETag mismatch: no streamed ETag matched %s", info.ETag)
+}
+
+// checkSFTPChecksum compares the SHA-256 of remotePath with the one
+// we streamed, if the server can compute it.
+func checkSFTPChecksum(conn *SFTPConnection, remotePath string, digests *streamDigests) (string, error) {
+	remoteSHA256, err := conn.RemoteSHA256(remotePath)
+	if err != nil {
+		return fmt.Sprintf("size matches (server cannot compute checksums: %v)", err), nil
+	}
+	if remoteSHA256 != digests.SHA256() {
+		return "", fmt.Errorf("Checksum mismatch: streamed sha256 is %s, remote sha256 is %s", digests.SHA256(), remoteSHA256)
+	}
+	return "size and SHA-256 match", nil
+}
+
+// parseMultipartETag splits a multipart ETag into its
+// digest and part count.
+func parseMultipartETag(etag string) (string, int, bool) {
+	digest, partCountStr, found := strings.Cut(etag, "-")
+	if !found || len(digest) != 32 {
+		return "", 0, false
+	}
+	partCount, err := strconv.Atoi(partCountStr)
+	if err != nil || partCount < 1 {
+		return "", 0, false
+	}
+	return digest, partCount, true
+}
+
+// streamDigests computes the MD5 and SHA-256 of everything written to
+// it, along with the multipart ETag for each of a set of part sizes.
+type streamDigests struct {
+	md5    hash.Hash
+	sha256 hash.Hash
+	parts  []*partDigest
+	size   int64
+}
+
+func newStreamDigests(partSizes []int64) *streamDigests {
+	digests := &streamDigests{
+		md5:    md5.New(),
+		sha256: sha256.New(),
+	}
+	seen := make(map[int64]bool)
+	for _, partSize := range partSizes {
+		if partSize > 0 && !seen[partSize] {
+			seen[partSize] = true
+			digests.parts = append(digests.parts, &partDigest{partSize: partSize, current: md5.New()})
+		}
+	}
+	return digests
+}
+
+func (digests *streamDigests) Write(p []byte) (int, error) {
+	digests.md5.Write(p)
+	digests.sha256.Write(p)
+	for _, part := range digests.parts {
+		part.write(p)
+	}
+	digests.size += int64(len(p))
+	return len(p), nil
+}
+
+// MD5 returns the hex-encoded MD5 of everything written so far.
+func (digests *streamDigests) MD5() string {
+	return hex.EncodeToString(digests.md5.Sum(nil))
+}
+
+// SHA256 returns the hex-encoded SHA-256 of everything written so far.
+func (digests *streamDigests) SHA256() string {
+	return hex.EncodeToString(digests.sha256.Sum(nil))
+}
+
+// MultipartETags returns the multipart ETag for each part size,
+// computed the same way as LocalMultipartETag.
+func (digests *streamDigests) MultipartETags() map[int64]string {
+	etags := make(map[int64]string)
+	for _, part := range digests.parts {
+		etags[part.partSize] = part.etag()
+	}
+	return etags
+}
+
+type partDigest struct {
+	partSize int64
+	sums     []byte
+	current  hash.Hash
+	inPart   int64
+	parts    int
+}
+
+func (part *partDigest) write(p []byte) {
+	for len(p) > 0 {
+		n := int64(len(p))
+		if remaining := part.partSize - part.inPart; n > remaining {
+			n = remaining
+		}
+		part.current.Write(p[:n])
+		part.inPart += n
+		p = p[n:]
+		if part.inPart == part.partSize {
+			part.sums = part.current.Sum(part.sums)
+			part.parts++
+			part.current.Reset()
+			part.inPart = 0
+		}
+	}
+}
+
+// etag returns the multipart ETag of everything written so far.
+// Like LocalMultipartETag, it counts an empty stream as one
+// empty part.
+func (part *partDigest) etag() string {
+	sums, parts := part.sums, part.parts
+	if part.inPart > 0 || parts == 0 {
+		sums = part.current.Sum(append([]byte{}, sums...))
+		parts++
+	}
+	combined := md5.Sum(sums)
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(combined[:]), parts)
+}
+
+// progressReader reports how many bytes have been read after each
+// whole percent of total.
+type progressReader struct {
+	reader      io.Reader
+	total       int64
+	copied      int64
+	lastPercent int
+	progress    func(copied, total int64)
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.copied += int64(n)
+	if r.progress != nil && n > 0 {
+		percent := 100
+		if r.total > 0 {
+			percent = int(r.copied * 100 / r.total)
+		}
+		if percent != r.lastPercent {
+			r.lastPercent = percent
+			r.progress(r.copied, r.total)
+		}
+	}
+	return n, err
+}
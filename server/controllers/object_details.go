@@ -0,0 +1,284 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/minio/minio-go/v7"
+)
+
+// ObjectDetails describes one object in the download browser in
+// more detail than a listing does.
+type ObjectDetails struct {
+	StorageServiceName string
+	Protocol           string
+	Bucket             string
+	Key                string
+	DisplayPath        string
+	Size               int64
+	LastModified       time.Time
+	ETag               string
+	ContentType        string
+	StorageClass       string
+	VersionID          string
+	UserMetadata       []BagTag
+	Tags               []BagTag
+	// TagsError says why we couldn't read the object's tags.
+	TagsError string
+	// RestoreStatus describes the restore of an archived object, or
+	// is empty if no restore was requested.
+	RestoreStatus string
+	// Archived is true if the object is in Glacier or Deep Archive
+	// and has no restored copy, so it can't be read.
+	Archived bool
+	// Bag is what we read from inside a serialized bag, unless
+	// BagError says why we couldn't.
+	Bag      *SerializedBagInfo
+	BagError string
+}
+
+// GetObjectDetails returns the details of the object stored under key
+// in bucket on ss. For S3 objects, that includes the metadata, tags
+// and restore status that a listing leaves out. If the object is a
+// serialized bag, it also lists the bag's top-level entries and reads
+// bag-info.txt, without downloading the whole bag. See
+// InspectSerializedBag.
+func GetObjectDetails(ss *core.StorageService, bucket, key string) (*ObjectDetails, error) {
+	details := &ObjectDetails{
+		StorageServiceName: ss.Name,
+		Protocol:           ss.Protocol,
+		Bucket:             bucket,
+		Key:                key,
+	}
+	if ss.Protocol == constants.ProtocolS3 {
+		return details, getS3ObjectDetails(ss, details)
+	}
+	info, displayPath, err := StatStoredObject(ss, bucket, key)
+	details.DisplayPath = displayPath
+	if err != nil {
+		return details, err
+	}
+	details.Size = info.Size
+	details.ETag = info.ETag
+	if !IsSerializedBag(key) {
+		return details, nil
+	}
+	obj, err := openRandomAccessObject(ss, bucket, key, info.Size)
+	if err != nil {
+		details.BagError = err.Error()
+		return details, nil
+	}
+	defer obj.Close()
+	inspectObjectBag(details, obj)
+	return details, nil
+}
+
+func getS3ObjectDetails(ss *core.StorageService, details *ObjectDetails) error {
+	details.DisplayPath = details.Bucket + "/" + details.Key
+	client, err := NewMinioClient(ss)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DiagnosticTimeout)
+	defer cancel()
+	objInfo, err := client.StatObject(ctx, details.Bucket, details.Key, minio.StatObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("Cannot find %s: %v", details.DisplayPath, err)
+	}
+	details.Size = objInfo.Size
+	details.LastModified = objInfo.LastModified
+	details.ETag = strings.Trim(objInfo.ETag, `"`)
+	details.ContentType = objInfo.ContentType
+	details.VersionID = objInfo.VersionID
+	details.StorageClass = S3StorageClass(objInfo)
+	details.Archived = IsArchivedS3Object(objInfo)
+	details.UserMetadata = sortedTags(objInfo.UserMetadata)
+
+	objTags, err := client.GetObjectTagging(ctx, details.Bucket, details.Key, minio.GetObjectTaggingOptions{VersionID: objInfo.VersionID})
+	if err != nil {
+		details.TagsError = err.Error()
+	} else {
+		details.Tags = sortedTags(objTags.ToMap())
+	}
+
+	if objInfo.Restore != nil {
+		if objInfo.Restore.OngoingRestore {
+			details.RestoreStatus = "Restore in progress."
+		} else {
+			details.RestoreStatus = fmt.Sprintf("Restored copy available until %s.", objInfo.Restore.ExpiryTime.Local().Format(time.RFC1123))
+		}
+	} else if IsArchiveStorageClass(details.StorageClass) {
+		details.RestoreStatus = "Not restored."
+	}
+
+	if !IsSerializedBag(details.Key) {
+		return nil
+	}
+	if details.Archived {
+		details.BagError = fmt.Sprintf("Object is in %s storage and must be restored before DART can read it.", details.StorageClass)
+		return nil
+	}
+	// Reading a large bag can take longer than a stat, so
+	// this doesn't share the stat's timeout.
+	obj, err := client.GetObject(context.Background(), details.Bucket, details.Key, minio.GetObjectOptions{VersionID: objInfo.VersionID})
+	if err != nil {
+		details.BagError = err.Error()
+		return nil
+	}
+	defer obj.Close()
+	inspectObjectBag(details, obj)
+	return nil
+}
+
+func inspectObjectBag(details *ObjectDetails, obj RandomAccessObject) {
+	bag, err := InspectSerializedBag(details.Key, obj, details.Size)
+	if err != nil {
+		details.BagError = err.Error()
+		return
+	}
+	details.Bag = bag
+}
+
+// sortedTags returns the entries of m sorted by name.
+func sortedTags(m map[string]string) []BagTag {
+	tags := make([]BagTag, 0, len(m))
+	for name, value := range m {
+		tags = append(tags, BagTag{Name: name, Value: value})
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+	return tags
+}
+
+// randomAccessReadCloser is a RandomAccessObject that must be closed.
+type randomAccessReadCloser interface {
+	RandomAccessObject
+	io.Closer
+}
+
+// openRandomAccessObject opens the file at key on an SFTP, WebDAV
+// or filesystem service for reading in any order.
+func openRandomAccessObject(ss *core.StorageService, bucket, key string, size int64) (randomAccessReadCloser, error) {
+	switch ss.Protocol {
+	case constants.ProtocolSFTP:
+		remotePath, err := SFTPRemotePath(bucket, key)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := NewSFTPConnection(ss)
+		if err != nil {
+			return nil, err
+		}
+		file, err := conn.Open(remotePath)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return &sftpRandomAccessFile{RandomAccessObject: file, file: file, conn: conn}, nil
+	case ProtocolWebDAV:
+		remotePath, err := WebDAVRemotePath(bucket, key)
+		if err != nil {
+			return nil, err
+		}
+		client, err := NewWebDAVClient(ss)
+		if err != nil {
+			return nil, err
+		}
+		open := func(offset int64) (io.ReadCloser, error) {
+			return client.Open(remotePath, offset)
+		}
+		return &rangeReader{open: open, size: size}, nil
+	case ProtocolFilesystem:
+		if err := checkKeySegments(key); err != nil {
+			return nil, err
+		}
+		return os.Open(filepath.Join(bucket, filepath.FromSlash(key)))
+	}
+	return nil, fmt.Errorf("DART cannot read bags on %s services", ss.Protocol)
+}
+
+// sftpRandomAccessFile closes the SFTP connection along with the file.
+type sftpRandomAccessFile struct {
+	RandomAccessObject
+	file io.Closer
+	conn *SFTPConnection
+}
+
+func (f *sftpRandomAccessFile) Close() error {
+	f.file.Close()
+	return f.conn.Close()
+}
+
+// rangeReader gives random access to a remote file through a function
+// that opens the file at an offset. Like a minio.Object, it makes a new
+// request for each read after a seek to a new position.
+type rangeReader struct {
+	open   func(offset int64) (io.ReadCloser, error)
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		body, err := r.open(r.offset)
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *rangeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return r.offset, fmt.Errorf("Cannot seek to negative offset %d", offset)
+	}
+	if offset != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *rangeReader) ReadAt(p []byte, offset int64) (int, error) {
+	if offset >= r.size {
+		return 0, io.EOF
+	}
+	body, err := r.open(offset)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	n, err := io.ReadFull(body, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *rangeReader) Close() error {
+	if r.body != nil {
+		return r.body.Close()
+	}
+	return nil
+}
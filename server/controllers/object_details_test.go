@@ -0,0 +1,101 @@
+package controllers_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart-runner/util"
+	"github.com/APTrust/dart/v3/server/controllers"
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetObjectDetails(t *testing.T) {
+	defer core.ClearDartTable()
+	ss := getFilesystemService(t)
+	require.NoError(t, core.ObjSaveWithoutValidation(ss))
+	bagData, err := os.ReadFile(filepath.Join(util.PathToTestData(), "bags", "example.edu.sample_good.tar"))
+	require.NoError(t, err)
+	writeReconcileFiles(t, ss.Bucket, map[string]string{
+		"deposits/example.edu.sample_good.tar": string(bagData),
+		"deposits/notes.txt":                   "not a bag",
+	})
+
+	details, err := controllers.GetObjectDetails(ss, ss.Bucket, "deposits/example.edu.sample_good.tar")
+	require.NoError(t, err)
+	assert.EqualValues(t, len(bagData), details.Size)
+	assert.Empty(t, details.BagError)
+	require.NotNil(t, details.Bag)
+	assert.Equal(t, "example.edu.sample_good", details.Bag.BagName)
+	assert.True(t, details.Bag.HasBagInfo)
+
+	details, err = controllers.GetObjectDetails(ss, ss.Bucket, "deposits/notes.txt")
+	require.NoError(t, err)
+	assert.Nil(t, details.Bag)
+
+	_, err = controllers.GetObjectDetails(ss, ss.Bucket, "deposits/missing.tar")
+	assert.Error(t, err)
+
+	params := url.Values{}
+	params.Set("ssid", ss.ID)
+	params.Set("bucket", ss.Bucket)
+	params.Set("key", "deposits/example.edu.sample_good.tar")
+	DoSimpleGetTest(t, "/download_jobs/details?"+params.Encode(), []string{
+		"Top-Level Entry",
+		"manifest-md5.txt",
+		"bag-info.txt",
+		"Source-Organization: virginia.edu",
+	})
+
+	params.Set("key", "deposits/missing.tar")
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/download_jobs/details?"+params.Encode(), nil)
+	require.NoError(t, err)
+	dartServer.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Contains(t, w.Body.String(), "alert-danger")
+}
+
+// NOTE: This test assumes that local Minio server is running.
+// See the note at the top of download_job_controller_test.go.
+func TestGetObjectDetailsS3(t *testing.T) {
+	defer core.ClearDartTable()
+	ss := loadMinioStorageService(t)
+	client, err := controllers.NewMinioClient(ss)
+	require.NoError(t, err)
+	bagData, err := os.ReadFile(filepath.Join(util.PathToTestData(), "bags", "example.edu.sample_good.zip"))
+	require.NoError(t, err)
+	key := "details-test/example.edu.sample_good.zip"
+	_, err = client.PutObject(context.Background(), ss.Bucket, key, strings.NewReader(string(bagData)), int64(len(bagData)), minio.PutObjectOptions{
+		ContentType:  "application/zip",
+		UserMetadata: map[string]string{"Bag-Name": "example.edu.sample_good"},
+		UserTags:     map[string]string{"project": "details-test"},
+	})
+	require.NoError(t, err)
+
+	details, err := controllers.GetObjectDetails(ss, ss.Bucket, key)
+	require.NoError(t, err)
+	assert.Equal(t, "application/zip", details.ContentType)
+	assert.Equal(t, "STANDARD", details.StorageClass)
+	assert.NotEmpty(t, details.ETag)
+	assert.False(t, details.Archived)
+	assert.Empty(t, details.RestoreStatus)
+	assert.Equal(t, "example.edu.sample_good", controllers.TagValue(details.UserMetadata, "Bag-Name"))
+	assert.Empty(t, details.TagsError)
+	assert.Equal(t, "details-test", controllers.TagValue(details.Tags, "project"))
+	require.NotNil(t, details.Bag, details.BagError)
+	assert.True(t, details.Bag.TopLevelListed)
+	assert.Equal(t, "virginia.edu", controllers.TagValue(details.Bag.Tags, "Source-Organization"))
+
+	_, err = controllers.GetObjectDetails(ss, ss.Bucket, "details-test/missing.zip")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Cannot find")
+}
@@ -0,0 +1,176 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/user"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// PresignedURL records a temporary download link we issued
+// for an S3 object.
+type PresignedURL struct {
+	ID                 string `json:"id"`
+	StorageServiceID   string `json:"storageServiceId"`
+	StorageServiceName string `json:"storageServiceName"`
+	Bucket             string `json:"bucket"`
+	Key                string `json:"key"`
+	// IssuedBy is the name of the user account that created the link.
+	IssuedBy string `json:"issuedBy"`
+	// SharedWith is an optional note on who the link is for.
+	SharedWith string    `json:"sharedWith"`
+	CreatedAt  time.Time `json:"createdAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	URL        string    `json:"url"`
+}
+
+// Expired returns true if the link no longer works.
+func (p *PresignedURL) Expired() bool {
+	return time.Now().After(p.ExpiresAt)
+}
+
+var presignedURLStore = NewJSONStore[PresignedURL]("presigned_urls.json")
+
+// presignExpiryChoices are the expiry times users can choose from.
+var presignExpiryChoices = []core.Choice{
+	{Label: "1 hour", Value: "1h"},
+	{Label: "4 hours", Value: "4h"},
+	{Label: "1 day", Value: "24h"},
+	{Label: "3 days", Value: "72h"},
+	{Label: "7 days", Value: "168h"},
+}
+
+// GET /presigned_urls
+func PresignedURLIndex(c *gin.Context) {
+	links, err := presignedURLStore.Load()
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+		return
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].CreatedAt.After(links[j].CreatedAt) })
+	data := gin.H{
+		"links":   links,
+		"helpUrl": GetHelpUrl(c),
+	}
+	c.HTML(http.StatusOK, "presigned_url/index.html", data)
+}
+
+// GET /presigned_urls/new?ssid=<id>&bucket=<name>&key=<key>
+func PresignedURLNew(c *gin.Context) {
+	link := &PresignedURL{
+		StorageServiceID: c.Query("ssid"),
+		Bucket:           c.Query("bucket"),
+		Key:              c.Query("key"),
+	}
+	data := gin.H{
+		"link":    link,
+		"form":    presignedURLForm(link, "24h"),
+		"helpUrl": GetHelpUrl(c),
+	}
+	c.HTML(http.StatusOK, "presigned_url/new.html", data)
+}
+
+// POST /presigned_urls/new
+func PresignedURLCreate(c *gin.Context) {
+	link := &PresignedURL{
+		StorageServiceID: c.PostForm("ssid"),
+		Bucket:           c.PostForm("bucket"),
+		Key:              c.PostForm("key"),
+		SharedWith:       strings.TrimSpace(c.PostForm("SharedWith")),
+	}
+	expiryValue := c.PostForm("Expiry")
+	form := presignedURLForm(link, expiryValue)
+	expiry, err := time.ParseDuration(expiryValue)
+	if err != nil || expiry < time.Second || expiry > MaxPresignExpiry {
+		form.Fields["Expiry"].Error = "Please choose when the link expires."
+	}
+	ss := core.ObjFind(link.StorageServiceID).StorageService()
+	if ss == nil || ss.Protocol != constants.ProtocolS3 {
+		form.Fields["Expiry"].Error = "Download links are available only for objects on S3 services."
+	}
+	if form.Fields["Expiry"].Error == "" {
+		link.CreatedAt = time.Now()
+		presigned, err := PresignS3Download(ss, link.Bucket, link.Key, expiry)
+		if err != nil {
+			form.Fields["Expiry"].Error = err.Error()
+		} else {
+			link.URL = presigned.String()
+			link.ExpiresAt = link.CreatedAt.Add(expiry)
+		}
+	}
+	if form.Fields["Expiry"].Error != "" {
+		data := gin.H{
+			"link":    link,
+			"form":    form,
+			"helpUrl": GetHelpUrl(c),
+		}
+		c.HTML(http.StatusBadRequest, "presigned_url/new.html", data)
+		return
+	}
+	link.ID = uuid.NewString()
+	link.StorageServiceName = ss.Name
+	link.IssuedBy = currentUserName()
+	err = presignedURLStore.Update(func(links []PresignedURL) ([]PresignedURL, error) {
+		return append(links, *link), nil
+	})
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+		return
+	}
+	core.Dart.Log.Infof("%s issued a download link for %s/%s that expires %s", link.IssuedBy, link.Bucket, link.Key, link.ExpiresAt.Format(time.RFC3339))
+	c.Redirect(http.StatusFound, fmt.Sprintf("/presigned_urls/show/%s", link.ID))
+}
+
+// GET /presigned_urls/show/:id
+func PresignedURLShow(c *gin.Context) {
+	links, err := presignedURLStore.Load()
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+		return
+	}
+	for i := range links {
+		if links[i].ID == c.Param("id") {
+			data := gin.H{
+				"link":    &links[i],
+				"helpUrl": GetHelpUrl(c),
+			}
+			c.HTML(http.StatusOK, "presigned_url/show.html", data)
+			return
+		}
+	}
+	AbortWithErrorHTML(c, http.StatusNotFound, fmt.Errorf("No download link with id %s", c.Param("id")))
+}
+
+func presignedURLForm(link *PresignedURL, expiry string) *core.Form {
+	form := core.NewForm("PresignedURL", link.ID, make(map[string]string))
+	expiryField := form.AddField("Expiry", "Expires In", expiry, true)
+	for _, choice := range presignExpiryChoices {
+		choice.Selected = choice.Value == expiry
+		expiryField.Choices = append(expiryField.Choices, choice)
+	}
+	expiryField.Help = "Anyone who has the link can download the object until it expires. Links can't be revoked early, except by changing the credentials of the storage service."
+	sharedWithField := form.AddField("SharedWith", "Shared With", link.SharedWith, false)
+	sharedWithField.Help = "Optional. Who you're giving the link to, for the log of issued links."
+	return form
+}
+
+// currentUserName returns the name of the user running DART.
+func currentUserName() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+	for _, name := range []string{"USER", "USERNAME"} {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return "unknown"
+}
@@ -0,0 +1,86 @@
+package controllers_test
+
+import (
+	"context"
+	"html"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart/v3/server/controllers"
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPresignedURLCreateWithoutS3Service(t *testing.T) {
+	defer core.ClearDartTable()
+	ss := getFilesystemService(t)
+	require.NoError(t, core.ObjSaveWithoutValidation(ss))
+	params := url.Values{}
+	params.Set("ssid", ss.ID)
+	params.Set("bucket", ss.Bucket)
+	params.Set("key", "bag.tar")
+	params.Set("Expiry", "24h")
+	DoSimplePostTest(t, PostTestSettings{
+		EndpointUrl:          "/presigned_urls/new",
+		Params:               params,
+		ExpectedResponseCode: http.StatusBadRequest,
+		ExpectedContent: []string{
+			"Download links are available only for objects on S3 services.",
+		},
+	})
+}
+
+// NOTE: This test assumes that local Minio server is running.
+// See the note at the top of download_job_controller_test.go.
+func TestPresignS3Download(t *testing.T) {
+	defer core.ClearDartTable()
+	ss := loadMinioStorageService(t)
+	client, err := controllers.NewMinioClient(ss)
+	require.NoError(t, err)
+	key := "presign-test/bag.tar"
+	content := "Shared bag"
+	_, err = client.PutObject(context.Background(), ss.Bucket, key, strings.NewReader(content), int64(len(content)), minio.PutObjectOptions{})
+	require.NoError(t, err)
+
+	presigned, err := controllers.PresignS3Download(ss, ss.Bucket, key, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, "3600", presigned.Query().Get("X-Amz-Expires"))
+	assert.Equal(t, `attachment; filename="bag.tar"`, presigned.Query().Get("response-content-disposition"))
+	resp, err := http.Get(presigned.String())
+	require.NoError(t, err)
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, content, string(data))
+
+	_, err = controllers.PresignS3Download(ss, ss.Bucket, key, 8*24*time.Hour)
+	assert.Error(t, err)
+	_, err = controllers.PresignS3Download(ss, ss.Bucket, "presign-test/missing.tar", time.Hour)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Cannot find presign-test/missing.tar")
+
+	// Create a link through the UI and check the log.
+	params := url.Values{}
+	params.Set("ssid", ss.ID)
+	params.Set("bucket", ss.Bucket)
+	params.Set("key", key)
+	DoSimpleGetTest(t, "/presigned_urls/new?"+params.Encode(), []string{"Share Download Link", key, "Expires In"})
+	params.Set("Expiry", "72h")
+	params.Set("SharedWith", "Archivist at example.edu")
+	w := httptest.NewRecorder()
+	req, err := NewPostRequest("/presigned_urls/new", params)
+	require.NoError(t, err)
+	dartServer.ServeHTTP(w, req)
+	require.Equal(t, http.StatusFound, w.Code)
+	showHtml := html.UnescapeString(GetUrl(t, w.Header().Get("Location")))
+	assert.Contains(t, showHtml, "X-Amz-Expires=259200")
+	assert.Contains(t, showHtml, "Copy to Clipboard")
+	DoSimpleGetTest(t, "/presigned_urls", []string{"Archivist at example.edu", ss.Bucket + "/" + key})
+}
@@ -0,0 +1,278 @@
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/APTrust/dart-runner/core"
+)
+
+// Statuses of a TagDiff.
+const (
+	TagOnlyInA  = "only-in-a"
+	TagOnlyInB  = "only-in-b"
+	TagModified = "modified"
+)
+
+// ProfileDiff lists the differences between two BagIt profiles,
+// A and B. Settings and tags that are the same in both profiles
+// don't appear in the diff.
+type ProfileDiff struct {
+	ProfileAID   string             `json:"profileAId"`
+	ProfileAName string             `json:"profileAName"`
+	ProfileBID   string             `json:"profileBId"`
+	ProfileBName string             `json:"profileBName"`
+	CreatedAt    time.Time          `json:"createdAt"`
+	Settings     []ProfileFieldDiff `json:"settings"`
+	Tags         []TagDiff          `json:"tags"`
+}
+
+// ProfileFieldDiff describes one setting that differs between two
+// profiles. For single-valued settings, ValueA and ValueB hold the
+// two values. For lists, OnlyInA and OnlyInB hold the items that
+// appear in one profile but not the other. Order doesn't count.
+type ProfileFieldDiff struct {
+	Field   string   `json:"field"`
+	ValueA  string   `json:"valueA,omitempty"`
+	ValueB  string   `json:"valueB,omitempty"`
+	OnlyInA []string `json:"onlyInA,omitempty"`
+	OnlyInB []string `json:"onlyInB,omitempty"`
+}
+
+// IsList returns true if the setting is a list.
+func (d *ProfileFieldDiff) IsList() bool {
+	return d.OnlyInA != nil || d.OnlyInB != nil
+}
+
+// TagDiff describes a tag definition that is in only one profile,
+// or that is in both with different settings.
+type TagDiff struct {
+	TagFile string             `json:"tagFile"`
+	TagName string             `json:"tagName"`
+	Status  string             `json:"status"`
+	Changes []ProfileFieldDiff `json:"changes,omitempty"`
+}
+
+// IsEmpty returns true if the two profiles are the same, as far
+// as the diff can tell.
+func (diff *ProfileDiff) IsEmpty() bool {
+	return len(diff.Settings) == 0 && len(diff.Tags) == 0
+}
+
+// FileName returns the name we give the diff's JSON file.
+func (diff *ProfileDiff) FileName() string {
+	return fmt.Sprintf("profile-diff-%s-%s.json", escapeFileName(diff.ProfileAName), escapeFileName(diff.ProfileBName))
+}
+
+// CompareBagItProfiles returns the differences between profiles a and
+// b in accepted BagIt versions, manifest and tag manifest algorithms,
+// serialization rules, tag files, and tag definitions. Tag definitions
+// are matched by tag file and tag name. Tag value rules are stored
+// apart from the profile, so callers that have them add them to the
+// diff with CompareTagValueRules.
+func CompareBagItProfiles(a, b *core.BagItProfile) *ProfileDiff {
+	diff := &ProfileDiff{
+		ProfileAID:   a.ID,
+		ProfileAName: a.Name,
+		ProfileBID:   b.ID,
+		ProfileBName: b.Name,
+		CreatedAt:    time.Now(),
+		Settings:     make([]ProfileFieldDiff, 0),
+		Tags:         make([]TagDiff, 0),
+	}
+	lists := []struct {
+		field string
+		a, b  []string
+	}{
+		{"Accepted BagIt Versions", a.AcceptBagItVersion, b.AcceptBagItVersion},
+		{"Required Manifests", a.ManifestsRequired, b.ManifestsRequired},
+		{"Allowed Manifests", a.ManifestsAllowed, b.ManifestsAllowed},
+		{"Required Tag Manifests", a.TagManifestsRequired, b.TagManifestsRequired},
+		{"Allowed Tag Manifests", a.TagManifestsAllowed, b.TagManifestsAllowed},
+		{"Accepted Serialization Formats", a.AcceptSerialization, b.AcceptSerialization},
+		{"Required Tag Files", a.TagFilesRequired, b.TagFilesRequired},
+		{"Allowed Tag Files", a.TagFilesAllowed, b.TagFilesAllowed},
+	}
+	for _, list := range lists {
+		if change := compareLists(list.field, list.a, list.b); change != nil {
+			diff.Settings = append(diff.Settings, *change)
+		}
+	}
+	values := []struct {
+		field string
+		a, b  string
+	}{
+		{"Serialization", a.Serialization, b.Serialization},
+		{"Tar Directory Must Match Name", strconv.FormatBool(a.TarDirMustMatchName), strconv.FormatBool(b.TarDirMustMatchName)},
+		{"Allow Fetch.txt", strconv.FormatBool(a.AllowFetchTxt), strconv.FormatBool(b.AllowFetchTxt)},
+	}
+	for _, value := range values {
+		if change := compareValues(value.field, value.a, value.b); change != nil {
+			diff.Settings = append(diff.Settings, *change)
+		}
+	}
+	diff.Tags = compareTagDefinitions(a.Tags, b.Tags)
+	return diff
+}
+
+// CompareTagValueRules adds the differences between the value rules
+// of profile A and profile B to the diff. Each rule that differs is a
+// change to its tag. Rules for tags that are in only one profile
+// don't count, since the diff already lists the whole tag.
+func (diff *ProfileDiff) CompareTagValueRules(rulesA, rulesB TagValueRuleSet) {
+	tagIndex := make(map[string]int, len(diff.Tags))
+	for i, tag := range diff.Tags {
+		tagIndex[tag.TagFile+"/"+tag.TagName] = i
+	}
+	keys := make(map[string]*TagValueRules)
+	for key, rules := range rulesA {
+		keys[key] = rules
+	}
+	for key, rules := range rulesB {
+		keys[key] = rules
+	}
+	for key, rules := range keys {
+		changes := compareTagValueRules(rulesA[key], rulesB[key])
+		if len(changes) == 0 {
+			continue
+		}
+		i, ok := tagIndex[key]
+		if !ok {
+			diff.Tags = append(diff.Tags, TagDiff{TagFile: rules.TagFile, TagName: rules.TagName, Status: TagModified})
+			i = len(diff.Tags) - 1
+			tagIndex[key] = i
+		}
+		if diff.Tags[i].Status == TagModified {
+			diff.Tags[i].Changes = append(diff.Tags[i].Changes, changes...)
+		}
+	}
+	sortTagDiffs(diff.Tags)
+}
+
+func compareTagValueRules(a, b *TagValueRules) []ProfileFieldDiff {
+	if a == nil {
+		a = &TagValueRules{}
+	}
+	if b == nil {
+		b = &TagValueRules{}
+	}
+	length := func(n int) string {
+		if n == 0 {
+			return ""
+		}
+		return strconv.Itoa(n)
+	}
+	dataType := func(rules *TagValueRules) string {
+		if rules.DataType == TagTypeText {
+			return ""
+		}
+		return TagDataTypeLabel(rules.DataType)
+	}
+	changes := make([]ProfileFieldDiff, 0)
+	for _, change := range []*ProfileFieldDiff{
+		compareValues("Pattern", a.Pattern, b.Pattern),
+		compareValues("Pattern Description", a.PatternDescription, b.PatternDescription),
+		compareValues("Data Type", dataType(a), dataType(b)),
+		compareValues("Minimum Length", length(a.MinLength), length(b.MinLength)),
+		compareValues("Maximum Length", length(a.MaxLength), length(b.MaxLength)),
+	} {
+		if change != nil {
+			changes = append(changes, *change)
+		}
+	}
+	return changes
+}
+
+func compareTagDefinitions(a, b []*core.TagDefinition) []TagDiff {
+	tagKey := func(tag *core.TagDefinition) string {
+		return tag.TagFile + "/" + tag.TagName
+	}
+	tagsInB := make(map[string]*core.TagDefinition, len(b))
+	for _, tag := range b {
+		tagsInB[tagKey(tag)] = tag
+	}
+	diffs := make([]TagDiff, 0)
+	seen := make(map[string]bool, len(a))
+	for _, tagA := range a {
+		key := tagKey(tagA)
+		seen[key] = true
+		tagB, ok := tagsInB[key]
+		if !ok {
+			diffs = append(diffs, TagDiff{TagFile: tagA.TagFile, TagName: tagA.TagName, Status: TagOnlyInA})
+			continue
+		}
+		changes := make([]ProfileFieldDiff, 0)
+		for _, change := range []*ProfileFieldDiff{
+			compareValues("Required", strconv.FormatBool(tagA.Required), strconv.FormatBool(tagB.Required)),
+			compareValues("Default Value", tagA.DefaultValue, tagB.DefaultValue),
+			compareLists("Allowed Values", tagA.Values, tagB.Values),
+			compareValues("Help", tagA.Help, tagB.Help),
+		} {
+			if change != nil {
+				changes = append(changes, *change)
+			}
+		}
+		if len(changes) > 0 {
+			diffs = append(diffs, TagDiff{TagFile: tagA.TagFile, TagName: tagA.TagName, Status: TagModified, Changes: changes})
+		}
+	}
+	for _, tagB := range b {
+		if !seen[tagKey(tagB)] {
+			diffs = append(diffs, TagDiff{TagFile: tagB.TagFile, TagName: tagB.TagName, Status: TagOnlyInB})
+		}
+	}
+	sortTagDiffs(diffs)
+	return diffs
+}
+
+func sortTagDiffs(diffs []TagDiff) {
+	sort.SliceStable(diffs, func(i, j int) bool {
+		if diffs[i].TagFile != diffs[j].TagFile {
+			return diffs[i].TagFile < diffs[j].TagFile
+		}
+		return diffs[i].TagName < diffs[j].TagName
+	})
+}
+
+// compareValues returns nil if a and b are the same, ignoring
+// leading and trailing whitespace.
+func compareValues(field, a, b string) *ProfileFieldDiff {
+	a = strings.TrimSpace(a)
+	b = strings.TrimSpace(b)
+	if a == b {
+		return nil
+	}
+	return &ProfileFieldDiff{Field: field, ValueA: a, ValueB: b}
+}
+
+// compareLists returns nil if a and b contain the same items.
+func compareLists(field string, a, b []string) *ProfileFieldDiff {
+	onlyInA := listDifference(a, b)
+	onlyInB := listDifference(b, a)
+	if len(onlyInA) == 0 && len(onlyInB) == 0 {
+		return nil
+	}
+	return &ProfileFieldDiff{Field: field, OnlyInA: onlyInA, OnlyInB: onlyInB}
+}
+
+// listDifference returns the items in a that are not in b, sorted.
+// The result is never nil, so ProfileFieldDiff.IsList can tell
+// lists from values.
+func listDifference(a, b []string) []string {
+	inB := make(map[string]bool, len(b))
+	for _, item := range b {
+		inB[item] = true
+	}
+	difference := make([]string, 0)
+	for _, item := range a {
+		if !inB[item] {
+			difference = append(difference, item)
+			inB[item] = true
+		}
+	}
+	sort.Strings(difference)
+	return difference
+}
@@ -0,0 +1,114 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/gin-gonic/gin"
+)
+
+// GET /profiles/compare?ProfileA=<id>&ProfileB=<id>
+//
+// Without both profile IDs, this shows only the form for choosing
+// the profiles to compare.
+func BagItProfileCompare(c *gin.Context) {
+	profileAID := c.Query("ProfileA")
+	profileBID := c.Query("ProfileB")
+	data := gin.H{
+		"form":    profileDiffForm(profileAID, profileBID),
+		"flash":   GetFlashCookie(c),
+		"helpUrl": GetHelpUrl(c),
+	}
+	if profileAID != "" && profileBID != "" {
+		diff, err := compareProfilesByID(profileAID, profileBID)
+		if err != nil {
+			AbortWithErrorHTML(c, http.StatusNotFound, err)
+			return
+		}
+		data["diff"] = diff
+	}
+	c.HTML(http.StatusOK, "bagit_profile/compare.html", data)
+}
+
+// GET /profiles/compare/export?ProfileA=<id>&ProfileB=<id>
+//
+// In a browser, this sends the diff as a JSON attachment. Wails can't
+// save attachments, so there we write the file to the Downloads folder
+// instead. See InventoryReportExport.
+func BagItProfileCompareExport(c *gin.Context) {
+	diff, err := compareProfilesByID(c.Query("ProfileA"), c.Query("ProfileB"))
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusNotFound, err)
+		return
+	}
+	diffJson, err := json.MarshalIndent(diff, "", "  ")
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+		return
+	}
+	fileName := diff.FileName()
+	if IsRunningWails {
+		jsonPath := filepath.Join(core.Dart.Paths.Downloads, fileName)
+		if err := os.WriteFile(jsonPath, diffJson, 0644); err != nil {
+			AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+			return
+		}
+		values := url.Values{}
+		values.Set("ProfileA", diff.ProfileAID)
+		values.Set("ProfileB", diff.ProfileBID)
+		SetFlashCookie(c, fmt.Sprintf("Saved the comparison to %s", jsonPath))
+		c.Redirect(http.StatusFound, fmt.Sprintf("/profiles/compare?%s", values.Encode()))
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", fileName))
+	c.Data(http.StatusOK, "application/json; charset=utf-8", diffJson)
+}
+
+func compareProfilesByID(profileAID, profileBID string) (*ProfileDiff, error) {
+	profileA := core.ObjFind(profileAID).BagItProfile()
+	if profileA == nil {
+		return nil, fmt.Errorf("No BagIt profile with id %s", profileAID)
+	}
+	profileB := core.ObjFind(profileBID).BagItProfile()
+	if profileB == nil {
+		return nil, fmt.Errorf("No BagIt profile with id %s", profileBID)
+	}
+	rulesA, err := LoadTagValueRules(profileA.ID)
+	if err != nil {
+		return nil, err
+	}
+	rulesB, err := LoadTagValueRules(profileB.ID)
+	if err != nil {
+		return nil, err
+	}
+	diff := CompareBagItProfiles(profileA, profileB)
+	diff.CompareTagValueRules(rulesA, rulesB)
+	return diff, nil
+}
+
+func profileDiffForm(profileAID, profileBID string) *core.Form {
+	form := core.NewForm("ProfileDiff", "", make(map[string]string))
+	profiles := core.ObjNameIdList(constants.TypeBagItProfile)
+	for _, field := range []*core.Field{
+		form.AddField("ProfileA", "Profile A", profileAID, true),
+		form.AddField("ProfileB", "Profile B", profileBID, true),
+	} {
+		field.Choices = []core.Choice{
+			{Label: "Choose One", Value: "", Selected: false},
+		}
+		for _, item := range profiles {
+			field.Choices = append(field.Choices, core.Choice{
+				Label:    item.Name,
+				Value:    item.ID,
+				Selected: item.ID == field.Value,
+			})
+		}
+	}
+	return form
+}
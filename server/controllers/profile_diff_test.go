@@ -0,0 +1,120 @@
+package controllers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart/v3/server/controllers"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// getDiffTestProfiles returns two profiles that differ in a few
+// settings and tag definitions.
+func getDiffTestProfiles() (*core.BagItProfile, *core.BagItProfile) {
+	a := &core.BagItProfile{
+		ID:                  uuid.NewString(),
+		Name:                "Profile A",
+		AcceptBagItVersion:  []string{"0.97", "1.0"},
+		AcceptSerialization: []string{"application/tar"},
+		ManifestsRequired:   []string{"md5", "sha256"},
+		ManifestsAllowed:    []string{"md5", "sha256", "sha512"},
+		Serialization:       "required",
+		TagFilesAllowed:     []string{"*"},
+		TarDirMustMatchName: true,
+		Tags: []*core.TagDefinition{
+			{ID: uuid.NewString(), TagFile: "bagit.txt", TagName: "BagIt-Version", Required: true},
+			{ID: uuid.NewString(), TagFile: "bag-info.txt", TagName: "Source-Organization", Required: true},
+			{ID: uuid.NewString(), TagFile: "aptrust-info.txt", TagName: "Access", Required: true, DefaultValue: "Institution", Values: []string{"Consortia", "Institution", "Restricted"}},
+		},
+	}
+	b := &core.BagItProfile{
+		ID:                  uuid.NewString(),
+		Name:                "Profile B",
+		AcceptBagItVersion:  []string{"1.0", "0.97"},
+		AcceptSerialization: []string{"application/tar", "application/zip"},
+		ManifestsRequired:   []string{"sha256"},
+		ManifestsAllowed:    []string{"sha512", "sha256", "md5"},
+		Serialization:       "optional",
+		TagFilesAllowed:     []string{"*"},
+		TarDirMustMatchName: true,
+		Tags: []*core.TagDefinition{
+			{ID: uuid.NewString(), TagFile: "bagit.txt", TagName: "BagIt-Version", Required: true},
+			{ID: uuid.NewString(), TagFile: "bag-info.txt", TagName: "Bag-Group-Identifier"},
+			{ID: uuid.NewString(), TagFile: "aptrust-info.txt", TagName: "Access", Required: false, DefaultValue: "Institution", Values: []string{"Institution", "Consortia"}, Help: "Who can see this bag."},
+		},
+	}
+	return a, b
+}
+
+func TestCompareBagItProfiles(t *testing.T) {
+	a, b := getDiffTestProfiles()
+	diff := controllers.CompareBagItProfiles(a, b)
+	assert.Equal(t, "Profile A", diff.ProfileAName)
+	assert.False(t, diff.IsEmpty())
+
+	// Lists compare without regard to order, so BagIt versions
+	// and allowed manifests are the same.
+	require.Equal(t, 3, len(diff.Settings), diff.Settings)
+	assert.Equal(t, controllers.ProfileFieldDiff{Field: "Required Manifests", OnlyInA: []string{"md5"}, OnlyInB: []string{}}, diff.Settings[0])
+	assert.True(t, diff.Settings[0].IsList())
+	assert.Equal(t, "Accepted Serialization Formats", diff.Settings[1].Field)
+	assert.Equal(t, []string{"application/zip"}, diff.Settings[1].OnlyInB)
+	assert.Equal(t, controllers.ProfileFieldDiff{Field: "Serialization", ValueA: "required", ValueB: "optional"}, diff.Settings[2])
+	assert.False(t, diff.Settings[2].IsList())
+
+	require.Equal(t, 3, len(diff.Tags), diff.Tags)
+	access := diff.Tags[0]
+	assert.Equal(t, "aptrust-info.txt", access.TagFile)
+	assert.Equal(t, controllers.TagModified, access.Status)
+	require.Equal(t, 3, len(access.Changes))
+	assert.Equal(t, "Required", access.Changes[0].Field)
+	assert.Equal(t, []string{"Restricted"}, access.Changes[1].OnlyInA)
+	assert.Equal(t, "Who can see this bag.", access.Changes[2].ValueB)
+	assert.Equal(t, controllers.TagDiff{TagFile: "bag-info.txt", TagName: "Bag-Group-Identifier", Status: controllers.TagOnlyInB}, diff.Tags[1])
+	assert.Equal(t, controllers.TagDiff{TagFile: "bag-info.txt", TagName: "Source-Organization", Status: controllers.TagOnlyInA}, diff.Tags[2])
+
+	assert.True(t, controllers.CompareBagItProfiles(a, a).IsEmpty())
+}
+
+func TestBagItProfileCompare(t *testing.T) {
+	defer core.ClearDartTable()
+	a, b := getDiffTestProfiles()
+	require.NoError(t, core.ObjSaveWithoutValidation(a))
+	require.NoError(t, core.ObjSaveWithoutValidation(b))
+	DoSimpleGetTest(t, "/profiles/compare", []string{"Compare BagIt Profiles", "Profile A", "Profile B"})
+
+	params := url.Values{}
+	params.Set("ProfileA", a.ID)
+	params.Set("ProfileB", b.ID)
+	DoSimpleGetTest(t, "/profiles/compare?"+params.Encode(), []string{
+		"Required Manifests",
+		"application/zip",
+		"Bag-Group-Identifier",
+		"Who can see this bag.",
+		"Export as JSON",
+	})
+
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/profiles/compare/export?"+params.Encode(), nil)
+	require.NoError(t, err)
+	dartServer.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "attachment; filename=profile-diff-Profile A-Profile B.json", w.Header().Get("Content-Disposition"))
+	diff := &controllers.ProfileDiff{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), diff))
+	assert.Equal(t, b.ID, diff.ProfileBID)
+	assert.Equal(t, 3, len(diff.Tags))
+
+	params.Set("ProfileB", "no-such-profile")
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodGet, "/profiles/compare?"+params.Encode(), nil)
+	require.NoError(t, err)
+	dartServer.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
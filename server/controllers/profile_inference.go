@@ -0,0 +1,185 @@
+package controllers
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/google/uuid"
+)
+
+// ImportSourceBag is the BagItProfileImport source for building a
+// draft profile from an existing bag. core.BagItProfileImport only
+// knows about URLs and JSON, so the import controller handles this
+// one itself. See InferBagItProfile.
+const ImportSourceBag = "bag"
+
+// serializationFormats maps bag file extensions to the
+// serialization formats we put in AcceptSerialization.
+var serializationFormats = []struct {
+	extension string
+	format    string
+}{
+	{".tar.gz", "application/gzip"},
+	{".tgz", "application/gzip"},
+	{".tar", "application/tar"},
+	{".zip", "application/zip"},
+}
+
+// InferBagItProfile builds a draft BagIt profile that describes the
+// bag at bagPath, which can be a directory or a tar, tar.gz or zip
+// file. The draft accepts the bag's BagIt version, requires the
+// manifest and tag manifest algorithms the bag uses and the tag files
+// it has, and requires every tag it finds in those files. Tags in
+// bagit.txt must have the values the bag has. For other tags, the
+// help text shows the bag's values, because values like Bagging-Date
+// change from one bag to the next. The user should review the draft
+// before using it.
+//
+// This returns an error if bagPath doesn't contain bagit.txt or a
+// payload manifest, since the result would not be a valid profile.
+func InferBagItProfile(bagPath string) (*core.BagItProfile, error) {
+	bagName := ""
+	manifests := make([]string, 0)
+	tagManifests := make([]string, 0)
+	tagFiles := make(map[string][]BagTag)
+	otherFiles := make([]string, 0)
+	hasFetchTxt := false
+	err := WalkBag(bagPath, func(entry BagEntry, reader io.Reader) error {
+		bagName = entry.BagName
+		switch {
+		case strings.HasPrefix(entry.Path, "data/"):
+			return nil
+		case entry.Path == "fetch.txt":
+			hasFetchTxt = true
+		case isPayloadManifest(entry.Path):
+			manifests = append(manifests, manifestAlgorithm(entry.Path, "manifest-"))
+		case strings.HasPrefix(entry.Path, "tagmanifest-") && strings.HasSuffix(entry.Path, ".txt"):
+			tagManifests = append(tagManifests, manifestAlgorithm(entry.Path, "tagmanifest-"))
+		default:
+			tags, err := ParseTagFile(reader)
+			if err != nil {
+				// Not a tag file we can read, but it's still
+				// something the partner puts in their bags.
+				otherFiles = append(otherFiles, entry.Path)
+				return nil
+			}
+			tagFiles[entry.Path] = tags
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := tagFiles["bagit.txt"]; !ok {
+		return nil, fmt.Errorf("%s does not contain a bag: bagit.txt is missing", bagPath)
+	}
+	if len(manifests) == 0 {
+		return nil, fmt.Errorf("%s has no payload manifest", bagPath)
+	}
+	sort.Strings(manifests)
+	sort.Strings(tagManifests)
+
+	profile := &core.BagItProfile{
+		ID:                   uuid.NewString(),
+		Name:                 fmt.Sprintf("Draft profile from %s %s", bagName, time.Now().Format(time.Stamp)),
+		Description:          fmt.Sprintf("Inferred from the bag at %s. Review the tag definitions before using this profile.", bagPath),
+		AcceptBagItVersion:   []string{TagValue(tagFiles["bagit.txt"], "BagIt-Version")},
+		AcceptSerialization:  []string{"application/tar", "application/zip"},
+		AllowFetchTxt:        hasFetchTxt,
+		ManifestsRequired:    manifests,
+		ManifestsAllowed:     manifests,
+		TagManifestsRequired: tagManifests,
+		TagManifestsAllowed:  tagManifests,
+		Serialization:        constants.SerializationOptional,
+		TagFilesAllowed:      []string{"*"},
+		TagFilesRequired:     make([]string, 0),
+		Tags:                 make([]*core.TagDefinition, 0),
+	}
+	profile.BagItProfileInfo.SourceOrganization = TagValue(tagFiles["bag-info.txt"], "Source-Organization")
+	for _, serialization := range serializationFormats {
+		if strings.HasSuffix(strings.ToLower(bagPath), serialization.extension) {
+			profile.Serialization = constants.SerializationRequired
+			profile.AcceptSerialization = []string{serialization.format}
+			fileName := filepath.Base(bagPath)
+			profile.TarDirMustMatchName = bagName == fileName[:len(fileName)-len(serialization.extension)]
+			break
+		}
+	}
+
+	// bagit.txt first, then bag-info.txt, then everything else.
+	tagFileNames := make([]string, 0, len(tagFiles))
+	for name := range tagFiles {
+		tagFileNames = append(tagFileNames, name)
+	}
+	sort.Slice(tagFileNames, func(i, j int) bool {
+		rank := func(name string) int {
+			switch name {
+			case "bagit.txt":
+				return 0
+			case "bag-info.txt":
+				return 1
+			}
+			return 2
+		}
+		if rank(tagFileNames[i]) != rank(tagFileNames[j]) {
+			return rank(tagFileNames[i]) < rank(tagFileNames[j])
+		}
+		return tagFileNames[i] < tagFileNames[j]
+	})
+	for _, tagFile := range tagFileNames {
+		if tagFile != "bagit.txt" {
+			profile.TagFilesRequired = append(profile.TagFilesRequired, tagFile)
+		}
+		profile.Tags = append(profile.Tags, inferTagDefinitions(tagFile, tagFiles[tagFile])...)
+	}
+	sort.Strings(otherFiles)
+	profile.TagFilesRequired = append(profile.TagFilesRequired, otherFiles...)
+	return profile, nil
+}
+
+// inferTagDefinitions returns one definition for each distinct tag
+// name in tags, in the order the names first appear.
+func inferTagDefinitions(tagFile string, tags []BagTag) []*core.TagDefinition {
+	definitions := make([]*core.TagDefinition, 0)
+	seen := make(map[string]bool)
+	values := make(map[string][]string)
+	for _, tag := range tags {
+		if !seen[tag.Name] {
+			seen[tag.Name] = true
+			definitions = append(definitions, &core.TagDefinition{
+				ID:       uuid.NewString(),
+				TagFile:  tagFile,
+				TagName:  tag.Name,
+				Required: true,
+				EmptyOK:  true,
+			})
+		}
+		if tag.Value != "" {
+			values[tag.Name] = append(values[tag.Name], tag.Value)
+		}
+	}
+	for _, definition := range definitions {
+		observed := values[definition.TagName]
+		if len(observed) == 0 {
+			continue
+		}
+		definition.EmptyOK = false
+		if tagFile == "bagit.txt" {
+			definition.Values = observed[:1]
+			definition.DefaultValue = observed[0]
+		} else {
+			definition.Help = "Value in sample bag: " + strings.Join(observed, "; ")
+		}
+	}
+	return definitions
+}
+
+func manifestAlgorithm(fileName, prefix string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(fileName, prefix), ".txt")
+}
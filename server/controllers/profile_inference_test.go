@@ -0,0 +1,109 @@
+package controllers_test
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart-runner/util"
+	"github.com/APTrust/dart/v3/server/controllers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInferBagItProfileFromTar(t *testing.T) {
+	bagPath := filepath.Join(util.PathToTestData(), "bags", "example.edu.sample_good.tar")
+	profile, err := controllers.InferBagItProfile(bagPath)
+	require.NoError(t, err)
+	assert.Contains(t, profile.Name, "Draft profile from example.edu.sample_good")
+	assert.Equal(t, []string{"0.97"}, profile.AcceptBagItVersion)
+	assert.Equal(t, []string{"md5"}, profile.ManifestsRequired)
+	assert.Equal(t, []string{"md5"}, profile.ManifestsAllowed)
+	assert.Empty(t, profile.TagManifestsRequired)
+	assert.Equal(t, constants.SerializationRequired, profile.Serialization)
+	assert.Equal(t, []string{"application/tar"}, profile.AcceptSerialization)
+	assert.True(t, profile.TarDirMustMatchName)
+	assert.Equal(t, []string{"bag-info.txt", "aptrust-info.txt"}, profile.TagFilesRequired)
+	assert.Equal(t, "virginia.edu", profile.BagItProfileInfo.SourceOrganization)
+
+	// bagit.txt comes first, and its tags must match the bag.
+	require.Equal(t, 11, len(profile.Tags))
+	version := profile.Tags[0]
+	assert.Equal(t, "bagit.txt", version.TagFile)
+	assert.Equal(t, "BagIt-Version", version.TagName)
+	assert.Equal(t, []string{"0.97"}, version.Values)
+	assert.Equal(t, "0.97", version.DefaultValue)
+
+	// Other tags show the sample value without requiring it.
+	sourceOrg := profile.Tags[2]
+	assert.Equal(t, "bag-info.txt", sourceOrg.TagFile)
+	assert.Equal(t, "Source-Organization", sourceOrg.TagName)
+	assert.True(t, sourceOrg.Required)
+	assert.Empty(t, sourceOrg.Values)
+	assert.Equal(t, "Value in sample bag: virginia.edu", sourceOrg.Help)
+	assert.Equal(t, "aptrust-info.txt", profile.Tags[8].TagFile)
+	assert.Equal(t, "Title", profile.Tags[8].TagName)
+}
+
+func TestInferBagItProfileFromDirectory(t *testing.T) {
+	bagDir := filepath.Join(t.TempDir(), "sample_bag")
+	files := map[string]string{
+		"bagit.txt":              "BagIt-Version: 1.0\nTag-File-Character-Encoding: UTF-8\n",
+		"bag-info.txt":           "Source-Organization: example.edu\nContact-Email:\nBag-Group-Identifier: one\nBag-Group-Identifier: two\n",
+		"manifest-sha256.txt":    "abc  data/file.txt\n",
+		"manifest-md5.txt":       "def  data/file.txt\n",
+		"tagmanifest-sha256.txt": "ghi  bag-info.txt\n",
+		"data/file.txt":          "Not a tag file",
+	}
+	for name, content := range files {
+		filePath := filepath.Join(bagDir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0755))
+		require.NoError(t, os.WriteFile(filePath, []byte(content), 0644))
+	}
+	profile, err := controllers.InferBagItProfile(bagDir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.0"}, profile.AcceptBagItVersion)
+	assert.Equal(t, []string{"md5", "sha256"}, profile.ManifestsRequired)
+	assert.Equal(t, []string{"sha256"}, profile.TagManifestsRequired)
+	assert.Equal(t, constants.SerializationOptional, profile.Serialization)
+	assert.False(t, profile.TarDirMustMatchName)
+	assert.Equal(t, []string{"bag-info.txt"}, profile.TagFilesRequired)
+
+	require.Equal(t, 5, len(profile.Tags))
+	contactEmail := profile.Tags[3]
+	assert.Equal(t, "Contact-Email", contactEmail.TagName)
+	assert.True(t, contactEmail.EmptyOK)
+	assert.Empty(t, contactEmail.Help)
+	groupID := profile.Tags[4]
+	assert.False(t, groupID.EmptyOK)
+	assert.Equal(t, "Value in sample bag: one; two", groupID.Help)
+
+	require.NoError(t, os.Remove(filepath.Join(bagDir, "bagit.txt")))
+	_, err = controllers.InferBagItProfile(bagDir)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "bagit.txt is missing")
+}
+
+func TestBagItProfileImportFromBag(t *testing.T) {
+	defer core.ClearDartTable()
+	params := url.Values{}
+	params.Set("ImportSource", controllers.ImportSourceBag)
+	params.Set("BagPath", filepath.Join(util.PathToTestData(), "bags", "README.md"))
+	DoSimplePostTest(t, PostTestSettings{
+		EndpointUrl:          "/profiles/import",
+		Params:               params,
+		ExpectedResponseCode: http.StatusBadRequest,
+		ExpectedContent:      []string{"Path to Bag", "is not a tar or zip file"},
+	})
+
+	params.Set("BagPath", filepath.Join(util.PathToTestData(), "bags", "example.edu.sample_good.tar"))
+	DoSimplePostTest(t, PostTestSettings{
+		EndpointUrl:          "/profiles/import",
+		Params:               params,
+		ExpectedResponseCode: http.StatusFound,
+	})
+}
@@ -0,0 +1,227 @@
+package controllers
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+)
+
+// Severities of a ProfileLintIssue.
+const (
+	// LintError means no bag can satisfy the profile, or DART
+	// will build bags that fail validation against it.
+	LintError = "error"
+	// LintWarning means the profile works, but probably not the
+	// way its author intended.
+	LintWarning = "warning"
+)
+
+// ProfileLintIssue is one problem that LintBagItProfile found.
+// TagFile and TagName are set for problems with a tag definition.
+type ProfileLintIssue struct {
+	Severity string `json:"severity"`
+	Field    string `json:"field"`
+	TagFile  string `json:"tagFile,omitempty"`
+	TagName  string `json:"tagName,omitempty"`
+	Message  string `json:"message"`
+}
+
+// IsError returns true if the issue is an error rather than a warning.
+func (issue ProfileLintIssue) IsError() bool {
+	return issue.Severity == LintError
+}
+
+// LintBagItProfile looks for rules in profile that contradict each
+// other or are likely to cause trouble. This is separate from the
+// validation in core.ObjSave, which checks only that the profile is
+// complete. A profile can pass validation and still have lint errors,
+// and we let users save it, since they may be fixing one problem at
+// a time. This also checks the tag's allowed and default values
+// against its value rules. Errors come before warnings.
+func LintBagItProfile(profile *core.BagItProfile) []ProfileLintIssue {
+	issues := make([]ProfileLintIssue, 0)
+	addIssue := func(severity, field, message string, args ...interface{}) {
+		issues = append(issues, ProfileLintIssue{Severity: severity, Field: field, Message: fmt.Sprintf(message, args...)})
+	}
+
+	// An empty allowed list means anything goes.
+	if len(profile.ManifestsAllowed) > 0 {
+		for _, alg := range listDifference(profile.ManifestsRequired, profile.ManifestsAllowed) {
+			addIssue(LintError, "ManifestsRequired", "Manifest algorithm %s is required but not allowed.", alg)
+		}
+	}
+	if len(profile.TagManifestsAllowed) > 0 {
+		for _, alg := range listDifference(profile.TagManifestsRequired, profile.TagManifestsAllowed) {
+			addIssue(LintError, "TagManifestsRequired", "Tag manifest algorithm %s is required but not allowed.", alg)
+		}
+	}
+	if len(profile.ManifestsRequired) > 0 && len(listDifference(profile.ManifestsRequired, []string{"md5", "sha1"})) == 0 {
+		addIssue(LintWarning, "ManifestsRequired", "All required manifest algorithms are weak. Consider requiring sha256 or sha512.")
+	}
+	for _, version := range profile.AcceptBagItVersion {
+		if version != "0.97" && version != "1.0" {
+			addIssue(LintWarning, "AcceptBagItVersion", "BagIt version %s is not one that DART can create.", version)
+		}
+	}
+
+	switch profile.Serialization {
+	case constants.SerializationRequired:
+		if len(profile.AcceptSerialization) == 0 {
+			addIssue(LintError, "AcceptSerialization", "Serialization is required, but no serialization formats are accepted.")
+		}
+	case constants.SerializationForbidden:
+		if len(profile.AcceptSerialization) > 0 {
+			addIssue(LintWarning, "AcceptSerialization", "Serialization is forbidden, so the accepted serialization formats will be ignored.")
+		}
+		if profile.TarDirMustMatchName {
+			addIssue(LintWarning, "TarDirMustMatchName", "Serialization is forbidden, so the rule that the tar directory must match the bag name will be ignored.")
+		}
+	}
+
+	// Tag Files Allowed comes from a textarea, so it's easy to
+	// add a tag file without allowing it.
+	reported := make(map[string]bool)
+	for _, tagFile := range profile.TagFilesRequired {
+		if !tagFileAllowed(profile, tagFile) {
+			addIssue(LintError, "TagFilesRequired", "Tag file %s is required but not in Tag Files Allowed.", tagFile)
+			reported[tagFile] = true
+		}
+	}
+	for _, tag := range profile.Tags {
+		if !reported[tag.TagFile] && !tagFileAllowed(profile, tag.TagFile) {
+			addIssue(LintError, "TagFilesAllowed", "Tag file %s has tag definitions but is not in Tag Files Allowed, so bags built with this profile will be invalid.", tag.TagFile)
+			reported[tag.TagFile] = true
+		}
+	}
+
+	// Value rules live apart from the profile, so a tag's allowed
+	// and default values can contradict them.
+	ruleSet, err := LoadTagValueRules(profile.ID)
+	if err != nil {
+		core.Dart.Log.Errorf("Cannot load tag value rules for profile %s: %v", profile.ID, err)
+	}
+	definedTags := make(map[string]bool)
+	for _, tag := range profile.Tags {
+		tagIssue := func(severity, message string, args ...interface{}) {
+			issues = append(issues, ProfileLintIssue{
+				Severity: severity,
+				Field:    "Tags",
+				TagFile:  tag.TagFile,
+				TagName:  tag.TagName,
+				Message:  fmt.Sprintf(message, args...),
+			})
+		}
+		key := tag.TagFile + "/" + tag.TagName
+		if definedTags[key] {
+			tagIssue(LintWarning, "This tag is defined more than once in %s.", tag.TagFile)
+		}
+		definedTags[key] = true
+
+		rules := ruleSet.For(tag)
+		checked := make(map[string]bool)
+		for _, value := range tag.Values {
+			value = strings.TrimSpace(value)
+			if checked[value] {
+				continue
+			}
+			checked[value] = true
+			if message := rules.Check(value); message != "" {
+				tagIssue(LintError, "Allowed value %q breaks this tag's value rules. %s", value, message)
+			}
+		}
+		if !checked[tag.DefaultValue] {
+			if message := rules.Check(tag.DefaultValue); message != "" {
+				tagIssue(LintError, "Default value %q breaks this tag's value rules. %s", tag.DefaultValue, message)
+			}
+		}
+
+		if len(tag.Values) == 0 {
+			continue
+		}
+		allowed := make([]string, 0, len(tag.Values))
+		for _, value := range tag.Values {
+			if strings.TrimSpace(value) != "" {
+				allowed = append(allowed, value)
+			}
+		}
+		if len(allowed) == 0 {
+			if tag.Required && !tag.EmptyOK {
+				tagIssue(LintError, "This tag is required and can't be empty, but its list of allowed values is empty.")
+			}
+			continue
+		}
+		if tag.DefaultValue != "" && len(listDifference([]string{tag.DefaultValue}, allowed)) > 0 {
+			tagIssue(LintError, "Default value %q is not one of the allowed values.", tag.DefaultValue)
+		}
+		if len(allowed) < len(tag.Values) && tag.Required && !tag.EmptyOK {
+			tagIssue(LintWarning, "The allowed values include an empty value, but the tag can't be empty.")
+		}
+		if duplicates := duplicateValues(allowed); len(duplicates) > 0 {
+			tagIssue(LintWarning, "Allowed values are listed more than once: %s.", strings.Join(duplicates, ", "))
+		}
+	}
+
+	sort.SliceStable(issues, func(i, j int) bool {
+		return issues[i].IsError() && !issues[j].IsError()
+	})
+	return issues
+}
+
+// LintSummary describes issues in a sentence, such as
+// "2 errors and 1 warning", or returns an empty string if
+// there are no issues.
+func LintSummary(issues []ProfileLintIssue) string {
+	errors, warnings := 0, 0
+	for _, issue := range issues {
+		if issue.IsError() {
+			errors++
+		} else {
+			warnings++
+		}
+	}
+	if errors+warnings == 0 {
+		return ""
+	}
+	plural := func(count int, noun string) string {
+		if count == 1 {
+			return fmt.Sprintf("1 %s", noun)
+		}
+		return fmt.Sprintf("%d %ss", count, noun)
+	}
+	return fmt.Sprintf("%s and %s", plural(errors, "error"), plural(warnings, "warning"))
+}
+
+// tagFileAllowed returns true if tagFile matches one of the patterns
+// in the profile's TagFilesAllowed. An empty list allows everything.
+// As in the BagIt Profiles spec, an asterisk matches zero or more
+// characters, including slashes. bagit.txt and bag-info.txt are
+// always allowed, since every bag DART builds has them.
+func tagFileAllowed(profile *core.BagItProfile, tagFile string) bool {
+	if len(profile.TagFilesAllowed) == 0 || tagFile == "bagit.txt" || tagFile == "bag-info.txt" {
+		return true
+	}
+	for _, pattern := range profile.TagFilesAllowed {
+		pattern = strings.TrimSpace(pattern)
+		expr := "^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$"
+		if matched, err := regexp.MatchString(expr, tagFile); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+func duplicateValues(values []string) []string {
+	counts := make(map[string]int)
+	duplicates := make([]string, 0)
+	for _, value := range values {
+		counts[value]++
+		if counts[value] == 2 {
+			duplicates = append(duplicates, value)
+		}
+	}
+	return duplicates
+}
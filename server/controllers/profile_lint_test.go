@@ -0,0 +1,81 @@
+package controllers_test
+
+import (
+	"testing"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart/v3/server/controllers"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLintBagItProfile(t *testing.T) {
+	profile, _ := getDiffTestProfiles()
+	assert.Empty(t, controllers.LintBagItProfile(profile))
+	assert.Empty(t, controllers.LintSummary(controllers.LintBagItProfile(profile)))
+
+	profile.ManifestsRequired = []string{"md5", "sha1"}
+	profile.Serialization = constants.SerializationRequired
+	profile.AcceptSerialization = []string{}
+	profile.TagFilesAllowed = []string{"custom/*", "aptrust-info.txt"}
+	profile.TagFilesRequired = []string{"custom/dir/tags.txt", "other-info.txt"}
+	profile.Tags = append(profile.Tags,
+		&core.TagDefinition{ID: uuid.NewString(), TagFile: "other-info.txt", TagName: "Color"},
+		&core.TagDefinition{ID: uuid.NewString(), TagFile: "extra-info.txt", TagName: "Size"},
+		&core.TagDefinition{ID: uuid.NewString(), TagFile: "extra-info.txt", TagName: "Shape"},
+		&core.TagDefinition{ID: uuid.NewString(), TagFile: "aptrust-info.txt", TagName: "Storage-Option", Required: true, Values: []string{""}},
+		&core.TagDefinition{ID: uuid.NewString(), TagFile: "aptrust-info.txt", TagName: "Title", DefaultValue: "Untitled", Values: []string{"A", "B", "A"}},
+		&core.TagDefinition{ID: uuid.NewString(), TagFile: "aptrust-info.txt", TagName: "Title"},
+	)
+
+	issues := controllers.LintBagItProfile(profile)
+	messages := make([]string, len(issues))
+	for i, issue := range issues {
+		messages[i] = issue.Severity + ": " + issue.TagName + " " + issue.Message
+	}
+	require.Equal(t, []string{
+		"error:  Manifest algorithm sha1 is required but not allowed.",
+		"error:  Serialization is required, but no serialization formats are accepted.",
+		"error:  Tag file other-info.txt is required but not in Tag Files Allowed.",
+		"error:  Tag file extra-info.txt has tag definitions but is not in Tag Files Allowed, so bags built with this profile will be invalid.",
+		"error: Storage-Option This tag is required and can't be empty, but its list of allowed values is empty.",
+		"error: Title Default value \"Untitled\" is not one of the allowed values.",
+		"warning:  All required manifest algorithms are weak. Consider requiring sha256 or sha512.",
+		"warning: Title Allowed values are listed more than once: A.",
+		"warning: Title This tag is defined more than once in aptrust-info.txt.",
+	}, messages)
+	assert.Equal(t, "aptrust-info.txt", issues[4].TagFile)
+	assert.Equal(t, "6 errors and 3 warnings", controllers.LintSummary(issues))
+	assert.Equal(t, "0 errors and 1 warning", controllers.LintSummary(issues[8:]))
+
+	profile.Serialization = constants.SerializationForbidden
+	profile.AcceptSerialization = []string{"application/tar"}
+	profile.TarDirMustMatchName = true
+	profile.AcceptBagItVersion = []string{"0.96"}
+	fields := make([]string, 0)
+	for _, issue := range controllers.LintBagItProfile(profile) {
+		fields = append(fields, issue.Field)
+	}
+	assert.Contains(t, fields, "AcceptSerialization")
+	assert.Contains(t, fields, "TarDirMustMatchName")
+	assert.Contains(t, fields, "AcceptBagItVersion")
+}
+
+func TestLintBagItProfileTagValueRules(t *testing.T) {
+	profile, _ := getDiffTestProfiles()
+	defer controllers.ReplaceTagValueRules(profile.ID, nil)
+	require.NoError(t, controllers.SaveTagValueRules(&controllers.TagValueRules{
+		ProfileID: profile.ID,
+		TagFile:   "aptrust-info.txt",
+		TagName:   "Access",
+		MaxLength: 10,
+	}, "Access"))
+
+	issues := controllers.LintBagItProfile(profile)
+	require.Equal(t, 1, len(issues))
+	assert.Equal(t, controllers.LintError, issues[0].Severity)
+	assert.Equal(t, "Access", issues[0].TagName)
+	assert.Equal(t, `Allowed value "Institution" breaks this tag's value rules. This value can be at most 10 characters long. It has 11.`, issues[0].Message)
+}
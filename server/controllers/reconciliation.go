@@ -0,0 +1,440 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/minio/minio-go/v7"
+)
+
+// Reconciliation statuses, one for each entry.
+const (
+	ReconcileMatch         = "match"
+	ReconcileMissingRemote = "missing-remote"
+	ReconcileRemoteOnly    = "remote-only"
+	ReconcileDiffers       = "differs"
+	// ReconcileUnchecked means the bag exists on both sides,
+	// but we couldn't compare the copies.
+	ReconcileUnchecked = "unchecked"
+)
+
+// ReconciliationEntry compares one local bag with the remote bag of
+// the same name. A bag is a serialized bag file, or a directory that
+// contains bagit.txt.
+type ReconciliationEntry struct {
+	Name       string `json:"name"`
+	IsDir      bool   `json:"isDir"`
+	LocalPath  string `json:"localPath"`
+	RemotePath string `json:"remotePath"`
+	LocalSize  int64  `json:"localSize"`
+	RemoteSize int64  `json:"remoteSize"`
+	Status     string `json:"status"`
+	// Method says how we compared the copies. It's one of the
+	// VerifiedBy constants.
+	Method string `json:"method"`
+	Detail string `json:"detail"`
+	// UploadJobID is the upload job created to fix this entry, if any.
+	UploadJobID string `json:"uploadJobId"`
+}
+
+// CanUpload returns true if uploading the local bag would fix
+// this entry.
+func (entry *ReconciliationEntry) CanUpload() bool {
+	return entry.LocalPath != "" && (entry.Status == ReconcileMissingRemote || entry.Status == ReconcileDiffers)
+}
+
+// Reconciliation compares the bags in a local directory with the bags
+// under a prefix on a storage service.
+//
+// Reconciliations are built by a BackgroundTask. Status is one of the
+// Task constants, and Error says why a failed reconciliation failed.
+type Reconciliation struct {
+	ID                 string                `json:"id"`
+	LocalDirectory     string                `json:"localDirectory"`
+	StorageServiceID   string                `json:"storageServiceId"`
+	StorageServiceName string                `json:"storageServiceName"`
+	Prefix             string                `json:"prefix"`
+	CompareChecksums   bool                  `json:"compareChecksums"`
+	CreatedAt          time.Time             `json:"createdAt"`
+	Status             string                `json:"status"`
+	Error              string                `json:"error"`
+	Entries            []ReconciliationEntry `json:"entries"`
+}
+
+// Count returns the number of entries with the specified status.
+func (r *Reconciliation) Count(status string) int {
+	count := 0
+	for _, entry := range r.Entries {
+		if entry.Status == status {
+			count++
+		}
+	}
+	return count
+}
+
+// Uploadable returns the names of entries that CanUpload and
+// don't have an upload job yet.
+func (r *Reconciliation) Uploadable() []string {
+	names := make([]string, 0)
+	for i := range r.Entries {
+		if r.Entries[i].CanUpload() && r.Entries[i].UploadJobID == "" {
+			names = append(names, r.Entries[i].Name)
+		}
+	}
+	return names
+}
+
+// reconcileProtocols lists the protocols we can list and upload to.
+var reconcileProtocols = []string{constants.ProtocolS3, constants.ProtocolSFTP, ProtocolWebDAV, ProtocolFilesystem}
+
+// BuildReconciliation compares the bags at the top level of localDir
+// with the bags directly under prefix in the bucket or directory of
+// ss. Those are the keys an upload job with prefix as its key prefix
+// would give the local bags.
+//
+// Bag files are compared by size and, if compareChecksums is true, by
+// checksum, using the same checks as post-upload verification. Bag
+// directories are compared file by file, by size only.
+//
+// It calls onProgress, if it's not nil, after comparing each local bag.
+// Canceling ctx stops the comparison before the next local bag, and
+// BuildReconciliation returns ctx's error.
+func BuildReconciliation(ctx context.Context, localDir string, ss *core.StorageService, prefix string, compareChecksums bool, onProgress func(compared, total int)) (*Reconciliation, error) {
+	prefix = strings.Trim(prefix, "/")
+	r := &Reconciliation{
+		LocalDirectory:     localDir,
+		StorageServiceID:   ss.ID,
+		StorageServiceName: ss.Name,
+		Prefix:             prefix,
+		CompareChecksums:   compareChecksums,
+		CreatedAt:          time.Now(),
+		Entries:            make([]ReconciliationEntry, 0),
+	}
+	if !isReconcileProtocol(ss.Protocol) {
+		return r, fmt.Errorf("DART cannot compare bags on %s services.", ss.Protocol)
+	}
+	localBags, err := listLocalBags(localDir)
+	if err != nil {
+		return r, err
+	}
+	remoteBags, err := listRemoteBags(ss, prefix)
+	if err != nil {
+		return r, err
+	}
+	for name, localPath := range localBags {
+		if err := ctx.Err(); err != nil {
+			return r, err
+		}
+		entry := ReconciliationEntry{
+			Name:      name,
+			LocalPath: localPath,
+			Status:    ReconcileMissingRemote,
+		}
+		if remote, ok := remoteBags[name]; ok {
+			entry.RemotePath = remote.Key
+			compareBags(ss, prefix, &entry, remote, compareChecksums)
+		} else if stat, err := os.Stat(localPath); err == nil {
+			entry.IsDir = stat.IsDir()
+			entry.LocalSize = stat.Size()
+		}
+		r.Entries = append(r.Entries, entry)
+		if onProgress != nil {
+			onProgress(len(r.Entries), len(localBags))
+		}
+	}
+	for name, remote := range remoteBags {
+		if _, ok := localBags[name]; ok {
+			continue
+		}
+		r.Entries = append(r.Entries, ReconciliationEntry{
+			Name:       name,
+			IsDir:      strings.HasSuffix(remote.Key, "/"),
+			RemotePath: remote.Key,
+			RemoteSize: remote.Size,
+			Status:     ReconcileRemoteOnly,
+		})
+	}
+	sort.Slice(r.Entries, func(i, j int) bool { return r.Entries[i].Name < r.Entries[j].Name })
+	return r, nil
+}
+
+func isReconcileProtocol(protocol string) bool {
+	for _, p := range reconcileProtocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// listLocalBags returns the paths of the bags at the top level of dir,
+// keyed by name. We skip hidden files.
+func listLocalBags(dir string) (map[string]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	bags := make(map[string]string)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		localPath := filepath.Join(dir, entry.Name())
+		stat, err := os.Stat(localPath)
+		if err != nil {
+			continue
+		}
+		if stat.IsDir() {
+			if _, err := os.Stat(filepath.Join(localPath, "bagit.txt")); err != nil {
+				continue
+			}
+		} else if !stat.Mode().IsRegular() || !IsSerializedBag(entry.Name()) {
+			continue
+		}
+		bags[entry.Name()] = localPath
+	}
+	return bags, nil
+}
+
+// listRemoteBags returns the bags directly under prefix on ss, keyed
+// by name. Keys of bag directories end with a slash. If the prefix is
+// a directory that doesn't exist yet, there are no remote bags.
+func listRemoteBags(ss *core.StorageService, prefix string) (map[string]minio.ObjectInfo, error) {
+	bags := make(map[string]minio.ObjectInfo)
+	objects, err := listStoredDirectory(ss, prefix, false)
+	if errors.Is(err, fs.ErrNotExist) {
+		return bags, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, obj := range objects {
+		name := path.Base(obj.Key)
+		if strings.HasSuffix(obj.Key, "/") {
+			// Like local directories, a remote directory is
+			// a bag only if it has a bagit.txt file.
+			if _, _, err := StatStoredObject(ss, ss.Bucket, obj.Key+"bagit.txt"); err != nil {
+				continue
+			}
+		} else if !IsSerializedBag(name) {
+			continue
+		}
+		bags[name] = obj
+	}
+	return bags, nil
+}
+
+// listStoredDirectory lists the files and directories under directory,
+// which is relative to the bucket or directory of ss. Keys are relative
+// to the bucket, and directory keys end with a slash. If recursive is
+// true, it lists only files, at every level.
+func listStoredDirectory(ss *core.StorageService, directory string, recursive bool) ([]minio.ObjectInfo, error) {
+	objects := make([]minio.ObjectInfo, 0)
+	switch ss.Protocol {
+	case constants.ProtocolS3:
+		client, err := NewMinioClient(ss)
+		if err != nil {
+			return objects, err
+		}
+		prefix := ""
+		if directory != "" {
+			prefix = directory + "/"
+		}
+		opts := minio.ListObjectsOptions{Prefix: prefix, Recursive: recursive}
+		err = WalkS3Objects(context.Background(), client, ss.Bucket, opts, func(obj minio.ObjectInfo) error {
+			objects = append(objects, obj)
+			return nil
+		})
+		return objects, err
+	case constants.ProtocolSFTP, ProtocolWebDAV:
+		listDirectory := ListSFTPDirectory
+		if ss.Protocol == ProtocolWebDAV {
+			listDirectory = ListWebDAVDirectory
+		}
+		entries, _, err := listDirectory(ss, ss.Bucket, directory, "", 1<<30)
+		if err != nil {
+			return objects, err
+		}
+		return expandStoredDirectory(ss, entries, recursive)
+	case ProtocolFilesystem:
+		if err := checkKeySegments(directory); err != nil {
+			return objects, err
+		}
+		entries, err := os.ReadDir(filepath.Join(ss.Bucket, filepath.FromSlash(directory)))
+		if err != nil {
+			return objects, err
+		}
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil {
+				return objects, err
+			}
+			obj := minio.ObjectInfo{
+				Key:          path.Join(directory, entry.Name()),
+				Size:         info.Size(),
+				LastModified: info.ModTime(),
+			}
+			if entry.IsDir() {
+				obj.Key += "/"
+				obj.Size = 0
+				obj.ContentType = DirectoryContentType
+			} else if !info.Mode().IsRegular() {
+				continue
+			}
+			objects = append(objects, obj)
+		}
+		return expandStoredDirectory(ss, objects, recursive)
+	}
+	return objects, fmt.Errorf("DART cannot list %s services", ss.Protocol)
+}
+
+// expandStoredDirectory returns entries as they are if recursive is
+// false. Otherwise, it replaces each directory with the files under it.
+func expandStoredDirectory(ss *core.StorageService, entries []minio.ObjectInfo, recursive bool) ([]minio.ObjectInfo, error) {
+	if !recursive {
+		return entries, nil
+	}
+	objects := make([]minio.ObjectInfo, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Key, "/") {
+			objects = append(objects, entry)
+			continue
+		}
+		children, err := listStoredDirectory(ss, strings.TrimSuffix(entry.Key, "/"), true)
+		if err != nil {
+			return objects, err
+		}
+		objects = append(objects, children...)
+	}
+	return objects, nil
+}
+
+// compareBags fills in entry by comparing the local bag with the
+// remote one.
+func compareBags(ss *core.StorageService, prefix string, entry *ReconciliationEntry, remote minio.ObjectInfo, compareChecksums bool) {
+	stat, err := os.Stat(entry.LocalPath)
+	if err != nil {
+		entry.Status = ReconcileUnchecked
+		entry.Detail = err.Error()
+		return
+	}
+	entry.IsDir = stat.IsDir()
+	if entry.IsDir != strings.HasSuffix(remote.Key, "/") {
+		entry.Status = ReconcileDiffers
+		entry.Detail = "One copy is a directory and the other is a file."
+		return
+	}
+	if entry.IsDir {
+		compareBagDirectories(ss, prefix, entry)
+		return
+	}
+	entry.LocalSize = stat.Size()
+	entry.RemoteSize = remote.Size
+	entry.Method = VerifiedBySize
+	if entry.LocalSize != entry.RemoteSize {
+		entry.Status = ReconcileDiffers
+		entry.Detail = fmt.Sprintf("Local bag is %d bytes, remote bag is %d bytes.", entry.LocalSize, entry.RemoteSize)
+		return
+	}
+	entry.Status = ReconcileMatch
+	if !compareChecksums {
+		return
+	}
+	switch ss.Protocol {
+	case constants.ProtocolS3, constants.ProtocolSFTP:
+		v := VerifyUploadAs(ss, entry.LocalPath, remote.Key)
+		entry.Method = v.Method
+		entry.Detail = v.Note
+		if !v.OK() {
+			entry.Status = ReconcileDiffers
+			entry.Detail = v.Error
+		}
+	case ProtocolFilesystem:
+		localSHA256, err := sha256File(entry.LocalPath)
+		if err == nil {
+			var remoteSHA256 string
+			remoteSHA256, err = sha256File(filepath.Join(ss.Bucket, filepath.FromSlash(remote.Key)))
+			entry.Method = VerifiedBySHA256
+			if err == nil && localSHA256 != remoteSHA256 {
+				entry.Status = ReconcileDiffers
+				entry.Detail = fmt.Sprintf("Local sha256 is %s, remote sha256 is %s.", localSHA256, remoteSHA256)
+			}
+		}
+		if err != nil {
+			entry.Status = ReconcileUnchecked
+			entry.Detail = err.Error()
+		}
+	default:
+		entry.Detail = "WebDAV servers don't report checksums. Compared size only."
+	}
+}
+
+// compareBagDirectories compares every file in the local bag directory
+// with the remote file under the key an upload job would give it.
+func compareBagDirectories(ss *core.StorageService, prefix string, entry *ReconciliationEntry) {
+	entry.Method = VerifiedBySize
+	opts := &UploadJobOptions{SymlinkPolicy: SymlinkSkip, EmptyDirPolicy: EmptyDirSkip}
+	plan, err := PlanUploadItems([]string{entry.LocalPath}, opts, prefix)
+	if err != nil {
+		entry.Status = ReconcileUnchecked
+		entry.Detail = err.Error()
+		return
+	}
+	remoteFiles, err := listStoredDirectory(ss, strings.TrimSuffix(entry.RemotePath, "/"), true)
+	if err != nil {
+		entry.Status = ReconcileUnchecked
+		entry.Detail = err.Error()
+		return
+	}
+	remoteSizes := make(map[string]int64)
+	for _, obj := range remoteFiles {
+		if strings.HasSuffix(obj.Key, "/") {
+			continue
+		}
+		remoteSizes[obj.Key] = obj.Size
+		entry.RemoteSize += obj.Size
+	}
+	missing, different := 0, 0
+	for _, item := range plan.Items {
+		if item.IsDir {
+			continue
+		}
+		entry.LocalSize += item.Size
+		remoteSize, ok := remoteSizes[item.Key]
+		if !ok {
+			missing++
+			continue
+		}
+		delete(remoteSizes, item.Key)
+		if remoteSize != item.Size {
+			different++
+		}
+	}
+	problems := make([]string, 0)
+	if missing > 0 {
+		problems = append(problems, fmt.Sprintf("Files missing remotely: %d", missing))
+	}
+	if different > 0 {
+		problems = append(problems, fmt.Sprintf("Files that differ in size: %d", different))
+	}
+	if len(remoteSizes) > 0 {
+		problems = append(problems, fmt.Sprintf("Remote files not in the local bag: %d", len(remoteSizes)))
+	}
+	if len(problems) > 0 {
+		entry.Status = ReconcileDiffers
+		entry.Detail = strings.Join(problems, ". ") + "."
+		return
+	}
+	entry.Status = ReconcileMatch
+	entry.Detail = fmt.Sprintf("Files that match in size: %d.", plan.FileCount())
+}
@@ -0,0 +1,257 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+var reconciliationStore = NewJSONStore[Reconciliation]("reconciliations.json")
+
+// GET /reconciliations
+func ReconciliationIndex(c *gin.Context) {
+	reconciliations, err := reconciliationStore.Load()
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+		return
+	}
+	for i := range reconciliations {
+		reconciliations[i].Status, reconciliations[i].Error = taskStatus(reconciliations[i].ID, reconciliations[i].Status, reconciliations[i].Error)
+	}
+	sort.Slice(reconciliations, func(i, j int) bool {
+		return reconciliations[i].CreatedAt.After(reconciliations[j].CreatedAt)
+	})
+	data := gin.H{
+		"reconciliations": reconciliations,
+		"helpUrl":         GetHelpUrl(c),
+	}
+	c.HTML(http.StatusOK, "reconciliation/index.html", data)
+}
+
+// GET /reconciliations/new
+//
+// The local directory defaults to the bagging directory.
+func ReconciliationNew(c *gin.Context) {
+	r := &Reconciliation{
+		StorageServiceID: c.Query("ssid"),
+		CompareChecksums: true,
+	}
+	r.LocalDirectory, _ = core.GetAppSetting(constants.BaggingDirectory)
+	data := gin.H{
+		"form":    reconciliationForm(r),
+		"helpUrl": GetHelpUrl(c),
+	}
+	c.HTML(http.StatusOK, "reconciliation/new.html", data)
+}
+
+// POST /reconciliations/new
+//
+// This saves the reconciliation and builds it in a BackgroundTask,
+// since comparing checksums means reading every local bag. The show
+// page reports progress until the reconciliation is done.
+func ReconciliationCreate(c *gin.Context) {
+	r := &Reconciliation{
+		LocalDirectory:   strings.TrimSpace(c.PostForm("LocalDirectory")),
+		StorageServiceID: c.PostForm("StorageServiceID"),
+		Prefix:           strings.Trim(strings.TrimSpace(c.PostForm("Prefix")), "/"),
+		CompareChecksums: c.PostForm("CompareChecksums") == "true",
+	}
+	form := reconciliationForm(r)
+	if r.LocalDirectory == "" {
+		form.Fields["LocalDirectory"].Error = "Please enter the directory that holds your bags."
+	} else if stat, err := os.Stat(r.LocalDirectory); err != nil || !stat.IsDir() {
+		form.Fields["LocalDirectory"].Error = fmt.Sprintf("Directory %s does not exist.", r.LocalDirectory)
+	}
+	ss := core.ObjFind(r.StorageServiceID).StorageService()
+	if ss == nil {
+		form.Fields["StorageServiceID"].Error = "Please choose a storage service."
+	} else if !isReconcileProtocol(ss.Protocol) {
+		form.Fields["StorageServiceID"].Error = fmt.Sprintf("DART cannot compare bags on %s services.", ss.Protocol)
+	}
+	// The prefix becomes the key prefix of any upload job we create,
+	// so it can't contain placeholders.
+	if strings.ContainsAny(r.Prefix, "{}") {
+		form.Fields["Prefix"].Error = "Prefix cannot contain curly braces."
+	} else if err := checkKeySegments(r.Prefix); err != nil {
+		form.Fields["Prefix"].Error = err.Error()
+	}
+	for _, field := range form.Fields {
+		if field.Error != "" {
+			data := gin.H{
+				"form":    form,
+				"helpUrl": GetHelpUrl(c),
+			}
+			c.HTML(http.StatusBadRequest, "reconciliation/new.html", data)
+			return
+		}
+	}
+	r.ID = uuid.NewString()
+	r.StorageServiceName = ss.Name
+	r.CreatedAt = time.Now()
+	r.Status = TaskRunning
+	r.Entries = make([]ReconciliationEntry, 0)
+	if err := saveReconciliation(r); err != nil {
+		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+		return
+	}
+	StartBackgroundTask(r.ID, "Listing bags...", func(ctx context.Context, task *BackgroundTask) {
+		built, err := BuildReconciliation(ctx, r.LocalDirectory, ss, r.Prefix, r.CompareChecksums, func(compared, total int) {
+			task.SetProgress(int64(compared), int64(total), fmt.Sprintf("Compared %d of %d local bags.", compared, total))
+		})
+		r.Status = finishedTaskStatus(ctx, err)
+		switch r.Status {
+		case TaskCompleted:
+			r.Entries = built.Entries
+		case TaskFailed:
+			r.Error = err.Error()
+		}
+		if err := saveReconciliation(r); err != nil {
+			core.Dart.Log.Errorf("Cannot save reconciliation %s: %v", r.ID, err)
+		}
+	})
+	c.Redirect(http.StatusFound, fmt.Sprintf("/reconciliations/show/%s", r.ID))
+}
+
+// GET /reconciliations/show/:id
+//
+// While the reconciliation is being built, this shows its progress.
+func ReconciliationShow(c *gin.Context) {
+	r, err := findReconciliation(c.Param("id"))
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusNotFound, err)
+		return
+	}
+	data := gin.H{
+		"reconciliation":  r,
+		"matchCount":      r.Count(ReconcileMatch),
+		"missingCount":    r.Count(ReconcileMissingRemote),
+		"remoteOnlyCount": r.Count(ReconcileRemoteOnly),
+		"differsCount":    r.Count(ReconcileDiffers),
+		"uncheckedCount":  r.Count(ReconcileUnchecked),
+		"uploadable":      r.Uploadable(),
+		"flash":           GetFlashCookie(c),
+		"helpUrl":         GetHelpUrl(c),
+	}
+	c.HTML(http.StatusOK, "reconciliation/show.html", data)
+}
+
+// POST /reconciliations/upload/:id
+//
+// This creates an upload job that sends the local copies of the named
+// bags to the reconciliation's storage service, under the same prefix,
+// and takes the user to the job's review page to run it.
+func ReconciliationUpload(c *gin.Context) {
+	r, err := findReconciliation(c.Param("id"))
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusNotFound, err)
+		return
+	}
+	ss := core.ObjFind(r.StorageServiceID).StorageService()
+	if ss == nil {
+		AbortWithErrorHTML(c, http.StatusNotFound, fmt.Errorf("Storage service %s no longer exists.", r.StorageServiceName))
+		return
+	}
+	names := c.PostFormArray("name")
+	entries := make([]*ReconciliationEntry, 0)
+	for i := range r.Entries {
+		for _, name := range names {
+			if r.Entries[i].Name == name && r.Entries[i].CanUpload() {
+				entries = append(entries, &r.Entries[i])
+			}
+		}
+	}
+	if len(entries) == 0 {
+		SetFlashCookie(c, "There's nothing to upload.")
+		c.Redirect(http.StatusFound, fmt.Sprintf("/reconciliations/show/%s", r.ID))
+		return
+	}
+
+	uploadJob := core.NewUploadJob()
+	for _, entry := range entries {
+		uploadJob.PathsToUpload = append(uploadJob.PathsToUpload, entry.LocalPath)
+	}
+	uploadJob.StorageServiceIDs = []string{ss.ID}
+	uploadJob.UploadOps = []*core.UploadOperation{core.NewUploadOperation(ss, uploadJob.PathsToUpload)}
+	opts := GetUploadJobOptions(uploadJob.ID)
+	opts.KeyPrefix = r.Prefix
+	if err := SaveUploadJobOptions(opts); err != nil {
+		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+		return
+	}
+	if err := core.ObjSaveWithoutValidation(uploadJob); err != nil {
+		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+		return
+	}
+	for _, entry := range entries {
+		entry.UploadJobID = uploadJob.ID
+	}
+	if err := saveReconciliation(r); err != nil {
+		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.Redirect(http.StatusFound, fmt.Sprintf("/upload_jobs/review/%s", uploadJob.ID))
+}
+
+func reconciliationForm(r *Reconciliation) *core.Form {
+	form := core.NewForm("Reconciliation", r.ID, make(map[string]string))
+	dirField := form.AddField("LocalDirectory", "Local Directory", r.LocalDirectory, true)
+	dirField.Help = "The directory that holds your bags, such as the bagging directory. DART compares the bags at the top level of this directory."
+
+	ssField := form.AddField("StorageServiceID", "Storage Service", r.StorageServiceID, true)
+	ssField.Choices = []core.Choice{
+		{Label: "Choose One", Value: "", Selected: false},
+	}
+	for _, ss := range core.ObjList(constants.TypeStorageService, "obj_name", 100, 0).StorageServices {
+		if ss.AllowsUpload && isReconcileProtocol(ss.Protocol) {
+			ssField.Choices = append(ssField.Choices, core.Choice{Label: ss.Name, Value: ss.ID, Selected: ss.ID == r.StorageServiceID})
+		}
+	}
+
+	prefixField := form.AddField("Prefix", "Prefix", r.Prefix, false)
+	prefixField.Help = "Optional. The folder or key prefix the bags were uploaded under, such as deposits/2026. Uploads from this page use the same prefix."
+
+	checksumField := form.AddField("CompareChecksums", "Compare Checksums", strconv.FormatBool(r.CompareChecksums), false)
+	checksumField.Choices = []core.Choice{
+		{Label: "Yes", Value: "true", Selected: r.CompareChecksums},
+		{Label: "No", Value: "false", Selected: !r.CompareChecksums},
+	}
+	checksumField.Help = "When a bag is the same size on both sides, compare checksums too. This reads every such local bag. Bag directories are compared by size only."
+	return form
+}
+
+func findReconciliation(id string) (*Reconciliation, error) {
+	reconciliations, err := reconciliationStore.Load()
+	if err != nil {
+		return nil, err
+	}
+	for i := range reconciliations {
+		if reconciliations[i].ID == id {
+			r := &reconciliations[i]
+			r.Status, r.Error = taskStatus(r.ID, r.Status, r.Error)
+			return r, nil
+		}
+	}
+	return nil, fmt.Errorf("No reconciliation with id %s", id)
+}
+
+func saveReconciliation(r *Reconciliation) error {
+	return reconciliationStore.Update(func(reconciliations []Reconciliation) ([]Reconciliation, error) {
+		for i := range reconciliations {
+			if reconciliations[i].ID == r.ID {
+				reconciliations[i] = *r
+				return reconciliations, nil
+			}
+		}
+		return append(reconciliations, *r), nil
+	})
+}
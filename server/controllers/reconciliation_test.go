@@ -0,0 +1,181 @@
+package controllers_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart/v3/server/controllers"
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeReconcileFiles creates files under dir. Keys are
+// slash-separated paths and values are file contents.
+func writeReconcileFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		filePath := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0755))
+		require.NoError(t, os.WriteFile(filePath, []byte(content), 0644))
+	}
+}
+
+func reconcileEntries(r *controllers.Reconciliation) map[string]controllers.ReconciliationEntry {
+	entries := make(map[string]controllers.ReconciliationEntry)
+	for _, entry := range r.Entries {
+		entries[entry.Name] = entry
+	}
+	return entries
+}
+
+func TestBuildReconciliation(t *testing.T) {
+	defer core.ClearDartTable()
+	localDir := t.TempDir()
+	writeReconcileFiles(t, localDir, map[string]string{
+		"same.tar":           "same contents",
+		"missing.tar":        "only local",
+		"changed.tar":        "local version",
+		"bag_dir/bagit.txt":  "BagIt-Version: 1.0",
+		"bag_dir/data/a.txt": "file a",
+		"bag_dir/data/b.txt": "file b",
+		"not_a_bag/file.txt": "not a bag",
+		"README.md":          "not a bag either",
+		".hidden.tar":        "hidden",
+	})
+	ss := getFilesystemService(t)
+	writeReconcileFiles(t, ss.Bucket, map[string]string{
+		"deposits/same.tar":           "same contents",
+		"deposits/changed.tar":        "LOCAL version",
+		"deposits/bag_dir/bagit.txt":  "BagIt-Version: 1.0",
+		"deposits/bag_dir/data/a.txt": "file a",
+		"deposits/remote.zip":         "only remote",
+		"deposits/notes.txt":          "not a bag",
+	})
+
+	r, err := controllers.BuildReconciliation(context.Background(), localDir, ss, "/deposits/", true, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "deposits", r.Prefix)
+	entries := reconcileEntries(r)
+	require.Equal(t, 5, len(entries), entries)
+
+	assert.Equal(t, controllers.ReconcileMatch, entries["same.tar"].Status)
+	assert.Equal(t, controllers.VerifiedBySHA256, entries["same.tar"].Method)
+	assert.Equal(t, controllers.ReconcileMissingRemote, entries["missing.tar"].Status)
+	assert.EqualValues(t, 10, entries["missing.tar"].LocalSize)
+	assert.Equal(t, controllers.ReconcileDiffers, entries["changed.tar"].Status)
+	assert.Contains(t, entries["changed.tar"].Detail, "sha256")
+	assert.Equal(t, controllers.ReconcileDiffers, entries["bag_dir"].Status)
+	assert.True(t, entries["bag_dir"].IsDir)
+	assert.Equal(t, "Files missing remotely: 1.", entries["bag_dir"].Detail)
+	assert.Equal(t, controllers.ReconcileRemoteOnly, entries["remote.zip"].Status)
+	assert.Equal(t, "deposits/remote.zip", entries["remote.zip"].RemotePath)
+
+	assert.Equal(t, []string{"bag_dir", "changed.tar", "missing.tar"}, r.Uploadable())
+	assert.Equal(t, 1, r.Count(controllers.ReconcileMatch))
+
+	// Without checksums, same-size bags match.
+	r, err = controllers.BuildReconciliation(context.Background(), localDir, ss, "deposits", false, nil)
+	require.NoError(t, err)
+	assert.Equal(t, controllers.ReconcileMatch, reconcileEntries(r)["changed.tar"].Status)
+}
+
+func TestReconciliationCreateWithMissingFields(t *testing.T) {
+	defer core.ClearDartTable()
+	params := url.Values{}
+	params.Set("LocalDirectory", "")
+	params.Set("StorageServiceID", "")
+	params.Set("Prefix", "{yyyy}")
+	DoSimplePostTest(t, PostTestSettings{
+		EndpointUrl:          "/reconciliations/new",
+		Params:               params,
+		ExpectedResponseCode: http.StatusBadRequest,
+		ExpectedContent: []string{
+			"Please enter the directory that holds your bags.",
+			"Please choose a storage service.",
+			"Prefix cannot contain curly braces.",
+		},
+	})
+}
+
+func TestReconciliationUpload(t *testing.T) {
+	defer core.ClearDartTable()
+	localDir := t.TempDir()
+	writeReconcileFiles(t, localDir, map[string]string{
+		"one.tar": "bag one",
+		"two.tar": "bag two",
+	})
+	ss := getFilesystemService(t)
+	require.NoError(t, core.ObjSaveWithoutValidation(ss))
+	DoSimpleGetTest(t, "/reconciliations/new?ssid="+ss.ID, []string{"Reconcile Bags", ss.Name, "Compare Checksums"})
+
+	params := url.Values{}
+	params.Set("LocalDirectory", localDir)
+	params.Set("StorageServiceID", ss.ID)
+	params.Set("Prefix", "deposits")
+	params.Set("CompareChecksums", "true")
+	w := httptest.NewRecorder()
+	req, err := NewPostRequest("/reconciliations/new", params)
+	require.NoError(t, err)
+	dartServer.ServeHTTP(w, req)
+	require.Equal(t, http.StatusFound, w.Code)
+	showUrl := w.Header().Get("Location")
+	reconciliationID := path.Base(showUrl)
+	require.Eventually(t, func() bool { return !controllers.BackgroundTaskRunning(reconciliationID) }, 30*time.Second, 100*time.Millisecond)
+	DoSimpleGetTest(t, showUrl, []string{"2 missing remotely", "one.tar", "two.tar", "Upload All (2)"})
+
+	// Upload one bag.
+	uploadUrl := strings.Replace(showUrl, "/show/", "/upload/", 1)
+	params = url.Values{}
+	params.Set("name", "one.tar")
+	w = httptest.NewRecorder()
+	req, err = NewPostRequest(uploadUrl, params)
+	require.NoError(t, err)
+	dartServer.ServeHTTP(w, req)
+	require.Equal(t, http.StatusFound, w.Code)
+	uploadJobID := strings.TrimPrefix(w.Header().Get("Location"), "/upload_jobs/review/")
+	require.NotEmpty(t, uploadJobID)
+	assert.Equal(t, "deposits", controllers.GetUploadJobOptions(uploadJobID).KeyPrefix)
+
+	html := GetUrl(t, showUrl)
+	assert.Contains(t, html, "/upload_jobs/review/"+uploadJobID)
+	assert.Contains(t, html, "Upload All (1)")
+}
+
+// NOTE: This test assumes that local Minio server is running.
+// See the note at the top of download_job_controller_test.go.
+func TestBuildReconciliationS3(t *testing.T) {
+	defer core.ClearDartTable()
+	ss := loadMinioStorageService(t)
+	client, err := controllers.NewMinioClient(ss)
+	require.NoError(t, err)
+
+	localDir := t.TempDir()
+	writeReconcileFiles(t, localDir, map[string]string{
+		"same.tar":    "same contents",
+		"changed.tar": "local version",
+		"missing.tar": "only local",
+	})
+	prefix := "reconcile-test"
+	for name, content := range map[string]string{"same.tar": "same contents", "changed.tar": "LOCAL version", "remote.tar": "only remote"} {
+		_, err = client.PutObject(context.Background(), ss.Bucket, prefix+"/"+name, strings.NewReader(content), int64(len(content)), minio.PutObjectOptions{})
+		require.NoError(t, err)
+	}
+
+	r, err := controllers.BuildReconciliation(context.Background(), localDir, ss, prefix, true, nil)
+	require.NoError(t, err)
+	entries := reconcileEntries(r)
+	assert.Equal(t, controllers.ReconcileMatch, entries["same.tar"].Status)
+	assert.Equal(t, controllers.VerifiedByETag, entries["same.tar"].Method)
+	assert.Equal(t, controllers.ReconcileDiffers, entries["changed.tar"].Status)
+	assert.Equal(t, controllers.ReconcileMissingRemote, entries["missing.tar"].Status)
+	assert.Equal(t, controllers.ReconcileRemoteOnly, entries["remote.tar"].Status)
+}
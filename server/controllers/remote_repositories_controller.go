@@ -1,6 +1,7 @@
 package controllers
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 
@@ -32,6 +33,7 @@ func RemoteRepositoryEdit(c *gin.Context) {
 		AbortWithErrorHTML(c, http.StatusInternalServerError, request.Errors[0])
 		return
 	}
+	AddCredentialReferenceHelp(request.TemplateData["form"].(*core.Form), "APIToken")
 	request.TemplateData["showTestButton"] = request.QueryResult.RemoteRepository().Validate()
 	c.HTML(http.StatusOK, "remote_repository/form.html", request.TemplateData)
 }
@@ -50,8 +52,10 @@ func RemoteRepositoryIndex(c *gin.Context) {
 // GET /remote_repositories/new
 func RemoteRepositoryNew(c *gin.Context) {
 	repo := core.NewRemoteRepository()
+	form := repo.ToForm()
+	AddCredentialReferenceHelp(form, "APIToken")
 	data := gin.H{
-		"form":                 repo.ToForm(),
+		"form":                 form,
 		"suppressDeleteButton": true,
 		"helpUrl":              GetHelpUrl(c),
 	}
@@ -68,11 +72,19 @@ func RemoteRepositorySave(c *gin.Context) {
 		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
 		return
 	}
-	err = core.ObjSave(repo)
+	err = protectRemoteRepositoryCredentials(repo)
+	if err == nil {
+		err = core.ObjSave(repo)
+	}
 	if err != nil {
 		objectExistsInDB, _ := core.ObjExists(repo.ID)
+		form := repo.ToForm()
+		AddCredentialReferenceHelp(form, "APIToken")
+		if errors.Is(err, ErrCredentialsLocked) {
+			form.Fields["APIToken"].Error = err.Error()
+		}
 		data := gin.H{
-			"form":             repo.ToForm(),
+			"form":             form,
 			"objectExistsInDB": objectExistsInDB,
 			"helpUrl":          GetHelpUrl(c),
 		}
@@ -97,14 +109,21 @@ func RemoteRepositoryTestConnection(c *gin.Context) {
 	}
 
 	// Save, because user may have updated URL or credentials.
-	// If save fails, continue with test.
-	core.ObjSave(repo)
+	// If save fails, continue with test. If the API token needs
+	// encrypting and stored credentials are locked, don't save.
+	if protectRemoteRepositoryCredentials(repo) == nil {
+		core.ObjSave(repo)
+	}
 
 	status := http.StatusOK
 	succeeded := true
 	message := fmt.Sprintf("It worked! We got a successful response from %s.", repo.Url)
 	if repo.UserID != "" && repo.APIToken != "" {
-		err = repo.TestConnection()
+		var resolved *core.RemoteRepository
+		resolved, err = ResolveRemoteRepositoryCredentials(repo)
+		if err == nil {
+			err = resolved.TestConnection()
+		}
 	} else {
 		err = fmt.Errorf("Can't test connection because user id or API key is missing.")
 	}
@@ -0,0 +1,344 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/gin-gonic/gin"
+)
+
+// RestoreJob describes a request to download a serialized bag from
+// a storage service, validate it, and unpack its payload into
+// TargetDir. Each restore job is backed by a core.ValidationJob with
+// the same ID, which does the actual validation work.
+type RestoreJob struct {
+	ID               string    `json:"id"`
+	StorageServiceID string    `json:"storageServiceId"`
+	Bucket           string    `json:"bucket"`
+	Key              string    `json:"key"`
+	BagItProfileID   string    `json:"bagItProfileId"`
+	TargetDir        string    `json:"targetDir"`
+	CreatedAt        time.Time `json:"createdAt"`
+	CompletedAt      time.Time `json:"completedAt"`
+	Succeeded        bool      `json:"succeeded"`
+}
+
+var restoreJobStore = NewJSONStore[RestoreJob]("restore_jobs.json")
+
+// Stages of a restore job, in addition to DART Runner's validation
+// stage. The job run page shows the progress of each one separately.
+const (
+	StageDownload = "download"
+	StageUnpack   = "unpack"
+)
+
+// GET /restore_jobs/new?ssid=<id>&bucket=<name>&key=<key>
+func RestoreJobNew(c *gin.Context) {
+	restoreJob := &RestoreJob{
+		StorageServiceID: c.Query("ssid"),
+		Bucket:           c.Query("bucket"),
+		Key:              c.Query("key"),
+	}
+	baggingDir, err := core.GetAppSetting(constants.BaggingDirectory)
+	if err == nil {
+		restoreJob.TargetDir = filepath.Join(baggingDir, "restored")
+	}
+	data := gin.H{
+		"form":       restoreJobForm(restoreJob),
+		"restoreJob": restoreJob,
+		"helpUrl":    GetHelpUrl(c),
+	}
+	c.HTML(http.StatusOK, "restore_job/new.html", data)
+}
+
+// POST /restore_jobs/new
+func RestoreJobCreate(c *gin.Context) {
+	restoreJob := &RestoreJob{
+		StorageServiceID: c.PostForm("ssid"),
+		Bucket:           c.PostForm("bucket"),
+		Key:              c.PostForm("key"),
+		BagItProfileID:   c.PostForm("BagItProfileID"),
+		TargetDir:        c.PostForm("TargetDir"),
+		CreatedAt:        time.Now(),
+	}
+	form := restoreJobForm(restoreJob)
+	localPath, err := LocalPathForKey(core.Dart.Paths.Downloads, restoreJob.Key)
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusBadRequest, err)
+		return
+	}
+	if restoreJob.BagItProfileID == "" {
+		form.Fields["BagItProfileID"].Error = "Please choose a BagIt profile."
+	}
+	if !filepath.IsAbs(restoreJob.TargetDir) {
+		form.Fields["TargetDir"].Error = "Restore To must be an absolute path."
+	}
+	if form.Fields["BagItProfileID"].Error != "" || form.Fields["TargetDir"].Error != "" {
+		data := gin.H{
+			"form":       form,
+			"restoreJob": restoreJob,
+			"helpUrl":    GetHelpUrl(c),
+		}
+		c.HTML(http.StatusBadRequest, "restore_job/new.html", data)
+		return
+	}
+
+	// The bag isn't downloaded yet, so the validation job would
+	// fail ObjSave's validation. We validate it again at run time.
+	valJob := core.NewValidationJob()
+	valJob.BagItProfileID = restoreJob.BagItProfileID
+	valJob.PathsToValidate = []string{localPath}
+	err = core.ObjSaveWithoutValidation(valJob)
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+		return
+	}
+	restoreJob.ID = valJob.ID
+	err = saveRestoreJob(restoreJob)
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.Redirect(http.StatusFound, fmt.Sprintf("/restore_jobs/review/%s", restoreJob.ID))
+}
+
+// GET /restore_jobs/review/:id
+func RestoreJobReview(c *gin.Context) {
+	restoreJob, err := findRestoreJob(c.Param("id"))
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusNotFound, err)
+		return
+	}
+	valJob, err := loadValidationJob(restoreJob.ID)
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusNotFound, err)
+		return
+	}
+	result := core.ObjFind(valJob.BagItProfileID)
+	if result.Error != nil {
+		AbortWithErrorHTML(c, http.StatusNotFound, result.Error)
+		return
+	}
+	jobSummary := core.NewValidationJobSummary(valJob, result.BagItProfile())
+	jobSummaryJson, _ := json.MarshalIndent(jobSummary, "", "  ")
+
+	values := url.Values{}
+	values.Set("ssid", restoreJob.StorageServiceID)
+	values.Set("bucket", restoreJob.Bucket)
+	values.Set("key", restoreJob.Key)
+
+	data := gin.H{
+		"jobID":          restoreJob.ID,
+		"workflowID":     "-",
+		"restoreJob":     restoreJob,
+		"jobSummary":     jobSummary,
+		"jobSummaryJson": string(jobSummaryJson),
+		"jobRunUrl":      "/restore_jobs/run/",
+		"backButtonUrl":  fmt.Sprintf("/restore_jobs/new?%s", values.Encode()),
+		"helpUrl":        GetHelpUrl(c),
+	}
+	c.HTML(http.StatusOK, "restore_job/review.html", data)
+}
+
+// GET /restore_jobs/run/:id
+//
+// By REST standards, this should be a POST. However, the Server
+// Send Events standard for JavaScript only supports GET.
+func RestoreJobRun(c *gin.Context) {
+	restoreJob, err := findRestoreJob(c.Param("id"))
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusNotFound, err)
+		return
+	}
+	valJob, err := loadValidationJob(restoreJob.ID)
+	if err != nil {
+		detailedError := fmt.Errorf("ValidationJob record not found. %s", err.Error())
+		AbortWithErrorHTML(c, http.StatusNotFound, detailedError)
+		return
+	}
+	result := core.ObjFind(valJob.BagItProfileID)
+	if result.Error != nil {
+		detailedError := fmt.Errorf("BagIt profile not found. %s", result.Error.Error())
+		AbortWithErrorHTML(c, http.StatusNotFound, detailedError)
+		return
+	}
+	profile := result.BagItProfile()
+
+	messageChannel := make(chan *core.EventMessage)
+	go func() {
+
+		// Give the listeners below a chance to attach.
+		time.Sleep(200 * time.Millisecond)
+
+		jobSummary := core.NewValidationJobSummary(valJob, profile)
+		messageChannel <- core.InitEvent(jobSummary)
+
+		exitCode := runRestoreJob(restoreJob, valJob, messageChannel)
+
+		status := constants.StatusFailed
+		if exitCode == constants.ExitOK {
+			status = constants.StatusSuccess
+		}
+		restoreJob.CompletedAt = time.Now()
+		restoreJob.Succeeded = exitCode == constants.ExitOK
+		if err := saveRestoreJob(restoreJob); err != nil {
+			core.Dart.Log.Errorf("Error saving restore job %s: %v", restoreJob.ID, err)
+		}
+		eventMessage := &core.EventMessage{
+			EventType: constants.EventTypeDisconnect,
+			Message:   fmt.Sprintf("Job completed with exit code %d (%s)", exitCode, status),
+			Status:    status,
+		}
+		messageChannel <- eventMessage
+	}()
+
+	streamer := func(w io.Writer) bool {
+		if msg, ok := <-messageChannel; ok {
+			c.SSEvent("message", msg)
+			if msg.EventType != constants.EventTypeDisconnect {
+				return true
+			}
+		}
+		err := core.ObjSaveWithoutValidation(valJob)
+		if err != nil {
+			core.Dart.Log.Errorf("Error saving validation job %s after run: %v", valJob.ID, err)
+		}
+		return false
+	}
+	c.Stream(streamer)
+	c.Writer.Flush()
+}
+
+// GET /restore_jobs/result/:id
+func RestoreJobShowResult(c *gin.Context) {
+	restoreJob, err := findRestoreJob(c.Param("id"))
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusNotFound, err)
+		return
+	}
+	artifacts, err := core.ArtifactListByJobID(restoreJob.ID)
+	if err != nil {
+		core.Dart.Log.Warningf("Error getting artifact list for restore job %s: %v", restoreJob.ID, err)
+	}
+	data := gin.H{
+		"restoreJob": restoreJob,
+		"artifacts":  artifacts,
+		"helpUrl":    GetHelpUrl(c),
+	}
+	c.HTML(http.StatusOK, "restore_job/result.html", data)
+}
+
+// runRestoreJob downloads, validates and unpacks the bag, sending
+// status messages through messageChannel along the way. It returns
+// an exit code, like the job runners in DART Runner.
+func runRestoreJob(restoreJob *RestoreJob, valJob *core.ValidationJob, messageChannel chan *core.EventMessage) int {
+	localPath := valJob.PathsToValidate[0]
+	messageChannel <- core.InfoEvent(StageDownload, fmt.Sprintf("Downloading %s from bucket %s", restoreJob.Key, restoreJob.Bucket))
+	_, err := DownloadToFile(restoreJob.StorageServiceID, restoreJob.Bucket, restoreJob.Key, localPath)
+	if err != nil {
+		return restoreJobFailed(restoreJob, messageChannel, StageDownload, fmt.Errorf("Download failed: %v", err))
+	}
+	if !valJob.Validate() {
+		validationErr := ""
+		for _, msg := range valJob.Errors {
+			validationErr += msg + " "
+		}
+		return restoreJobFailed(restoreJob, messageChannel, constants.StageValidation, fmt.Errorf("Job is invalid. %s", validationErr))
+	}
+	exitCode := valJob.Run(messageChannel)
+	if exitCode != constants.ExitOK {
+		return exitCode
+	}
+
+	messageChannel <- core.InfoEvent(StageUnpack, fmt.Sprintf("Unpacking payload into %s", restoreJob.TargetDir))
+	unpacked, err := UnpackPayload(localPath, restoreJob.TargetDir)
+	if err != nil {
+		return restoreJobFailed(restoreJob, messageChannel, StageUnpack, fmt.Errorf("Unpacking failed: %v", err))
+	}
+	for name, contents := range unpacked.Manifests {
+		saveRestoreArtifact(core.NewManifestArtifact(unpacked.BagName, restoreJob.ID, name, contents))
+	}
+
+	results, err := VerifyPayloadChecksums(unpacked)
+	if err != nil {
+		return restoreJobFailed(restoreJob, messageChannel, StageUnpack, fmt.Errorf("Checksum verification failed: %v", err))
+	}
+	report := ChecksumReport(results)
+	saveRestoreArtifact(core.NewTagFileArtifact(unpacked.BagName, restoreJob.ID, "checksum-report.txt", report))
+	for _, result := range results {
+		if !result.OK() {
+			return restoreJobFailed(restoreJob, messageChannel, StageUnpack, fmt.Errorf("Checksum mismatch for %s (%s). See the checksum report for details.", result.Path, result.Algorithm))
+		}
+	}
+	message := fmt.Sprintf("Restored %d files to %s. All %d checksums match.", len(unpacked.PayloadFiles), unpacked.PayloadDir, len(results))
+	core.Dart.Log.Info(message)
+	messageChannel <- core.InfoEvent(StageUnpack, message)
+	return constants.ExitOK
+}
+
+func restoreJobFailed(restoreJob *RestoreJob, messageChannel chan *core.EventMessage, stage string, err error) int {
+	core.Dart.Log.Errorf("Restore job %s (%s): %v", restoreJob.ID, restoreJob.Key, err)
+	messageChannel <- core.WarningEvent(stage, err.Error())
+	return constants.ExitRuntimeErr
+}
+
+func saveRestoreArtifact(artifact *core.Artifact) {
+	if err := core.ArtifactSave(artifact); err != nil {
+		core.Dart.Log.Errorf("Error saving artifact %s for restore job %s: %v", artifact.FileName, artifact.JobID, err)
+	}
+}
+
+func restoreJobForm(restoreJob *RestoreJob) *core.Form {
+	form := core.NewForm("RestoreJob", restoreJob.ID, make(map[string]string))
+	form.AddField("ssid", "", restoreJob.StorageServiceID, true)
+	form.AddField("bucket", "", restoreJob.Bucket, true)
+	form.AddField("key", "", restoreJob.Key, true)
+
+	profileField := form.AddField("BagItProfileID", "Validate with BagIt Profile", restoreJob.BagItProfileID, true)
+	profileField.Choices = []core.Choice{
+		{Label: "Choose One", Value: "", Selected: false},
+	}
+	for _, item := range core.ObjNameIdList(constants.TypeBagItProfile) {
+		profileField.Choices = append(profileField.Choices, core.Choice{
+			Label:    item.Name,
+			Value:    item.ID,
+			Selected: item.ID == restoreJob.BagItProfileID,
+		})
+	}
+
+	targetField := form.AddField("TargetDir", "Restore To", restoreJob.TargetDir, true)
+	targetField.Help = "The bag's payload will be unpacked into a folder with the bag's name inside this folder."
+	return form
+}
+
+func findRestoreJob(id string) (*RestoreJob, error) {
+	restoreJobs, err := restoreJobStore.Load()
+	if err != nil {
+		return nil, err
+	}
+	for i := range restoreJobs {
+		if restoreJobs[i].ID == id {
+			return &restoreJobs[i], nil
+		}
+	}
+	return nil, fmt.Errorf("No restore job with id %s", id)
+}
+
+func saveRestoreJob(restoreJob *RestoreJob) error {
+	return restoreJobStore.Update(func(restoreJobs []RestoreJob) ([]RestoreJob, error) {
+		for i := range restoreJobs {
+			if restoreJobs[i].ID == restoreJob.ID {
+				restoreJobs[i] = *restoreJob
+				return restoreJobs, nil
+			}
+		}
+		return append(restoreJobs, *restoreJob), nil
+	})
+}
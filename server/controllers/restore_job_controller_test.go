@@ -0,0 +1,143 @@
+package controllers_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart-runner/util"
+	"github.com/APTrust/dart/v3/server/controllers"
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// NOTE: These tests assume that local Minio server is running.
+// See the note at the top of download_job_controller_test.go.
+
+func TestRestoreJobNew(t *testing.T) {
+	defer core.ClearDartTable()
+	saveTestProfiles(t)
+	ss := loadMinioStorageService(t)
+
+	params := url.Values{}
+	params.Set("ssid", ss.ID)
+	params.Set("bucket", ss.Bucket)
+	params.Set("key", "restore-test/example.edu.sample_good.tar")
+	expected := []string{
+		"Restore Bag",
+		"restore-test/example.edu.sample_good.tar",
+		"Validate with BagIt Profile",
+		"APTrust",
+		"BTR SHA-512",
+		"Restore To",
+	}
+	DoSimpleGetTest(t, "/restore_jobs/new?"+params.Encode(), expected)
+}
+
+func TestRestoreJobCreateWithMissingFields(t *testing.T) {
+	defer core.ClearDartTable()
+	saveTestProfiles(t)
+	ss := loadMinioStorageService(t)
+
+	params := url.Values{}
+	params.Set("ssid", ss.ID)
+	params.Set("bucket", ss.Bucket)
+	params.Set("key", "restore-test/example.edu.sample_good.tar")
+	params.Set("BagItProfileID", "")
+	params.Set("TargetDir", "relative/path")
+	DoSimplePostTest(t, PostTestSettings{
+		EndpointUrl:          "/restore_jobs/new",
+		Params:               params,
+		ExpectedResponseCode: http.StatusBadRequest,
+		ExpectedContent: []string{
+			"Please choose a BagIt profile.",
+			"Restore To must be an absolute path.",
+		},
+	})
+}
+
+func TestRestoreJobRun(t *testing.T) {
+	defer core.ClearDartTable()
+	saveTestProfiles(t)
+	ss := loadMinioStorageService(t)
+
+	// Put a good bag into Minio.
+	client, err := controllers.NewMinioClient(ss)
+	require.NoError(t, err)
+	s3Key := "restore-test/example.edu.sample_good.tar"
+	bagPath := filepath.Join(util.PathToTestData(), "bags", "example.edu.sample_good.tar")
+	_, err = client.FPutObject(context.Background(), ss.Bucket, s3Key, bagPath, minio.PutObjectOptions{})
+	require.NoError(t, err)
+
+	localPath, err := controllers.LocalPathForKey(core.Dart.Paths.Downloads, s3Key)
+	require.NoError(t, err)
+	defer os.Remove(localPath)
+
+	// Create the restore job.
+	targetDir := t.TempDir()
+	params := url.Values{}
+	params.Set("ssid", ss.ID)
+	params.Set("bucket", ss.Bucket)
+	params.Set("key", s3Key)
+	params.Set("BagItProfileID", constants.ProfileIDAPTrust)
+	params.Set("TargetDir", targetDir)
+	w := httptest.NewRecorder()
+	req, err := NewPostRequest("/restore_jobs/new", params)
+	require.NoError(t, err)
+	dartServer.ServeHTTP(w, req)
+	require.Equal(t, http.StatusFound, w.Code)
+	location := w.Header().Get("Location")
+	require.True(t, strings.HasPrefix(location, "/restore_jobs/review/"))
+	jobID := strings.TrimPrefix(location, "/restore_jobs/review/")
+
+	DoSimpleGetTest(t, location, []string{
+		"Review and Restore",
+		s3Key,
+		targetDir,
+		"/restore_jobs/run/",
+		"downloadInfo",
+		"unpackInfo",
+		"var isRestoreJob = true",
+	})
+
+	// Run it. This requires use of StreamRecorder
+	// to capture server-sent events.
+	recorder := NewStreamRecorder()
+	req, _ = http.NewRequest(http.MethodGet, fmt.Sprintf("/restore_jobs/run/%s", jobID), nil)
+	dartServer.ServeHTTP(recorder, req)
+	for !recorder.Flushed {
+		time.Sleep(250 * time.Millisecond)
+	}
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	require.NotNil(t, recorder.LastEvent)
+	assert.Equal(t, "Job completed with exit code 0 (success)", recorder.LastEvent.Message)
+
+	// Download and unpack messages have their own stages,
+	// so they don't overwrite the validation messages.
+	assert.Contains(t, recorder.Body.String(), `"stage":"download"`)
+	assert.Contains(t, recorder.Body.String(), `"stage":"unpack"`)
+
+	// Payload should be unpacked into the target dir.
+	payloadDir := filepath.Join(targetDir, "example.edu.sample_good")
+	assert.FileExists(t, filepath.Join(payloadDir, "datastream-DC"))
+	assert.FileExists(t, filepath.Join(payloadDir, "datastream-MARC"))
+
+	// And the checksum report should be among the artifacts.
+	DoSimpleGetTest(t, fmt.Sprintf("/restore_jobs/result/%s", jobID), []string{
+		"Restore Results",
+		"Succeeded",
+		"manifest-md5.txt",
+		"checksum-report.txt",
+		"4 checksums verified, 0 failed.",
+	})
+}
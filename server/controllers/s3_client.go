@@ -0,0 +1,186 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/APTrust/dart-runner/core"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// NewMinioClient returns a minio client for the specified storage
+// service. The S3Client in DART Runner covers listing and whole-object
+// downloads, but features such as ranged GETs need direct access
+// to the underlying minio API.
+//
+// The client uses the service's StorageServiceOptions to decide
+// whether to use TLS, which CAs to trust, whether to present a
+// client certificate, and how to address buckets. Credential
+// references in the service's login and password are resolved here.
+func NewMinioClient(ss *core.StorageService) (*minio.Client, error) {
+	if ss == nil {
+		return nil, fmt.Errorf("Storage service is nil")
+	}
+	opts := GetStorageServiceOptions(ss)
+	transport, err := opts.Transport()
+	if err != nil {
+		return nil, err
+	}
+	ss, err = ResolveStorageServiceCredentials(ss)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := ss.Host
+	if ss.Port > 0 {
+		endpoint = fmt.Sprintf("%s:%d", ss.Host, ss.Port)
+	}
+	return minio.New(endpoint, &minio.Options{
+		Creds:        credentials.NewStaticV4(ss.Login, ss.Password, ""),
+		Secure:       opts.UseTLS,
+		Transport:    transport,
+		BucketLookup: opts.MinioBucketLookup(),
+	})
+}
+
+// ErrStopS3Walk can be returned by the function passed to
+// WalkS3Objects to stop listing early. WalkS3Objects does not
+// treat it as an error.
+var ErrStopS3Walk = errors.New("stop S3 walk")
+
+// WalkS3Objects lists the objects in bucket that opts selects, in key
+// order, and calls fn for each one. ETags come without the quotes S3
+// puts around them. It stops at the first listing error, or at the
+// first error from fn, and returns that error.
+func WalkS3Objects(ctx context.Context, client *minio.Client, bucket string, opts minio.ListObjectsOptions, fn func(minio.ObjectInfo) error) error {
+	// The minio client keeps fetching pages until the listing is
+	// complete, so we cancel when we stop early.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for s3Obj := range client.ListObjects(ctx, bucket, opts) {
+		if s3Obj.Err != nil {
+			return fmt.Errorf("Error listing objects in bucket %s: %w", bucket, s3Obj.Err)
+		}
+		s3Obj.ETag = strings.Trim(s3Obj.ETag, `"`)
+		if err := fn(s3Obj); err != nil {
+			if errors.Is(err, ErrStopS3Walk) {
+				return nil
+			}
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// ListS3ObjectsPage returns up to maxKeys objects from bucket, in key
+// order, starting after the key startAfter. Pass an empty startAfter
+// to start at the beginning of the bucket.
+func ListS3ObjectsPage(client *minio.Client, bucket, startAfter string, maxKeys int) []minio.ObjectInfo {
+	s3Objects := make([]minio.ObjectInfo, 0, maxKeys)
+	opts := minio.ListObjectsOptions{
+		Recursive:  true,
+		MaxKeys:    maxKeys,
+		StartAfter: startAfter,
+	}
+	err := WalkS3Objects(context.Background(), client, bucket, opts, func(s3Obj minio.ObjectInfo) error {
+		s3Objects = append(s3Objects, s3Obj)
+		if len(s3Objects) == maxKeys {
+			return ErrStopS3Walk
+		}
+		return nil
+	})
+	// If the minio client can't get a list of objects, in some cases
+	// it returns a single object containing an error explaining why.
+	// We don't want to show that on the front end as a zero-byte
+	// object with no name, so we log the error and return what we
+	// listed before it.
+	if err != nil {
+		core.Dart.Log.Errorf("Error listing objects for bucket %s: %v", bucket, err)
+	}
+	return s3Objects
+}
+
+// S3UploadProvider identifies uploads that DART runs itself, rather
+// than DART Runner, in an upload operation's result.
+const S3UploadProvider = "DART S3 uploader"
+
+// UploadToS3 uploads the file at sourcePath to the bucket of S3
+// service ss under key and returns the key. If sourcePath is a
+// directory, each file in it goes under key plus its relative path.
+// We use this instead of DART Runner when a key template or S3 upload
+// options apply, because DART Runner always uses the file's name as
+// the key and has no way to set storage class, tags or metadata.
+func UploadToS3(ss *core.StorageService, sourcePath, key string) (string, error) {
+	return UploadToS3WithOptions(ss, sourcePath, key, minio.PutObjectOptions{})
+}
+
+// UploadToS3WithOptions is like UploadToS3, but it sets the storage
+// class, encryption, tags and metadata in putOpts on each object.
+func UploadToS3WithOptions(ss *core.StorageService, sourcePath, key string, putOpts minio.PutObjectOptions) (string, error) {
+	client, err := NewMinioClient(ss)
+	if err != nil {
+		return "", err
+	}
+	sourceInfo, err := os.Stat(sourcePath)
+	if err != nil {
+		return "", err
+	}
+	ctx := context.Background()
+	if !sourceInfo.IsDir() {
+		_, err = client.FPutObject(ctx, ss.Bucket, key, sourcePath, putOpts)
+		return key, err
+	}
+	err = filepath.WalkDir(sourcePath, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+		relPath, err := filepath.Rel(sourcePath, filePath)
+		if err != nil {
+			return err
+		}
+		_, err = client.FPutObject(ctx, ss.Bucket, path.Join(key, filepath.ToSlash(relPath)), filePath, putOpts)
+		return err
+	})
+	return key, err
+}
+
+// MaxPresignExpiry is the longest a presigned URL can stay valid.
+// Signature version 4 doesn't allow more than seven days.
+const MaxPresignExpiry = 7 * 24 * time.Hour
+
+// PresignS3Download returns a URL that lets anyone who has it GET the
+// object at key in bucket on S3 service ss until expiry passes. We
+// check that the object exists and can be read first, since S3 will
+// sign a URL for anything. Objects in Glacier and Deep Archive can't
+// be read until they're restored.
+func PresignS3Download(ss *core.StorageService, bucket, key string, expiry time.Duration) (*url.URL, error) {
+	if expiry < time.Second || expiry > MaxPresignExpiry {
+		return nil, fmt.Errorf("Links must expire in between one second and seven days.")
+	}
+	client, err := NewMinioClient(ss)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DiagnosticTimeout)
+	defer cancel()
+	objInfo, err := client.StatObject(ctx, bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Cannot find %s in bucket %s: %v", key, bucket, err)
+	}
+	if IsArchivedS3Object(objInfo) {
+		return nil, fmt.Errorf("%s is in %s and must be restored before it can be downloaded.", key, S3StorageClass(objInfo))
+	}
+	// Ask S3 to send the object as an attachment, so browsers
+	// save it instead of trying to display it.
+	params := url.Values{}
+	params.Set("response-content-disposition", fmt.Sprintf("attachment; filename=%q", path.Base(key)))
+	return client.PresignedGetObject(ctx, bucket, key, expiry, params)
+}
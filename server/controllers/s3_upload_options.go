@@ -0,0 +1,342 @@
+package controllers
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/gin-gonic/gin"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// Server-side encryption settings for S3 uploads. EncryptionNone lets
+// a workflow turn off encryption that its storage service turns on.
+const (
+	EncryptionNone   = "none"
+	EncryptionAES256 = "AES256"
+	EncryptionKMS    = "aws:kms"
+)
+
+// S3StorageClasses are the storage classes DART offers for S3 uploads.
+// Wasabi and most S3-compatible services accept only STANDARD.
+var S3StorageClasses = []string{
+	"STANDARD",
+	"STANDARD_IA",
+	"ONEZONE_IA",
+	"INTELLIGENT_TIERING",
+	"GLACIER_IR",
+	"GLACIER",
+	"DEEP_ARCHIVE",
+}
+
+// Limits S3 places on object tags and user metadata.
+const (
+	MaxS3ObjectTags      = 10
+	MaxS3TagKeyLength    = 128
+	MaxS3TagValueLength  = 256
+	MaxS3UserMetadataLen = 2048
+)
+
+var s3MetadataName = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// S3UploadOptions describe how DART stores bags on S3 services.
+// Tags and Metadata hold one Name=Value pair per line. Values may use
+// the same placeholders as key templates, so an object's tags and
+// metadata can come from the bag's tag values. Metadata names are sent
+// as x-amz-meta-* headers.
+type S3UploadOptions struct {
+	StorageClass string `json:"storageClass"`
+	Encryption   string `json:"encryption"`
+	KMSKeyID     string `json:"kmsKeyId"`
+	Tags         string `json:"tags"`
+	Metadata     string `json:"metadata"`
+}
+
+// IsEmpty returns true if these options don't change anything about
+// how DART Runner would upload a bag.
+func (opts S3UploadOptions) IsEmpty() bool {
+	return opts.StorageClass == "" &&
+		(opts.Encryption == "" || opts.Encryption == EncryptionNone) &&
+		strings.TrimSpace(opts.Tags) == "" &&
+		strings.TrimSpace(opts.Metadata) == ""
+}
+
+// Override returns a copy of opts with each setting that override
+// sets replaced by override's. Tags and metadata are replaced as
+// a whole, not merged.
+func (opts S3UploadOptions) Override(override S3UploadOptions) S3UploadOptions {
+	if override.StorageClass != "" {
+		opts.StorageClass = override.StorageClass
+	}
+	if override.Encryption != "" {
+		opts.Encryption = override.Encryption
+		opts.KMSKeyID = override.KMSKeyID
+	}
+	if strings.TrimSpace(override.Tags) != "" {
+		opts.Tags = override.Tags
+	}
+	if strings.TrimSpace(override.Metadata) != "" {
+		opts.Metadata = override.Metadata
+	}
+	return opts
+}
+
+// Validate returns a map of form field names to error messages. The
+// map is empty if the options are valid. Placeholders are checked
+// when the job runs, since their values depend on the job.
+func (opts S3UploadOptions) Validate() map[string]string {
+	errors := make(map[string]string)
+	if opts.StorageClass != "" && !isS3StorageClass(opts.StorageClass) {
+		errors["S3StorageClass"] = fmt.Sprintf("Unknown storage class %s.", opts.StorageClass)
+	}
+	switch opts.Encryption {
+	case "", EncryptionNone, EncryptionAES256:
+		if opts.KMSKeyID != "" {
+			errors["S3KMSKeyID"] = "A KMS key applies only to aws:kms encryption."
+		}
+	case EncryptionKMS:
+	default:
+		errors["S3Encryption"] = fmt.Sprintf("Unknown encryption setting %s.", opts.Encryption)
+	}
+	tags, err := parseNameValueLines(opts.Tags)
+	if err == nil {
+		err = checkS3Tags(tags)
+	}
+	if err != nil {
+		errors["S3Tags"] = err.Error()
+	}
+	metadata, err := parseNameValueLines(opts.Metadata)
+	if err == nil {
+		for name := range metadata {
+			if !s3MetadataName.MatchString(name) {
+				err = fmt.Errorf("Metadata name %q may contain only letters, digits and hyphens.", name)
+				break
+			}
+		}
+	}
+	if err != nil {
+		errors["S3Metadata"] = err.Error()
+	}
+	return errors
+}
+
+func isS3StorageClass(storageClass string) bool {
+	for _, sc := range S3StorageClasses {
+		if sc == storageClass {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNameValueLines parses text with one Name=Value pair per line.
+// Blank lines are ignored.
+func parseNameValueLines(text string) (map[string]string, error) {
+	pairs := make(map[string]string)
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		name, value, found := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !found || name == "" {
+			return nil, fmt.Errorf("Line %q should look like Name=Value.", line)
+		}
+		if _, exists := pairs[name]; exists {
+			return nil, fmt.Errorf("%s is listed more than once.", name)
+		}
+		pairs[name] = strings.TrimSpace(value)
+	}
+	return pairs, nil
+}
+
+func checkS3Tags(tags map[string]string) error {
+	if len(tags) > MaxS3ObjectTags {
+		return fmt.Errorf("S3 allows at most %d tags per object.", MaxS3ObjectTags)
+	}
+	for name, value := range tags {
+		if len(name) > MaxS3TagKeyLength {
+			return fmt.Errorf("Tag name %s is longer than %d characters.", name, MaxS3TagKeyLength)
+		}
+		if keyTemplatePlaceholder.MatchString(value) {
+			continue
+		}
+		if len(value) > MaxS3TagValueLength {
+			return fmt.Errorf("The value of tag %s is longer than %d characters.", name, MaxS3TagValueLength)
+		}
+	}
+	return nil
+}
+
+// S3UploadOptionsFor returns the S3 upload options for uploads to ss
+// in a job that belongs to the specified workflow: the service's
+// options, overridden by any the workflow sets.
+func S3UploadOptionsFor(workflowID string, ss *core.StorageService) S3UploadOptions {
+	opts := GetStorageServiceOptions(ss).S3
+	if workflowID != "" {
+		opts = opts.Override(GetWorkflowOptions(workflowID).S3)
+	}
+	return opts
+}
+
+// PutObjectOptions converts opts to minio's put options, filling
+// placeholders in tag and metadata values from lookup.
+func (opts S3UploadOptions) PutObjectOptions(lookup func(string) (string, bool)) (minio.PutObjectOptions, error) {
+	putOpts := minio.PutObjectOptions{
+		StorageClass: opts.StorageClass,
+	}
+	switch opts.Encryption {
+	case EncryptionAES256:
+		putOpts.ServerSideEncryption = encrypt.NewSSE()
+	case EncryptionKMS:
+		sse, err := encrypt.NewSSEKMS(opts.KMSKeyID, nil)
+		if err != nil {
+			return putOpts, err
+		}
+		putOpts.ServerSideEncryption = sse
+	}
+	tags, err := expandNameValueLines("Object tag", opts.Tags, lookup)
+	if err != nil {
+		return putOpts, err
+	}
+	if err = checkS3Tags(tags); err != nil {
+		return putOpts, err
+	}
+	metadata, err := expandNameValueLines("Object metadata", opts.Metadata, lookup)
+	if err != nil {
+		return putOpts, err
+	}
+	metadataLength := 0
+	for name, value := range metadata {
+		metadataLength += len("x-amz-meta-") + len(name) + len(value)
+	}
+	if metadataLength > MaxS3UserMetadataLen {
+		return putOpts, fmt.Errorf("Object metadata is %d bytes. S3 allows %d.", metadataLength, MaxS3UserMetadataLen)
+	}
+	if len(tags) > 0 {
+		putOpts.UserTags = tags
+	}
+	if len(metadata) > 0 {
+		putOpts.UserMetadata = metadata
+	}
+	return putOpts, nil
+}
+
+// expandNameValueLines parses Name=Value lines and fills the
+// placeholders in each value from lookup.
+func expandNameValueLines(description, text string, lookup func(string) (string, bool)) (map[string]string, error) {
+	pairs, err := parseNameValueLines(text)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range pairs {
+		expanded, err := expandPlaceholders(fmt.Sprintf("%s %s", description, name), value, lookup, nil)
+		if err != nil {
+			return nil, err
+		}
+		pairs[name] = expanded
+	}
+	return pairs, nil
+}
+
+// s3UploadSettings returns the minio put options for each S3 upload
+// operation in job that has S3 upload options. Other operations
+// are left to DART Runner.
+func s3UploadSettings(job *core.Job, lookup func(string) (string, bool)) (map[*core.UploadOperation]minio.PutObjectOptions, error) {
+	settings := make(map[*core.UploadOperation]minio.PutObjectOptions)
+	for _, op := range job.UploadOps {
+		if op.StorageService == nil || op.StorageService.Protocol != constants.ProtocolS3 {
+			continue
+		}
+		opts := S3UploadOptionsFor(job.WorkflowID, op.StorageService)
+		if opts.IsEmpty() {
+			continue
+		}
+		putOpts, err := opts.PutObjectOptions(lookup)
+		if err != nil {
+			return nil, fmt.Errorf("Upload options for %s: %v", op.StorageService.Name, err)
+		}
+		settings[op] = putOpts
+	}
+	return settings, nil
+}
+
+// S3UploadOptionsFromRequest reads S3 upload options from the fields
+// that AddS3UploadOptionFields adds to a form.
+func S3UploadOptionsFromRequest(c *gin.Context) S3UploadOptions {
+	return S3UploadOptions{
+		StorageClass: c.PostForm("S3StorageClass"),
+		Encryption:   c.PostForm("S3Encryption"),
+		KMSKeyID:     strings.TrimSpace(c.PostForm("S3KMSKeyID")),
+		Tags:         c.PostForm("S3Tags"),
+		Metadata:     c.PostForm("S3Metadata"),
+	}
+}
+
+// AddS3UploadOptionFields adds fields for opts to a storage service
+// or workflow form. On workflow forms, empty settings mean "use the
+// storage service's setting", which inheritLabel describes.
+func AddS3UploadOptionFields(form *core.Form, opts S3UploadOptions, inheritLabel string) {
+	storageClassField := form.AddField("S3StorageClass", "Storage Class", opts.StorageClass, false)
+	storageClassField.Choices = []core.Choice{
+		{Label: inheritLabel, Value: "", Selected: opts.StorageClass == ""},
+	}
+	for _, storageClass := range S3StorageClasses {
+		storageClassField.Choices = append(storageClassField.Choices, core.Choice{
+			Label:    storageClass,
+			Value:    storageClass,
+			Selected: opts.StorageClass == storageClass,
+		})
+	}
+	storageClassField.Help = "The S3 storage class for uploaded bags. AWS supports all of these. Wasabi and most other services support only STANDARD."
+
+	encryptionField := form.AddField("S3Encryption", "Server-Side Encryption", opts.Encryption, false)
+	encryptionField.Choices = []core.Choice{
+		{Label: inheritLabel, Value: "", Selected: opts.Encryption == ""},
+		{Label: "None", Value: EncryptionNone, Selected: opts.Encryption == EncryptionNone},
+		{Label: "S3-managed keys (AES256)", Value: EncryptionAES256, Selected: opts.Encryption == EncryptionAES256},
+		{Label: "KMS-managed keys (aws:kms)", Value: EncryptionKMS, Selected: opts.Encryption == EncryptionKMS},
+	}
+
+	kmsField := form.AddField("S3KMSKeyID", "KMS Key ID", opts.KMSKeyID, false)
+	kmsField.Help = "The ID or ARN of the KMS key for aws:kms encryption. Leave this empty to use the bucket's default key."
+
+	tagsField := form.AddField("S3Tags", "Object Tags", opts.Tags, false)
+	tagsField.Help = fmt.Sprintf("One Name=Value pair per line, up to %d. Values can use the same placeholders as key templates, such as Source=%s.", MaxS3ObjectTags, "{Source-Organization}")
+
+	metadataField := form.AddField("S3Metadata", "Object Metadata", opts.Metadata, false)
+	metadataField.Help = "One Name=Value pair per line, sent as x-amz-meta-Name headers. Values can use placeholders, such as Internal-Sender-Identifier={Internal-Sender-Identifier}."
+}
+
+// describeS3PutOptions returns a short description of putOpts for
+// job messages.
+func describeS3PutOptions(putOpts minio.PutObjectOptions) string {
+	parts := make([]string, 0)
+	if putOpts.StorageClass != "" {
+		parts = append(parts, "storage class "+putOpts.StorageClass)
+	}
+	if putOpts.ServerSideEncryption != nil {
+		parts = append(parts, "encryption "+string(putOpts.ServerSideEncryption.Type()))
+	}
+	if len(putOpts.UserTags) > 0 {
+		parts = append(parts, "tags "+strings.Join(sortedKeys(putOpts.UserTags), ", "))
+	}
+	if len(putOpts.UserMetadata) > 0 {
+		parts = append(parts, "metadata "+strings.Join(sortedKeys(putOpts.UserMetadata), ", "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,127 @@
+package controllers_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart/v3/server/controllers"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testTagLookup(name string) (string, bool) {
+	values := map[string]string{
+		"Source-Organization":        "Example University",
+		"Internal-Sender-Identifier": "coll-7/item-42",
+		"Empty-Tag":                  "",
+	}
+	value, ok := values[name]
+	return value, ok
+}
+
+func TestS3UploadOptionsValidate(t *testing.T) {
+	opts := controllers.S3UploadOptions{
+		StorageClass: "DEEP_ARCHIVE",
+		Encryption:   controllers.EncryptionKMS,
+		KMSKeyID:     "arn:aws:kms:us-east-1:111122223333:key/abcd",
+		Tags:         "Source={Source-Organization}\n\nRetention=permanent",
+		Metadata:     "Internal-Sender-Identifier={Internal-Sender-Identifier}",
+	}
+	assert.Empty(t, opts.Validate())
+
+	opts = controllers.S3UploadOptions{
+		StorageClass: "COLD",
+		Encryption:   controllers.EncryptionAES256,
+		KMSKeyID:     "some-key",
+		Tags:         "no equals sign",
+		Metadata:     "Bad Name=value",
+	}
+	errors := opts.Validate()
+	assert.Contains(t, errors["S3StorageClass"], "Unknown storage class COLD")
+	assert.Contains(t, errors["S3KMSKeyID"], "only to aws:kms")
+	assert.Contains(t, errors["S3Tags"], "should look like Name=Value")
+	assert.Contains(t, errors["S3Metadata"], "only letters, digits and hyphens")
+
+	opts = controllers.S3UploadOptions{
+		Tags: "A=1\nB=2\nC=3\nD=4\nE=5\nF=6\nG=7\nH=8\nI=9\nJ=10\nK=11",
+	}
+	assert.Contains(t, opts.Validate()["S3Tags"], "at most 10 tags")
+}
+
+func TestS3UploadOptionsOverride(t *testing.T) {
+	serviceOpts := controllers.S3UploadOptions{
+		StorageClass: "STANDARD_IA",
+		Encryption:   controllers.EncryptionKMS,
+		KMSKeyID:     "service-key",
+		Tags:         "Source={Source-Organization}",
+	}
+	assert.False(t, serviceOpts.IsEmpty())
+	assert.True(t, controllers.S3UploadOptions{Encryption: controllers.EncryptionNone}.IsEmpty())
+
+	// Empty workflow settings leave the service's alone.
+	assert.Equal(t, serviceOpts, serviceOpts.Override(controllers.S3UploadOptions{}))
+
+	merged := serviceOpts.Override(controllers.S3UploadOptions{
+		StorageClass: "GLACIER",
+		Encryption:   controllers.EncryptionNone,
+		Metadata:     "Workflow=nightly",
+	})
+	assert.Equal(t, "GLACIER", merged.StorageClass)
+	assert.Equal(t, controllers.EncryptionNone, merged.Encryption)
+	assert.Empty(t, merged.KMSKeyID)
+	assert.Equal(t, serviceOpts.Tags, merged.Tags)
+	assert.Equal(t, "Workflow=nightly", merged.Metadata)
+}
+
+func TestS3PutObjectOptions(t *testing.T) {
+	opts := controllers.S3UploadOptions{
+		StorageClass: "GLACIER",
+		Encryption:   controllers.EncryptionAES256,
+		Tags:         "Source={Source-Organization}",
+		Metadata:     "Internal-Sender-Identifier={Internal-Sender-Identifier}",
+	}
+	putOpts, err := opts.PutObjectOptions(testTagLookup)
+	require.NoError(t, err)
+	assert.Equal(t, "GLACIER", putOpts.StorageClass)
+	require.NotNil(t, putOpts.ServerSideEncryption)
+	assert.Equal(t, encrypt.S3, putOpts.ServerSideEncryption.Type())
+	assert.Equal(t, map[string]string{"Source": "Example University"}, putOpts.UserTags)
+	assert.Equal(t, map[string]string{"Internal-Sender-Identifier": "coll-7/item-42"}, putOpts.UserMetadata)
+
+	opts.Tags = "Empty={Empty-Tag}"
+	_, err = opts.PutObjectOptions(testTagLookup)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Object tag Empty refers to {Empty-Tag}, which has no value")
+}
+
+func TestUploadToS3WithOptions(t *testing.T) {
+	defer core.ClearDartTable()
+	ss := loadMinioStorageService(t)
+	tarFile := filepath.Join(t.TempDir(), "bag.tar")
+	require.NoError(t, os.WriteFile(tarFile, []byte("Bag contents"), 0644))
+
+	putOpts, err := controllers.S3UploadOptions{
+		Tags:     "Source={Source-Organization}",
+		Metadata: "Internal-Sender-Identifier={Internal-Sender-Identifier}",
+	}.PutObjectOptions(testTagLookup)
+	require.NoError(t, err)
+	key := "Example University/bag.tar"
+	_, err = controllers.UploadToS3WithOptions(ss, tarFile, key, putOpts)
+	require.NoError(t, err)
+
+	client, err := controllers.NewMinioClient(ss)
+	require.NoError(t, err)
+	ctx := context.Background()
+	defer client.RemoveObject(ctx, ss.Bucket, key, minio.RemoveObjectOptions{})
+	objInfo, err := client.StatObject(ctx, ss.Bucket, key, minio.StatObjectOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "coll-7/item-42", objInfo.UserMetadata["Internal-Sender-Identifier"])
+	tags, err := client.GetObjectTagging(ctx, ss.Bucket, key, minio.GetObjectTaggingOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"Source": "Example University"}, tags.ToMap())
+}
@@ -128,13 +128,17 @@ func SettingsExportShowJson(c *gin.Context) {
 		AbortWithErrorHTML(c, http.StatusNotFound, err)
 		return
 	}
+	// Encrypted secrets can't be decrypted on another machine,
+	// so we leave them out and ask the user to re-enter them.
+	strippedSecrets := StripEncryptedSecrets(exportSettings)
 	jsonData, err := json.MarshalIndent(exportSettings, "", "  ")
 	if err != nil {
 		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
 		return
 	}
-	displayPasswordWarning := exportSettings.ContainsPlaintextPassword()
-	displayTokenWarning := exportSettings.ContainsPlaintextAPIToken()
+	// Credential references such as env:VAR_NAME are safe to share.
+	displayPasswordWarning := ExportContainsPlaintextPassword(exportSettings)
+	displayTokenWarning := ExportContainsPlaintextAPIToken(exportSettings)
 	displayPlainTextWarning := "none"
 	if displayPasswordWarning || displayTokenWarning {
 		displayPlainTextWarning = "block"
@@ -145,6 +149,8 @@ func SettingsExportShowJson(c *gin.Context) {
 		"displayPasswordWarning":  displayPasswordWarning,
 		"displayTokenWarning":     displayTokenWarning,
 		"displayPlaintextWarning": displayPlainTextWarning,
+		"strippedSecrets":         strippedSecrets,
+		"secretPlaceholder":       EncryptedSecretPlaceholder,
 		"helpUrl":                 GetHelpUrl(c),
 	}
 	c.HTML(http.StatusOK, "settings/export_result.html", data)
@@ -0,0 +1,442 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/APTrust/dart-runner/core"
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// DirectoryContentType is the content type we assign to directories
+// when listing SFTP services in the download browser, so the front
+// end knows to render them as folders instead of downloadable files.
+const DirectoryContentType = "inode/directory"
+
+// SFTPConnection wraps an SFTP client along with the SSH connection
+// beneath it, so callers can close both with a single call.
+type SFTPConnection struct {
+	*sftp.Client
+	sshClient *ssh.Client
+}
+
+// Close closes the SFTP session and the underlying SSH connection.
+func (conn *SFTPConnection) Close() error {
+	conn.Client.Close()
+	return conn.sshClient.Close()
+}
+
+// RemoteSHA256 asks the server to compute the SHA-256 checksum of
+// remotePath by running sha256sum, or shasum on systems without it,
+// over SSH. This fails on servers that allow only SFTP, which is
+// common, so callers should treat an error as "checksum unavailable".
+func (conn *SFTPConnection) RemoteSHA256(remotePath string) (string, error) {
+	quotedPath := "'" + strings.ReplaceAll(remotePath, "'", `'\''`) + "'"
+	var lastErr error
+	for _, command := range []string{"sha256sum -- ", "shasum -a 256 -- "} {
+		session, err := conn.sshClient.NewSession()
+		if err != nil {
+			return "", err
+		}
+		output, err := session.Output(command + quotedPath)
+		session.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		fields := strings.Fields(string(output))
+		if len(fields) > 0 && len(fields[0]) == 64 {
+			return strings.ToLower(fields[0]), nil
+		}
+		lastErr = fmt.Errorf("unexpected output from %s", strings.Fields(command)[0])
+	}
+	return "", lastErr
+}
+
+// NewSFTPConnection connects to the SFTP server described by ss.
+// If ss.LoginExtra is set, it should be the path to a private key,
+// which we use for public key authentication. If ss.Password is set,
+// we try password authentication as well. Credential references in
+// the login and password are resolved before connecting.
+func NewSFTPConnection(ss *core.StorageService) (*SFTPConnection, error) {
+	if ss == nil {
+		return nil, fmt.Errorf("Storage service is nil")
+	}
+	ss, err := ResolveStorageServiceCredentials(ss)
+	if err != nil {
+		return nil, err
+	}
+	authMethods := make([]ssh.AuthMethod, 0)
+	if ss.LoginExtra != "" {
+		keyBytes, err := os.ReadFile(ss.LoginExtra)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read private key %s: %v", ss.LoginExtra, err)
+		}
+		signer, err := ssh.ParsePrivateKey(keyBytes)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot parse private key %s: %v", ss.LoginExtra, err)
+		}
+		authMethods = append(authMethods, ssh.PublicKeys(signer))
+	}
+	if ss.Password != "" {
+		authMethods = append(authMethods, ssh.Password(ss.Password))
+	}
+	port := ss.Port
+	if port == 0 {
+		port = 22
+	}
+	config := &ssh.ClientConfig{
+		User:            ss.Login,
+		Auth:            authMethods,
+		HostKeyCallback: SFTPHostKeyCallback(GetStorageServiceOptions(ss), DefaultKnownHostsFiles()),
+		Timeout:         30 * time.Second,
+	}
+	sshClient, err := ssh.Dial("tcp", net.JoinHostPort(ss.Host, strconv.Itoa(port)), config)
+	if err != nil {
+		return nil, err
+	}
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, err
+	}
+	return &SFTPConnection{Client: sftpClient, sshClient: sshClient}, nil
+}
+
+// SFTPHostKeyCallback returns a callback that accepts the server's
+// host key only if it matches the fingerprint pinned in opts, or, if
+// no fingerprint is pinned, a key listed for the host in one of the
+// knownHostsFiles. Otherwise the connection fails with an error that
+// includes the key's fingerprint, so the user can check it with the
+// server's administrator and pin it on the storage service.
+func SFTPHostKeyCallback(opts *StorageServiceOptions, knownHostsFiles []string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		fingerprint := ssh.FingerprintSHA256(key)
+		if opts.SFTPHostKey != "" {
+			if fingerprint == opts.SFTPHostKey {
+				return nil
+			}
+			return fmt.Errorf("The host key for %s does not match the fingerprint pinned on this storage service. Expected %s but the server sent %s. If the server's key changed on purpose, update the SFTP Host Key Fingerprint setting.", hostname, opts.SFTPHostKey, fingerprint)
+		}
+		if len(knownHostsFiles) > 0 {
+			callback, err := knownhosts.New(knownHostsFiles...)
+			if err != nil {
+				return fmt.Errorf("Cannot read known_hosts: %v", err)
+			}
+			err = callback(hostname, remote, key)
+			var keyErr *knownhosts.KeyError
+			if err == nil || !errors.As(err, &keyErr) || len(keyErr.Want) > 0 {
+				return err
+			}
+		}
+		return fmt.Errorf("DART cannot verify the host key for %s, because it isn't in known_hosts and no fingerprint is pinned on this storage service. The server's key fingerprint is %s. Check it with the server's administrator, then enter it in the SFTP Host Key Fingerprint setting.", hostname, fingerprint)
+	}
+}
+
+// DefaultKnownHostsFiles returns the paths of the user's known_hosts
+// files that exist. OpenSSH keeps them in ~/.ssh on every platform.
+func DefaultKnownHostsFiles() []string {
+	files := make([]string, 0)
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return files
+	}
+	for _, name := range []string{"known_hosts", "known_hosts2"} {
+		knownHostsFile := filepath.Join(homeDir, ".ssh", name)
+		if _, err := os.Stat(knownHostsFile); err == nil {
+			files = append(files, knownHostsFile)
+		}
+	}
+	return files
+}
+
+// SFTPRemotePath returns the path on the SFTP server of the file
+// whose key is relative to bucket. For SFTP services, the bucket is
+// a directory, usually relative to the user's home directory.
+func SFTPRemotePath(bucket, key string) (string, error) {
+	if err := checkKeySegments(key); err != nil {
+		return "", err
+	}
+	remotePath := path.Join(bucket, key)
+	if remotePath == "" {
+		remotePath = "."
+	}
+	return remotePath, nil
+}
+
+// ListSFTPDirectory lists the contents of directory, which is relative
+// to bucket, in the same form the download browser uses for S3 objects.
+// Keys are relative to bucket. Directories have keys ending in a slash
+// and DirectoryContentType as their content type. Symlinks and other
+// special files are skipped.
+//
+// Entries are sorted by key. Listing starts after the key startAfter
+// and returns at most maxKeys entries. The boolean return value is
+// true if there are more entries after the last one returned.
+func ListSFTPDirectory(ss *core.StorageService, bucket, directory, startAfter string, maxKeys int) ([]minio.ObjectInfo, bool, error) {
+	objects := make([]minio.ObjectInfo, 0)
+	remoteDir, err := SFTPRemotePath(bucket, directory)
+	if err != nil {
+		return objects, false, err
+	}
+	conn, err := NewSFTPConnection(ss)
+	if err != nil {
+		return objects, false, err
+	}
+	defer conn.Close()
+	entries, err := conn.ReadDir(remoteDir)
+	if err != nil {
+		return objects, false, err
+	}
+	for _, entry := range entries {
+		key := path.Join(directory, entry.Name())
+		obj := minio.ObjectInfo{
+			Key:          key,
+			Size:         entry.Size(),
+			LastModified: entry.ModTime(),
+		}
+		if entry.IsDir() {
+			obj.Key = key + "/"
+			obj.Size = 0
+			obj.ContentType = DirectoryContentType
+		} else if !entry.Mode().IsRegular() {
+			continue
+		}
+		objects = append(objects, obj)
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	objects, hasMore := pageObjects(objects, startAfter, maxKeys)
+	return objects, hasMore, nil
+}
+
+// checkKeySegments returns an error if key contains a ".." segment,
+// which could reach outside of the bucket directory.
+func checkKeySegments(key string) error {
+	for _, segment := range strings.Split(key, "/") {
+		if segment == ".." {
+			return fmt.Errorf("Key %s contains illegal path segment '..'", key)
+		}
+	}
+	return nil
+}
+
+// pageObjects returns up to maxKeys of the sorted objects, starting
+// after the key startAfter, and whether any objects are left over.
+func pageObjects(objects []minio.ObjectInfo, startAfter string, maxKeys int) ([]minio.ObjectInfo, bool) {
+	if startAfter != "" {
+		index := sort.Search(len(objects), func(i int) bool {
+			return objects[i].Key > startAfter
+		})
+		objects = objects[index:]
+	}
+	hasMore := len(objects) > maxKeys
+	if hasMore {
+		objects = objects[:maxKeys]
+	}
+	return objects, hasMore
+}
+
+// GetSFTPDownloadFile opens the SFTP file with the specified key for
+// reading. Closing the returned ReadCloser also closes the connection.
+func GetSFTPDownloadFile(ssid, bucket, key string) (io.ReadCloser, error) {
+	ss := core.ObjFind(ssid).StorageService()
+	if ss == nil {
+		return nil, fmt.Errorf("No such storage service: %s", ssid)
+	}
+	remotePath, err := SFTPRemotePath(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := NewSFTPConnection(ss)
+	if err != nil {
+		return nil, err
+	}
+	file, err := conn.Open(remotePath)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &sftpReadCloser{File: file, conn: conn}, nil
+}
+
+// SFTPFileETag returns a stand-in for an S3 ETag for a file on an
+// SFTP server. It changes whenever the file's size or modification
+// time changes, which is the best we can do without reading the file.
+func SFTPFileETag(fileInfo os.FileInfo) string {
+	return fmt.Sprintf("%d-%d", fileInfo.Size(), fileInfo.ModTime().Unix())
+}
+
+type sftpReadCloser struct {
+	*sftp.File
+	conn *SFTPConnection
+}
+
+func (rc *sftpReadCloser) Close() error {
+	rc.File.Close()
+	return rc.conn.Close()
+}
+
+// DownloadSFTPFileToFile downloads a file from an SFTP service to
+// localPath and returns the number of bytes written during this call.
+// Like DownloadS3ObjectToFile, it writes to a partial file first and
+// resumes interrupted downloads. SFTP has no ETags, so we use
+// SFTPFileETag to tell whether the remote file has changed since
+// the partial download began.
+func DownloadSFTPFileToFile(ssid, bucket, key, localPath string) (int64, error) {
+	ss := core.ObjFind(ssid).StorageService()
+	if ss == nil {
+		return 0, fmt.Errorf("No such storage service: %s", ssid)
+	}
+	remotePath, err := SFTPRemotePath(bucket, key)
+	if err != nil {
+		return 0, err
+	}
+	conn, err := NewSFTPConnection(ss)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	remoteFile, err := conn.Open(remotePath)
+	if err != nil {
+		return 0, err
+	}
+	defer remoteFile.Close()
+	stat, err := remoteFile.Stat()
+	if err != nil {
+		return 0, err
+	}
+	objInfo := minio.ObjectInfo{
+		Key:  key,
+		Size: stat.Size(),
+		ETag: SFTPFileETag(stat),
+	}
+
+	partialFile := localPath + PartialDownloadSuffix
+	etagFile := partialFile + ".etag"
+	offset := resumeOffset(partialFile, etagFile, objInfo)
+	if err = os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return 0, err
+	}
+	if err = os.WriteFile(etagFile, []byte(objInfo.ETag), 0644); err != nil {
+		return 0, err
+	}
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		core.Dart.Log.Infof("Resuming download of %s at byte %d of %d", remotePath, offset, objInfo.Size)
+	}
+	if _, err = remoteFile.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	localFile, err := os.OpenFile(partialFile, flags, 0644)
+	if err != nil {
+		return 0, err
+	}
+	bytesWritten, err := io.Copy(localFile, remoteFile)
+	if err == nil {
+		err = localFile.Sync()
+	}
+	localFile.Close()
+	if err != nil {
+		return bytesWritten, err
+	}
+	return bytesWritten, finishPartialDownload(partialFile, etagFile, localPath, objInfo.Size)
+}
+
+// SFTPUploadProvider identifies SFTP uploads that DART runs itself,
+// rather than DART Runner, in an upload operation's result.
+const SFTPUploadProvider = "DART SFTP uploader"
+
+// UploadToSFTP uploads the file or directory at sourcePath to the
+// bucket directory of SFTP service ss under key, creating any
+// directories the key names, and returns the remote path. Each file
+// is written under a temporary name and renamed once it's complete,
+// so readers never see a partial file under its real name. We use
+// this instead of DART Runner when a key template applies.
+func UploadToSFTP(ss *core.StorageService, sourcePath, key string) (string, error) {
+	remotePath, err := SFTPRemotePath(ss.Bucket, key)
+	if err != nil {
+		return "", err
+	}
+	sourceInfo, err := os.Stat(sourcePath)
+	if err != nil {
+		return "", err
+	}
+	conn, err := NewSFTPConnection(ss)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if !sourceInfo.IsDir() {
+		return remotePath, uploadFileToSFTP(conn, sourcePath, remotePath)
+	}
+	err = filepath.WalkDir(sourcePath, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+		relPath, err := filepath.Rel(sourcePath, filePath)
+		if err != nil {
+			return err
+		}
+		return uploadFileToSFTP(conn, filePath, path.Join(remotePath, filepath.ToSlash(relPath)))
+	})
+	return remotePath, err
+}
+
+func uploadFileToSFTP(conn *SFTPConnection, sourcePath, remotePath string) error {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	return writeSFTPFile(conn, source, remotePath)
+}
+
+// writeSFTPFile copies everything from source to remotePath, creating
+// any directories it names. Like uploadFileToSFTP, it writes under a
+// temporary name and renames the file once it's complete.
+func writeSFTPFile(conn *SFTPConnection, source io.Reader, remotePath string) error {
+	if err := conn.MkdirAll(path.Dir(remotePath)); err != nil {
+		return err
+	}
+	tempPath := path.Join(path.Dir(remotePath), fmt.Sprintf(".%s.dart-tmp-%s", path.Base(remotePath), uuid.NewString()))
+	target, err := conn.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(target, source)
+	closeErr := target.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// Plain SFTP rename fails if the target exists,
+		// so we remove any earlier upload first.
+		if _, statErr := conn.Stat(remotePath); statErr == nil {
+			err = conn.Remove(remotePath)
+		}
+	}
+	if err == nil {
+		err = conn.Rename(tempPath, remotePath)
+	}
+	if err != nil {
+		conn.Remove(tempPath)
+	}
+	return err
+}
@@ -0,0 +1,208 @@
+package controllers_test
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart-runner/util"
+	"github.com/APTrust/dart/v3/server/controllers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// NOTE: These tests assume that the local SFTP server is running.
+//
+// If you run the full test suite using `./scripts/run.sh tests`, the
+// script will start the SFTP server for you.
+
+const sftpTestDir = "sftp-download-test"
+
+func TestSFTPRemotePath(t *testing.T) {
+	remotePath, err := controllers.SFTPRemotePath("uploads", "a/b/bag.tar")
+	require.NoError(t, err)
+	assert.Equal(t, "uploads/a/b/bag.tar", remotePath)
+
+	remotePath, err = controllers.SFTPRemotePath("", "")
+	require.NoError(t, err)
+	assert.Equal(t, ".", remotePath)
+
+	_, err = controllers.SFTPRemotePath("uploads", "../../etc/passwd")
+	assert.Error(t, err)
+}
+
+func TestSFTPHostKeyCallback(t *testing.T) {
+	key := loadSFTPHostKey(t)
+	fingerprint := ssh.FingerprintSHA256(key)
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2222}
+
+	// Pinned fingerprint must match.
+	opts := &controllers.StorageServiceOptions{SFTPHostKey: fingerprint}
+	assert.NoError(t, controllers.SFTPHostKeyCallback(opts, nil)("localhost:2222", addr, key))
+	opts.SFTPHostKey = "SHA256:uJ0xC3m5ThtBdObwhNBgVPTjSNUrDnV3xMyDa5ASIfo"
+	err := controllers.SFTPHostKeyCallback(opts, nil)("localhost:2222", addr, key)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "does not match")
+
+	// With no pin and no known_hosts entry, the error
+	// tells the user which fingerprint to check.
+	opts.SFTPHostKey = ""
+	err = controllers.SFTPHostKeyCallback(opts, nil)("localhost:2222", addr, key)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), fingerprint)
+
+	// Keys listed in known_hosts are accepted.
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	require.NoError(t, os.WriteFile(knownHosts, []byte(knownhosts.Line([]string{"[localhost]:2222"}, key)+"\n"), 0600))
+	assert.NoError(t, controllers.SFTPHostKeyCallback(opts, []string{knownHosts})("localhost:2222", addr, key))
+	err = controllers.SFTPHostKeyCallback(opts, []string{knownHosts})("otherhost:22", addr, key)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), fingerprint)
+
+	// Fingerprints must look like the ones ssh-keygen prints.
+	opts.SFTPHostKey = "Yt+MqzxZXehVd89qJxNmZxInCF4VYSSDQMIk+s3uZg4"
+	assert.Contains(t, opts.Validate(), "SFTPHostKey")
+	opts.SFTPHostKey = fingerprint
+	assert.NotContains(t, opts.Validate(), "SFTPHostKey")
+}
+
+func TestListSFTPDirectory(t *testing.T) {
+	defer core.ClearDartTable()
+	ss := loadSFTPStorageService(t)
+	putSFTPTestFiles(t, ss)
+
+	objects, hasMore, err := controllers.ListSFTPDirectory(ss, ss.Bucket, sftpTestDir, "", 2)
+	require.NoError(t, err)
+	assert.True(t, hasMore)
+	require.Equal(t, 2, len(objects))
+	assert.Equal(t, sftpTestDir+"/a.txt", objects[0].Key)
+	assert.Equal(t, int64(len("File a")), objects[0].Size)
+	assert.Equal(t, sftpTestDir+"/b.txt", objects[1].Key)
+
+	// Second page should contain only the subdirectory.
+	objects, hasMore, err = controllers.ListSFTPDirectory(ss, ss.Bucket, sftpTestDir, objects[1].Key, 2)
+	require.NoError(t, err)
+	assert.False(t, hasMore)
+	require.Equal(t, 1, len(objects))
+	assert.Equal(t, sftpTestDir+"/sub/", objects[0].Key)
+	assert.Equal(t, controllers.DirectoryContentType, objects[0].ContentType)
+
+	objects, _, err = controllers.ListSFTPDirectory(ss, ss.Bucket, sftpTestDir+"/sub", "", 200)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(objects))
+	assert.Equal(t, sftpTestDir+"/sub/c.txt", objects[0].Key)
+}
+
+func TestDownloadJobBrowseSFTP(t *testing.T) {
+	defer core.ClearDartTable()
+	ss := loadSFTPStorageService(t)
+	putSFTPTestFiles(t, ss)
+
+	params := url.Values{}
+	params.Set("ssid", ss.ID)
+	params.Set("originalSource", ss.ID)
+	params.Set("bucket", ss.Bucket)
+	params.Set("originalBucket", ss.Bucket)
+	params.Set("directory", sftpTestDir)
+	html := PostUrl(t, PostTestSettings{
+		EndpointUrl:          "/download_jobs/browse",
+		Params:               params,
+		ExpectedResponseCode: http.StatusOK,
+	})
+	assert.Contains(t, html, "Directory")
+	assert.Contains(t, html, "Up one level")
+	assert.Contains(t, html, sftpTestDir+"/a.txt")
+	assert.Contains(t, html, sftpTestDir+"/b.txt")
+	assert.Contains(t, html, `class="directory-link" data-directory="`+sftpTestDir+`/sub/"`)
+}
+
+func TestDownloadSFTPFileToFileResume(t *testing.T) {
+	defer core.ClearDartTable()
+	ss := loadSFTPStorageService(t)
+	conn, err := controllers.NewSFTPConnection(ss)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	content := []byte(strings.Repeat("0123456789", 10000))
+	key := sftpTestDir + "/object.bin"
+	putSFTPFile(t, conn, path.Join(ss.Bucket, key), content)
+
+	// Start with a partial download and the right "ETag",
+	// which for SFTP is size plus modification time.
+	stat, err := conn.Stat(path.Join(ss.Bucket, key))
+	require.NoError(t, err)
+	localPath := filepath.Join(t.TempDir(), "object.bin")
+	partialFile := localPath + controllers.PartialDownloadSuffix
+	require.NoError(t, os.WriteFile(partialFile, content[:len(content)/2], 0644))
+	require.NoError(t, os.WriteFile(partialFile+".etag", []byte(controllers.SFTPFileETag(stat)), 0644))
+
+	bytesWritten, err := controllers.DownloadToFile(ss.ID, ss.Bucket, key, localPath)
+	require.NoError(t, err)
+	assert.EqualValues(t, len(content)-len(content)/2, bytesWritten)
+	downloaded, err := os.ReadFile(localPath)
+	require.NoError(t, err)
+	assert.Equal(t, content, downloaded)
+	assert.False(t, util.FileExists(partialFile))
+
+	// Browser downloads go through GetDownloadFile.
+	reader, err := controllers.GetDownloadFile(ss.ID, ss.Bucket, key)
+	require.NoError(t, err)
+	defer reader.Close()
+	buf := make([]byte, 10)
+	_, err = reader.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(buf))
+}
+
+func loadSFTPStorageService(t *testing.T) *core.StorageService {
+	ss, err := core.LoadStorageServiceFixture("storage_service_local_sftp.json")
+	require.NoError(t, err)
+	require.NotNil(t, ss)
+	ss.AllowsDownload = true
+	require.NoError(t, core.ObjSave(ss))
+	pinSFTPHostKey(t, ss)
+	return ss
+}
+
+// pinSFTPHostKey pins the fingerprint of the local SFTP server's
+// host key on ss. scripts/run.sh starts the server with this key.
+func pinSFTPHostKey(t *testing.T, ss *core.StorageService) {
+	opts := controllers.GetStorageServiceOptions(ss)
+	opts.SFTPHostKey = ssh.FingerprintSHA256(loadSFTPHostKey(t))
+	require.NoError(t, controllers.SaveStorageServiceOptions(opts))
+}
+
+func loadSFTPHostKey(t *testing.T) ssh.PublicKey {
+	data, err := os.ReadFile(filepath.Join(util.PathToTestData(), "sftp", "sftp_host_key.pub"))
+	require.NoError(t, err)
+	key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	require.NoError(t, err)
+	return key
+}
+
+func putSFTPTestFiles(t *testing.T, ss *core.StorageService) {
+	conn, err := controllers.NewSFTPConnection(ss)
+	require.NoError(t, err)
+	defer conn.Close()
+	root := path.Join(ss.Bucket, sftpTestDir)
+	putSFTPFile(t, conn, path.Join(root, "a.txt"), []byte("File a"))
+	putSFTPFile(t, conn, path.Join(root, "b.txt"), []byte("File b"))
+	putSFTPFile(t, conn, path.Join(root, "sub", "c.txt"), []byte("File c"))
+}
+
+func putSFTPFile(t *testing.T, conn *controllers.SFTPConnection, remotePath string, content []byte) {
+	require.NoError(t, conn.MkdirAll(path.Dir(remotePath)))
+	file, err := conn.Create(remotePath)
+	require.NoError(t, err)
+	defer file.Close()
+	_, err = file.Write(content)
+	require.NoError(t, err)
+}
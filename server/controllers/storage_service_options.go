@@ -0,0 +1,304 @@
+package controllers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/APTrust/dart-runner/core"
+	"github.com/gin-gonic/gin"
+	"github.com/minio/minio-go/v7"
+)
+
+// Bucket lookup styles for S3 services. Path style puts the bucket
+// name in the URL path (https://host/bucket/key), which is what most
+// MinIO installations expect. Virtual-host style puts it in the host
+// name (https://bucket.host/key), which AWS prefers.
+const (
+	BucketLookupAuto        = "auto"
+	BucketLookupPath        = "path"
+	BucketLookupVirtualHost = "virtual-host"
+)
+
+// StorageServiceOptions holds connection settings for a storage
+// service that core.StorageService has no fields for. We keep them
+// in a separate store, keyed by storage service ID.
+type StorageServiceOptions struct {
+	StorageServiceID string `json:"storageServiceId"`
+	// UseTLS says whether to connect to S3 services over HTTPS.
+	UseTLS bool `json:"useTLS"`
+	// CABundle is the path to a PEM file of CA certificates to trust
+	// in addition to the system's. Use this for endpoints whose
+	// certificates are signed by a private CA.
+	CABundle string `json:"caBundle"`
+	// ClientCert and ClientKey are paths to the PEM-encoded
+	// certificate and private key we present to services that
+	// require mutual TLS.
+	ClientCert   string `json:"clientCert"`
+	ClientKey    string `json:"clientKey"`
+	BucketLookup string `json:"bucketLookup"`
+	// KeyTemplate, if set, says where to put bags in the bucket.
+	// See CheckKeyTemplate.
+	KeyTemplate string `json:"keyTemplate"`
+	// S3 holds storage class, encryption, tag and metadata
+	// settings for uploads to S3 services.
+	S3 S3UploadOptions `json:"s3"`
+	// SFTPHostKey is the SHA256 fingerprint of the SFTP server's host
+	// key, as ssh-keygen -lf prints it, e.g. "SHA256:uJ0x...". If it's
+	// empty, we check the host key against the user's known_hosts.
+	// See SFTPHostKeyCallback.
+	SFTPHostKey string `json:"sftpHostKey"`
+}
+
+var storageServiceOptionsStore = NewJSONStore[StorageServiceOptions]("storage_service_options.json")
+
+// sftpFingerprint matches SHA256 key fingerprints, which are 32 bytes
+// in unpadded base64.
+var sftpFingerprint = regexp.MustCompile(`^SHA256:[A-Za-z0-9+/]{43}$`)
+
+// DefaultStorageServiceOptions returns the options we use for services
+// whose options haven't been saved yet. Before these options existed,
+// DART used TLS for every host other than localhost, so we default to
+// that to keep existing services working.
+func DefaultStorageServiceOptions(ss *core.StorageService) *StorageServiceOptions {
+	return &StorageServiceOptions{
+		StorageServiceID: ss.ID,
+		UseTLS:           ss.Host != "localhost" && ss.Host != "127.0.0.1",
+		BucketLookup:     BucketLookupAuto,
+	}
+}
+
+// GetStorageServiceOptions returns the saved options for ss, or the
+// default options if none have been saved.
+func GetStorageServiceOptions(ss *core.StorageService) *StorageServiceOptions {
+	allOptions, err := storageServiceOptionsStore.Load()
+	if err != nil {
+		core.Dart.Log.Errorf("Cannot load storage service options: %v", err)
+	}
+	for i := range allOptions {
+		if allOptions[i].StorageServiceID == ss.ID {
+			return &allOptions[i]
+		}
+	}
+	return DefaultStorageServiceOptions(ss)
+}
+
+// SaveStorageServiceOptions saves opts, replacing any
+// options previously saved for the same storage service.
+func SaveStorageServiceOptions(opts *StorageServiceOptions) error {
+	return storageServiceOptionsStore.Update(func(allOptions []StorageServiceOptions) ([]StorageServiceOptions, error) {
+		for i := range allOptions {
+			if allOptions[i].StorageServiceID == opts.StorageServiceID {
+				allOptions[i] = *opts
+				return allOptions, nil
+			}
+		}
+		return append(allOptions, *opts), nil
+	})
+}
+
+// DeleteStorageServiceOptions deletes the options for the
+// storage service with the specified ID, if there are any.
+func DeleteStorageServiceOptions(storageServiceID string) error {
+	return storageServiceOptionsStore.Update(func(allOptions []StorageServiceOptions) ([]StorageServiceOptions, error) {
+		kept := make([]StorageServiceOptions, 0, len(allOptions))
+		for _, opts := range allOptions {
+			if opts.StorageServiceID != storageServiceID {
+				kept = append(kept, opts)
+			}
+		}
+		return kept, nil
+	})
+}
+
+// StorageServiceOptionsFromRequest reads options for ss from the
+// fields that AddStorageServiceOptionFields adds to the storage service
+// form. If the request has no UseTLS field, we fall back to the default.
+func StorageServiceOptionsFromRequest(c *gin.Context, ss *core.StorageService) *StorageServiceOptions {
+	opts := DefaultStorageServiceOptions(ss)
+	if useTLS, err := strconv.ParseBool(c.PostForm("UseTLS")); err == nil {
+		opts.UseTLS = useTLS
+	}
+	opts.CABundle = c.PostForm("CABundle")
+	opts.ClientCert = c.PostForm("ClientCert")
+	opts.ClientKey = c.PostForm("ClientKey")
+	if lookup := c.PostForm("BucketLookup"); lookup != "" {
+		opts.BucketLookup = lookup
+	}
+	opts.KeyTemplate = c.PostForm("KeyTemplate")
+	opts.S3 = S3UploadOptionsFromRequest(c)
+	opts.SFTPHostKey = strings.TrimSpace(c.PostForm("SFTPHostKey"))
+	return opts
+}
+
+// Validate returns a map of field names to error messages. The map
+// is empty if the options are valid.
+func (opts *StorageServiceOptions) Validate() map[string]string {
+	errors := make(map[string]string)
+	for fieldName, filePath := range map[string]string{
+		"CABundle":   opts.CABundle,
+		"ClientCert": opts.ClientCert,
+		"ClientKey":  opts.ClientKey,
+	} {
+		if filePath == "" {
+			continue
+		}
+		if _, err := os.Stat(filePath); err != nil {
+			errors[fieldName] = fmt.Sprintf("Cannot read file %s.", filePath)
+		}
+	}
+	if (opts.ClientCert == "") != (opts.ClientKey == "") {
+		errors["ClientKey"] = "Client certificate and client key must be specified together."
+	}
+	switch opts.BucketLookup {
+	case BucketLookupAuto, BucketLookupPath, BucketLookupVirtualHost, "":
+	default:
+		errors["BucketLookup"] = fmt.Sprintf("Invalid bucket addressing style: %s.", opts.BucketLookup)
+	}
+	if err := CheckKeyTemplate(opts.KeyTemplate); err != nil {
+		errors["KeyTemplate"] = err.Error()
+	}
+	if opts.SFTPHostKey != "" && !sftpFingerprint.MatchString(opts.SFTPHostKey) {
+		errors["SFTPHostKey"] = "Enter the fingerprint in the form ssh-keygen -lf prints it, starting with SHA256:"
+	}
+	for fieldName, message := range opts.S3.Validate() {
+		errors[fieldName] = message
+	}
+	if len(errors) == 0 && (opts.CABundle != "" || opts.ClientCert != "") {
+		if _, err := opts.TLSConfig(); err != nil {
+			errors["CABundle"] = err.Error()
+		}
+	}
+	return errors
+}
+
+// UsesCustomTLS returns true if these options specify a CA bundle
+// or client certificate, which means the default TLS configuration
+// won't do.
+func (opts *StorageServiceOptions) UsesCustomTLS() bool {
+	return opts.CABundle != "" || opts.ClientCert != ""
+}
+
+// ChangesConnection returns true if these options connect to S3
+// service ss differently than the defaults do. DART Runner knows
+// nothing of these options and always connects with the defaults,
+// so DART must run uploads to services whose options change the
+// connection.
+func (opts *StorageServiceOptions) ChangesConnection(ss *core.StorageService) bool {
+	defaults := DefaultStorageServiceOptions(ss)
+	return opts.UseTLS != defaults.UseTLS ||
+		opts.UsesCustomTLS() ||
+		opts.ClientKey != "" ||
+		(opts.BucketLookup != "" && opts.BucketLookup != defaults.BucketLookup)
+}
+
+// TLSConfig returns a TLS configuration that trusts the system's CAs
+// plus those in CABundle, and that presents ClientCert if there is one.
+func (opts *StorageServiceOptions) TLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if opts.CABundle != "" {
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil || rootCAs == nil {
+			rootCAs = x509.NewCertPool()
+		}
+		pemData, err := os.ReadFile(opts.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		if !rootCAs.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("No PEM certificates found in %s.", opts.CABundle)
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+	if opts.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(opts.ClientCert, opts.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// MinioBucketLookup converts BucketLookup to its minio equivalent.
+func (opts *StorageServiceOptions) MinioBucketLookup() minio.BucketLookupType {
+	switch opts.BucketLookup {
+	case BucketLookupPath:
+		return minio.BucketLookupPath
+	case BucketLookupVirtualHost:
+		return minio.BucketLookupDNS
+	}
+	return minio.BucketLookupAuto
+}
+
+// Transport returns an HTTP transport for S3 requests that uses
+// these options' TLS settings, or nil if minio's default will do.
+func (opts *StorageServiceOptions) Transport() (http.RoundTripper, error) {
+	if !opts.UseTLS || !opts.UsesCustomTLS() {
+		return nil, nil
+	}
+	tlsConfig, err := opts.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport, err := minio.DefaultTransport(true)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// AddStorageServiceOptionFields adds fields for opts to a storage
+// service form, so they can be edited along with the service itself.
+func AddStorageServiceOptionFields(form *core.Form, opts *StorageServiceOptions, errors map[string]string) {
+	useTLS := strconv.FormatBool(opts.UseTLS)
+	useTLSField := form.AddField("UseTLS", "Use TLS (HTTPS)", useTLS, false)
+	useTLSField.Choices = []core.Choice{
+		{Label: "Yes", Value: "true", Selected: opts.UseTLS},
+		{Label: "No", Value: "false", Selected: !opts.UseTLS},
+	}
+	useTLSField.Help = "Turn this off only for S3-compatible services on a trusted network that don't support HTTPS."
+
+	caField := form.AddField("CABundle", "CA Bundle", opts.CABundle, false)
+	caField.Help = "Optional path to a PEM file with additional CA certificates to trust, for services whose certificates are signed by a private certificate authority."
+
+	certField := form.AddField("ClientCert", "Client Certificate", opts.ClientCert, false)
+	certField.Help = "Optional path to a PEM client certificate, for services that require mutual TLS."
+
+	keyField := form.AddField("ClientKey", "Client Key", opts.ClientKey, false)
+	keyField.Help = "Path to the PEM private key for the client certificate."
+
+	lookup := opts.BucketLookup
+	if lookup == "" {
+		lookup = BucketLookupAuto
+	}
+	lookupField := form.AddField("BucketLookup", "Bucket Addressing", lookup, false)
+	lookupField.Choices = []core.Choice{
+		{Label: "Automatic", Value: BucketLookupAuto, Selected: lookup == BucketLookupAuto},
+		{Label: "Path style (https://host/bucket)", Value: BucketLookupPath, Selected: lookup == BucketLookupPath},
+		{Label: "Virtual-host style (https://bucket.host)", Value: BucketLookupVirtualHost, Selected: lookup == BucketLookupVirtualHost},
+	}
+	lookupField.Help = "Most MinIO servers need path style. AWS and most hosted services work with automatic."
+
+	templateField := form.AddField("KeyTemplate", "Object Key Template", opts.KeyTemplate, false)
+	templateField.Help = keyTemplateHelp
+
+	AddS3UploadOptionFields(form, opts.S3, "Bucket default")
+
+	hostKeyField := form.AddField("SFTPHostKey", "SFTP Host Key Fingerprint", opts.SFTPHostKey, false)
+	hostKeyField.Help = "The SHA256 fingerprint of the server's host key, such as SHA256:uJ0xC3m5ThtBdObwhNBgVPTjSNUrDnV3xMyDa5ASIfo. Leave this blank to check the key against your known_hosts file instead. DART will not connect to a server whose key it can't verify."
+
+	for fieldName, message := range errors {
+		if field, ok := form.Fields[fieldName]; ok {
+			field.Error = message
+		}
+	}
+}
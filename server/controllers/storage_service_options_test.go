@@ -0,0 +1,92 @@
+package controllers_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart/v3/server/controllers"
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultStorageServiceOptions(t *testing.T) {
+	ss := core.NewStorageService()
+	ss.Protocol = constants.ProtocolS3
+	ss.Host = "localhost"
+	assert.False(t, controllers.DefaultStorageServiceOptions(ss).UseTLS)
+	ss.Host = "127.0.0.1"
+	assert.False(t, controllers.DefaultStorageServiceOptions(ss).UseTLS)
+	ss.Host = "s3.amazonaws.com"
+	opts := controllers.DefaultStorageServiceOptions(ss)
+	assert.True(t, opts.UseTLS)
+	assert.Equal(t, ss.ID, opts.StorageServiceID)
+	assert.Equal(t, controllers.BucketLookupAuto, opts.BucketLookup)
+	assert.Equal(t, minio.BucketLookupAuto, opts.MinioBucketLookup())
+}
+
+func TestStorageServiceOptionsValidate(t *testing.T) {
+	opts := &controllers.StorageServiceOptions{
+		UseTLS:       true,
+		BucketLookup: controllers.BucketLookupPath,
+	}
+	assert.Empty(t, opts.Validate())
+	assert.Equal(t, minio.BucketLookupPath, opts.MinioBucketLookup())
+
+	opts.BucketLookup = "sideways"
+	opts.CABundle = "/path/does/not/exist.pem"
+	opts.ClientCert = "/path/does/not/exist.crt"
+	errors := opts.Validate()
+	assert.Equal(t, "Cannot read file /path/does/not/exist.pem.", errors["CABundle"])
+	assert.Equal(t, "Cannot read file /path/does/not/exist.crt.", errors["ClientCert"])
+	assert.Equal(t, "Client certificate and client key must be specified together.", errors["ClientKey"])
+	assert.Equal(t, "Invalid bucket addressing style: sideways.", errors["BucketLookup"])
+
+	// A file that exists but contains no certificates
+	notPEM := filepath.Join(t.TempDir(), "not-a-cert.pem")
+	require.NoError(t, os.WriteFile(notPEM, []byte("Not a certificate"), 0644))
+	opts = &controllers.StorageServiceOptions{
+		UseTLS:   true,
+		CABundle: notPEM,
+	}
+	errors = opts.Validate()
+	assert.Contains(t, errors["CABundle"], "No PEM certificates found")
+	_, err := opts.Transport()
+	assert.Error(t, err)
+}
+
+func TestStorageServiceOptionsTransport(t *testing.T) {
+	// No custom TLS settings means we let minio use its default transport.
+	opts := &controllers.StorageServiceOptions{UseTLS: true}
+	transport, err := opts.Transport()
+	require.NoError(t, err)
+	assert.Nil(t, transport)
+
+	// We also ignore TLS settings when TLS is off.
+	opts = &controllers.StorageServiceOptions{UseTLS: false, CABundle: "/does/not/matter.pem"}
+	transport, err = opts.Transport()
+	require.NoError(t, err)
+	assert.Nil(t, transport)
+}
+
+func TestSaveAndDeleteStorageServiceOptions(t *testing.T) {
+	ss := core.NewStorageService()
+	ss.Host = "minio.example.lan"
+	opts := controllers.GetStorageServiceOptions(ss)
+	assert.True(t, opts.UseTLS)
+
+	opts.UseTLS = false
+	opts.BucketLookup = controllers.BucketLookupVirtualHost
+	require.NoError(t, controllers.SaveStorageServiceOptions(opts))
+
+	saved := controllers.GetStorageServiceOptions(ss)
+	assert.False(t, saved.UseTLS)
+	assert.Equal(t, controllers.BucketLookupVirtualHost, saved.BucketLookup)
+	assert.Equal(t, minio.BucketLookupDNS, saved.MinioBucketLookup())
+
+	require.NoError(t, controllers.DeleteStorageServiceOptions(ss.ID))
+	assert.True(t, controllers.GetStorageServiceOptions(ss).UseTLS)
+}
@@ -21,6 +21,10 @@ func StorageServiceDelete(c *gin.Context) {
 		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
 		return
 	}
+	err = DeleteStorageServiceOptions(request.QueryResult.StorageService().ID)
+	if err != nil {
+		core.Dart.Log.Warningf("Error deleting options for storage service %s: %v", request.QueryResult.StorageService().ID, err)
+	}
 	SetFlashCookie(c, fmt.Sprintf("Deleted storage service %s", request.QueryResult.StorageService().Name))
 	c.Redirect(http.StatusFound, "/storage_services")
 }
@@ -32,7 +36,12 @@ func StorageServiceEdit(c *gin.Context) {
 		AbortWithErrorHTML(c, http.StatusInternalServerError, request.Errors[0])
 		return
 	}
-	request.TemplateData["showTestButton"] = request.QueryResult.StorageService().Validate()
+	ss := request.QueryResult.StorageService()
+	form := request.TemplateData["form"].(*core.Form)
+	AddExtendedProtocolChoices(form)
+	AddStorageServiceOptionFields(form, GetStorageServiceOptions(ss), nil)
+	AddCredentialReferenceHelp(form, "Password")
+	request.TemplateData["showTestButton"] = ValidateStorageService(ss)
 	c.HTML(http.StatusOK, "storage_service/form.html", request.TemplateData)
 }
 
@@ -50,8 +59,12 @@ func StorageServiceIndex(c *gin.Context) {
 // GET /storage_services/new
 func StorageServiceNew(c *gin.Context) {
 	ss := core.NewStorageService()
+	form := ss.ToForm()
+	AddExtendedProtocolChoices(form)
+	AddStorageServiceOptionFields(form, DefaultStorageServiceOptions(ss), nil)
+	AddCredentialReferenceHelp(form, "Password")
 	data := gin.H{
-		"form":                 ss.ToForm(),
+		"form":                 form,
 		"suppressDeleteButton": true,
 		"helpUrl":              GetHelpUrl(c),
 	}
@@ -68,11 +81,33 @@ func StorageServiceSave(c *gin.Context) {
 		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
 		return
 	}
-	err = core.ObjSave(ss)
-	if err != nil {
+	opts := StorageServiceOptionsFromRequest(c, ss)
+	optionErrors := opts.Validate()
+	if err = protectStorageServiceCredentials(ss); err != nil {
+		optionErrors["Password"] = err.Error()
+	}
+	if len(optionErrors) > 0 {
+		// Validate the service too, so the form shows all errors at once.
+		ValidateStorageService(ss)
+	} else if IsExtendedProtocol(ss.Protocol) {
+		// DART Runner doesn't know extended protocols,
+		// so it can't validate these services.
+		if ValidateStorageService(ss) {
+			err = core.ObjSaveWithoutValidation(ss)
+		} else {
+			err = fmt.Errorf("Storage service has validation errors")
+		}
+	} else {
+		err = core.ObjSave(ss)
+	}
+	if err != nil || len(optionErrors) > 0 {
 		objectExistsInDB, _ := core.ObjExists(ss.ID)
+		form := ss.ToForm()
+		AddExtendedProtocolChoices(form)
+		AddStorageServiceOptionFields(form, opts, optionErrors)
+		AddCredentialReferenceHelp(form, "Password")
 		data := gin.H{
-			"form":             ss.ToForm(),
+			"form":             form,
 			"objectExistsInDB": objectExistsInDB,
 			"showTestButton":   false,
 			"helpUrl":          GetHelpUrl(c),
@@ -80,6 +115,11 @@ func StorageServiceSave(c *gin.Context) {
 		c.HTML(http.StatusBadRequest, "storage_service/form.html", data)
 		return
 	}
+	err = SaveStorageServiceOptions(opts)
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+		return
+	}
 	SetFlashCookie(c, fmt.Sprintf("Saved storage service %s", ss.Name))
 	c.Redirect(http.StatusFound, "/storage_services")
 }
@@ -95,20 +135,33 @@ func StorageServiceTestConnection(c *gin.Context) {
 
 	// Save this, because the user has likely been adjusting
 	// hostname, credentials, or other attributes. But if the
-	// save fails, continue with the test anyway.
-	core.ObjSave(ss)
+	// save fails, continue with the test anyway. If the password
+	// needs encrypting and stored credentials are locked, we
+	// test without saving.
+	if protectStorageServiceCredentials(ss) == nil {
+		if IsExtendedProtocol(ss.Protocol) {
+			if ValidateStorageService(ss) {
+				core.ObjSaveWithoutValidation(ss)
+			}
+		} else {
+			core.ObjSave(ss)
+		}
+	}
+	opts := StorageServiceOptionsFromRequest(c, ss)
+	if optionErrors := opts.Validate(); len(optionErrors) == 0 {
+		SaveStorageServiceOptions(opts)
+	}
 
 	status := http.StatusOK
-	result := "Connection succeeded!"
-	err = ss.TestConnection()
-	if err != nil {
+	diagnosis := DiagnoseConnection(ss)
+	if !diagnosis.Succeeded() {
 		status = http.StatusInternalServerError
-		result = err.Error()
 	}
 	data := gin.H{
-		"ss":      ss,
-		"result":  result,
-		"helpUrl": GetHelpUrl(c),
+		"ss":        ss,
+		"result":    diagnosis.Summary(),
+		"diagnosis": diagnosis,
+		"helpUrl":   GetHelpUrl(c),
 	}
 	c.HTML(status, "storage_service/test.html", data)
 }
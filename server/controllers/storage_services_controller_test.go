@@ -72,6 +72,12 @@ func TestStorageServiceNew(t *testing.T) {
 		`name="Bucket"`,
 		`name="Login"`,
 		`name="Password"`,
+		"Connection Security",
+		`name="UseTLS"`,
+		`name="CABundle"`,
+		`name="ClientCert"`,
+		`name="ClientKey"`,
+		`name="BucketLookup"`,
 	}
 
 	DoSimpleGetTest(t, "/storage_services/new", expected)
@@ -101,6 +107,23 @@ func testSSNewWithMisingParams(t *testing.T) {
 	ok, notFound := AssertContainsAllStrings(html, expectedContent)
 	assert.True(t, ok, "Missing from page: %v", notFound)
 
+	// Make sure we validate connection security options.
+	expectedContent = []string{
+		"Cannot read file /path/does/not/exist.pem.",
+		"Invalid bucket addressing style: sideways.",
+	}
+	params := url.Values{}
+	params.Set("CABundle", "/path/does/not/exist.pem")
+	params.Set("BucketLookup", "sideways")
+	w = httptest.NewRecorder()
+	req, err = NewPostRequest("/storage_services/new", params)
+	require.Nil(t, err)
+	dartServer.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	html = w.Body.String()
+	ok, notFound = AssertContainsAllStrings(html, expectedContent)
+	assert.True(t, ok, "Missing from page: %v", notFound)
+
 	// For S3 protocol, make sure we tell the user that
 	// we require a bucket name.
 	expectedContent = []string{"StorageService requires a bucket name when the protocol is S3."}
@@ -197,6 +220,10 @@ func TestStorageServiceConnection(t *testing.T) {
 	expected := []string{
 		ss.Name,
 		"succeeded",
+		"DNS Lookup",
+		"TCP Connection",
+		"Authentication",
+		"Write, Read and Delete",
 	}
 
 	params := url.Values{}
@@ -0,0 +1,487 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/mail"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/APTrust/dart-runner/core"
+)
+
+// Data types for TagValueRules.
+const (
+	TagTypeText    = ""
+	TagTypeDate    = "date"
+	TagTypeInteger = "integer"
+	TagTypeURI     = "uri"
+	TagTypeEmail   = "email"
+)
+
+// TagDataTypes lists the data types users can choose for a tag,
+// with the labels we show for them.
+var TagDataTypes = []struct {
+	Value string
+	Label string
+}{
+	{TagTypeText, "Any text"},
+	{TagTypeDate, "Date (YYYY-MM-DD)"},
+	{TagTypeInteger, "Whole number"},
+	{TagTypeURI, "URI"},
+	{TagTypeEmail, "Email address"},
+}
+
+// TagValueRules constrain the value of one tag in a BagIt profile,
+// beyond the Required flag and allowed Values that core.TagDefinition
+// supports. core.TagDefinition has no fields for these, so we keep
+// them in a separate store. Rules are keyed by profile ID, tag file
+// and tag name rather than tag ID, so they still apply to the copies
+// of the profile that jobs and workflows carry.
+//
+// Rules apply only to non-empty values. Whether a tag can be empty
+// is up to the tag definition.
+type TagValueRules struct {
+	ProfileID string `json:"profileId,omitempty"`
+	TagFile   string `json:"tagFile"`
+	TagName   string `json:"tagName"`
+	// Pattern is a regular expression the whole value must match.
+	Pattern string `json:"pattern"`
+	// PatternDescription tells users what Pattern means, in plain
+	// words, such as "an ORCID like 0000-0002-1825-0097". We show
+	// it in error messages instead of the expression itself.
+	PatternDescription string `json:"patternDescription"`
+	DataType           string `json:"dataType"`
+	// MinLength and MaxLength count characters, not bytes.
+	// Zero means no limit.
+	MinLength int `json:"minLength"`
+	MaxLength int `json:"maxLength"`
+}
+
+// TagValueRuleSet holds a profile's rules, keyed by the tag's
+// fully qualified name, e.g. "bag-info.txt/Bagging-Date".
+type TagValueRuleSet map[string]*TagValueRules
+
+// TagValueRulesExportKey is the key that holds tag value rules in
+// exported profiles. The BagIt Profiles spec has no place for them,
+// and tools that read profiles ignore keys they don't know.
+const TagValueRulesExportKey = "DART-Tag-Value-Rules"
+
+var tagValueRulesStore = NewJSONStore[TagValueRules]("tag_value_rules.json")
+
+var tagDatePattern = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
+
+// IsEmpty returns true if the rules don't constrain anything.
+func (rules *TagValueRules) IsEmpty() bool {
+	return rules == nil || (strings.TrimSpace(rules.Pattern) == "" &&
+		rules.DataType == TagTypeText &&
+		rules.MinLength == 0 &&
+		rules.MaxLength == 0)
+}
+
+// Validate returns a map of field names to error messages. The map
+// is empty if the rules themselves are valid.
+func (rules *TagValueRules) Validate() map[string]string {
+	errors := make(map[string]string)
+	if rules.Pattern != "" {
+		if _, err := regexp.Compile(rules.Pattern); err != nil {
+			errors["Pattern"] = fmt.Sprintf("This is not a valid regular expression: %s", err.Error())
+		}
+	}
+	if TagDataTypeLabel(rules.DataType) == "" {
+		errors["DataType"] = "Please choose one of the listed data types."
+	}
+	if rules.MinLength < 0 {
+		errors["MinLength"] = "Minimum length can't be negative."
+	}
+	if rules.MaxLength < 0 {
+		errors["MaxLength"] = "Maximum length can't be negative."
+	} else if rules.MaxLength > 0 && rules.MinLength > rules.MaxLength {
+		errors["MaxLength"] = "Maximum length must be greater than or equal to minimum length."
+	}
+	return errors
+}
+
+// Check returns a message explaining why value breaks the rules,
+// or an empty string if it doesn't. Empty values always pass.
+func (rules *TagValueRules) Check(value string) string {
+	if rules.IsEmpty() || value == "" {
+		return ""
+	}
+	length := utf8.RuneCountInString(value)
+	if rules.MinLength > 0 && length < rules.MinLength {
+		return fmt.Sprintf("This value must be at least %d characters long. It has %d.", rules.MinLength, length)
+	}
+	if rules.MaxLength > 0 && length > rules.MaxLength {
+		return fmt.Sprintf("This value can be at most %d characters long. It has %d.", rules.MaxLength, length)
+	}
+	if message := checkTagDataType(rules.DataType, value); message != "" {
+		return message
+	}
+	if rules.Pattern != "" {
+		// Anchor the pattern, so it has to match the whole value.
+		re, err := regexp.Compile("^(?:" + rules.Pattern + ")$")
+		if err == nil && !re.MatchString(value) {
+			if rules.PatternDescription != "" {
+				return fmt.Sprintf("This value must be %s.", rules.PatternDescription)
+			}
+			return fmt.Sprintf("This value is not in the required format. It must match the pattern %s.", rules.Pattern)
+		}
+	}
+	return ""
+}
+
+// Describe summarizes the rules in a sentence or two for
+// help text, or returns an empty string if there are none.
+func (rules *TagValueRules) Describe() string {
+	if rules.IsEmpty() {
+		return ""
+	}
+	parts := make([]string, 0)
+	if rules.DataType != TagTypeText {
+		parts = append(parts, fmt.Sprintf("Must be a %s.", strings.ToLower(TagDataTypeLabel(rules.DataType))))
+	}
+	if rules.PatternDescription != "" {
+		parts = append(parts, fmt.Sprintf("Must be %s.", rules.PatternDescription))
+	} else if rules.Pattern != "" {
+		parts = append(parts, fmt.Sprintf("Must match %s.", rules.Pattern))
+	}
+	switch {
+	case rules.MinLength > 0 && rules.MaxLength > 0:
+		parts = append(parts, fmt.Sprintf("%d to %d characters.", rules.MinLength, rules.MaxLength))
+	case rules.MinLength > 0:
+		parts = append(parts, fmt.Sprintf("At least %d characters.", rules.MinLength))
+	case rules.MaxLength > 0:
+		parts = append(parts, fmt.Sprintf("At most %d characters.", rules.MaxLength))
+	}
+	return strings.Join(parts, " ")
+}
+
+// TagDataTypeLabel returns the label for dataType, or an empty
+// string if it's not one of TagDataTypes.
+func TagDataTypeLabel(dataType string) string {
+	for _, option := range TagDataTypes {
+		if option.Value == dataType {
+			return option.Label
+		}
+	}
+	return ""
+}
+
+// For returns the rules for tagDef, or nil if it has none.
+func (ruleSet TagValueRuleSet) For(tagDef *core.TagDefinition) *TagValueRules {
+	if ruleSet == nil {
+		return nil
+	}
+	return ruleSet[tagDef.TagFile+"/"+tagDef.TagName]
+}
+
+// List returns copies of the rules, sorted by tag file and tag name.
+// The list is empty, not nil, if there are no rules, so revisions
+// can tell an empty snapshot from a missing one.
+func (ruleSet TagValueRuleSet) List() []TagValueRules {
+	list := make([]TagValueRules, 0, len(ruleSet))
+	for _, rules := range ruleSet {
+		list = append(list, *rules)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].TagFile != list[j].TagFile {
+			return list[i].TagFile < list[j].TagFile
+		}
+		return list[i].TagName < list[j].TagName
+	})
+	return list
+}
+
+// NewTagValueRuleSet returns a rule set holding copies of rules.
+func NewTagValueRuleSet(rules []TagValueRules) TagValueRuleSet {
+	ruleSet := make(TagValueRuleSet, len(rules))
+	for i := range rules {
+		copied := rules[i]
+		ruleSet[copied.TagFile+"/"+copied.TagName] = &copied
+	}
+	return ruleSet
+}
+
+// LoadTagValueRules returns the rules for all tags in the profile
+// with the given ID.
+func LoadTagValueRules(profileID string) (TagValueRuleSet, error) {
+	allRules, err := tagValueRulesStore.Load()
+	if err != nil {
+		return nil, err
+	}
+	ruleSet := make(TagValueRuleSet)
+	for i := range allRules {
+		if allRules[i].ProfileID == profileID {
+			ruleSet[allRules[i].TagFile+"/"+allRules[i].TagName] = &allRules[i]
+		}
+	}
+	return ruleSet, nil
+}
+
+// FindTagValueRules returns the rules for one tag in a profile,
+// or empty rules for that tag if none have been saved.
+func FindTagValueRules(profileID, tagFile, tagName string) (*TagValueRules, error) {
+	ruleSet, err := LoadTagValueRules(profileID)
+	if err != nil {
+		return nil, err
+	}
+	if rules, ok := ruleSet[tagFile+"/"+tagName]; ok {
+		return rules, nil
+	}
+	return &TagValueRules{ProfileID: profileID, TagFile: tagFile, TagName: tagName}, nil
+}
+
+// SaveTagValueRules saves rules, replacing any saved rules for the
+// tag previously named oldTagName in the same file. Pass the current
+// tag name as oldTagName unless the tag was renamed. Empty rules are
+// deleted rather than saved.
+func SaveTagValueRules(rules *TagValueRules, oldTagName string) error {
+	return tagValueRulesStore.Update(func(allRules []TagValueRules) ([]TagValueRules, error) {
+		kept := make([]TagValueRules, 0, len(allRules)+1)
+		for _, existing := range allRules {
+			if existing.ProfileID == rules.ProfileID && existing.TagFile == rules.TagFile &&
+				(existing.TagName == oldTagName || existing.TagName == rules.TagName) {
+				continue
+			}
+			kept = append(kept, existing)
+		}
+		if !rules.IsEmpty() {
+			kept = append(kept, *rules)
+		}
+		return kept, nil
+	})
+}
+
+// ReplaceTagValueRules replaces all of the rules for the profile
+// with the given ID with rules, which may come from another profile,
+// a revision or an import. Empty rules are skipped. Pass nil to
+// delete all of the profile's rules.
+func ReplaceTagValueRules(profileID string, rules []TagValueRules) error {
+	return tagValueRulesStore.Update(func(allRules []TagValueRules) ([]TagValueRules, error) {
+		kept := make([]TagValueRules, 0, len(allRules)+len(rules))
+		for _, existing := range allRules {
+			if existing.ProfileID != profileID {
+				kept = append(kept, existing)
+			}
+		}
+		for _, replacement := range rules {
+			if !replacement.IsEmpty() {
+				replacement.ProfileID = profileID
+				kept = append(kept, replacement)
+			}
+		}
+		return kept, nil
+	})
+}
+
+// CopyTagValueRules gives the profile with ID toProfileID the same
+// rules as the profile with ID fromProfileID. We call this when
+// we clone a profile, since the clone gets a new ID.
+func CopyTagValueRules(fromProfileID, toProfileID string) error {
+	ruleSet, err := LoadTagValueRules(fromProfileID)
+	if err != nil {
+		return err
+	}
+	return ReplaceTagValueRules(toProfileID, ruleSet.List())
+}
+
+// AddTagValueRulesToExport adds ruleSet to profileJson, the JSON
+// of an exported profile, under TagValueRulesExportKey. The rules
+// leave out the profile ID, since the profile gets a new ID when
+// someone imports it. This returns profileJson unchanged if there
+// are no rules.
+func AddTagValueRulesToExport(profileJson string, ruleSet TagValueRuleSet) (string, error) {
+	if len(ruleSet) == 0 {
+		return profileJson, nil
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal([]byte(profileJson), &fields); err != nil {
+		return "", err
+	}
+	rules := ruleSet.List()
+	for i := range rules {
+		rules[i].ProfileID = ""
+	}
+	rulesJson, err := json.Marshal(rules)
+	if err != nil {
+		return "", err
+	}
+	fields[TagValueRulesExportKey] = rulesJson
+	data, err := json.MarshalIndent(fields, "", "  ")
+	return string(data), err
+}
+
+// TagValueRulesFromExport returns the tag value rules in jsonData,
+// the JSON of an exported profile, for the tags that profile defines.
+// It returns an empty list if the JSON has no rules, as in profiles
+// that other tools export.
+func TagValueRulesFromExport(jsonData []byte, profile *core.BagItProfile) ([]TagValueRules, error) {
+	rules := make([]TagValueRules, 0)
+	if len(strings.TrimSpace(string(jsonData))) == 0 {
+		return rules, nil
+	}
+	var export map[string]json.RawMessage
+	if err := json.Unmarshal(jsonData, &export); err != nil || export[TagValueRulesExportKey] == nil {
+		return rules, nil
+	}
+	var exported []TagValueRules
+	if err := json.Unmarshal(export[TagValueRulesExportKey], &exported); err != nil {
+		return nil, fmt.Errorf("%s is invalid: %s", TagValueRulesExportKey, err.Error())
+	}
+	definedTags := make(map[string]bool, len(profile.Tags))
+	for _, tag := range profile.Tags {
+		definedTags[tag.TagFile+"/"+tag.TagName] = true
+	}
+	for _, tagRules := range exported {
+		if !definedTags[tagRules.TagFile+"/"+tagRules.TagName] {
+			continue
+		}
+		if errors := tagRules.Validate(); len(errors) > 0 {
+			messages := make([]string, 0, len(errors))
+			for _, message := range errors {
+				messages = append(messages, message)
+			}
+			sort.Strings(messages)
+			return nil, fmt.Errorf("%s has invalid rules for %s/%s: %s", TagValueRulesExportKey, tagRules.TagFile, tagRules.TagName, strings.Join(messages, " "))
+		}
+		tagRules.ProfileID = profile.ID
+		rules = append(rules, tagRules)
+	}
+	return rules, nil
+}
+
+// DeleteTagValueRules deletes the rules for one tag. If tagName is
+// empty, it deletes the rules for every tag in tagFile.
+func DeleteTagValueRules(profileID, tagFile, tagName string) error {
+	return tagValueRulesStore.Update(func(allRules []TagValueRules) ([]TagValueRules, error) {
+		kept := make([]TagValueRules, 0, len(allRules))
+		for _, existing := range allRules {
+			if existing.ProfileID == profileID && existing.TagFile == tagFile &&
+				(tagName == "" || existing.TagName == tagName) {
+				continue
+			}
+			kept = append(kept, existing)
+		}
+		return kept, nil
+	})
+}
+
+// ValidateBatchTagValues checks the tag values in a CSV batch file
+// against the rules for the workflow's BagIt profile. Tag columns
+// have headers like "bag-info.txt/Title". The returned map has keys
+// like "Line 3, bag-info.txt/Title", which the batch page lists
+// along with the other validation errors. The map is empty if all
+// values are OK.
+func ValidateBatchTagValues(workflow *core.Workflow, pathToCSVFile string) (map[string]string, error) {
+	errors := make(map[string]string)
+	if workflow == nil || workflow.BagItProfile == nil {
+		return errors, nil
+	}
+	ruleSet, err := LoadTagValueRules(workflow.BagItProfile.ID)
+	if err != nil || len(ruleSet) == 0 {
+		return errors, err
+	}
+	file, err := os.Open(pathToCSVFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	headers, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading CSV batch file headers: %s", err.Error())
+	}
+	// Excel adds a byte order mark to CSV files saved as UTF-8.
+	if len(headers) > 0 {
+		headers[0] = strings.TrimPrefix(headers[0], "\ufeff")
+	}
+	for lineNumber := 2; ; lineNumber++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error reading line %d of CSV batch file: %s", lineNumber, err.Error())
+		}
+		for i, value := range record {
+			if i >= len(headers) {
+				break
+			}
+			if message := ruleSet[headers[i]].Check(strings.TrimSpace(value)); message != "" {
+				errors[fmt.Sprintf("Line %d, %s", lineNumber, headers[i])] = message
+			}
+		}
+	}
+	return errors, nil
+}
+
+// ValidateBagTagValues checks the values of the tags in the bag at
+// bagPath against the rules for profile. The returned map has keys
+// like "bag-info.txt/Bagging-Date" and says which value is wrong, so
+// the message makes sense in a list of validation errors. Tags the
+// bag doesn't have are left to the validator.
+func ValidateBagTagValues(bagPath string, profile *core.BagItProfile) (map[string]string, error) {
+	errors := make(map[string]string)
+	ruleSet, err := LoadTagValueRules(profile.ID)
+	if err != nil || len(ruleSet) == 0 {
+		return errors, err
+	}
+	tagFiles := make(map[string]bool)
+	for key := range ruleSet {
+		tagFiles[ruleSet[key].TagFile] = true
+	}
+	err = WalkBag(bagPath, func(entry BagEntry, reader io.Reader) error {
+		if !tagFiles[entry.Path] {
+			return nil
+		}
+		tags, err := ParseTagFile(reader)
+		if err != nil {
+			return nil
+		}
+		for _, tag := range tags {
+			key := entry.Path + "/" + tag.Name
+			if message := ruleSet[key].Check(tag.Value); message != "" {
+				errors[key] = fmt.Sprintf("Value '%s' is not valid. %s", tag.Value, message)
+			}
+		}
+		return nil
+	})
+	return errors, err
+}
+
+func checkTagDataType(dataType, value string) string {
+	switch dataType {
+	case TagTypeDate:
+		// Bagging-Date values sometimes include the time, as in
+		// 2014-04-14T11:55:26-0400, so we check only the date.
+		if len(value) >= 10 && tagDatePattern.MatchString(value[:10]) && (len(value) == 10 || value[10] == 'T') {
+			if _, err := time.Parse("2006-01-02", value[:10]); err == nil {
+				return ""
+			}
+		}
+		return "This value must be a date in the form YYYY-MM-DD, such as 2024-03-15."
+	case TagTypeInteger:
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return "This value must be a whole number, such as 42."
+		}
+	case TagTypeURI:
+		if u, err := url.Parse(value); err != nil || u.Scheme == "" || (u.Host == "" && u.Opaque == "") {
+			return "This value must be a full URI, including the scheme, such as https://example.com/items/1."
+		}
+	case TagTypeEmail:
+		if address, err := mail.ParseAddress(value); err != nil || address.Address != value {
+			return "This value must be an email address, such as archivist@example.com."
+		}
+	}
+	return ""
+}
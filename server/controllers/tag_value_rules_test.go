@@ -0,0 +1,207 @@
+package controllers_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart-runner/util"
+	"github.com/APTrust/dart/v3/server/controllers"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTagValueRulesCheck(t *testing.T) {
+	var noRules *controllers.TagValueRules
+	assert.True(t, noRules.IsEmpty())
+	assert.Empty(t, noRules.Check("anything"))
+
+	date := &controllers.TagValueRules{DataType: controllers.TagTypeDate}
+	assert.Empty(t, date.Check(""))
+	assert.Empty(t, date.Check("2024-03-15"))
+	assert.Empty(t, date.Check("2014-04-14T11:55:26.17-0400"))
+	assert.Equal(t, "This value must be a date in the form YYYY-MM-DD, such as 2024-03-15.", date.Check("2024-02-30"))
+	assert.NotEmpty(t, date.Check("03/15/2024"))
+	assert.NotEmpty(t, date.Check("2024-03-15 and then some"))
+
+	integer := &controllers.TagValueRules{DataType: controllers.TagTypeInteger}
+	assert.Empty(t, integer.Check("-42"))
+	assert.Equal(t, "This value must be a whole number, such as 42.", integer.Check("4.2"))
+
+	uri := &controllers.TagValueRules{DataType: controllers.TagTypeURI}
+	assert.Empty(t, uri.Check("https://example.com/items/1"))
+	assert.Empty(t, uri.Check("urn:isbn:0451450523"))
+	assert.NotEmpty(t, uri.Check("example.com/items/1"))
+
+	email := &controllers.TagValueRules{DataType: controllers.TagTypeEmail}
+	assert.Empty(t, email.Check("archivist@example.com"))
+	assert.NotEmpty(t, email.Check("Archivist <archivist@example.com>"))
+	assert.NotEmpty(t, email.Check("archivist"))
+
+	orcid := &controllers.TagValueRules{
+		Pattern:            `\d{4}-\d{4}-\d{4}-\d{3}[0-9X]`,
+		PatternDescription: "an ORCID like 0000-0002-1825-0097",
+	}
+	assert.Empty(t, orcid.Check("0000-0002-1825-0097"))
+	// The pattern must match the whole value.
+	assert.Equal(t, "This value must be an ORCID like 0000-0002-1825-0097.", orcid.Check("https://orcid.org/0000-0002-1825-0097"))
+	orcid.PatternDescription = ""
+	assert.Equal(t, `This value is not in the required format. It must match the pattern \d{4}-\d{4}-\d{4}-\d{3}[0-9X].`, orcid.Check("0000"))
+
+	length := &controllers.TagValueRules{MinLength: 3, MaxLength: 5}
+	assert.Empty(t, length.Check("äöü"))
+	assert.Equal(t, "This value must be at least 3 characters long. It has 2.", length.Check("ab"))
+	assert.Equal(t, "This value can be at most 5 characters long. It has 6.", length.Check("abcdef"))
+	assert.Equal(t, "3 to 5 characters.", length.Describe())
+}
+
+func TestTagValueRulesValidate(t *testing.T) {
+	rules := &controllers.TagValueRules{
+		Pattern:   "[a-z",
+		DataType:  "color",
+		MinLength: 10,
+		MaxLength: 5,
+	}
+	errors := rules.Validate()
+	assert.Equal(t, 3, len(errors))
+	assert.Contains(t, errors["Pattern"], "This is not a valid regular expression")
+	assert.Equal(t, "Please choose one of the listed data types.", errors["DataType"])
+	assert.Equal(t, "Maximum length must be greater than or equal to minimum length.", errors["MaxLength"])
+
+	rules = &controllers.TagValueRules{Pattern: "[a-z]+", DataType: controllers.TagTypeInteger, MinLength: 1}
+	assert.Empty(t, rules.Validate())
+	assert.Equal(t, "Must be a whole number. Must match [a-z]+. At least 1 characters.", rules.Describe())
+}
+
+func TestTagValueRulesStore(t *testing.T) {
+	profileID := uuid.NewString()
+	rules := &controllers.TagValueRules{
+		ProfileID: profileID,
+		TagFile:   "bag-info.txt",
+		TagName:   "Contact-Email",
+		DataType:  controllers.TagTypeEmail,
+	}
+	require.NoError(t, controllers.SaveTagValueRules(rules, rules.TagName))
+	found, err := controllers.FindTagValueRules(profileID, "bag-info.txt", "Contact-Email")
+	require.NoError(t, err)
+	assert.Equal(t, rules, found)
+
+	// Renaming the tag moves its rules.
+	rules.TagName = "Contact-Address"
+	require.NoError(t, controllers.SaveTagValueRules(rules, "Contact-Email"))
+	ruleSet, err := controllers.LoadTagValueRules(profileID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(ruleSet))
+	assert.Equal(t, controllers.TagTypeEmail, ruleSet.For(&core.TagDefinition{TagFile: "bag-info.txt", TagName: "Contact-Address"}).DataType)
+	assert.Nil(t, ruleSet.For(&core.TagDefinition{TagFile: "bag-info.txt", TagName: "Contact-Email"}))
+
+	// Saving empty rules deletes them.
+	rules.DataType = controllers.TagTypeText
+	require.NoError(t, controllers.SaveTagValueRules(rules, rules.TagName))
+	found, err = controllers.FindTagValueRules(profileID, "bag-info.txt", "Contact-Address")
+	require.NoError(t, err)
+	assert.True(t, found.IsEmpty())
+
+	rules.DataType = controllers.TagTypeEmail
+	require.NoError(t, controllers.SaveTagValueRules(rules, rules.TagName))
+	require.NoError(t, controllers.DeleteTagValueRules(profileID, "bag-info.txt", ""))
+	ruleSet, err = controllers.LoadTagValueRules(profileID)
+	require.NoError(t, err)
+	assert.Empty(t, ruleSet)
+}
+
+func TestTagValueRulesExport(t *testing.T) {
+	profile, _ := getDiffTestProfiles()
+	profileJson := `{"BagIt-Profile-Info": {"Source-Organization": "Example"}}`
+
+	exported, err := controllers.AddTagValueRulesToExport(profileJson, controllers.TagValueRuleSet{})
+	require.NoError(t, err)
+	assert.Equal(t, profileJson, exported)
+
+	ruleSet := controllers.NewTagValueRuleSet([]controllers.TagValueRules{
+		{ProfileID: uuid.NewString(), TagFile: "bag-info.txt", TagName: "Source-Organization", MaxLength: 80},
+		{ProfileID: uuid.NewString(), TagFile: "bag-info.txt", TagName: "Not-In-Profile", DataType: controllers.TagTypeURI},
+	})
+	exported, err = controllers.AddTagValueRulesToExport(profileJson, ruleSet)
+	require.NoError(t, err)
+	assert.Contains(t, exported, controllers.TagValueRulesExportKey)
+	assert.Contains(t, exported, `"Source-Organization": "Example"`)
+	assert.NotContains(t, exported, "profileId")
+
+	// Imports keep only the rules for tags the profile defines,
+	// and give them the new profile's ID.
+	imported, err := controllers.TagValueRulesFromExport([]byte(exported), profile)
+	require.NoError(t, err)
+	assert.Equal(t, []controllers.TagValueRules{
+		{ProfileID: profile.ID, TagFile: "bag-info.txt", TagName: "Source-Organization", MaxLength: 80},
+	}, imported)
+
+	imported, err = controllers.TagValueRulesFromExport([]byte(profileJson), profile)
+	require.NoError(t, err)
+	assert.Empty(t, imported)
+
+	_, err = controllers.TagValueRulesFromExport([]byte(`{"DART-Tag-Value-Rules": [{"tagFile": "bag-info.txt", "tagName": "Source-Organization", "pattern": "("}]}`), profile)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid rules for bag-info.txt/Source-Organization")
+}
+
+func TestValidateBatchTagValues(t *testing.T) {
+	profile, _ := getDiffTestProfiles()
+	profile.ID = uuid.NewString()
+	workflow := &core.Workflow{ID: uuid.NewString(), BagItProfile: profile}
+	csvFile := filepath.Join(util.PathToTestData(), "files", "csv_workflow_batch.csv")
+
+	// No rules, no errors.
+	errors, err := controllers.ValidateBatchTagValues(workflow, csvFile)
+	require.NoError(t, err)
+	assert.Empty(t, errors)
+
+	rules := &controllers.TagValueRules{
+		ProfileID: profile.ID,
+		TagFile:   "bag-info.txt",
+		TagName:   "Source-Organization",
+		MaxLength: 18,
+	}
+	require.NoError(t, controllers.SaveTagValueRules(rules, rules.TagName))
+	defer controllers.DeleteTagValueRules(profile.ID, "bag-info.txt", "")
+	errors, err = controllers.ValidateBatchTagValues(workflow, csvFile)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"Line 4, bag-info.txt/Source-Organization": "This value can be at most 18 characters long. It has 22.",
+	}, errors)
+
+	_, err = controllers.ValidateBatchTagValues(workflow, filepath.Join(t.TempDir(), "missing.csv"))
+	assert.Error(t, err)
+}
+
+func TestValidateBagTagValues(t *testing.T) {
+	profile, _ := getDiffTestProfiles()
+	profile.ID = uuid.NewString()
+	defer controllers.DeleteTagValueRules(profile.ID, "bag-info.txt", "")
+	for _, rules := range []*controllers.TagValueRules{
+		{ProfileID: profile.ID, TagFile: "bag-info.txt", TagName: "Bagging-Date", DataType: controllers.TagTypeDate},
+		{ProfileID: profile.ID, TagFile: "bag-info.txt", TagName: "Source-Organization", DataType: controllers.TagTypeEmail},
+	} {
+		require.NoError(t, controllers.SaveTagValueRules(rules, rules.TagName))
+	}
+
+	bagPath := filepath.Join(util.PathToTestData(), "bags", "example.edu.sample_good.tar")
+	errors, err := controllers.ValidateBagTagValues(bagPath, profile)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"bag-info.txt/Source-Organization": "Value 'virginia.edu' is not valid. This value must be an email address, such as archivist@example.com.",
+	}, errors)
+
+	// Conformance matrices include the same errors.
+	bagDir := t.TempDir()
+	data, err := os.ReadFile(bagPath)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(bagDir, "example.edu.sample_good.tar"), data, 0644))
+	profile.ManifestsRequired = []string{"md5"}
+	matrix, err := controllers.RunConformanceMatrix(profile, bagDir)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(matrix.Results))
+	assert.Contains(t, matrix.Results[0].Failures, "bag-info.txt/Source-Organization")
+}
@@ -60,7 +60,6 @@ func UploadJobShowFiles(c *gin.Context) {
 	templateData["nextButtonUrl"] = fmt.Sprintf("/upload_jobs/targets/%s", uploadJob.ID)
 	templateData["addFileUrl"] = fmt.Sprintf("/upload_jobs/add_file/%s", uploadJob.ID)
 	templateData["helpUrl"] = GetHelpUrl(c)
-	templateData["suppressDeleteButton"] = true
 
 	c.HTML(http.StatusOK, "job/files.html", templateData)
 
@@ -124,6 +123,27 @@ func UploadJobDeleteFile(c *gin.Context) {
 	c.Redirect(http.StatusFound, fmt.Sprintf("/upload_jobs/files/%s?%s", uploadJob.ID, values.Encode()))
 }
 
+// PUT /upload_jobs/delete/:id
+// POST /upload_jobs/delete/:id
+func UploadJobDelete(c *gin.Context) {
+	uploadJob, err := loadUploadJob(c.Param("id"))
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusNotFound, err)
+		return
+	}
+	err = core.ObjDelete(uploadJob)
+	if err != nil {
+		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
+		return
+	}
+	err = DeleteUploadJobOptions(uploadJob.ID)
+	if err != nil {
+		core.Dart.Log.Warningf("Error deleting options for upload job %s: %v", uploadJob.ID, err)
+	}
+	SetFlashCookie(c, fmt.Sprintf("Deleted upload job %s.", uploadJob.ObjName()))
+	c.Redirect(http.StatusFound, "/")
+}
+
 // GET /upload_jobs/targets/:id
 func UploadJobShowTargets(c *gin.Context) {
 	uploadJob, err := loadUploadJob(c.Param("id"))
@@ -132,10 +152,12 @@ func UploadJobShowTargets(c *gin.Context) {
 		return
 	}
 	form := uploadJob.ToForm()
+	AddUploadJobOptionFields(form, GetUploadJobOptions(uploadJob.ID), nil)
 	data := gin.H{
-		"form":      form,
-		"uploadJob": uploadJob,
-		"helpUrl":   GetHelpUrl(c),
+		"form":           form,
+		"uploadJob":      uploadJob,
+		"hasDirectories": UploadJobHasDirectories(uploadJob),
+		"helpUrl":        GetHelpUrl(c),
 	}
 	c.HTML(http.StatusOK, "upload_job/choose_targets.html", data)
 }
@@ -158,13 +180,28 @@ func UploadJobSaveTarget(c *gin.Context) {
 		}
 		uploadJob.UploadOps[i] = core.NewUploadOperation(result.StorageService(), uploadJob.PathsToUpload)
 	}
-	err = core.ObjSave(uploadJob)
+	opts := UploadJobOptionsFromRequest(c, uploadJob.ID)
+	optionErrors := opts.Validate()
+	if len(optionErrors) == 0 {
+		err = SaveUploadJobOptions(opts)
+	} else {
+		err = fmt.Errorf("Upload job options have validation errors")
+	}
+	if err == nil {
+		if ValidateUploadJob(uploadJob) {
+			err = core.ObjSaveWithoutValidation(uploadJob)
+		} else {
+			err = fmt.Errorf("Upload job has validation errors")
+		}
+	}
 	if err != nil {
 		form := uploadJob.ToForm()
+		AddUploadJobOptionFields(form, opts, optionErrors)
 		data := gin.H{
-			"form":      form,
-			"uploadJob": uploadJob,
-			"helpUrl":   GetHelpUrl(c),
+			"form":           form,
+			"uploadJob":      uploadJob,
+			"hasDirectories": UploadJobHasDirectories(uploadJob),
+			"helpUrl":        GetHelpUrl(c),
 		}
 		c.HTML(http.StatusBadRequest, "upload_job/choose_targets.html", data)
 		return
@@ -204,6 +241,16 @@ func UploadJobReview(c *gin.Context) {
 		"backButtonUrl":  fmt.Sprintf("/upload_jobs/targets/%s", uploadJob.ID),
 		"helpUrl":        GetHelpUrl(c),
 	}
+
+	// Show what a directory upload will include, or why it can't run.
+	if opts := GetUploadJobOptions(uploadJob.ID); uploadJobRunsInDART(uploadJob, opts) {
+		plan, err := planUploadJob(uploadJob, opts, time.Now())
+		if err != nil {
+			data["uploadPlanError"] = err.Error()
+		} else {
+			data["uploadPlan"] = plan
+		}
+	}
 	c.HTML(http.StatusOK, "job/run.html", data)
 }
 
@@ -218,7 +265,7 @@ func UploadJobRun(c *gin.Context) {
 		AbortWithErrorHTML(c, http.StatusNotFound, detailedError)
 		return
 	}
-	if !uploadJob.Validate() {
+	if !ValidateUploadJob(uploadJob) {
 		validationErr := ""
 		for _, msg := range uploadJob.Errors {
 			validationErr += msg + " "
@@ -241,7 +288,7 @@ func UploadJobRun(c *gin.Context) {
 
 		// Run the job and have it send status updates back to the
 		// front end through the message channel.
-		exitCode := uploadJob.Run(messageChannel)
+		exitCode := RunUploadJobWithExtendedUploads(uploadJob, messageChannel)
 
 		// When job completes, create the final disconnect event
 		// to tell the front end to stop listening for server-sent
@@ -273,7 +320,9 @@ func UploadJobRun(c *gin.Context) {
 				return true
 			}
 		}
-		err := core.ObjSave(uploadJob)
+		// DART Runner's validation rejects directories and
+		// extended protocols, so we validated the job above.
+		err := core.ObjSaveWithoutValidation(uploadJob)
 		if err != nil {
 			core.Dart.Log.Error("Error saving upload job %s after run: %v", uploadJob.ID, err)
 		}
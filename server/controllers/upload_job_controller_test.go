@@ -11,6 +11,7 @@ import (
 	"github.com/APTrust/dart-runner/constants"
 	"github.com/APTrust/dart-runner/core"
 	"github.com/APTrust/dart-runner/util"
+	"github.com/APTrust/dart/v3/server/controllers"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -42,6 +43,25 @@ func TestUploadJobNew(t *testing.T) {
 	testUploadJobRun(t, uploadJob.ID)
 }
 
+func TestUploadJobDelete(t *testing.T) {
+	defer core.ClearDartTable()
+	uploadJob := core.NewUploadJob()
+	require.NoError(t, core.ObjSaveWithoutValidation(uploadJob))
+	opts := controllers.GetUploadJobOptions(uploadJob.ID)
+	opts.KeyPrefix = "transfers"
+	require.NoError(t, controllers.SaveUploadJobOptions(opts))
+
+	DoSimplePostTest(t, PostTestSettings{
+		EndpointUrl:              fmt.Sprintf("/upload_jobs/delete/%s", uploadJob.ID),
+		ExpectedResponseCode:     http.StatusFound,
+		ExpectedRedirectLocation: "/",
+	})
+	assert.Error(t, core.ObjFind(uploadJob.ID).Error)
+
+	// The job's options go with it.
+	assert.Empty(t, controllers.GetUploadJobOptions(uploadJob.ID).KeyPrefix)
+}
+
 func testUploadJobShowFiles(t *testing.T, id string) {
 	expected := []string{
 		"jumpMenu",
@@ -189,6 +209,7 @@ func loadTestStorageServices(t *testing.T) []*core.StorageService {
 
 	require.NoError(t, core.ObjSave(localMinioService))
 	require.NoError(t, core.ObjSave(localSFTPService))
+	pinSFTPHostKey(t, localSFTPService)
 
 	return []*core.StorageService{localMinioService, localSFTPService}
 }
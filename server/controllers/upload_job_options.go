@@ -0,0 +1,172 @@
+package controllers
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/APTrust/dart-runner/core"
+	"github.com/gin-gonic/gin"
+)
+
+// Symlink policies for directory uploads.
+const (
+	// SymlinkSkip leaves symbolic links out of the upload.
+	SymlinkSkip = "skip"
+	// SymlinkFollow uploads the file or directory a link points to,
+	// under the link's name.
+	SymlinkFollow = "follow"
+	// SymlinkFail stops the job before it starts if there are any links.
+	SymlinkFail = "fail"
+)
+
+// Empty directory policies for directory uploads.
+const (
+	// EmptyDirSkip leaves empty directories out of the upload.
+	EmptyDirSkip = "skip"
+	// EmptyDirCreate creates empty directories on the remote side.
+	// On S3, that's a zero-byte object whose key ends with a slash,
+	// which is how the S3 console creates folders.
+	EmptyDirCreate = "create"
+)
+
+// UploadJobOptions holds settings for an upload-only job that
+// core.UploadJob has no fields for. Like WorkflowOptions, we keep
+// them in a separate store, keyed by upload job ID.
+type UploadJobOptions struct {
+	UploadJobID string `json:"uploadJobId"`
+	// KeyPrefix is prepended to the key of everything the job
+	// uploads. It can use the {yyyy}, {mm} and {dd} placeholders.
+	KeyPrefix      string `json:"keyPrefix"`
+	SymlinkPolicy  string `json:"symlinkPolicy"`
+	EmptyDirPolicy string `json:"emptyDirPolicy"`
+}
+
+var uploadJobOptionsStore = NewJSONStore[UploadJobOptions]("upload_job_options.json")
+
+// GetUploadJobOptions returns the saved options for the upload job
+// with the specified ID, or the default options if none have been
+// saved. By default, we skip symlinks and empty directories.
+func GetUploadJobOptions(uploadJobID string) *UploadJobOptions {
+	allOptions, err := uploadJobOptionsStore.Load()
+	if err != nil {
+		core.Dart.Log.Errorf("Cannot load upload job options: %v", err)
+	}
+	for i := range allOptions {
+		if allOptions[i].UploadJobID == uploadJobID {
+			return &allOptions[i]
+		}
+	}
+	return &UploadJobOptions{
+		UploadJobID:    uploadJobID,
+		SymlinkPolicy:  SymlinkSkip,
+		EmptyDirPolicy: EmptyDirSkip,
+	}
+}
+
+// SaveUploadJobOptions saves opts, replacing any
+// options previously saved for the same upload job.
+func SaveUploadJobOptions(opts *UploadJobOptions) error {
+	return uploadJobOptionsStore.Update(func(allOptions []UploadJobOptions) ([]UploadJobOptions, error) {
+		for i := range allOptions {
+			if allOptions[i].UploadJobID == opts.UploadJobID {
+				allOptions[i] = *opts
+				return allOptions, nil
+			}
+		}
+		return append(allOptions, *opts), nil
+	})
+}
+
+// DeleteUploadJobOptions deletes the options for the upload
+// job with the specified ID, if there are any.
+func DeleteUploadJobOptions(uploadJobID string) error {
+	return uploadJobOptionsStore.Update(func(allOptions []UploadJobOptions) ([]UploadJobOptions, error) {
+		kept := make([]UploadJobOptions, 0, len(allOptions))
+		for _, opts := range allOptions {
+			if opts.UploadJobID != uploadJobID {
+				kept = append(kept, opts)
+			}
+		}
+		return kept, nil
+	})
+}
+
+// UploadJobOptionsFromRequest reads options for the upload job
+// with the specified ID from the upload targets form. Policies
+// missing from the form default to skip.
+func UploadJobOptionsFromRequest(c *gin.Context, uploadJobID string) *UploadJobOptions {
+	return &UploadJobOptions{
+		UploadJobID:    uploadJobID,
+		KeyPrefix:      strings.TrimSpace(c.PostForm("KeyPrefix")),
+		SymlinkPolicy:  c.DefaultPostForm("SymlinkPolicy", SymlinkSkip),
+		EmptyDirPolicy: c.DefaultPostForm("EmptyDirPolicy", EmptyDirSkip),
+	}
+}
+
+// Validate returns a map of field names to error messages. The map
+// is empty if the options are valid.
+func (opts *UploadJobOptions) Validate() map[string]string {
+	errors := make(map[string]string)
+	if err := CheckKeyTemplate(opts.KeyPrefix); err != nil {
+		errors["KeyPrefix"] = err.Error()
+	} else if _, err := opts.ExpandKeyPrefix(uploadJobKeyLookup(time.Now())); err != nil {
+		errors["KeyPrefix"] = err.Error()
+	}
+	switch opts.SymlinkPolicy {
+	case SymlinkSkip, SymlinkFollow, SymlinkFail:
+	default:
+		errors["SymlinkPolicy"] = fmt.Sprintf("Unknown symlink policy %q.", opts.SymlinkPolicy)
+	}
+	switch opts.EmptyDirPolicy {
+	case EmptyDirSkip, EmptyDirCreate:
+	default:
+		errors["EmptyDirPolicy"] = fmt.Sprintf("Unknown empty directory policy %q.", opts.EmptyDirPolicy)
+	}
+	return errors
+}
+
+// ExpandKeyPrefix fills the placeholders in opts.KeyPrefix from lookup
+// and returns the prefix without leading or trailing slashes.
+func (opts *UploadJobOptions) ExpandKeyPrefix(lookup func(string) (string, bool)) (string, error) {
+	if opts.KeyPrefix == "" {
+		return "", nil
+	}
+	prefix, err := expandPlaceholders("Key prefix", opts.KeyPrefix, lookup, nil)
+	if err != nil {
+		return "", err
+	}
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return "", nil
+	}
+	return prefix, ValidateObjectKey(prefix)
+}
+
+// AddUploadJobOptionFields adds fields for opts to an upload job's
+// targets form.
+func AddUploadJobOptionFields(form *core.Form, opts *UploadJobOptions, errors map[string]string) {
+	prefixField := form.AddField("KeyPrefix", "Key Prefix", opts.KeyPrefix, false)
+	prefixField.Help = "Optional folder for uploaded files and directories, relative to the bucket, such as transfers/{yyyy}-{mm}-{dd}. Directories keep their structure beneath it."
+
+	symlinkField := form.AddField("SymlinkPolicy", "Symbolic Links", opts.SymlinkPolicy, true)
+	symlinkField.Choices = []core.Choice{
+		{Label: "Skip them", Value: SymlinkSkip, Selected: opts.SymlinkPolicy == SymlinkSkip},
+		{Label: "Upload what they point to", Value: SymlinkFollow, Selected: opts.SymlinkPolicy == SymlinkFollow},
+		{Label: "Don't start the job", Value: SymlinkFail, Selected: opts.SymlinkPolicy == SymlinkFail},
+	}
+	symlinkField.Help = "What to do with symbolic links inside directories you upload. Links that point back into a directory they're in are always an error."
+
+	emptyDirField := form.AddField("EmptyDirPolicy", "Empty Directories", opts.EmptyDirPolicy, true)
+	emptyDirField.Choices = []core.Choice{
+		{Label: "Skip them", Value: EmptyDirSkip, Selected: opts.EmptyDirPolicy == EmptyDirSkip},
+		{Label: "Create them", Value: EmptyDirCreate, Selected: opts.EmptyDirPolicy == EmptyDirCreate},
+	}
+	emptyDirField.Help = "S3 has no real directories. For S3 targets, DART creates an empty object whose name ends with a slash."
+
+	for fieldName, message := range errors {
+		if field, ok := form.Fields[fieldName]; ok {
+			field.Error = message
+		}
+	}
+}
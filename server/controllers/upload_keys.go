@@ -0,0 +1,307 @@
+package controllers
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/APTrust/dart-runner/core"
+)
+
+// A key template tells DART where to put a bag on a storage service,
+// relative to the service's bucket. Placeholders in curly braces are
+// replaced when the job runs:
+//
+//	{bag_name}       the bag's name, without any extension
+//	{job_name}       the job's name
+//	{workflow_name}  the name of the job's workflow
+//	{yyyy} {mm} {dd} the year, month and day the job runs
+//	{Tag-Name}       the value of Tag-Name in bag-info.txt
+//	{file.txt/Tag}   the value of Tag in tag file file.txt
+//
+// For example, {Source-Organization}/{yyyy}/{mm}/{bag_name}.tar. If
+// the expanded template ends with a slash, we append the file name.
+const (
+	KeyVarBagName      = "bag_name"
+	KeyVarJobName      = "job_name"
+	KeyVarWorkflowName = "workflow_name"
+	KeyVarYear         = "yyyy"
+	KeyVarMonth        = "mm"
+	KeyVarDay          = "dd"
+)
+
+// MaxObjectKeyLength is the longest key S3 allows, in bytes.
+const MaxObjectKeyLength = 1024
+
+// illegalKeyCharacters are characters we don't allow in object keys.
+// S3 would accept most of them, but Windows shares, SFTP servers and
+// many tools that later read the bucket would not.
+const illegalKeyCharacters = `\:*?"<>|`
+
+// keyTemplateHelp is the help text for key template form fields.
+const keyTemplateHelp = "Optional path for uploaded bags, relative to the bucket, such as {Source-Organization}/{yyyy}/{mm}/{bag_name}.tar. You can use {bag_name}, {job_name}, {workflow_name}, {yyyy}, {mm}, {dd} and the names of bag-info.txt tags. Leave this empty to upload bags under their file names."
+
+var keyTemplatePlaceholder = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// CheckKeyTemplate returns an error if template has unbalanced
+// braces, empty placeholders or illegal characters. It can't tell
+// whether tag placeholders will have values. That depends on the job.
+func CheckKeyTemplate(template string) error {
+	if template == "" {
+		return nil
+	}
+	for _, match := range keyTemplatePlaceholder.FindAllStringSubmatch(template, -1) {
+		if strings.TrimSpace(match[1]) == "" {
+			return fmt.Errorf("Key template contains an empty placeholder {}.")
+		}
+	}
+	literal := keyTemplatePlaceholder.ReplaceAllString(template, "x")
+	if strings.ContainsAny(literal, "{}") {
+		return fmt.Errorf("Key template has an unmatched curly brace.")
+	}
+	return ValidateObjectKey(strings.TrimSuffix(literal, "/"))
+}
+
+// ValidateObjectKey returns an error if key is empty, too long, starts
+// with a slash, has empty, "." or ".." path segments, or contains
+// control characters or characters that are illegal on common
+// filesystems.
+func ValidateObjectKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("Object key is empty.")
+	}
+	if len(key) > MaxObjectKeyLength {
+		return fmt.Errorf("Object key is %d bytes long. The limit is %d.", len(key), MaxObjectKeyLength)
+	}
+	if strings.HasPrefix(key, "/") {
+		return fmt.Errorf("Object key %q must not start with a slash.", key)
+	}
+	for _, r := range key {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("Object key %q contains a control character.", key)
+		}
+		if strings.ContainsRune(illegalKeyCharacters, r) {
+			return fmt.Errorf("Object key %q contains illegal character %q.", key, r)
+		}
+	}
+	for _, segment := range strings.Split(key, "/") {
+		switch segment {
+		case "":
+			return fmt.Errorf("Object key %q contains an empty path segment.", key)
+		case ".", "..":
+			return fmt.Errorf("Object key %q contains a %q path segment.", key, segment)
+		}
+	}
+	return nil
+}
+
+// ExpandKeyTemplate replaces the placeholders in template with the
+// values that lookup returns, and appends fileName if the result
+// ends with a slash. It returns an error if a placeholder is unknown
+// or empty, if a value contains a slash, or if the resulting key
+// is not legal.
+func ExpandKeyTemplate(template, fileName string, lookup func(name string) (string, bool)) (string, error) {
+	if err := CheckKeyTemplate(template); err != nil {
+		return "", err
+	}
+	key, err := expandPlaceholders("Key template", template, lookup, func(name, value string) error {
+		if strings.Contains(value, "/") {
+			return fmt.Errorf("The value of {%s} (%q) contains a slash, which would add a level to the key.", name, value)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if strings.HasSuffix(key, "/") {
+		key += fileName
+	}
+	return key, ValidateObjectKey(key)
+}
+
+// expandPlaceholders replaces the placeholders in template with the
+// values that lookup returns. It returns an error if a placeholder is
+// unknown or empty, or if check rejects a value. The description says
+// what kind of template this is, for error messages.
+func expandPlaceholders(description, template string, lookup func(string) (string, bool), check func(name, value string) error) (string, error) {
+	var expandErr error
+	expanded := keyTemplatePlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		name := strings.TrimSpace(placeholder[1 : len(placeholder)-1])
+		value, found := lookup(name)
+		value = strings.TrimSpace(value)
+		switch {
+		case expandErr != nil:
+		case !found:
+			expandErr = fmt.Errorf("%s refers to {%s}, which is neither a known variable nor a tag in this job.", description, name)
+		case value == "":
+			expandErr = fmt.Errorf("%s refers to {%s}, which has no value in this job.", description, name)
+		case check != nil:
+			expandErr = check(name, value)
+		}
+		return value
+	})
+	return expanded, expandErr
+}
+
+// jobKeyLookup returns a function that looks up key template
+// placeholders for job, using now for the date placeholders.
+func jobKeyLookup(job *core.Job, workflowName string, now time.Time) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		switch name {
+		case KeyVarBagName:
+			if job.PackageOp == nil {
+				return "", false
+			}
+			return job.PackageOp.BagName, true
+		case KeyVarJobName:
+			return job.Name(), true
+		case KeyVarWorkflowName:
+			return workflowName, workflowName != ""
+		case KeyVarYear:
+			return now.Format("2006"), true
+		case KeyVarMonth:
+			return now.Format("01"), true
+		case KeyVarDay:
+			return now.Format("02"), true
+		}
+		return jobTagValue(job, name)
+	}
+}
+
+// jobWorkflowName returns the name of job's workflow, or an
+// empty string if the job doesn't belong to a workflow.
+func jobWorkflowName(job *core.Job) string {
+	if job.WorkflowID == "" {
+		return ""
+	}
+	result := core.ObjFind(job.WorkflowID)
+	if result.Error != nil || result.Workflow() == nil {
+		return ""
+	}
+	return result.Workflow().Name
+}
+
+// jobTagValue returns the value of the tag that name refers to.
+// Plain tag names refer to bag-info.txt. Names of the form
+// file.txt/Tag-Name refer to other tag files.
+func jobTagValue(job *core.Job, name string) (string, bool) {
+	if job.BagItProfile == nil {
+		return "", false
+	}
+	tagFile, tagName, found := strings.Cut(name, "/")
+	if !found {
+		tagFile, tagName = "bag-info.txt", name
+	}
+	for _, tag := range job.BagItProfile.Tags {
+		if tag.TagFile == tagFile && strings.EqualFold(tag.TagName, tagName) {
+			return tag.GetValue(), true
+		}
+	}
+	return "", false
+}
+
+// KeyTemplateFor returns the key template for uploads to ss in a job
+// that belongs to the specified workflow. A workflow's template takes
+// precedence over the storage service's. An empty template means the
+// file is uploaded under its own name.
+func KeyTemplateFor(workflowID string, ss *core.StorageService) string {
+	if workflowID != "" {
+		if template := GetWorkflowOptions(workflowID).KeyTemplate; template != "" {
+			return template
+		}
+	}
+	if ss == nil {
+		return ""
+	}
+	return GetStorageServiceOptions(ss).KeyTemplate
+}
+
+// UploadKeys holds the object key for each file of each upload
+// operation whose files don't go under their own names.
+type UploadKeys map[*core.UploadOperation]map[string]string
+
+// Key returns the object key for sourcePath in op. That's the
+// file's base name unless a key template applies.
+func (keys UploadKeys) Key(op *core.UploadOperation, sourcePath string) string {
+	if key, ok := keys[op][sourcePath]; ok {
+		return key
+	}
+	return filepath.Base(sourcePath)
+}
+
+// UploadKeyPreview describes where one file of a job will be
+// uploaded, for display before the job runs.
+type UploadKeyPreview struct {
+	StorageServiceName string
+	Bucket             string
+	SourcePath         string
+	Template           string
+	Key                string
+	Error              string
+}
+
+// PreviewJobUploadKeys expands the key templates that apply to job's
+// uploads, using today's date. Previews with no template show the
+// file name.
+func PreviewJobUploadKeys(job *core.Job) []*UploadKeyPreview {
+	previews, _ := jobUploadKeys(job, time.Now())
+	return previews
+}
+
+// JobUploadKeys expands the key templates that apply to job's uploads.
+// It returns an error describing the first template that can't be
+// expanded into a legal key.
+func JobUploadKeys(job *core.Job) (UploadKeys, error) {
+	previews, keys := jobUploadKeys(job, time.Now())
+	for _, preview := range previews {
+		if preview.Error != "" {
+			return nil, fmt.Errorf("Cannot build object key for %s on %s: %s", filepath.Base(preview.SourcePath), preview.StorageServiceName, preview.Error)
+		}
+	}
+	return keys, nil
+}
+
+func jobUploadKeys(job *core.Job, now time.Time) ([]*UploadKeyPreview, UploadKeys) {
+	previews := make([]*UploadKeyPreview, 0)
+	keys := make(UploadKeys)
+	lookup := jobKeyLookup(job, jobWorkflowName(job), now)
+	for _, op := range job.UploadOps {
+		if op.StorageService == nil {
+			continue
+		}
+		template := KeyTemplateFor(job.WorkflowID, op.StorageService)
+		usedKeys := make(map[string]string)
+		for _, sourcePath := range op.SourceFiles {
+			preview := &UploadKeyPreview{
+				StorageServiceName: op.StorageService.Name,
+				Bucket:             op.StorageService.Bucket,
+				SourcePath:         sourcePath,
+				Template:           template,
+				Key:                filepath.Base(sourcePath),
+			}
+			previews = append(previews, preview)
+			if template == "" {
+				continue
+			}
+			key, err := ExpandKeyTemplate(template, filepath.Base(sourcePath), lookup)
+			if err == nil && usedKeys[key] != "" {
+				err = fmt.Errorf("Key %s is also used for %s. Add {bag_name} to the template or end it with a slash.", key, filepath.Base(usedKeys[key]))
+			}
+			if err != nil {
+				preview.Key = ""
+				preview.Error = err.Error()
+				continue
+			}
+			preview.Key = key
+			usedKeys[key] = sourcePath
+			if keys[op] == nil {
+				keys[op] = make(map[string]string)
+			}
+			keys[op][sourcePath] = key
+		}
+	}
+	return previews, keys
+}
@@ -0,0 +1,182 @@
+package controllers_test
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart/v3/server/controllers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckKeyTemplate(t *testing.T) {
+	valid := []string{
+		"",
+		"{bag_name}.tar",
+		"{Source-Organization}/{yyyy}/{mm}/{bag_name}.tar",
+		"deposits/{aptrust-info.txt/Access}/",
+	}
+	for _, template := range valid {
+		assert.NoError(t, controllers.CheckKeyTemplate(template), template)
+	}
+	invalid := map[string]string{
+		"{bag_name.tar":        "unmatched curly brace",
+		"{}/{bag_name}":        "empty placeholder",
+		"/{bag_name}":          "must not start with a slash",
+		"a//{bag_name}":        "empty path segment",
+		"../{bag_name}":        `".." path segment`,
+		"a:b/{bag_name}":       "illegal character ':'",
+		"back\\slash/{bag_nm}": `illegal character '\\'`,
+	}
+	for template, message := range invalid {
+		err := controllers.CheckKeyTemplate(template)
+		require.Error(t, err, template)
+		assert.Contains(t, err.Error(), message, template)
+	}
+}
+
+func TestExpandKeyTemplate(t *testing.T) {
+	values := map[string]string{
+		"bag_name":            "bag-001",
+		"Source-Organization": "Example University",
+		"yyyy":                "2026",
+		"Empty-Tag":           "",
+		"Slashed":             "a/b",
+		"Colon":               "a:b",
+	}
+	lookup := func(name string) (string, bool) {
+		value, ok := values[name]
+		return value, ok
+	}
+	key, err := controllers.ExpandKeyTemplate("{Source-Organization}/{yyyy}/{bag_name}.tar", "bag-001.tar", lookup)
+	require.NoError(t, err)
+	assert.Equal(t, "Example University/2026/bag-001.tar", key)
+
+	key, err = controllers.ExpandKeyTemplate("{ Source-Organization }/", "bag-001.tar", lookup)
+	require.NoError(t, err)
+	assert.Equal(t, "Example University/bag-001.tar", key)
+
+	errors := map[string]string{
+		"{No-Such-Tag}/{bag_name}": "neither a known variable nor a tag",
+		"{Empty-Tag}/{bag_name}":   "has no value",
+		"{Slashed}/{bag_name}":     "contains a slash",
+		"{Colon}/{bag_name}":       "illegal character ':'",
+	}
+	for template, message := range errors {
+		_, err = controllers.ExpandKeyTemplate(template, "bag-001.tar", lookup)
+		require.Error(t, err, template)
+		assert.Contains(t, err.Error(), message, template)
+	}
+}
+
+func getKeyTemplateJob(t *testing.T, ss *core.StorageService) *core.Job {
+	return &core.Job{
+		ID: "11111111-2222-3333-4444-555555555555",
+		PackageOp: &core.PackageOperation{
+			BagName:    "bag-001",
+			OutputPath: filepath.Join(t.TempDir(), "bag-001.tar"),
+		},
+		BagItProfile: &core.BagItProfile{
+			Tags: []*core.TagDefinition{
+				{TagFile: "bag-info.txt", TagName: "Source-Organization", UserValue: "Example University"},
+				{TagFile: "aptrust-info.txt", TagName: "Access", DefaultValue: "Institution"},
+				{TagFile: "bag-info.txt", TagName: "Internal-Sender-Description"},
+			},
+		},
+		UploadOps: []*core.UploadOperation{
+			core.NewUploadOperation(ss, []string{filepath.Join(t.TempDir(), "bag-001.tar")}),
+		},
+	}
+}
+
+func TestJobUploadKeys(t *testing.T) {
+	defer core.ClearDartTable()
+	ss := getFilesystemService(t)
+	job := getKeyTemplateJob(t, ss)
+	op := job.UploadOps[0]
+	sourcePath := op.SourceFiles[0]
+
+	// No template: the bag goes under its file name.
+	keys, err := controllers.JobUploadKeys(job)
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+	assert.Equal(t, "bag-001.tar", keys.Key(op, sourcePath))
+
+	opts := controllers.DefaultStorageServiceOptions(ss)
+	opts.KeyTemplate = "{Source-Organization}/{aptrust-info.txt/Access}/{yyyy}/{bag_name}.tar"
+	require.NoError(t, controllers.SaveStorageServiceOptions(opts))
+	keys, err = controllers.JobUploadKeys(job)
+	require.NoError(t, err)
+	expected := path.Join("Example University", "Institution", time.Now().Format("2006"), "bag-001.tar")
+	assert.Equal(t, expected, keys.Key(op, sourcePath))
+
+	previews := controllers.PreviewJobUploadKeys(job)
+	require.Equal(t, 1, len(previews))
+	assert.Equal(t, opts.KeyTemplate, previews[0].Template)
+	assert.Equal(t, expected, previews[0].Key)
+	assert.Empty(t, previews[0].Error)
+
+	// A workflow's template overrides the storage service's.
+	job.WorkflowID = "99999999-2222-3333-4444-555555555555"
+	require.NoError(t, controllers.SaveWorkflowOptions(&controllers.WorkflowOptions{
+		WorkflowID:  job.WorkflowID,
+		KeyTemplate: "{Internal-Sender-Description}/{bag_name}.tar",
+	}))
+	_, err = controllers.JobUploadKeys(job)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "{Internal-Sender-Description}, which has no value")
+	previews = controllers.PreviewJobUploadKeys(job)
+	assert.Empty(t, previews[0].Key)
+	assert.Contains(t, previews[0].Error, "has no value")
+
+	require.NoError(t, controllers.DeleteWorkflowOptions(job.WorkflowID))
+	assert.Empty(t, controllers.GetWorkflowOptions(job.WorkflowID).KeyTemplate)
+	require.NoError(t, controllers.DeleteStorageServiceOptions(ss.ID))
+}
+
+func TestCopyToFilesystemAs(t *testing.T) {
+	ss := getFilesystemService(t)
+	tarFile := filepath.Join(t.TempDir(), "bag.tar")
+	require.NoError(t, os.WriteFile(tarFile, []byte("Bag contents"), 0644))
+
+	targetPath, err := controllers.CopyToFilesystemAs(ss, tarFile, "Example University/2026/bag.tar")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(ss.Bucket, "Example University", "2026", "bag.tar"), targetPath)
+	data, err := os.ReadFile(targetPath)
+	require.NoError(t, err)
+	assert.Equal(t, "Bag contents", string(data))
+
+	_, err = controllers.CopyToFilesystemAs(ss, tarFile, "../escape.tar")
+	assert.Error(t, err)
+}
+
+func TestUploadToSFTP(t *testing.T) {
+	defer core.ClearDartTable()
+	ss := loadSFTPStorageService(t)
+	tarFile := filepath.Join(t.TempDir(), "bag.tar")
+	require.NoError(t, os.WriteFile(tarFile, []byte("Bag contents"), 0644))
+
+	key := "Example University/2026/bag.tar"
+	remotePath, err := controllers.UploadToSFTP(ss, tarFile, key)
+	require.NoError(t, err)
+	assert.Equal(t, path.Join(ss.Bucket, key), remotePath)
+
+	// Uploading again replaces the earlier copy.
+	require.NoError(t, os.WriteFile(tarFile, []byte("New bag contents"), 0644))
+	_, err = controllers.UploadToSFTP(ss, tarFile, key)
+	require.NoError(t, err)
+	v := controllers.VerifyUploadAs(ss, tarFile, key)
+	assert.True(t, v.OK(), v.Error)
+
+	conn, err := controllers.NewSFTPConnection(ss)
+	require.NoError(t, err)
+	defer conn.Close()
+	entries, err := conn.ReadDir(path.Dir(remotePath))
+	require.NoError(t, err)
+	require.Equal(t, 1, len(entries), "temp files should be gone")
+	require.NoError(t, conn.Remove(remotePath))
+}
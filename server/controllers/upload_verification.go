@@ -0,0 +1,364 @@
+package controllers
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/minio/minio-go/v7"
+)
+
+// UploadVerificationReportName is the name of the artifact in which
+// we save the results of post-upload verification.
+const UploadVerificationReportName = "upload-verification.txt"
+
+// Verification methods, from strongest to weakest.
+const (
+	VerifiedBySHA256        = "sha256"
+	VerifiedByETag          = "etag-md5"
+	VerifiedByMultipartETag = "etag-multipart"
+	VerifiedBySize          = "size"
+)
+
+// UploadVerification describes how we checked one uploaded file
+// against its local source, and what we found.
+type UploadVerification struct {
+	StorageServiceName string
+	LocalPath          string
+	RemotePath         string
+	LocalSize          int64
+	RemoteSize         int64
+	Method             string
+	Expected           string
+	Actual             string
+	Note               string
+	Error              string
+}
+
+// OK returns true if the remote file matched the local one.
+func (v *UploadVerification) OK() bool {
+	return v.Error == ""
+}
+
+// VerifyUpload checks that the copy of localPath on ss matches the
+// local file. DART Runner stores uploads under the file's base name,
+// at the top of the bucket for S3 and in the bucket directory for
+// SFTP, so that's where we look. Use VerifyUploadAs for files that
+// were uploaded under a different key.
+//
+// For S3, we compare size and ETag. A single-part ETag is the MD5 of
+// the object. A multipart ETag is the MD5 of the parts' MD5s, so we
+// recompute it locally for each part size that yields the right part
+// count. ETags of objects encrypted with KMS or customer keys aren't
+// checksums, so for those we check only the size.
+//
+// For SFTP, we compare size and, if the server lets us run sha256sum
+// or shasum over SSH, the SHA-256 checksum.
+func VerifyUpload(ss *core.StorageService, localPath string) *UploadVerification {
+	return VerifyUploadAs(ss, localPath, filepath.Base(localPath))
+}
+
+// VerifyUploadAs checks that the object stored under key in the bucket
+// of ss matches the local file at localPath. See VerifyUpload.
+func VerifyUploadAs(ss *core.StorageService, localPath, key string) *UploadVerification {
+	v := &UploadVerification{
+		StorageServiceName: ss.Name,
+		LocalPath:          localPath,
+	}
+	stat, err := os.Stat(localPath)
+	if err != nil {
+		v.Error = err.Error()
+		return v
+	}
+	if stat.IsDir() {
+		v.Method = VerifiedBySize
+		v.Note = "Directory uploads are not verified."
+		return v
+	}
+	v.LocalSize = stat.Size()
+	switch ss.Protocol {
+	case constants.ProtocolS3:
+		verifyS3Upload(v, ss, key)
+	case constants.ProtocolSFTP:
+		verifySFTPUpload(v, ss, key)
+	default:
+		v.Error = fmt.Sprintf("DART cannot verify uploads to %s services", ss.Protocol)
+	}
+	return v
+}
+
+func verifyS3Upload(v *UploadVerification, ss *core.StorageService, key string) {
+	client, err := NewMinioClient(ss)
+	if err != nil {
+		v.RemotePath = ss.Bucket + "/" + key
+		v.Error = err.Error()
+		return
+	}
+	verifyS3Object(v, client, ss.Bucket, key)
+}
+
+// verifyS3Object compares the object at key in bucket with the local
+// file described by v, using an existing client.
+func verifyS3Object(v *UploadVerification, client *minio.Client, bucket, key string) {
+	v.RemotePath = bucket + "/" + key
+	ctx, cancel := context.WithTimeout(context.Background(), DiagnosticTimeout)
+	defer cancel()
+	objInfo, err := client.StatObject(ctx, bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		v.Error = fmt.Sprintf("Cannot find uploaded object: %v", err)
+		return
+	}
+	v.RemoteSize = objInfo.Size
+	if v.RemoteSize != v.LocalSize {
+		v.Method = VerifiedBySize
+		v.Error = fmt.Sprintf("Size mismatch: local file is %d bytes, remote object is %d bytes", v.LocalSize, v.RemoteSize)
+		return
+	}
+	etag := strings.Trim(objInfo.ETag, `"`)
+	v.Actual = etag
+	encryption := objInfo.Metadata.Get("X-Amz-Server-Side-Encryption")
+	if encryption == "aws:kms" || encryption == "aws:kms:dsse" || objInfo.Metadata.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") != "" {
+		v.Method = VerifiedBySize
+		v.Note = "Object is encrypted with a KMS or customer key, so its ETag is not a checksum. Verified size only."
+		return
+	}
+	etagPrefix, partCountStr, isMultipart := strings.Cut(etag, "-")
+	if !isMultipart {
+		v.Method = VerifiedByETag
+		digests, err := fileDigests(v.LocalPath, []string{"md5"})
+		if err != nil {
+			v.Error = err.Error()
+			return
+		}
+		v.Expected = digests["md5"]
+		if v.Expected != etag {
+			v.Error = fmt.Sprintf("ETag mismatch: local MD5 is %s, remote ETag is %s", v.Expected, etag)
+		}
+		return
+	}
+	v.Method = VerifiedByMultipartETag
+	partCount, err := strconv.Atoi(partCountStr)
+	if err != nil || len(etagPrefix) != 32 {
+		v.Method = VerifiedBySize
+		v.Note = fmt.Sprintf("Unrecognized ETag %s. Verified size only.", etag)
+		return
+	}
+	partSizes := MultipartPartSizeCandidates(v.LocalSize, partCount)
+	for _, partSize := range partSizes {
+		localETag, err := LocalMultipartETag(v.LocalPath, partSize)
+		if err != nil {
+			v.Error = err.Error()
+			return
+		}
+		if localETag == etag {
+			v.Expected = localETag
+			v.Note = fmt.Sprintf("Matched with part size %d.", partSize)
+			return
+		}
+	}
+	v.Error = fmt.Sprintf("Multipart ETag mismatch: no local ETag matched %s (tried %d part sizes)", etag, len(partSizes))
+}
+
+func verifySFTPUpload(v *UploadVerification, ss *core.StorageService, key string) {
+	remotePath, err := SFTPRemotePath(ss.Bucket, key)
+	if err != nil {
+		v.Error = err.Error()
+		return
+	}
+	v.RemotePath = remotePath
+	conn, err := NewSFTPConnection(ss)
+	if err != nil {
+		v.Error = err.Error()
+		return
+	}
+	defer conn.Close()
+	verifySFTPFile(v, conn, remotePath)
+}
+
+// verifySFTPFile compares the file at remotePath with the local
+// file described by v, using an existing connection.
+func verifySFTPFile(v *UploadVerification, conn *SFTPConnection, remotePath string) {
+	v.RemotePath = remotePath
+	stat, err := conn.Stat(remotePath)
+	if err != nil {
+		v.Error = fmt.Sprintf("Cannot find uploaded file: %v", err)
+		return
+	}
+	v.RemoteSize = stat.Size()
+	v.Method = VerifiedBySize
+	if v.RemoteSize != v.LocalSize {
+		v.Error = fmt.Sprintf("Size mismatch: local file is %d bytes, remote file is %d bytes", v.LocalSize, v.RemoteSize)
+		return
+	}
+	remoteSHA256, err := conn.RemoteSHA256(remotePath)
+	if err != nil {
+		v.Note = fmt.Sprintf("Server cannot compute checksums (%v). Verified size only.", err)
+		return
+	}
+	v.Method = VerifiedBySHA256
+	v.Actual = remoteSHA256
+	v.Expected, err = sha256File(v.LocalPath)
+	if err != nil {
+		v.Error = err.Error()
+		return
+	}
+	if v.Expected != v.Actual {
+		v.Error = fmt.Sprintf("Checksum mismatch: local sha256 is %s, remote sha256 is %s", v.Expected, v.Actual)
+	}
+}
+
+// MultipartPartSizeCandidates returns the part sizes, smallest first,
+// that would split an object of size bytes into partCount parts. We
+// try the part size minio-go would choose, sizes commonly used by
+// other S3 clients, and the smallest whole number of MiB that works.
+func MultipartPartSizeCandidates(size int64, partCount int) []int64 {
+	const mib = 1024 * 1024
+	sizes := make(map[int64]bool)
+	if _, partSize, _, err := minio.OptimalPartInfo(size, 0); err == nil {
+		sizes[partSize] = true
+	}
+	for _, n := range []int64{5, 8, 10, 15, 16, 25, 32, 50, 64, 100, 128, 256, 512} {
+		sizes[n*mib] = true
+	}
+	if partCount > 0 {
+		perPart := (size + int64(partCount) - 1) / int64(partCount)
+		sizes[((perPart+mib-1)/mib)*mib] = true
+	}
+	candidates := make([]int64, 0)
+	for partSize := range sizes {
+		if partSize > 0 && (size+partSize-1)/partSize == int64(partCount) {
+			candidates = append(candidates, partSize)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i] < candidates[j] })
+	return candidates
+}
+
+// LocalMultipartETag returns the ETag S3 would assign to filePath if it
+// were uploaded in parts of partSize bytes: the MD5 of the concatenated
+// MD5s of the parts, followed by a dash and the number of parts.
+func LocalMultipartETag(filePath string, partSize int64) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	combined := md5.New()
+	partCount := 0
+	for {
+		partHash := md5.New()
+		n, err := io.CopyN(partHash, file, partSize)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		if n == 0 && partCount > 0 {
+			break
+		}
+		combined.Write(partHash.Sum(nil))
+		partCount++
+		if n < partSize {
+			break
+		}
+	}
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(combined.Sum(nil)), partCount), nil
+}
+
+// VerifyUploadOperations verifies every file uploaded by ops and records
+// the outcome in each operation's result. A mismatch is recorded as an
+// error in the result. It returns the verifications and ExitOK if all
+// of them passed.
+func VerifyUploadOperations(ops []*core.UploadOperation, messageChannel chan *core.EventMessage) ([]*UploadVerification, int) {
+	verifications := make([]*UploadVerification, 0)
+	exitCode := constants.ExitOK
+	for _, op := range ops {
+		if op.Result == nil {
+			continue
+		}
+		if op.Result.Errors == nil {
+			op.Result.Errors = make(map[string]string)
+		}
+		for _, sourcePath := range op.SourceFiles {
+			messageChannel <- core.InfoEvent(constants.StageUpload, fmt.Sprintf("Verifying upload of %s to %s", sourcePath, op.StorageService.Name))
+			v := VerifyUpload(op.StorageService, sourcePath)
+			verifications = append(verifications, v)
+			if !v.OK() {
+				op.Result.Errors[sourcePath] = fmt.Sprintf("Upload verification failed: %s", v.Error)
+				messageChannel <- core.WarningEvent(constants.StageUpload, fmt.Sprintf("Upload verification failed for %s on %s: %s", sourcePath, op.StorageService.Name, v.Error))
+				exitCode = constants.ExitRuntimeErr
+				continue
+			}
+			if v.Actual != "" {
+				op.Result.RemoteChecksum = v.Actual
+			}
+			op.Result.Info = strings.TrimSpace(op.Result.Info + " " + v.Summary())
+			messageChannel <- core.InfoEvent(constants.StageUpload, v.Summary())
+		}
+	}
+	return verifications, exitCode
+}
+
+// Summary returns a one-line description of the verification.
+func (v *UploadVerification) Summary() string {
+	if !v.OK() {
+		return fmt.Sprintf("%s: verification FAILED: %s", v.RemotePath, v.Error)
+	}
+	methods := map[string]string{
+		VerifiedBySHA256:        "size and SHA-256 match",
+		VerifiedByETag:          "size and ETag (MD5) match",
+		VerifiedByMultipartETag: "size and multipart ETag match",
+		VerifiedBySize:          "size matches",
+	}
+	summary := fmt.Sprintf("Verified %s on %s: %s.", v.RemotePath, v.StorageServiceName, methods[v.Method])
+	if v.Note != "" {
+		summary += " " + v.Note
+	}
+	return summary
+}
+
+// UploadVerificationReport returns a plain-text report
+// of verifications, suitable for saving as an artifact.
+func UploadVerificationReport(verifications []*UploadVerification) string {
+	var sb strings.Builder
+	failed := 0
+	for _, v := range verifications {
+		status := "OK"
+		if !v.OK() {
+			status = "FAILED"
+			failed++
+		}
+		sb.WriteString(fmt.Sprintf("%-6s  %s  %s -> %s (%s)\n", status, v.StorageServiceName, v.LocalPath, v.RemotePath, v.Method))
+		sb.WriteString(fmt.Sprintf("        local size %d, remote size %d\n", v.LocalSize, v.RemoteSize))
+		if v.Expected != "" || v.Actual != "" {
+			sb.WriteString(fmt.Sprintf("        expected %s, got %s\n", v.Expected, v.Actual))
+		}
+		if v.Note != "" {
+			sb.WriteString(fmt.Sprintf("        %s\n", v.Note))
+		}
+		if v.Error != "" {
+			sb.WriteString(fmt.Sprintf("        %s\n", v.Error))
+		}
+	}
+	sb.WriteString(fmt.Sprintf("\n%d uploads verified, %d failed.\n", len(verifications)-failed, failed))
+	return sb.String()
+}
+
+// saveUploadVerificationReport saves the report for verifications
+// as an artifact of the job with the specified ID.
+func saveUploadVerificationReport(bagName, jobID string, verifications []*UploadVerification) {
+	if len(verifications) == 0 {
+		return
+	}
+	artifact := core.NewTagFileArtifact(bagName, jobID, UploadVerificationReportName, UploadVerificationReport(verifications))
+	if err := core.ArtifactSave(artifact); err != nil {
+		core.Dart.Log.Errorf("Error saving upload verification report for job %s: %v", jobID, err)
+	}
+}
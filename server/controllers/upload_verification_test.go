@@ -0,0 +1,112 @@
+package controllers_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart/v3/server/controllers"
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalMultipartETag(t *testing.T) {
+	content := []byte("abcdefghijkl")
+	filePath := filepath.Join(t.TempDir(), "parts.bin")
+	require.NoError(t, os.WriteFile(filePath, content, 0644))
+
+	// Parts of 5 bytes: abcde, fghij, kl
+	combined := md5.New()
+	for _, part := range [][]byte{content[0:5], content[5:10], content[10:]} {
+		sum := md5.Sum(part)
+		combined.Write(sum[:])
+	}
+	expected := fmt.Sprintf("%s-3", hex.EncodeToString(combined.Sum(nil)))
+	etag, err := controllers.LocalMultipartETag(filePath, 5)
+	require.NoError(t, err)
+	assert.Equal(t, expected, etag)
+
+	// Exact multiple of the part size: two parts, no empty third part.
+	etag, err = controllers.LocalMultipartETag(filePath, 6)
+	require.NoError(t, err)
+	assert.Contains(t, etag, "-2")
+}
+
+func TestMultipartPartSizeCandidates(t *testing.T) {
+	const mib = 1024 * 1024
+	size := int64(100 * mib)
+	candidates := controllers.MultipartPartSizeCandidates(size, 7)
+	assert.Contains(t, candidates, int64(16*mib))
+	for _, partSize := range candidates {
+		assert.Equal(t, int64(7), (size+partSize-1)/partSize)
+	}
+	assert.Empty(t, controllers.MultipartPartSizeCandidates(size, 1000000))
+}
+
+func TestVerifyUploadSFTP(t *testing.T) {
+	defer core.ClearDartTable()
+	ss := loadSFTPStorageService(t)
+	content := []byte("Bag contents to verify")
+	localPath := filepath.Join(t.TempDir(), "verify-me.tar")
+	require.NoError(t, os.WriteFile(localPath, content, 0644))
+
+	conn, err := controllers.NewSFTPConnection(ss)
+	require.NoError(t, err)
+	defer conn.Close()
+	remotePath := path.Join(ss.Bucket, "verify-me.tar")
+	putSFTPFile(t, conn, remotePath, content)
+
+	v := controllers.VerifyUpload(ss, localPath)
+	assert.True(t, v.OK(), v.Error)
+	assert.Equal(t, int64(len(content)), v.RemoteSize)
+	assert.Contains(t, []string{controllers.VerifiedBySize, controllers.VerifiedBySHA256}, v.Method)
+
+	putSFTPFile(t, conn, remotePath, content[:10])
+	v = controllers.VerifyUpload(ss, localPath)
+	assert.False(t, v.OK())
+	assert.Contains(t, v.Error, "Size mismatch")
+
+	require.NoError(t, conn.Remove(remotePath))
+	v = controllers.VerifyUpload(ss, localPath)
+	assert.False(t, v.OK())
+	assert.Contains(t, v.Error, "Cannot find uploaded file")
+}
+
+func TestVerifyUploadS3(t *testing.T) {
+	defer core.ClearDartTable()
+	ss := loadMinioStorageService(t)
+	content := []byte("Bag contents to verify on S3")
+	localPath := filepath.Join(t.TempDir(), "verify-me-s3.tar")
+	require.NoError(t, os.WriteFile(localPath, content, 0644))
+
+	client, err := controllers.NewMinioClient(ss)
+	require.NoError(t, err)
+	ctx := context.Background()
+	_, err = client.PutObject(ctx, ss.Bucket, "verify-me-s3.tar", bytes.NewReader(content), int64(len(content)), minio.PutObjectOptions{})
+	require.NoError(t, err)
+	defer client.RemoveObject(ctx, ss.Bucket, "verify-me-s3.tar", minio.RemoveObjectOptions{})
+
+	v := controllers.VerifyUpload(ss, localPath)
+	assert.True(t, v.OK(), v.Error)
+	assert.Equal(t, controllers.VerifiedByETag, v.Method)
+
+	// Change the object but keep the size the same.
+	changed := bytes.ToUpper(content)
+	_, err = client.PutObject(ctx, ss.Bucket, "verify-me-s3.tar", bytes.NewReader(changed), int64(len(changed)), minio.PutObjectOptions{})
+	require.NoError(t, err)
+	v = controllers.VerifyUpload(ss, localPath)
+	assert.False(t, v.OK())
+	assert.Contains(t, v.Error, "ETag mismatch")
+
+	report := controllers.UploadVerificationReport([]*controllers.UploadVerification{v})
+	assert.Contains(t, report, "FAILED")
+	assert.Contains(t, report, "0 uploads verified, 1 failed.")
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"path/filepath"
 	"time"
 
 	"github.com/APTrust/dart-runner/constants"
@@ -243,6 +244,9 @@ func ValidationJobRun(c *gin.Context) {
 		// Run the job and have it send status updates back to the
 		// front end through the message channel.
 		exitCode := valJob.Run(messageChannel)
+		if !checkValidationJobTagValues(valJob, profile, messageChannel) && exitCode == constants.ExitOK {
+			exitCode = constants.ExitRuntimeErr
+		}
 
 		// When job completes, create the final disconnect event
 		// to tell the front end to stop listening for server-sent
@@ -296,6 +300,31 @@ func ValidationJobRun(c *gin.Context) {
 	//fmt.Println("Job Execute: client disconnected.")
 }
 
+// checkValidationJobTagValues checks the tag values in each bag the
+// job validated against the profile's TagValueRules, which the
+// validator in DART Runner doesn't know about. It reports each bad
+// value as an error event and in valJob.Errors, and returns false
+// if it found any.
+func checkValidationJobTagValues(valJob *core.ValidationJob, profile *core.BagItProfile, messageChannel chan *core.EventMessage) bool {
+	allValid := true
+	for _, bagPath := range valJob.PathsToValidate {
+		tagErrors, err := ValidateBagTagValues(bagPath, profile)
+		if err != nil {
+			core.Dart.Log.Warningf("Could not check tag values in %s: %v", bagPath, err)
+			continue
+		}
+		for tagName, message := range tagErrors {
+			allValid = false
+			if valJob.Errors == nil {
+				valJob.Errors = make(map[string]string)
+			}
+			valJob.Errors[fmt.Sprintf("%s: %s", filepath.Base(bagPath), tagName)] = message
+			messageChannel <- core.ErrorEvent(constants.StageValidation, fmt.Sprintf("%s: %s: %s", filepath.Base(bagPath), tagName, message))
+		}
+	}
+	return allValid
+}
+
 func loadValidationJob(valJobID string) (*core.ValidationJob, error) {
 	result := core.ObjFind(valJobID)
 	return result.ValidationJob(), result.Error
@@ -0,0 +1,601 @@
+package controllers
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/APTrust/dart-runner/core"
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+)
+
+// ProtocolWebDAV is the protocol for WebDAV storage services, such as
+// Nextcloud. The service's Bucket is the path of the collection that
+// we upload to and browse, for example remote.php/dav/files/alice.
+const ProtocolWebDAV = "webdav"
+
+// WebDAVUploadProvider is the provider name we record in the
+// results of WebDAV uploads.
+const WebDAVUploadProvider = "DART WebDAV uploader"
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?><d:propfind xmlns:d="DAV:"><d:allprop/></d:propfind>`
+
+// WebDAVEntry describes a file or collection on a WebDAV server.
+type WebDAVEntry struct {
+	Path        string
+	IsDir       bool
+	Size        int64
+	ModTime     time.Time
+	ETag        string
+	ContentType string
+}
+
+// Name returns the last segment of the entry's path.
+func (entry *WebDAVEntry) Name() string {
+	return path.Base(strings.TrimSuffix(entry.Path, "/"))
+}
+
+type webDAVMultistatus struct {
+	Responses []webDAVResponse `xml:"DAV: response"`
+}
+
+type webDAVResponse struct {
+	Href      string           `xml:"DAV: href"`
+	Propstats []webDAVPropstat `xml:"DAV: propstat"`
+}
+
+type webDAVPropstat struct {
+	Prop   webDAVProp `xml:"DAV: prop"`
+	Status string     `xml:"DAV: status"`
+}
+
+type webDAVProp struct {
+	ResourceType struct {
+		Collection *struct{} `xml:"DAV: collection"`
+	} `xml:"DAV: resourcetype"`
+	ContentLength string `xml:"DAV: getcontentlength"`
+	LastModified  string `xml:"DAV: getlastmodified"`
+	ETag          string `xml:"DAV: getetag"`
+	ContentType   string `xml:"DAV: getcontenttype"`
+}
+
+// WebDAVClient makes requests to a WebDAV storage service. It uses
+// the service's StorageServiceOptions to decide whether to use TLS
+// and which certificates to trust or present.
+type WebDAVClient struct {
+	ss         *core.StorageService
+	baseURL    *url.URL
+	httpClient *http.Client
+}
+
+// NewWebDAVClient returns a client for WebDAV service ss.
+func NewWebDAVClient(ss *core.StorageService) (*WebDAVClient, error) {
+	if ss == nil {
+		return nil, fmt.Errorf("Storage service is nil")
+	}
+	opts := GetStorageServiceOptions(ss)
+	transport, err := opts.Transport()
+	if err != nil {
+		return nil, err
+	}
+	ss, err = ResolveStorageServiceCredentials(ss)
+	if err != nil {
+		return nil, err
+	}
+	scheme := "http"
+	if opts.UseTLS {
+		scheme = "https"
+	}
+	host := ss.Host
+	if ss.Port > 0 {
+		host = net.JoinHostPort(ss.Host, strconv.Itoa(ss.Port))
+	}
+	return &WebDAVClient{
+		ss:         ss,
+		baseURL:    &url.URL{Scheme: scheme, Host: host},
+		httpClient: &http.Client{Transport: transport},
+	}, nil
+}
+
+// WebDAVRemotePath returns the server path of the file whose key is
+// relative to bucket. The path always starts with a slash.
+func WebDAVRemotePath(bucket, key string) (string, error) {
+	if err := checkKeySegments(key); err != nil {
+		return "", err
+	}
+	return path.Join("/", bucket, key), nil
+}
+
+// URL returns the full URL of remotePath on the server.
+func (client *WebDAVClient) URL(remotePath string) string {
+	u := *client.baseURL
+	u.Path = remotePath
+	return u.String()
+}
+
+// Do sends a request for remotePath with the service's credentials.
+func (client *WebDAVClient) Do(method, remotePath string, body io.Reader, headers map[string]string) (*http.Response, error) {
+	req, err := client.newRequest(method, remotePath, body, headers)
+	if err != nil {
+		return nil, err
+	}
+	return client.httpClient.Do(req)
+}
+
+func (client *WebDAVClient) newRequest(method, remotePath string, body io.Reader, headers map[string]string) (*http.Request, error) {
+	req, err := http.NewRequest(method, client.URL(remotePath), body)
+	if err != nil {
+		return nil, err
+	}
+	if client.ss.Login != "" || client.ss.Password != "" {
+		req.SetBasicAuth(client.ss.Login, client.ss.Password)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	return req, nil
+}
+
+// webDAVError returns an error describing an unexpected response.
+// The error wraps fs.ErrNotExist for 404 responses.
+func webDAVError(method, remotePath string, resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s %s returned %s: %w", method, remotePath, resp.Status, fs.ErrNotExist)
+	}
+	return fmt.Errorf("%s %s returned %s", method, remotePath, resp.Status)
+}
+
+// Propfind returns the properties of remotePath and, if depth is 1,
+// of its immediate children.
+func (client *WebDAVClient) Propfind(remotePath string, depth int) ([]*WebDAVEntry, error) {
+	headers := map[string]string{
+		"Depth":        strconv.Itoa(depth),
+		"Content-Type": "application/xml; charset=utf-8",
+	}
+	resp, err := client.Do("PROPFIND", remotePath, strings.NewReader(propfindBody), headers)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, webDAVError("PROPFIND", remotePath, resp)
+	}
+	multistatus := &webDAVMultistatus{}
+	if err = xml.NewDecoder(resp.Body).Decode(multistatus); err != nil {
+		return nil, fmt.Errorf("Cannot parse PROPFIND response for %s: %v", remotePath, err)
+	}
+	entries := make([]*WebDAVEntry, 0, len(multistatus.Responses))
+	for _, response := range multistatus.Responses {
+		entry, err := newWebDAVEntry(response)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func newWebDAVEntry(response webDAVResponse) (*WebDAVEntry, error) {
+	href, err := url.Parse(response.Href)
+	if err != nil {
+		return nil, fmt.Errorf("Server returned invalid href %s: %v", response.Href, err)
+	}
+	entry := &WebDAVEntry{Path: href.Path}
+	for _, propstat := range response.Propstats {
+		if !strings.Contains(propstat.Status, " 200 ") {
+			continue
+		}
+		prop := propstat.Prop
+		entry.IsDir = prop.ResourceType.Collection != nil
+		if prop.ContentLength != "" {
+			entry.Size, _ = strconv.ParseInt(prop.ContentLength, 10, 64)
+		}
+		if prop.LastModified != "" {
+			entry.ModTime, _ = http.ParseTime(prop.LastModified)
+		}
+		entry.ETag = strings.Trim(prop.ETag, `"`)
+		entry.ContentType = prop.ContentType
+	}
+	return entry, nil
+}
+
+// Stat returns information about remotePath.
+func (client *WebDAVClient) Stat(remotePath string) (*WebDAVEntry, error) {
+	entries, err := client.Propfind(remotePath, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("PROPFIND %s returned no entries", remotePath)
+	}
+	return entries[0], nil
+}
+
+// ReadDir returns the immediate children of the collection at remotePath.
+func (client *WebDAVClient) ReadDir(remotePath string) ([]*WebDAVEntry, error) {
+	entries, err := client.Propfind(remotePath, 1)
+	if err != nil {
+		return nil, err
+	}
+	dirPath := strings.TrimSuffix(remotePath, "/")
+	children := make([]*WebDAVEntry, 0, len(entries))
+	for _, entry := range entries {
+		if strings.TrimSuffix(entry.Path, "/") == dirPath {
+			continue
+		}
+		children = append(children, entry)
+	}
+	return children, nil
+}
+
+// Open opens remotePath for reading, starting at offset.
+func (client *WebDAVClient) Open(remotePath string, offset int64) (io.ReadCloser, error) {
+	headers := map[string]string{}
+	if offset > 0 {
+		headers["Range"] = fmt.Sprintf("bytes=%d-", offset)
+	}
+	resp, err := client.Do(http.MethodGet, remotePath, nil, headers)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return resp.Body, nil
+	case http.StatusOK:
+		// The server ignored our Range header and sent the whole
+		// file, so skip the bytes we already have.
+		if offset > 0 {
+			if _, err = io.CopyN(io.Discard, resp.Body, offset); err != nil {
+				resp.Body.Close()
+				return nil, err
+			}
+		}
+		return resp.Body, nil
+	}
+	resp.Body.Close()
+	return nil, webDAVError(http.MethodGet, remotePath, resp)
+}
+
+// Put writes size bytes from reader to remotePath.
+func (client *WebDAVClient) Put(remotePath string, reader io.Reader, size int64) error {
+	req, err := client.newRequest(http.MethodPut, remotePath, reader, nil)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return webDAVError(http.MethodPut, remotePath, resp)
+	}
+	return nil
+}
+
+// Mkdir creates the collection at remotePath. It is not an
+// error if the collection already exists.
+func (client *WebDAVClient) Mkdir(remotePath string) error {
+	resp, err := client.Do("MKCOL", remotePath, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusCreated {
+		return nil
+	}
+	if resp.StatusCode == http.StatusMethodNotAllowed {
+		// MKCOL on an existing resource returns 405.
+		if entry, statErr := client.Stat(remotePath); statErr == nil && entry.IsDir {
+			return nil
+		}
+	}
+	return webDAVError("MKCOL", remotePath, resp)
+}
+
+// MkdirAll creates the collection at remotePath along with any
+// missing parent collections.
+func (client *WebDAVClient) MkdirAll(remotePath string) error {
+	current := "/"
+	for _, segment := range strings.Split(strings.Trim(remotePath, "/"), "/") {
+		if segment == "" {
+			continue
+		}
+		current = path.Join(current, segment)
+		if err := client.Mkdir(current); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Move moves remotePath to destPath, replacing anything already there.
+func (client *WebDAVClient) Move(remotePath, destPath string) error {
+	headers := map[string]string{
+		"Destination": client.URL(destPath),
+		"Overwrite":   "T",
+	}
+	resp, err := client.Do("MOVE", remotePath, nil, headers)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+		return webDAVError("MOVE", remotePath, resp)
+	}
+	return nil
+}
+
+// Delete deletes the file or collection at remotePath.
+func (client *WebDAVClient) Delete(remotePath string) error {
+	resp, err := client.Do(http.MethodDelete, remotePath, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return webDAVError(http.MethodDelete, remotePath, resp)
+	}
+	return nil
+}
+
+// webDAVETag returns the entry's ETag, or a stand-in built from its
+// size and modification time if the server doesn't provide ETags.
+func webDAVETag(entry *WebDAVEntry) string {
+	if entry.ETag != "" {
+		return entry.ETag
+	}
+	return fmt.Sprintf("%d-%d", entry.Size, entry.ModTime.Unix())
+}
+
+// validateWebDAVService checks that ss has a name and a host,
+// setting ss.Errors.
+func validateWebDAVService(ss *core.StorageService) bool {
+	ss.Errors = make(map[string]string)
+	if strings.TrimSpace(ss.Name) == "" {
+		ss.Errors["Name"] = "StorageService requires a name."
+	}
+	if strings.TrimSpace(ss.Host) == "" {
+		ss.Errors["Host"] = "StorageService requires a hostname or IP address."
+	}
+	if err := checkKeySegments(ss.Bucket); err != nil {
+		ss.Errors["Bucket"] = err.Error()
+	}
+	return len(ss.Errors) == 0
+}
+
+// ListWebDAVDirectory lists the contents of directory, which is
+// relative to bucket, in the same form as ListSFTPDirectory.
+func ListWebDAVDirectory(ss *core.StorageService, bucket, directory, startAfter string, maxKeys int) ([]minio.ObjectInfo, bool, error) {
+	objects := make([]minio.ObjectInfo, 0)
+	remoteDir, err := WebDAVRemotePath(bucket, directory)
+	if err != nil {
+		return objects, false, err
+	}
+	client, err := NewWebDAVClient(ss)
+	if err != nil {
+		return objects, false, err
+	}
+	entries, err := client.ReadDir(remoteDir)
+	if err != nil {
+		return objects, false, err
+	}
+	for _, entry := range entries {
+		obj := minio.ObjectInfo{
+			Key:          path.Join(directory, entry.Name()),
+			Size:         entry.Size,
+			LastModified: entry.ModTime,
+			ETag:         entry.ETag,
+			ContentType:  entry.ContentType,
+		}
+		if entry.IsDir {
+			obj.Key += "/"
+			obj.Size = 0
+			obj.ContentType = DirectoryContentType
+		}
+		objects = append(objects, obj)
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	objects, hasMore := pageObjects(objects, startAfter, maxKeys)
+	return objects, hasMore, nil
+}
+
+// GetWebDAVDownloadFile opens the WebDAV file with the
+// specified key for reading.
+func GetWebDAVDownloadFile(ssid, bucket, key string) (io.ReadCloser, error) {
+	ss := core.ObjFind(ssid).StorageService()
+	if ss == nil {
+		return nil, fmt.Errorf("No such storage service: %s", ssid)
+	}
+	remotePath, err := WebDAVRemotePath(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	client, err := NewWebDAVClient(ss)
+	if err != nil {
+		return nil, err
+	}
+	return client.Open(remotePath, 0)
+}
+
+// DownloadWebDAVFileToFile downloads a file from a WebDAV service to
+// localPath and returns the number of bytes written during this call.
+// Like DownloadS3ObjectToFile, it writes to a partial file first and
+// resumes interrupted downloads with a ranged GET, as long as the
+// file's ETag hasn't changed.
+func DownloadWebDAVFileToFile(ssid, bucket, key, localPath string) (int64, error) {
+	ss := core.ObjFind(ssid).StorageService()
+	if ss == nil {
+		return 0, fmt.Errorf("No such storage service: %s", ssid)
+	}
+	remotePath, err := WebDAVRemotePath(bucket, key)
+	if err != nil {
+		return 0, err
+	}
+	client, err := NewWebDAVClient(ss)
+	if err != nil {
+		return 0, err
+	}
+	entry, err := client.Stat(remotePath)
+	if err != nil {
+		return 0, err
+	}
+	if entry.IsDir {
+		return 0, fmt.Errorf("%s is a directory", remotePath)
+	}
+	objInfo := minio.ObjectInfo{
+		Key:  key,
+		Size: entry.Size,
+		ETag: webDAVETag(entry),
+	}
+
+	partialFile := localPath + PartialDownloadSuffix
+	etagFile := partialFile + ".etag"
+	offset := resumeOffset(partialFile, etagFile, objInfo)
+	if err = os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return 0, err
+	}
+	if err = os.WriteFile(etagFile, []byte(objInfo.ETag), 0644); err != nil {
+		return 0, err
+	}
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		core.Dart.Log.Infof("Resuming download of %s at byte %d of %d", remotePath, offset, objInfo.Size)
+	}
+	localFile, err := os.OpenFile(partialFile, flags, 0644)
+	if err != nil {
+		return 0, err
+	}
+	var bytesWritten int64
+	if offset < objInfo.Size {
+		var reader io.ReadCloser
+		reader, err = client.Open(remotePath, offset)
+		if err == nil {
+			bytesWritten, err = io.Copy(localFile, reader)
+			reader.Close()
+		}
+	}
+	if err == nil {
+		err = localFile.Sync()
+	}
+	localFile.Close()
+	if err != nil {
+		return bytesWritten, err
+	}
+	return bytesWritten, finishPartialDownload(partialFile, etagFile, localPath, objInfo.Size)
+}
+
+// UploadToWebDAV uploads the file or directory at sourcePath into the
+// bucket of WebDAV service ss and returns the remote path of the copy.
+// Like CopyToFilesystem, it uploads under a temporary name, checks
+// that the size of every file on the server matches the local file,
+// and only then moves the upload to its real name.
+func UploadToWebDAV(ss *core.StorageService, sourcePath string) (string, error) {
+	return UploadToWebDAVAs(ss, sourcePath, filepath.Base(sourcePath))
+}
+
+// UploadToWebDAVAs is like UploadToWebDAV, but it uploads to key,
+// a path relative to the bucket. It creates any collections the
+// key names.
+func UploadToWebDAVAs(ss *core.StorageService, sourcePath, key string) (string, error) {
+	client, err := NewWebDAVClient(ss)
+	if err != nil {
+		return "", err
+	}
+	return uploadToWebDAVKey(client, ss.Bucket, sourcePath, key)
+}
+
+// uploadToWebDAVKey does the work of UploadToWebDAVAs
+// with an existing client.
+func uploadToWebDAVKey(client *WebDAVClient, bucket, sourcePath, key string) (string, error) {
+	targetPath, err := WebDAVRemotePath(bucket, key)
+	if err != nil {
+		return "", err
+	}
+	sourceInfo, err := os.Stat(sourcePath)
+	if err != nil {
+		return "", err
+	}
+	targetDir := path.Dir(targetPath)
+	if err = client.MkdirAll(targetDir); err != nil {
+		return "", err
+	}
+	tempPath := path.Join(targetDir, fmt.Sprintf(".%s.dart-tmp-%s", path.Base(targetPath), uuid.NewString()))
+	if sourceInfo.IsDir() {
+		err = uploadDirToWebDAV(client, sourcePath, tempPath)
+	} else {
+		err = uploadFileToWebDAV(client, sourcePath, tempPath)
+	}
+	if err == nil {
+		err = client.Move(tempPath, targetPath)
+	}
+	if err != nil {
+		if deleteErr := client.Delete(tempPath); deleteErr != nil && !errors.Is(deleteErr, fs.ErrNotExist) {
+			core.Dart.Log.Warningf("Could not delete temporary upload %s: %v", tempPath, deleteErr)
+		}
+		return "", err
+	}
+	return targetPath, nil
+}
+
+func uploadDirToWebDAV(client *WebDAVClient, sourceDir, remoteDir string) error {
+	return filepath.WalkDir(sourceDir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(sourceDir, filePath)
+		if err != nil {
+			return err
+		}
+		remotePath := path.Join(remoteDir, filepath.ToSlash(relPath))
+		if entry.IsDir() {
+			return client.Mkdir(remotePath)
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		return uploadFileToWebDAV(client, filePath, remotePath)
+	})
+}
+
+// uploadFileToWebDAV uploads a single file, then checks that the
+// server reports the same size as the local file.
+func uploadFileToWebDAV(client *WebDAVClient, sourcePath, remotePath string) error {
+	file, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if err = client.Put(remotePath, file, stat.Size()); err != nil {
+		return err
+	}
+	entry, err := client.Stat(remotePath)
+	if err != nil {
+		return err
+	}
+	if entry.Size != stat.Size() {
+		return fmt.Errorf("Size mismatch for %s: local file has %d bytes, server reports %d", sourcePath, stat.Size(), entry.Size)
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package controllers_test
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart/v3/server/controllers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+)
+
+const webDAVUser = "dav_user"
+const webDAVPassword = "dav_password"
+
+// startWebDAVServer starts a local WebDAV server backed by a temp
+// directory and returns a storage service that points to it, along
+// with the directory. The service's bucket is "deposits".
+func startWebDAVServer(t *testing.T) (*core.StorageService, string) {
+	rootDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(rootDir, "deposits"), 0755))
+	handler := &webdav.Handler{
+		FileSystem: webdav.Dir(rootDir),
+		LockSystem: webdav.NewMemLS(),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != webDAVUser || password != webDAVPassword {
+			w.Header().Set("WWW-Authenticate", `Basic realm="dart"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	host, portStr, err := net.SplitHostPort(server.Listener.Addr().String())
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+
+	ss := core.NewStorageService()
+	ss.Name = "Local WebDAV"
+	ss.Protocol = controllers.ProtocolWebDAV
+	ss.Host = host
+	ss.Port = port
+	ss.Bucket = "deposits"
+	ss.Login = webDAVUser
+	ss.Password = webDAVPassword
+	ss.AllowsUpload = true
+	ss.AllowsDownload = true
+	require.NoError(t, core.ObjSaveWithoutValidation(ss))
+	return ss, rootDir
+}
+
+func TestWebDAVRemotePath(t *testing.T) {
+	remotePath, err := controllers.WebDAVRemotePath("remote.php/dav/files/alice", "a/bag.tar")
+	require.NoError(t, err)
+	assert.Equal(t, "/remote.php/dav/files/alice/a/bag.tar", remotePath)
+
+	_, err = controllers.WebDAVRemotePath("deposits", "../secret")
+	assert.Error(t, err)
+}
+
+func TestUploadToWebDAV(t *testing.T) {
+	defer core.ClearDartTable()
+	ss, rootDir := startWebDAVServer(t)
+
+	sourceDir := t.TempDir()
+	tarFile := filepath.Join(sourceDir, "bag.tar")
+	require.NoError(t, os.WriteFile(tarFile, []byte("tarred bag"), 0644))
+	remotePath, err := controllers.UploadToWebDAV(ss, tarFile)
+	require.NoError(t, err)
+	assert.Equal(t, "/deposits/bag.tar", remotePath)
+	data, err := os.ReadFile(filepath.Join(rootDir, "deposits", "bag.tar"))
+	require.NoError(t, err)
+	assert.Equal(t, "tarred bag", string(data))
+
+	bagDir := filepath.Join(sourceDir, "my_bag")
+	require.NoError(t, os.MkdirAll(filepath.Join(bagDir, "data"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(bagDir, "data", "file.txt"), []byte("payload"), 0644))
+	_, err = controllers.UploadToWebDAV(ss, bagDir)
+	require.NoError(t, err)
+	data, err = os.ReadFile(filepath.Join(rootDir, "deposits", "my_bag", "data", "file.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "payload", string(data))
+
+	// No temp uploads should be left behind.
+	entries, err := os.ReadDir(filepath.Join(rootDir, "deposits"))
+	require.NoError(t, err)
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+	assert.ElementsMatch(t, []string{"bag.tar", "my_bag"}, names)
+
+	// Bad credentials
+	ss.Password = "wrong"
+	_, err = controllers.UploadToWebDAV(ss, tarFile)
+	assert.ErrorContains(t, err, "401")
+}
+
+func TestListWebDAVDirectory(t *testing.T) {
+	defer core.ClearDartTable()
+	ss, rootDir := startWebDAVServer(t)
+	dir := filepath.Join(rootDir, "deposits", "listing")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("File a"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "b.txt"), []byte("File b"), 0644))
+
+	objects, hasMore, err := controllers.ListWebDAVDirectory(ss, ss.Bucket, "listing", "", 2)
+	require.NoError(t, err)
+	assert.True(t, hasMore)
+	require.Equal(t, 2, len(objects))
+	assert.Equal(t, "listing/a.txt", objects[0].Key)
+	assert.Equal(t, int64(len("File a")), objects[0].Size)
+	assert.Equal(t, "listing/b.txt", objects[1].Key)
+
+	objects, hasMore, err = controllers.ListWebDAVDirectory(ss, ss.Bucket, "listing", objects[1].Key, 2)
+	require.NoError(t, err)
+	assert.False(t, hasMore)
+	require.Equal(t, 1, len(objects))
+	assert.Equal(t, "listing/sub/", objects[0].Key)
+	assert.Equal(t, controllers.DirectoryContentType, objects[0].ContentType)
+}
+
+func TestDownloadWebDAVFile(t *testing.T) {
+	defer core.ClearDartTable()
+	ss, rootDir := startWebDAVServer(t)
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "deposits", "file.txt"), content, 0644))
+
+	readCloser, err := controllers.GetDownloadFile(ss.ID, ss.Bucket, "file.txt")
+	require.NoError(t, err)
+	data, err := io.ReadAll(readCloser)
+	readCloser.Close()
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+
+	// Simulate an interrupted download, then resume.
+	localPath := filepath.Join(t.TempDir(), "file.txt")
+	bytesWritten, err := controllers.DownloadToFile(ss.ID, ss.Bucket, "file.txt", localPath)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), bytesWritten)
+	require.NoError(t, os.Remove(localPath))
+
+	client, err := controllers.NewWebDAVClient(ss)
+	require.NoError(t, err)
+	entry, err := client.Stat("/deposits/file.txt")
+	require.NoError(t, err)
+	partialFile := localPath + controllers.PartialDownloadSuffix
+	require.NoError(t, os.WriteFile(partialFile, content[:10], 0644))
+	require.NoError(t, os.WriteFile(partialFile+".etag", []byte(entry.ETag), 0644))
+
+	bytesWritten, err = controllers.DownloadToFile(ss.ID, ss.Bucket, "file.txt", localPath)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)-10), bytesWritten)
+	data, err = os.ReadFile(localPath)
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+	assert.NoFileExists(t, partialFile)
+}
+
+func TestDiagnoseWebDAVConnection(t *testing.T) {
+	defer core.ClearDartTable()
+	ss, rootDir := startWebDAVServer(t)
+	diagnosis := controllers.DiagnoseConnection(ss)
+	assert.True(t, diagnosis.Succeeded(), diagnosis.Summary())
+	require.Equal(t, 6, len(diagnosis.Steps))
+	assert.True(t, diagnosis.Steps[5].Succeeded)
+	entries, err := os.ReadDir(filepath.Join(rootDir, "deposits"))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	ss.Password = "wrong"
+	diagnosis = controllers.DiagnoseConnection(ss)
+	failedStep := diagnosis.FailedStep()
+	require.NotNil(t, failedStep)
+	assert.Equal(t, controllers.StepAuth, failedStep.Name)
+}
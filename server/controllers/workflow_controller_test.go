@@ -18,6 +18,7 @@ import (
 	"github.com/APTrust/dart-runner/constants"
 	"github.com/APTrust/dart-runner/core"
 	"github.com/APTrust/dart-runner/util"
+	"github.com/APTrust/dart/v3/server/controllers"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -392,6 +393,12 @@ func testWorkflowRunBatch(t *testing.T, batchUrl string) {
 			}
 		}
 		assert.True(t, foundJobResult)
+
+		// Each job should record the revision of the
+		// profile it was built with.
+		record := controllers.GetJobProfileRevision(job.ID)
+		require.NotNil(t, record, job.ID)
+		assert.Equal(t, job.BagItProfile.ID, record.ProfileID)
 	}
 }
 
@@ -407,3 +414,97 @@ func loadTestWorkflow(t *testing.T) *core.Workflow {
 	}
 	return workflow
 }
+
+// loadFilesystemWorkflow loads the test workflow and points its
+// uploads at a local filesystem storage service, which DART Runner's
+// own validation doesn't know about.
+func loadFilesystemWorkflow(t *testing.T) (*core.Workflow, *core.StorageService) {
+	workflow := loadTestWorkflow(t)
+	ss := getFilesystemService(t)
+	require.NoError(t, core.ObjSaveWithoutValidation(ss))
+	workflow.StorageServiceIDs = []string{ss.ID}
+	workflow.StorageServices = []*core.StorageService{ss}
+	require.NoError(t, core.ObjSaveWithoutValidation(workflow))
+	return workflow, ss
+}
+
+func TestWorkflowSaveWithFilesystemService(t *testing.T) {
+	defer core.ClearDartTable()
+	workflow := loadTestWorkflow(t)
+	ss := getFilesystemService(t)
+	require.NoError(t, core.ObjSaveWithoutValidation(ss))
+
+	params := url.Values{}
+	params.Set("Name", workflow.Name)
+	params.Set("PackageFormat", constants.PackageFormatBagIt)
+	params.Set("Description", workflow.Description)
+	params.Set("Serialization", workflow.Serialization)
+	params.Add("StorageServiceIDs", ss.ID)
+	params.Set("BagItProfileID", workflow.BagItProfile.ID)
+	settings := PostTestSettings{
+		EndpointUrl:              fmt.Sprintf("/workflows/edit/%s", workflow.ID),
+		Params:                   params,
+		ExpectedResponseCode:     http.StatusFound,
+		ExpectedRedirectLocation: "/workflows",
+	}
+	DoSimplePostTest(t, settings)
+
+	workflow = core.ObjFind(workflow.ID).Workflow()
+	require.NotNil(t, workflow)
+	assert.Equal(t, []string{ss.ID}, workflow.StorageServiceIDs)
+}
+
+func TestWorkflowRunWithFilesystemService(t *testing.T) {
+	defer core.ClearDartTable()
+	workflow, ss := loadFilesystemWorkflow(t)
+
+	endpointUrl := fmt.Sprintf("/workflows/run/%s", workflow.ID)
+	w := httptest.NewRecorder()
+	req, err := NewPostRequest(endpointUrl, url.Values{})
+	require.Nil(t, err)
+	dartServer.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	responseData := make(map[string]string)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &responseData))
+	parts := strings.Split(responseData["location"], "/")
+	job := core.ObjFind(parts[len(parts)-1]).Job()
+	require.NotNil(t, job)
+	require.Equal(t, 1, len(job.UploadOps))
+	assert.Equal(t, ss.ID, job.UploadOps[0].StorageService.ID)
+}
+
+func TestWorkflowRunBatchWithFilesystemService(t *testing.T) {
+	defer core.ClearDartTable()
+	workflow, ss := loadFilesystemWorkflow(t)
+
+	csvFile := filepath.Join(util.PathToTestData(), "files", "postbuild_test_batch.csv")
+	tmpFile := util.MakeTempCSVFileWithValidPaths(t, csvFile)
+	defer func() { os.Remove(tmpFile) }()
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	writer.WriteField("WorkflowID", workflow.ID)
+	part, err := writer.CreateFormFile("CsvUpload", tmpFile)
+	require.NoError(t, err)
+	file, err := os.Open(tmpFile)
+	require.NoError(t, err)
+	defer file.Close()
+	_, err = io.Copy(part, file)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/workflows/batch/validate", body)
+	req.Header.Add("Content-Type", writer.FormDataContentType())
+	recorder := httptest.NewRecorder()
+	dartServer.ServeHTTP(recorder, req)
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	responseData := make(map[string]interface{})
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &responseData))
+
+	testWorkflowRunBatch(t, responseData["location"].(string))
+
+	// Each of the three bags should have landed in the target directory.
+	entries, err := os.ReadDir(ss.Bucket)
+	require.NoError(t, err)
+	assert.Equal(t, 3, len(entries))
+}
@@ -0,0 +1,99 @@
+package controllers
+
+import (
+	"github.com/APTrust/dart-runner/core"
+	"github.com/gin-gonic/gin"
+)
+
+// WorkflowOptions holds settings for a workflow that core.Workflow
+// has no fields for. Like StorageServiceOptions, we keep them in a
+// separate store, keyed by workflow ID.
+type WorkflowOptions struct {
+	WorkflowID string `json:"workflowId"`
+	// KeyTemplate, if set, overrides the key templates of the
+	// workflow's storage services. See CheckKeyTemplate.
+	KeyTemplate string `json:"keyTemplate"`
+	// S3 overrides the S3 upload options of the workflow's storage
+	// services. Empty settings leave the services' settings alone.
+	S3 S3UploadOptions `json:"s3"`
+}
+
+var workflowOptionsStore = NewJSONStore[WorkflowOptions]("workflow_options.json")
+
+// GetWorkflowOptions returns the saved options for the workflow with
+// the specified ID, or empty options if none have been saved.
+func GetWorkflowOptions(workflowID string) *WorkflowOptions {
+	allOptions, err := workflowOptionsStore.Load()
+	if err != nil {
+		core.Dart.Log.Errorf("Cannot load workflow options: %v", err)
+	}
+	for i := range allOptions {
+		if allOptions[i].WorkflowID == workflowID {
+			return &allOptions[i]
+		}
+	}
+	return &WorkflowOptions{WorkflowID: workflowID}
+}
+
+// SaveWorkflowOptions saves opts, replacing any
+// options previously saved for the same workflow.
+func SaveWorkflowOptions(opts *WorkflowOptions) error {
+	return workflowOptionsStore.Update(func(allOptions []WorkflowOptions) ([]WorkflowOptions, error) {
+		for i := range allOptions {
+			if allOptions[i].WorkflowID == opts.WorkflowID {
+				allOptions[i] = *opts
+				return allOptions, nil
+			}
+		}
+		return append(allOptions, *opts), nil
+	})
+}
+
+// DeleteWorkflowOptions deletes the options for the
+// workflow with the specified ID, if there are any.
+func DeleteWorkflowOptions(workflowID string) error {
+	return workflowOptionsStore.Update(func(allOptions []WorkflowOptions) ([]WorkflowOptions, error) {
+		kept := make([]WorkflowOptions, 0, len(allOptions))
+		for _, opts := range allOptions {
+			if opts.WorkflowID != workflowID {
+				kept = append(kept, opts)
+			}
+		}
+		return kept, nil
+	})
+}
+
+// WorkflowOptionsFromRequest reads options for the workflow
+// with the specified ID from the workflow form.
+func WorkflowOptionsFromRequest(c *gin.Context, workflowID string) *WorkflowOptions {
+	return &WorkflowOptions{
+		WorkflowID:  workflowID,
+		KeyTemplate: c.PostForm("KeyTemplate"),
+		S3:          S3UploadOptionsFromRequest(c),
+	}
+}
+
+// Validate returns a map of field names to error messages. The map
+// is empty if the options are valid.
+func (opts *WorkflowOptions) Validate() map[string]string {
+	errors := make(map[string]string)
+	if err := CheckKeyTemplate(opts.KeyTemplate); err != nil {
+		errors["KeyTemplate"] = err.Error()
+	}
+	for fieldName, message := range opts.S3.Validate() {
+		errors[fieldName] = message
+	}
+	return errors
+}
+
+// AddWorkflowOptionFields adds fields for opts to a workflow form.
+func AddWorkflowOptionFields(form *core.Form, opts *WorkflowOptions, errors map[string]string) {
+	keyField := form.AddField("KeyTemplate", "Object Key Template", opts.KeyTemplate, false)
+	keyField.Help = keyTemplateHelp + " A template here overrides the templates of this workflow's storage services."
+	AddS3UploadOptionFields(form, opts.S3, "Same as storage service")
+	for fieldName, message := range errors {
+		if field, ok := form.Fields[fieldName]; ok {
+			field.Error = message
+		}
+	}
+}
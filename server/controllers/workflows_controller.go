@@ -28,8 +28,10 @@ func WorkflowNew(c *gin.Context) {
 		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
 		return
 	}
+	form := workflow.ToForm()
+	AddWorkflowOptionFields(form, GetWorkflowOptions(workflow.ID), nil)
 	data := gin.H{
-		"form":                 workflow.ToForm(),
+		"form":                 form,
 		"suppressDeleteButton": false,
 		"helpUrl":              GetHelpUrl(c),
 	}
@@ -51,7 +53,7 @@ func WorkflowCreateFromJob(c *gin.Context) {
 		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
 		return
 	}
-	err = core.ObjSave(workflow)
+	err = saveValidWorkflow(workflow)
 	if err != nil {
 		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
 		return
@@ -76,6 +78,9 @@ func WorkflowDelete(c *gin.Context) {
 		AbortWithErrorHTML(c, http.StatusNotFound, err)
 		return
 	}
+	if err = DeleteWorkflowOptions(result.Workflow().ID); err != nil {
+		core.Dart.Log.Warningf("Could not delete options for workflow %s: %v", result.Workflow().ID, err)
+	}
 	SetFlashCookie(c, fmt.Sprintf("Deleted workflow %s", result.Workflow().Name))
 	c.Redirect(http.StatusFound, "/workflows")
 }
@@ -87,6 +92,9 @@ func WorkflowEdit(c *gin.Context) {
 		AbortWithErrorHTML(c, http.StatusInternalServerError, request.Errors[0])
 		return
 	}
+	if form, ok := request.TemplateData["form"].(*core.Form); ok {
+		AddWorkflowOptionFields(form, GetWorkflowOptions(c.Param("id")), nil)
+	}
 	c.HTML(http.StatusOK, "workflow/form.html", request.TemplateData)
 }
 
@@ -104,11 +112,13 @@ func WorkflowIndex(c *gin.Context) {
 // PUT /workflows/edit/:id
 // POST /workflows/edit/:id
 func WorkflowSave(c *gin.Context) {
-	workflow, err := saveWorkflow(c)
+	workflow, opts, err := saveWorkflow(c)
 	if err != nil {
 		objectExistsInDB, _ := core.ObjExists(workflow.ID)
+		form := workflow.ToForm()
+		AddWorkflowOptionFields(form, opts, opts.Validate())
 		data := gin.H{
-			"form":             workflow.ToForm(),
+			"form":             form,
 			"objectExistsInDB": objectExistsInDB,
 			"helpUrl":          GetHelpUrl(c),
 		}
@@ -121,17 +131,22 @@ func WorkflowSave(c *gin.Context) {
 
 // POST /workflows/export/:id
 func WorkflowExport(c *gin.Context) {
-	workflow, err := saveWorkflow(c)
+	workflow, opts, err := saveWorkflow(c)
 	if err != nil {
 		objectExistsInDB, _ := core.ObjExists(workflow.ID)
+		form := workflow.ToForm()
+		AddWorkflowOptionFields(form, opts, opts.Validate())
 		data := gin.H{
-			"form":             workflow.ToForm(),
+			"form":             form,
 			"objectExistsInDB": objectExistsInDB,
 			"helpUrl":          GetHelpUrl(c),
 		}
 		c.HTML(http.StatusBadRequest, "workflow/form.html", data)
 		return
 	}
+	// The workflow is already saved, so we can strip
+	// encrypted passwords that wouldn't work elsewhere.
+	strippedSecrets := stripEncryptedPasswords(workflow.StorageServices)
 	workflowJson, err := workflow.ExportJson()
 	if err != nil {
 		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
@@ -144,6 +159,8 @@ func WorkflowExport(c *gin.Context) {
 	data := gin.H{
 		"json":                   string(workflowJson),
 		"passwordWarningDisplay": passwordWarningDisplay,
+		"strippedSecrets":        strippedSecrets,
+		"secretPlaceholder":      EncryptedSecretPlaceholder,
 		"helpUrl":                GetHelpUrl(c),
 	}
 	c.HTML(http.StatusOK, "settings/export_result.html", data)
@@ -162,6 +179,9 @@ func WorkflowRun(c *gin.Context) {
 		AbortWithErrorHTML(c, http.StatusInternalServerError, err)
 		return
 	}
+	if err = RecordJobProfileRevision(job); err != nil {
+		core.Dart.Log.Errorf("Cannot record BagIt profile revision for job %s: %v", job.ID, err)
+	}
 	data := map[string]string{
 		"status":   "OK",
 		"location": fmt.Sprintf("/jobs/files/%s", job.ID),
@@ -218,9 +238,17 @@ func WorkflowBatchValidate(c *gin.Context) {
 	wb := core.NewWorkflowBatch(workflow, tempFile)
 	status := http.StatusOK
 	data := gin.H{}
-	if !wb.Validate() {
+	if !ValidateWorkflowBatch(wb) {
 		status = http.StatusBadRequest
 		data["errors"] = wb.Errors
+	} else if tagErrors, err := ValidateBatchTagValues(workflow, tempFile); err != nil {
+		AbortWithErrorJSON(c, http.StatusInternalServerError, err)
+		return
+	} else if len(tagErrors) > 0 {
+		// WorkflowBatch.Validate checks only required and allowed
+		// values, so we check the profile's value rules here.
+		status = http.StatusBadRequest
+		data["errors"] = tagErrors
 	} else {
 		queryParams := url.Values{}
 		queryParams.Set("WorkflowID", workflowID)
@@ -237,7 +265,7 @@ func WorkflowRunBatch(c *gin.Context) {
 	pathToCSVFile := c.Query("PathToCSVFile")
 	workflow := core.ObjFind(workflowID).Workflow()
 	wb := core.NewWorkflowBatch(workflow, pathToCSVFile)
-	if !wb.Validate() {
+	if !ValidateWorkflowBatch(wb) {
 		errMsg := ""
 		for _, message := range wb.Errors {
 			errMsg += message + "; "
@@ -245,6 +273,19 @@ func WorkflowRunBatch(c *gin.Context) {
 		AbortWithErrorJSON(c, http.StatusInternalServerError, fmt.Errorf("workflow has validation errors: %s", errMsg))
 		return
 	}
+	tagErrors, err := ValidateBatchTagValues(wb.Workflow, wb.PathToCSVFile)
+	if err != nil {
+		AbortWithErrorJSON(c, http.StatusInternalServerError, err)
+		return
+	}
+	if len(tagErrors) > 0 {
+		errMsg := ""
+		for key, message := range tagErrors {
+			errMsg += key + ": " + message + "; "
+		}
+		AbortWithErrorJSON(c, http.StatusBadRequest, fmt.Errorf("batch has invalid tag values: %s", errMsg))
+		return
+	}
 	parser := core.NewCSVBatchParser(wb.PathToCSVFile, wb.Workflow)
 	outputDir, err := core.GetAppSetting(constants.BaggingDirectory)
 	if err != nil {
@@ -267,6 +308,9 @@ func WorkflowRunBatch(c *gin.Context) {
 			//defer close(messageChannel)
 
 			job := jobParams.ToJob()
+			if err := RecordJobProfileRevision(job); err != nil {
+				core.Dart.Log.Errorf("Cannot record BagIt profile revision for job %s: %v", job.ID, err)
+			}
 			job.UpdatePayloadStats()
 
 			// First things first. Send initialization data to the
@@ -280,7 +324,7 @@ func WorkflowRunBatch(c *gin.Context) {
 			// It will not return until it's done. An exit code of zero
 			// indicates success. See constants.go for the meanings of
 			// other exit codes.
-			exitCode := core.RunJobWithMessageChannel(job, false, messageChannel)
+			exitCode := RunJobWithExtendedUploads(job, messageChannel)
 
 			// At this point, the job has completed, and we need to create
 			// the final disconnect event to tell the front end to stop
@@ -389,13 +433,20 @@ func WorkflowRunBatch(c *gin.Context) {
 	// See job_run_controller.go for details on the emitter.
 }
 
-func saveWorkflow(c *gin.Context) (*core.Workflow, error) {
+// saveWorkflow saves the workflow and its options from the workflow
+// form. If the options are invalid, it saves neither and returns an
+// error. Call opts.Validate to get the details.
+func saveWorkflow(c *gin.Context) (*core.Workflow, *WorkflowOptions, error) {
 	workflow := &core.Workflow{}
 	err := c.Bind(workflow)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	workflow.ID = c.Param("id")
+	opts := WorkflowOptionsFromRequest(c, workflow.ID)
+	if len(opts.Validate()) > 0 {
+		return workflow, opts, fmt.Errorf("Workflow options have validation errors")
+	}
 	profileID := c.PostForm("BagItProfileID")
 	if util.LooksLikeUUID(profileID) {
 		result := core.ObjFind(profileID)
@@ -403,6 +454,18 @@ func saveWorkflow(c *gin.Context) (*core.Workflow, error) {
 			workflow.BagItProfile = result.BagItProfile()
 		}
 	}
-	err = core.ObjSave(workflow)
-	return workflow, err
+	if err = saveValidWorkflow(workflow); err != nil {
+		return workflow, opts, err
+	}
+	return workflow, opts, SaveWorkflowOptions(opts)
+}
+
+// saveValidWorkflow saves workflow if ValidateWorkflow says it's
+// valid. DART Runner's own validation would reject workflows that
+// upload to services with extended protocols.
+func saveValidWorkflow(workflow *core.Workflow) error {
+	if !ValidateWorkflow(workflow) {
+		return fmt.Errorf("Workflow has validation errors")
+	}
+	return core.ObjSaveWithoutValidation(workflow)
 }
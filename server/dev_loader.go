@@ -8,6 +8,7 @@ import (
 	"github.com/APTrust/dart-runner/constants"
 	"github.com/APTrust/dart-runner/core"
 	"github.com/APTrust/dart-runner/util"
+	"github.com/APTrust/dart/v3/server/controllers"
 	"github.com/gin-gonic/gin"
 )
 
@@ -20,27 +21,28 @@ func initTemplates(router *gin.Engine) {
 	// body of that helper here inline.
 
 	router.SetFuncMap(template.FuncMap{
-		"add":            util.Add,
-		"dateISO":        util.DateISO,
-		"dateTimeISO":    util.DateTimeISO,
-		"dateTimeUS":     util.DateTimeUS,
-		"dateUS":         util.DateUS,
-		"dict":           util.Dict,
-		"dirStats":       util.DirStats,
-		"displayDate":    util.DisplayDate,
-		"escapeAttr":     util.EscapeAttr,
-		"escapeHTML":     util.EscapeHTML,
-		"fileIconFor":    util.FileIconFor,
-		"humanSize":      util.HumanSize,
-		"mod":            util.Mod,
-		"strEq":          util.StrEq,
-		"strStartsWith":  util.StrStartsWith,
-		"truncate":       util.Truncate,
-		"truncateMiddle": util.TruncateMiddle,
-		"truncateStart":  util.TruncateStart,
-		"unixToISO":      util.UnixToISO,
-		"workflowList":   func() []core.NameIDPair { return core.ObjNameIdList(constants.TypeWorkflow) },
-		"yesNo":          util.YesNo,
+		"add":             util.Add,
+		"dateISO":         util.DateISO,
+		"dateTimeISO":     util.DateTimeISO,
+		"dateTimeUS":      util.DateTimeUS,
+		"dateUS":          util.DateUS,
+		"dict":            util.Dict,
+		"dirStats":        util.DirStats,
+		"displayDate":     util.DisplayDate,
+		"escapeAttr":      util.EscapeAttr,
+		"escapeHTML":      util.EscapeHTML,
+		"fileIconFor":     util.FileIconFor,
+		"humanSize":       util.HumanSize,
+		"isSerializedBag": controllers.IsSerializedBag,
+		"mod":             util.Mod,
+		"strEq":           util.StrEq,
+		"strStartsWith":   util.StrStartsWith,
+		"truncate":        util.Truncate,
+		"truncateMiddle":  util.TruncateMiddle,
+		"truncateStart":   util.TruncateStart,
+		"unixToISO":       util.UnixToISO,
+		"workflowList":    func() []core.NameIDPair { return core.ObjNameIdList(constants.TypeWorkflow) },
+		"yesNo":           util.YesNo,
 	})
 
 	// Load the view templates
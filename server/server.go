@@ -19,6 +19,7 @@ func Run(port int, quietMode bool) {
 	}
 	core.Dart.RuntimeMode = constants.ModeDartGUI
 	r := InitAppEngine(quietMode)
+	go controllers.MonitorGlacierRestores(controllers.GlacierRestoreCheckInterval)
 	r.Run(fmt.Sprintf("127.0.0.1:%d", port))
 }
 
@@ -96,6 +97,14 @@ func initRoutes(router *gin.Engine) {
 	router.GET("/profiles/import", controllers.BagItProfileImportStart)
 	router.POST("/profiles/import", controllers.BagItProfileImport)
 	router.GET("/profiles/export/:id", controllers.BagItProfileExport)
+	router.GET("/profiles/compare", controllers.BagItProfileCompare)
+	router.GET("/profiles/compare/export", controllers.BagItProfileCompareExport)
+	router.GET("/profiles/revisions/:id", controllers.BagItProfileRevisions)
+	router.GET("/profiles/revision/:profile_id/:number", controllers.BagItProfileRevisionShow)
+	router.POST("/profiles/restore_revision/:profile_id/:number", controllers.BagItProfileRevisionRestore)
+	router.GET("/profiles/conformance", controllers.ConformanceMatrixIndex)
+	router.POST("/profiles/conformance", controllers.ConformanceMatrixCreate)
+	router.GET("/profiles/conformance/:id", controllers.ConformanceMatrixShow)
 
 	// BagIt Profile Tags & Tag Files
 	router.GET("/profiles/new_tag/:profile_id/:tag_file", controllers.BagItProfileNewTag)
@@ -109,6 +118,14 @@ func initRoutes(router *gin.Engine) {
 	router.POST("/profiles/delete_tag_file/:profile_id", controllers.BagItProfileDeleteTagFile)
 	router.PUT("/profiles/delete_tag_file/:profile_id", controllers.BagItProfileDeleteTagFile)
 
+	// Credential Encryption
+	router.GET("/credentials", controllers.CredentialVaultShow)
+	router.POST("/credentials/enable", controllers.CredentialVaultEnable)
+	router.POST("/credentials/unlock", controllers.CredentialVaultUnlock)
+	router.POST("/credentials/lock", controllers.CredentialVaultLock)
+	router.POST("/credentials/change_passphrase", controllers.CredentialVaultChangePassphrase)
+	router.POST("/credentials/disable", controllers.CredentialVaultDisable)
+
 	// Internal Settings
 	router.GET("/internal_settings", controllers.InternalSettingIndex)
 
@@ -178,15 +195,14 @@ func initRoutes(router *gin.Engine) {
 
 	// Upload Jobs
 	//
-	// These are disabled for now. We've hidden them from the main menu.
-	// We can re-enable upload-only jobs if we restrict
-	// them to uploading files only (no directories, because directory uploads
-	// require considerable work and open up a huge number of potential problems).
-	//
+	// Jobs that upload directories, or that use a key prefix, are run
+	// by DART rather than DART Runner. See controllers/directory_uploads.go.
 	router.GET("/upload_jobs/new", controllers.UploadJobNew)
 	router.GET("/upload_jobs/files/:id", controllers.UploadJobShowFiles)
 	router.POST("/upload_jobs/add_file/:id", controllers.UploadJobAddFile)
 	router.POST("/upload_jobs/delete_file/:id", controllers.UploadJobDeleteFile)
+	router.PUT("/upload_jobs/delete/:id", controllers.UploadJobDelete)
+	router.POST("/upload_jobs/delete/:id", controllers.UploadJobDelete)
 	router.GET("/upload_jobs/targets/:id", controllers.UploadJobShowTargets)
 	router.POST("/upload_jobs/targets/:id", controllers.UploadJobSaveTarget)
 	router.GET("/upload_jobs/review/:id", controllers.UploadJobReview)
@@ -196,6 +212,50 @@ func initRoutes(router *gin.Engine) {
 	router.GET("/download_jobs/new", controllers.DownloadJobNew)
 	router.POST("/download_jobs/browse", controllers.DownloadJobBrowse)
 	router.POST("/download_jobs/download", controllers.DownloadJobDownload)
+	router.GET("/download_jobs/details", controllers.DownloadJobDetails)
+
+	// Restore Jobs
+	router.GET("/restore_jobs/new", controllers.RestoreJobNew)
+	router.POST("/restore_jobs/new", controllers.RestoreJobCreate)
+	router.GET("/restore_jobs/review/:id", controllers.RestoreJobReview)
+	router.GET("/restore_jobs/run/:id", controllers.RestoreJobRun)
+	router.GET("/restore_jobs/result/:id", controllers.RestoreJobShowResult)
+
+	// Background Tasks
+	router.GET("/background_tasks/status/:id", controllers.BackgroundTaskStatus)
+	router.POST("/background_tasks/cancel/:id", controllers.BackgroundTaskCancel)
+
+	// Inventory Reports
+	router.GET("/inventory_reports", controllers.InventoryReportIndex)
+	router.GET("/inventory_reports/new", controllers.InventoryReportNew)
+	router.POST("/inventory_reports/new", controllers.InventoryReportCreate)
+	router.GET("/inventory_reports/show/:id", controllers.InventoryReportShow)
+	router.GET("/inventory_reports/export/:id", controllers.InventoryReportExport)
+
+	// Reconciliations
+	router.GET("/reconciliations", controllers.ReconciliationIndex)
+	router.GET("/reconciliations/new", controllers.ReconciliationNew)
+	router.POST("/reconciliations/new", controllers.ReconciliationCreate)
+	router.GET("/reconciliations/show/:id", controllers.ReconciliationShow)
+	router.POST("/reconciliations/upload/:id", controllers.ReconciliationUpload)
+
+	// Presigned URLs
+	router.GET("/presigned_urls", controllers.PresignedURLIndex)
+	router.GET("/presigned_urls/new", controllers.PresignedURLNew)
+	router.POST("/presigned_urls/new", controllers.PresignedURLCreate)
+	router.GET("/presigned_urls/show/:id", controllers.PresignedURLShow)
+
+	// Glacier Restores
+	router.GET("/glacier_restores", controllers.GlacierRestoreIndex)
+	router.GET("/glacier_restores/new", controllers.GlacierRestoreNew)
+	router.POST("/glacier_restores/new", controllers.GlacierRestoreCreate)
+	router.POST("/glacier_restores/check", controllers.GlacierRestoreCheck)
+
+	// Copy Jobs
+	router.GET("/copy_jobs/new", controllers.CopyJobNew)
+	router.POST("/copy_jobs/new", controllers.CopyJobCreate)
+	router.GET("/copy_jobs/review/:id", controllers.CopyJobReview)
+	router.GET("/copy_jobs/run/:id", controllers.CopyJobRun)
 
 	// Validation Jobs
 	router.GET("/validation_jobs/new", controllers.ValidationJobNew)